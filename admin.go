@@ -0,0 +1,103 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// An Admin is a client of the admin server of dev_appserver.py, which
+// reads the state of the services directly, without API calls.
+type Admin struct {
+	c *Instance
+}
+
+// AdminEntity is an entity read by an Admin.
+type AdminEntity struct {
+	// Key is the encoded key of the entity.
+	Key string `json:"key"`
+	// Properties holds the values of the properties, converted to JSON
+	// values, or to their Python repr if they have no JSON equivalent.
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// Admin returns a client of the admin server, which fails if there
+// is none, as with Options.APIServerOnly.
+func (c *Instance) Admin() *Admin { return &Admin{c} }
+
+// Execute runs code, a Python program, in the interactive console of the
+// admin server, in the default module, and returns its output.
+func (a *Admin) Execute(code string) (string, error) {
+	token, err := a.c.adminXSRFToken("/console")
+	if err != nil {
+		return "", err
+	}
+	res, err := a.c.client.PostForm(a.c.adminURL+"/console", url.Values{
+		"code":        {code},
+		"module_name": {"default"},
+		"xsrf_token":  {token},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	out, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("aetest: interactive console: %s", res.Status)
+	}
+	return string(out), nil
+}
+
+// entitiesCode prints the entities of the datastore query built by the
+// Python expression %s, which reads its argument from arg, as a line of
+// JSON following a marker.
+const entitiesCode = `
+import base64, json
+from google.appengine.api import datastore
+from google.appengine.ext import gql
+arg = base64.b64decode('%s').decode('utf-8')
+print '\naetest-entities:', json.dumps(
+    [{'key': str(e.key()), 'properties': dict(e)} for e in %s.Run()],
+    default=repr)
+`
+
+// entities runs entitiesCode and decodes its output.
+func (a *Admin) entities(query, arg string) ([]AdminEntity, error) {
+	code := fmt.Sprintf(entitiesCode, base64.StdEncoding.EncodeToString([]byte(arg)), query)
+	out, err := a.Execute(code)
+	if err != nil {
+		return nil, err
+	}
+	i := strings.LastIndex(out, "\naetest-entities:")
+	if i < 0 {
+		return nil, fmt.Errorf("aetest: interactive console: %s", strings.TrimSpace(out))
+	}
+	var entities []AdminEntity
+	if err := json.Unmarshal([]byte(out[i+len("\naetest-entities:"):]), &entities); err != nil {
+		return nil, err
+	}
+	return entities, nil
+}
+
+// Entities returns the entities of the given kind in the default
+// namespace.
+func (a *Admin) Entities(kind string) ([]AdminEntity, error) {
+	return a.entities("datastore.Query(arg)", kind)
+}
+
+// ExecuteGQL returns the entities matched by a GQL query, such as
+// "SELECT * FROM Order WHERE Total > 100".
+func (a *Admin) ExecuteGQL(query string) ([]AdminEntity, error) {
+	return a.entities("gql.GQL(arg).Bind([], {})", query)
+}
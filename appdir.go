@@ -0,0 +1,124 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxFreeWorkDirs is how many work directories with the same stub app are
+// kept for reuse.
+const maxFreeWorkDirs = 4
+
+// workDirs holds the work directories of the closed contexts, keyed by the
+// content of their stub app, for reuse by later contexts.
+var workDirs struct {
+	sync.Mutex
+	free map[string][]string
+}
+
+// appFiles returns the files of the stub app, keyed by name.
+func (c *Instance) appFiles() map[string]string {
+	name, src := c.appFile()
+	files := map[string]string{
+		"app.yaml": c.appYAML(),
+		name:       src,
+	}
+	if c.opts.QueueYAML != "" {
+		files["queue.yaml"] = c.opts.QueueYAML
+	}
+	return files
+}
+
+func appKey(files map[string]string) string {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		parts = append(parts, name, files[name])
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// makeWorkDir sets c.workDir to a directory holding the stub app, in its
+// "app" subdirectory, and the storage of the API server, in its "storage"
+// subdirectory. It reuses the directory of a closed context with the same
+// stub app if there is one and Options.ReuseWorkDirs is set.
+func (c *Instance) makeWorkDir() error {
+	files := c.appFiles()
+	if c.opts.ReuseWorkDirs {
+		key := appKey(files)
+		workDirs.Lock()
+		if free := workDirs.free[key]; len(free) > 0 {
+			c.workDir = free[len(free)-1]
+			workDirs.free[key] = free[:len(free)-1]
+		}
+		workDirs.Unlock()
+	}
+	if c.workDir != "" {
+		c.appDir = filepath.Join(c.workDir, "app")
+		return nil
+	}
+
+	dir, err := ioutil.TempDir(tempDir(), "appengine-aetest")
+	if err != nil {
+		return err
+	}
+	appDir := filepath.Join(dir, "app")
+	if err := os.Mkdir(appDir, 0755); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(appDir, name), []byte(content), 0644); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+	c.workDir, c.appDir = dir, appDir
+	return nil
+}
+
+// releaseWorkDir makes c.workDir available to later contexts, or removes
+// it if maxFreeWorkDirs directories with the same stub app already are.
+func (c *Instance) releaseWorkDir() {
+	key := appKey(c.appFiles())
+	workDirs.Lock()
+	defer workDirs.Unlock()
+	if len(workDirs.free[key]) >= maxFreeWorkDirs {
+		os.RemoveAll(c.workDir)
+		return
+	}
+	if workDirs.free == nil {
+		workDirs.free = make(map[string][]string)
+	}
+	workDirs.free[key] = append(workDirs.free[key], c.workDir)
+}
+
+// RemoveWorkDirs removes the directories that closed contexts left for
+// reuse by later ones. It is meant to be called once all the tests are
+// done, such as at the end of TestMain.
+func RemoveWorkDirs() error {
+	workDirs.Lock()
+	defer workDirs.Unlock()
+	var err error
+	for _, dirs := range workDirs.free {
+		for _, dir := range dirs {
+			if err1 := os.RemoveAll(dir); err == nil {
+				err = err1
+			}
+		}
+	}
+	workDirs.free = nil
+	return err
+}
@@ -0,0 +1,110 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"appengine"
+	"code.google.com/p/goprotobuf/proto"
+
+	appidentitypb "appengine_internal/app_identity"
+	filepb "appengine_internal/files"
+)
+
+// appIdentity reports the configured service account name and records the
+// scopes of the access tokens minted by the app identity service.
+func (c *Instance) appIdentity(service, method string, in, out proto.Message, next func() error) error {
+	if service != "app_identity_service" {
+		return next()
+	}
+	switch method {
+	case "GetServiceAccountName":
+		if c.opts.ServiceAccountName == "" {
+			return next()
+		}
+		res := out.(*appidentitypb.GetServiceAccountNameResponse)
+		res.ServiceAccountName = proto.String(c.opts.ServiceAccountName)
+		return nil
+	case "GetAccessToken":
+		if err := next(); err != nil {
+			return err
+		}
+		scopes := in.(*appidentitypb.GetAccessTokenRequest).Scope
+		token := out.(*appidentitypb.GetAccessTokenResponse).GetAccessToken()
+		c.mu.Lock()
+		if c.tokenScopes == nil {
+			c.tokenScopes = make(map[string][]string)
+		}
+		c.tokenScopes[token] = append([]string(nil), scopes...)
+		c.mu.Unlock()
+		return nil
+	}
+	return next()
+}
+
+// AccessTokenScopes returns the scopes that were requested when the
+// given token was minted by appengine.AccessToken.
+func (c *Instance) AccessTokenScopes(token string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	scopes, ok := c.tokenScopes[token]
+	if !ok {
+		return nil, fmt.Errorf("aetest: access token %q was not minted by this context", token)
+	}
+	return append([]string(nil), scopes...), nil
+}
+
+// VerifySignature checks that sig is a signature of data produced
+// by appengine.SignBytes, using the API server's public certificates.
+func (c *Instance) VerifySignature(data, sig []byte) error {
+	certs, err := appengine.PublicCertificates(c)
+	if err != nil {
+		return err
+	}
+	h := sha256.Sum256(data)
+	for _, cert := range certs {
+		block, _ := pem.Decode(cert.Data)
+		if block == nil {
+			return fmt.Errorf("aetest: certificate %q is not PEM encoded", cert.KeyName)
+		}
+		x, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("aetest: unable to parse certificate %q: %v", cert.KeyName, err)
+		}
+		pub, ok := x.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			continue
+		}
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig) == nil {
+			return nil
+		}
+	}
+	return errors.New("aetest: signature does not match any public certificate")
+}
+
+// defaultBucket answers the calls for the name of the default bucket with
+// Options.DefaultGCSBucket.
+func (c *Instance) defaultBucket(service, method string, in, out proto.Message, next func() error) error {
+	b := c.opts.DefaultGCSBucket
+	if b == "" {
+		return next()
+	}
+	switch service + "." + method {
+	case "app_identity_service.GetDefaultGcsBucketName":
+		out.(*appidentitypb.GetDefaultGcsBucketNameResponse).DefaultGcsBucketName = proto.String(b)
+		return nil
+	case "file.GetDefaultGsBucketName":
+		out.(*filepb.GetDefaultGsBucketNameResponse).DefaultGsBucketName = proto.String(b)
+		return nil
+	}
+	return next()
+}
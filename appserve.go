@@ -0,0 +1,88 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// servedAppDir returns the directory of the app run by the child process:
+// Options.AppDir if set, and the stub app otherwise.
+func (c *Instance) servedAppDir() string {
+	if c.opts.AppDir != "" {
+		return resolvePath(c.opts.AppDir)
+	}
+	return c.childPath(c.appDir)
+}
+
+// setModuleURL records the URL of a module reported by the child process.
+func (c *Instance) setModuleURL(module, u string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.moduleURLs == nil {
+		c.moduleURLs = make(map[string]string)
+	}
+	c.moduleURLs[module] = u
+}
+
+// ModuleURL returns the URL at which dev_appserver.py serves the
+// given module of the app, "default" if empty, or "" if it serves
+// no such module, for instance with Options.APIServerOnly.
+func (c *Instance) ModuleURL(module string) string {
+	if module == "" {
+		module = "default"
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.moduleURLs[module]
+}
+
+// Client returns an http.Client for requests to the URLs returned by
+// ModuleURL. The requests are made as the user logged in to the
+// context, if any.
+func (c *Instance) Client() *http.Client {
+	return &http.Client{
+		Transport: &loginTransport{c: c, rt: c.client.Transport},
+	}
+}
+
+// loginTransport sends requests as the user logged in to a context, with
+// the login cookie of dev_appserver.py.
+type loginTransport struct {
+	c  *Instance
+	rt http.RoundTripper
+}
+
+func (t *loginTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	h := t.c.Request().(*http.Request).Header
+	email := h.Get("X-AppEngine-User-Email")
+	if email == "" {
+		return t.transport().RoundTrip(req)
+	}
+	admin := "False"
+	if h.Get("X-AppEngine-User-Is-Admin") == "1" {
+		admin = "True"
+	}
+	// Leave req unchanged, as RoundTrippers must.
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.AddCookie(&http.Cookie{
+		Name:  "dev_appserver_login",
+		Value: fmt.Sprintf("%s:%s:%s", email, admin, h.Get("X-AppEngine-User-Id")),
+	})
+	return t.transport().RoundTrip(r)
+}
+
+func (t *loginTransport) transport() http.RoundTripper {
+	if t.rt == nil {
+		return http.DefaultTransport
+	}
+	return t.rt
+}
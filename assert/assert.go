@@ -0,0 +1,99 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+/*
+Package assert checks the state of the App Engine services in tests.
+
+Each helper reports a failed check with t.Errorf, and returns whether the
+check passed:
+
+	assert.EntityExists(t, c, key)
+	assert.KindCount(t, c, "Order", 3)
+	assert.MemcacheContains(t, c, "some-key", []byte("some-value"))
+*/
+package assert
+
+import (
+	"bytes"
+	"testing"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+// EntityExists checks that the datastore holds an entity with the given
+// key.
+func EntityExists(t testing.TB, c appengine.Context, key *datastore.Key) bool {
+	var props datastore.PropertyList
+	switch err := datastore.Get(c, key, &props); err {
+	case nil:
+		return true
+	case datastore.ErrNoSuchEntity:
+		t.Errorf("entity %v does not exist", key)
+	default:
+		t.Errorf("unable to get entity %v: %v", key, err)
+	}
+	return false
+}
+
+// EntityMissing checks that the datastore holds no entity with the given
+// key.
+func EntityMissing(t testing.TB, c appengine.Context, key *datastore.Key) bool {
+	var props datastore.PropertyList
+	switch err := datastore.Get(c, key, &props); err {
+	case nil:
+		t.Errorf("entity %v exists", key)
+	case datastore.ErrNoSuchEntity:
+		return true
+	default:
+		t.Errorf("unable to get entity %v: %v", key, err)
+	}
+	return false
+}
+
+// KindCount checks that the datastore holds want entities of the given
+// kind in c's namespace.
+func KindCount(t testing.TB, c appengine.Context, kind string, want int) bool {
+	n, err := datastore.NewQuery(kind).KeysOnly().Count(c)
+	if err != nil {
+		t.Errorf("unable to count %s entities: %v", kind, err)
+		return false
+	}
+	if n != want {
+		t.Errorf("%d %s entities, want %d", n, kind, want)
+		return false
+	}
+	return true
+}
+
+// MemcacheContains checks that memcache holds the given value for key.
+func MemcacheContains(t testing.TB, c appengine.Context, key string, value []byte) bool {
+	it, err := memcache.Get(c, key)
+	switch {
+	case err == memcache.ErrCacheMiss:
+		t.Errorf("memcache has no item %q", key)
+	case err != nil:
+		t.Errorf("unable to get memcache item %q: %v", key, err)
+	case !bytes.Equal(it.Value, value):
+		t.Errorf("memcache item %q = %q, want %q", key, it.Value, value)
+	default:
+		return true
+	}
+	return false
+}
+
+// MemcacheMissing checks that memcache holds no item for key.
+func MemcacheMissing(t testing.TB, c appengine.Context, key string) bool {
+	it, err := memcache.Get(c, key)
+	switch {
+	case err == memcache.ErrCacheMiss:
+		return true
+	case err != nil:
+		t.Errorf("unable to get memcache item %q: %v", key, err)
+	default:
+		t.Errorf("memcache has item %q = %q", key, it.Value)
+	}
+	return false
+}
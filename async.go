@@ -0,0 +1,30 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+// A Future is a Context being created by StartAsync.
+type Future struct {
+	done chan struct{}
+	c    Context
+	err  error
+}
+
+// StartAsync starts creating a Context with NewContext and returns
+// immediately, so that the API server starts while other work proceeds.
+func StartAsync(opts *Options) *Future {
+	f := &Future{done: make(chan struct{})}
+	go func() {
+		f.c, f.err = NewContext(opts)
+		close(f.done)
+	}()
+	return f
+}
+
+// Context waits until the Context is ready and returns it, or the error
+// NewContext returned.
+func (f *Future) Context() (Context, error) {
+	<-f.done
+	return f.c, f.err
+}
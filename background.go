@@ -0,0 +1,61 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"appengine_internal"
+	"code.google.com/p/goprotobuf/proto"
+
+	systempb "appengine_internal/system"
+)
+
+// BackgroundContext returns a context derived from this one that
+// acts as a background request of a manual scaling module, as
+// returned by appengine.BackgroundContext: it is logged out, has no
+// request deadline, and carries a request ID of its own.
+func (c *Instance) BackgroundContext() *Instance {
+	return c.backgroundContext(c.newID())
+}
+
+// backgroundContext returns a background context whose request ID is id.
+func (c *Instance) backgroundContext(id string) *Instance {
+	d := c.Derive()
+	d.requestID = id
+	d.deadline = time.Time{}
+	// Background requests are sent to this path, with their ID, in
+	// production.
+	req, _ := http.NewRequest("GET", "/_ah/background", nil)
+	req.Header = d.req.Header
+	req.Header.Set("X-AppEngine-BackgroundRequest", id)
+	d.req = req
+	return d
+}
+
+// startBackgroundRequests answers the calls that start a background
+// request, made by runtime.RunInBackground, by serving the request with
+// Options.BackgroundHandler.
+func (c *Instance) startBackgroundRequests(service, method string, in, out proto.Message, next func() error) error {
+	if service != "system" || method != "StartBackgroundRequest" {
+		return next()
+	}
+	id := c.newID()
+	out.(*systempb.StartBackgroundRequestResponse).RequestId = proto.String(id)
+	h := c.opts.BackgroundHandler
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	bc := c.backgroundContext(id)
+	go func() {
+		// The handler of appengine/runtime gets the context of the
+		// request with appengine.NewContext, which then returns bc.
+		defer appengine_internal.RegisterTestContext(bc.req, bc)()
+		serveWithContext(bc, h, httptest.NewRecorder(), bc.req)
+	}()
+	return nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"sync"
+
+	"appengine_internal"
+)
+
+// maxBatchConns is the number of connections to the API server kept open
+// for the calls of a batch.
+const maxBatchConns = 16
+
+// Call is an API call of a batch.
+type Call struct {
+	Service string
+	Method  string
+	In      appengine_internal.ProtoMessage
+	Out     appengine_internal.ProtoMessage
+	Opts    *appengine_internal.CallOptions
+}
+
+// CallBatch makes the independent calls concurrently and returns
+// their errors, in the same order. Call itself is safe to use from
+// several goroutines.
+func (c *Instance) CallBatch(calls []Call) []error {
+	errs := make([]error, len(calls))
+	sem := make(chan bool, maxBatchConns)
+	var wg sync.WaitGroup
+	for i := range calls {
+		wg.Add(1)
+		sem <- true
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			call := calls[i]
+			errs[i] = c.Call(call.Service, call.Method, call.In, call.Out, call.Opts)
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
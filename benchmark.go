@@ -0,0 +1,56 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"testing"
+)
+
+// A BenchmarkContext is an Instance whose setup and teardown are excluded
+// from the time of a benchmark.
+type BenchmarkContext struct {
+	*Instance
+	b *testing.B
+}
+
+// NewBenchmarkContext creates a Context, as NewContext does, without
+// counting the time it takes, and resets the timer of b. It fails b if
+// the Context cannot be created.
+func NewBenchmarkContext(b *testing.B, opts *Options) *BenchmarkContext {
+	b.StopTimer()
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.T == nil {
+		o.T = b
+	}
+	c, err := NewInstance(&o)
+	if err != nil {
+		b.Fatalf("aetest: unable to create context: %v", err)
+	}
+	b.ResetTimer()
+	b.StartTimer()
+	return &BenchmarkContext{Instance: c, b: b}
+}
+
+// Reset clears the datastore and memcache, without counting the time it
+// takes, so that each iteration starts from the same state.
+func (c *BenchmarkContext) Reset() {
+	c.b.StopTimer()
+	defer c.b.StartTimer()
+	if err := c.ClearDatastore(); err != nil {
+		c.b.Fatalf("aetest: unable to clear the datastore: %v", err)
+	}
+	if err := c.ClearMemcache(); err != nil {
+		c.b.Fatalf("aetest: unable to clear memcache: %v", err)
+	}
+}
+
+// Close closes the Context without counting the time it takes.
+func (c *BenchmarkContext) Close() error {
+	c.b.StopTimer()
+	return c.Instance.Close()
+}
@@ -0,0 +1,180 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+
+	"appengine"
+	"appengine/blobstore"
+	"appengine/datastore"
+	"code.google.com/p/goprotobuf/proto"
+
+	filepb "appengine_internal/files"
+)
+
+// blobInfoKind is the datastore kind that holds blob metadata.
+const blobInfoKind = "__BlobInfo__"
+
+// maxFileChunk is the largest amount of data sent in one file service call.
+const maxFileChunk = 1 << 20
+
+// contentType guesses the MIME type of data stored under filename.
+func contentType(filename string, data []byte) string {
+	if t := mime.TypeByExtension(path.Ext(filename)); t != "" {
+		return t
+	}
+	return http.DetectContentType(data)
+}
+
+// WriteBlob stores data in the blobstore under the given filename
+// and returns its blob key. If the filename cannot be recorded, the blob
+// is deleted.
+func (c *Instance) WriteBlob(filename string, data []byte) (appengine.BlobKey, error) {
+	w, err := blobstore.Create(c, contentType(filename, data))
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	key, err := w.Key()
+	if err != nil || filename == "" {
+		return key, err
+	}
+	if err := c.nameBlob(key, filename); err != nil {
+		blobstore.Delete(c, key)
+		return "", err
+	}
+	return key, nil
+}
+
+// nameBlob records filename as the name of the blob with the given key.
+func (c *Instance) nameBlob(key appengine.BlobKey, filename string) error {
+	// blobstore.Create has no way to name the blob, so record the
+	// filename in its BlobInfo directly. BlobInfos live in the default
+	// namespace.
+	dc, err := appengine.Namespace(c, "")
+	if err != nil {
+		return err
+	}
+	k := datastore.NewKey(dc, blobInfoKind, string(key), 0, nil)
+	var props datastore.PropertyList
+	if err := datastore.Get(dc, k, &props); err != nil {
+		return err
+	}
+	found := false
+	for i := range props {
+		if props[i].Name == "filename" {
+			props[i].Value = filename
+			found = true
+		}
+	}
+	if !found {
+		props = append(props, datastore.Property{Name: "filename", Value: filename})
+	}
+	_, err = datastore.Put(dc, k, &props)
+	return err
+}
+
+// ReadBlob returns the content of the blob with the given key.
+func (c *Instance) ReadBlob(key appengine.BlobKey) ([]byte, error) {
+	return ioutil.ReadAll(blobstore.NewReader(c, key))
+}
+
+// gcsFilename returns the file service name of a Cloud Storage object.
+func gcsFilename(bucket, object string) string {
+	return "/gs/" + bucket + "/" + object
+}
+
+// WriteGCSObject stores data as the named Cloud Storage object.
+func (c *Instance) WriteGCSObject(bucket, object string, data []byte) error {
+	creq := &filepb.CreateRequest{
+		Filesystem:  proto.String("gs"),
+		ContentType: filepb.FileContentType_RAW.Enum(),
+		Filename:    proto.String(gcsFilename(bucket, object)),
+		Parameters: []*filepb.CreateRequest_Parameter{{
+			Name:  proto.String("content_type"),
+			Value: proto.String(contentType(object, data)),
+		}},
+	}
+	cres := &filepb.CreateResponse{}
+	if err := c.Call("file", "Create", creq, cres, nil); err != nil {
+		return err
+	}
+	filename := cres.Filename
+	oreq := &filepb.OpenRequest{
+		Filename:      filename,
+		ContentType:   filepb.FileContentType_RAW.Enum(),
+		OpenMode:      filepb.OpenRequest_APPEND.Enum(),
+		ExclusiveLock: proto.Bool(true),
+	}
+	if err := c.Call("file", "Open", oreq, &filepb.OpenResponse{}, nil); err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxFileChunk {
+			n = maxFileChunk
+		}
+		areq := &filepb.AppendRequest{
+			Filename: filename,
+			Data:     data[:n],
+		}
+		if err := c.Call("file", "Append", areq, &filepb.AppendResponse{}, nil); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	closeReq := &filepb.CloseRequest{
+		Filename: filename,
+		Finalize: proto.Bool(true),
+	}
+	return c.Call("file", "Close", closeReq, &filepb.CloseResponse{}, nil)
+}
+
+// ReadGCSObject returns the content of the named Cloud Storage object.
+func (c *Instance) ReadGCSObject(bucket, object string) ([]byte, error) {
+	filename := proto.String(gcsFilename(bucket, object))
+	oreq := &filepb.OpenRequest{
+		Filename:    filename,
+		ContentType: filepb.FileContentType_RAW.Enum(),
+		OpenMode:    filepb.OpenRequest_READ.Enum(),
+	}
+	if err := c.Call("file", "Open", oreq, &filepb.OpenResponse{}, nil); err != nil {
+		return nil, err
+	}
+	var data []byte
+	for {
+		rreq := &filepb.ReadRequest{
+			Filename: filename,
+			Pos:      proto.Int64(int64(len(data))),
+			MaxBytes: proto.Int64(maxFileChunk),
+		}
+		rres := &filepb.ReadResponse{}
+		if err := c.Call("file", "Read", rreq, rres, nil); err != nil {
+			return nil, err
+		}
+		if len(rres.Data) == 0 {
+			break
+		}
+		data = append(data, rres.Data...)
+	}
+	closeReq := &filepb.CloseRequest{
+		Filename: filename,
+		Finalize: proto.Bool(false),
+	}
+	if err := c.Call("file", "Close", closeReq, &filepb.CloseResponse{}, nil); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"appengine/mail"
+)
+
+// bouncePath is the path bounce notifications are posted to.
+const bouncePath = "/_ah/bounce"
+
+// bounceSender is the sender of the bounce notifications.
+const bounceSender = "Mail Delivery Subsystem <mailer-daemon@googlemail.com>"
+
+// DeliverBounce posts to h the notification that msg, sent by the app,
+// could not be delivered to recipient, as App Engine posts it to
+// /_ah/bounce: a form of the original- and notification- fields, and the
+// raw-message field holding the notification email. h, by default
+// http.DefaultServeMux, serves it in the test process, with the context
+// returned by c.ContextForRequest, available with RequestContext.
+// DeliverBounce fails if h does not respond with a 2xx status.
+func DeliverBounce(c *Instance, h http.Handler, msg *mail.Message, recipient string) error {
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	subject := "Delivery Status Notification (Failure)"
+	text := fmt.Sprintf("Delivery to the following recipient failed permanently:\n\n     %s\n\n"+
+		"Technical details of permanent failure:\n"+
+		"The email account that you tried to reach does not exist.\n\n"+
+		"----- Original message -----\n\n"+
+		"From: %s\nTo: %s\nSubject: %s\n\n%s\n",
+		recipient, msg.Sender, strings.Join(msg.To, ", "), msg.Subject, msg.Body)
+	raw := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		bounceSender, msg.Sender, subject, strings.Replace(text, "\n", "\r\n", -1))
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	fields := []struct{ name, value string }{
+		{"original-from", msg.Sender},
+		{"original-to", strings.Join(msg.To, ", ")},
+		{"original-cc", strings.Join(msg.Cc, ", ")},
+		{"original-bcc", strings.Join(msg.Bcc, ", ")},
+		{"original-subject", msg.Subject},
+		{"original-text", msg.Body},
+		{"notification-from", bounceSender},
+		{"notification-to", msg.Sender},
+		{"notification-subject", subject},
+		{"notification-text", text},
+		{"raw-message", raw},
+	}
+	for _, f := range fields {
+		if err := w.WriteField(f.name, f.value); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	r, err := http.NewRequest("POST", bouncePath, &body)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", w.FormDataContentType())
+	rec := httptest.NewRecorder()
+	WrapHandler(c, h).ServeHTTP(rec, r)
+	if rec.Code < 200 || rec.Code > 299 {
+		return fmt.Errorf("aetest: bounce handler responded with status %d: %s", rec.Code, rec.Body)
+	}
+	return nil
+}
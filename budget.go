@@ -0,0 +1,36 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"sync"
+	"testing"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// Budget is the maximum number of API calls allowed per service, such as
+// "datastore_v3" or "memcache". Services not in the budget are unlimited.
+type Budget map[string]int
+
+// WithRPCBudget makes t fail when the API calls made from now on through
+// c and the contexts derived from it exceed budget. The calls are
+// counted by a hook added with AddCallHook.
+func WithRPCBudget(t testing.TB, c *Instance, budget Budget) {
+	var (
+		mu     sync.Mutex
+		counts = make(map[string]int) // keyed by service
+	)
+	c.AddCallHook(func(service, method string, in, out proto.Message, next func() error) error {
+		mu.Lock()
+		counts[service]++
+		n := counts[service]
+		mu.Unlock()
+		if max, ok := budget[service]; ok && n == max+1 {
+			t.Errorf("aetest: call to %s.%s exceeds the budget of %d %s calls", service, method, max, service)
+		}
+		return next()
+	})
+}
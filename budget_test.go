@@ -0,0 +1,44 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"fmt"
+	"testing"
+
+	memcachepb "appengine_internal/memcache"
+)
+
+// budgetT records the errors of a test.
+type budgetT struct {
+	testing.TB
+	errs []string
+}
+
+func (t *budgetT) Errorf(format string, args ...interface{}) {
+	t.errs = append(t.errs, fmt.Sprintf(format, args...))
+}
+
+func TestWithRPCBudget(t *testing.T) {
+	c, err := NewInstance(&Options{Hermetic: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	bt := &budgetT{TB: t}
+	WithRPCBudget(bt, c, Budget{"memcache": 2})
+	d := c.Derive()
+	for i := 0; i < 4; i++ {
+		req := &memcachepb.MemcacheGetRequest{Key: [][]byte{[]byte("k")}}
+		if err := d.Call("memcache", "Get", req, &memcachepb.MemcacheGetResponse{}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := "aetest: call to memcache.Get exceeds the budget of 2 memcache calls"
+	if len(bt.errs) != 1 || bt.errs[0] != want {
+		t.Errorf("errors = %q, want [%q]", bt.errs, want)
+	}
+}
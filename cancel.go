@@ -0,0 +1,55 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrCanceled is returned by the API calls aborted by Close or by closing
+// Options.Cancel.
+var ErrCanceled = errors.New("aetest: API call canceled")
+
+// cancel aborts the API calls in flight and makes later ones fail with
+// ErrCanceled.
+func (c *Instance) cancel() {
+	c.cancelOnce.Do(func() { close(c.done) })
+}
+
+// canceled reports whether cancel was called.
+func (c *Instance) canceled() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// watchCancel calls cancel once ch is closed.
+func (c *Instance) watchCancel(ch <-chan struct{}) {
+	select {
+	case <-ch:
+		c.cancel()
+	case <-c.done:
+	}
+}
+
+// sleep waits for d, and reports whether it did before the API calls were
+// canceled.
+func (c *Instance) sleep(d time.Duration) bool {
+	return sleep(d, c.done)
+}
+
+// sleep waits for d, and reports whether it did before done was closed.
+func sleep(d time.Duration, done <-chan struct{}) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-done:
+		return false
+	}
+}
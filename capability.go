@@ -0,0 +1,87 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"appengine_internal"
+	"code.google.com/p/goprotobuf/proto"
+
+	capabilitypb "appengine_internal/capability"
+	remoteapipb "appengine_internal/remote_api"
+)
+
+// capabilityMethods lists, per service and capability, the methods that
+// fail while the capability is disabled. The "*" capability covers every
+// method of a service.
+var capabilityMethods = map[string]map[string][]string{
+	"datastore_v3": {
+		"write": {"Put", "Delete", "Commit"},
+	},
+}
+
+// DisableCapability makes the capability service report the given
+// capability of service as disabled, and makes the calls that need
+// it fail with a capability-disabled error. The capability "*"
+// stands for every capability of service.
+func (c *Instance) DisableCapability(service, capability string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.disabled == nil {
+		c.disabled = make(map[string]bool)
+	}
+	c.disabled[service+"."+capability] = true
+}
+
+// EnableCapability undoes the effect of DisableCapability.
+func (c *Instance) EnableCapability(service, capability string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.disabled, service+"."+capability)
+}
+
+// capabilityDisabled reports whether any of the capabilities of service is
+// disabled.
+func (c *Instance) capabilityDisabled(service string, capabilities ...string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.disabled[service+".*"] {
+		return true
+	}
+	for _, name := range capabilities {
+		if c.disabled[service+"."+name] {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCapability answers capability queries and fails calls that need a
+// disabled capability.
+func (c *Instance) checkCapability(service, method string, in, out proto.Message, next func() error) error {
+	if service == "capability_service" && method == "IsEnabled" {
+		req := in.(*capabilitypb.IsEnabledRequest)
+		if !c.capabilityDisabled(req.GetPackage(), req.Capability...) {
+			return next()
+		}
+		res := out.(*capabilitypb.IsEnabledResponse)
+		res.SummaryStatus = capabilitypb.IsEnabledResponse_DISABLED.Enum()
+		return nil
+	}
+	var caps []string
+	for name, methods := range capabilityMethods[service] {
+		for _, m := range methods {
+			if m == method {
+				caps = append(caps, name)
+			}
+		}
+	}
+	if c.capabilityDisabled(service, caps...) {
+		return &appengine_internal.CallError{
+			Detail: "The API call " + service + "." + method + "() is temporarily unavailable.",
+			Code:   int32(remoteapipb.RpcError_CAPABILITY_DISABLED),
+		}
+	}
+	return next()
+}
@@ -0,0 +1,140 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"appengine_internal"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+var record = flag.Bool("aetest.record", false, "record the API calls of the cassettes of Options.Cassette anew")
+
+// cassetteEntry is an API call recorded in a cassette file.
+type cassetteEntry struct {
+	Service  string
+	Method   string
+	Request  []byte
+	Response []byte         `json:",omitempty"`
+	Error    *cassetteError `json:",omitempty"`
+}
+
+// cassetteError is the error returned by a recorded call.
+type cassetteError struct {
+	// Kind is "api" for an APIError, "call" for a CallError, and empty
+	// for any other error.
+	Kind    string `json:",omitempty"`
+	Service string `json:",omitempty"`
+	Detail  string
+	Code    int32 `json:",omitempty"`
+	Timeout bool  `json:",omitempty"`
+}
+
+func newCassetteError(err error) *cassetteError {
+	switch err := err.(type) {
+	case *appengine_internal.APIError:
+		return &cassetteError{Kind: "api", Service: err.Service, Detail: err.Detail, Code: err.Code}
+	case *appengine_internal.CallError:
+		return &cassetteError{Kind: "call", Detail: err.Detail, Code: err.Code, Timeout: err.Timeout}
+	}
+	return &cassetteError{Detail: err.Error()}
+}
+
+func (e *cassetteError) err() error {
+	switch e.Kind {
+	case "api":
+		return &appengine_internal.APIError{Service: e.Service, Detail: e.Detail, Code: e.Code}
+	case "call":
+		return &appengine_internal.CallError{Detail: e.Detail, Code: e.Code, Timeout: e.Timeout}
+	}
+	return errors.New(e.Detail)
+}
+
+// cassette records the API calls sent to the API server, or replays them
+// in place of the API server.
+type cassette struct {
+	path      string
+	recording bool
+
+	mu      sync.Mutex
+	entries []cassetteEntry
+	next    int // index of the next entry to replay
+}
+
+// openCassette opens the cassette file at path. The cassette records if
+// the file does not exist or the -aetest.record flag is set, and replays
+// otherwise.
+func openCassette(path string) (*cassette, error) {
+	cs := &cassette{path: path}
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case *record || os.IsNotExist(err):
+		cs.recording = true
+		return cs, nil
+	case err != nil:
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &cs.entries); err != nil {
+		return nil, fmt.Errorf("aetest: invalid cassette %s: %v", path, err)
+	}
+	return cs, nil
+}
+
+// add records a call to the API server.
+func (cs *cassette) add(service, method string, req, res []byte, err error) {
+	e := cassetteEntry{
+		Service:  service,
+		Method:   method,
+		Request:  req,
+		Response: res,
+	}
+	if err != nil {
+		e.Error = newCassetteError(err)
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.entries = append(cs.entries, e)
+}
+
+// replay answers a call with the next recorded call, which must be to the
+// same method.
+func (cs *cassette) replay(service, method string, out proto.Message) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.next == len(cs.entries) {
+		return fmt.Errorf("aetest: cassette %s: unexpected call to %s.%s after the %d recorded calls", cs.path, service, method, len(cs.entries))
+	}
+	e := cs.entries[cs.next]
+	if e.Service != service || e.Method != method {
+		return fmt.Errorf("aetest: cassette %s: call %d is to %s.%s, but %s.%s was recorded", cs.path, cs.next, service, method, e.Service, e.Method)
+	}
+	cs.next++
+	if e.Error != nil {
+		return e.Error.err()
+	}
+	return proto.Unmarshal(e.Response, out)
+}
+
+// save writes the recorded calls to the cassette file.
+func (cs *cassette) save() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	b, err := json.MarshalIndent(cs.entries, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cs.path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cs.path, b, 0644)
+}
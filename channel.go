@@ -0,0 +1,56 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+
+	channelpb "appengine_internal/channel"
+)
+
+// captureChannel records the tokens created and messages sent through the
+// channel service.
+func (c *Instance) captureChannel(service, method string, in, out proto.Message, next func() error) error {
+	if err := next(); err != nil || service != "channel" {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch method {
+	case "CreateChannel":
+		id := in.(*channelpb.CreateChannelRequest).GetApplicationKey()
+		if c.channelTokens == nil {
+			c.channelTokens = make(map[string][]string)
+		}
+		c.channelTokens[id] = append(c.channelTokens[id], out.(*channelpb.CreateChannelResponse).GetToken())
+	case "SendChannelMessage":
+		req := in.(*channelpb.SendMessageRequest)
+		id := req.GetApplicationKey()
+		if c.channelMessages == nil {
+			c.channelMessages = make(map[string][]string)
+		}
+		c.channelMessages[id] = append(c.channelMessages[id], req.GetMessage())
+	}
+	return nil
+}
+
+// ChannelTokens returns the tokens created for the given channel
+// client ID, in the order they were created. The channel stub of the
+// API server keeps them to itself, so those created by the served app
+// or with RawCall are missing.
+func (c *Instance) ChannelTokens(clientID string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.channelTokens[clientID]...)
+}
+
+// ChannelMessages returns the messages sent to the given channel
+// client ID, in the order they were sent. Like ChannelTokens, it
+// misses those sent by the served app or with RawCall.
+func (c *Instance) ChannelMessages(clientID string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.channelMessages[clientID]...)
+}
@@ -0,0 +1,142 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	memcachepb "appengine_internal/memcache"
+)
+
+// maxRelativeExpiration is the largest memcache expiration, in seconds,
+// taken as relative to the current time rather than as a Unix time.
+const maxRelativeExpiration = 30 * 24 * 60 * 60
+
+// SetClock sets the time reported by Now, and used to expire
+// memcache items stored from then on.
+func (c *Instance) SetClock(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clockSet = true
+	c.clockOffset = t.Sub(time.Now())
+}
+
+// AdvanceClock moves the time reported by Now forward by d,
+// expiring the memcache items whose expiration time it passes.
+func (c *Instance) AdvanceClock(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clockSet = true
+	c.clockOffset += d
+}
+
+// Now returns the current time of the clock set by SetClock and
+// AdvanceClock. It is the real time until either is called.
+func (c *Instance) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().Add(c.clockOffset)
+}
+
+// expireMemcache makes memcache items expire according to the clock set by
+// SetClock and AdvanceClock. The API server keeps such items forever, and
+// they are deleted once the clock passes their expiration time.
+func (c *Instance) expireMemcache(service, method string, in, out proto.Message, next func() error) error {
+	if service != "memcache" {
+		return next()
+	}
+	c.mu.Lock()
+	clockSet := c.clockSet
+	c.mu.Unlock()
+	if !clockSet {
+		return next()
+	}
+	if err := c.deleteExpiredItems(); err != nil {
+		return err
+	}
+	if method != "Set" {
+		return next()
+	}
+
+	req := in.(*memcachepb.MemcacheSetRequest)
+	// The expiration times are cleared for the API server only; the
+	// request of the caller is restored from its clone.
+	orig := proto.Clone(req).(*memcachepb.MemcacheSetRequest)
+	defer func() {
+		for i, item := range req.Item {
+			item.ExpirationTime = orig.Item[i].ExpirationTime
+		}
+	}()
+	now := c.Now()
+	expiry := make(map[string]time.Time)
+	for _, item := range req.Item {
+		e := item.GetExpirationTime()
+		switch {
+		case e == 0:
+			expiry[string(item.Key)] = time.Time{}
+			continue
+		case e <= maxRelativeExpiration:
+			expiry[string(item.Key)] = now.Add(time.Duration(e) * time.Second)
+		default:
+			expiry[string(item.Key)] = time.Unix(int64(e), 0)
+		}
+		item.ExpirationTime = nil
+	}
+	if err := next(); err != nil {
+		return err
+	}
+
+	ns := req.GetNameSpace()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.memcacheExpiry == nil {
+		c.memcacheExpiry = make(map[string]map[string]time.Time)
+	}
+	if c.memcacheExpiry[ns] == nil {
+		c.memcacheExpiry[ns] = make(map[string]time.Time)
+	}
+	for k, t := range expiry {
+		if t.IsZero() {
+			delete(c.memcacheExpiry[ns], k)
+		} else {
+			c.memcacheExpiry[ns][k] = t
+		}
+	}
+	return nil
+}
+
+// deleteExpiredItems deletes the memcache items whose expiration time the
+// clock has passed.
+func (c *Instance) deleteExpiredItems() error {
+	now := c.Now()
+	expired := make(map[string][][]byte) // keyed by namespace
+	c.mu.Lock()
+	for ns, items := range c.memcacheExpiry {
+		for k, t := range items {
+			if !t.After(now) {
+				expired[ns] = append(expired[ns], []byte(k))
+				delete(items, k)
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	for ns, keys := range expired {
+		req := &memcachepb.MemcacheDeleteRequest{
+			NameSpace: proto.String(ns),
+		}
+		for _, k := range keys {
+			req.Item = append(req.Item, &memcachepb.MemcacheDeleteRequest_Item{Key: k})
+		}
+		// The hooks must not see a call the code under test did not
+		// make.
+		if err := c.dispatch("memcache", "Delete", req, &memcachepb.MemcacheDeleteResponse{}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"testing"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	memcachepb "appengine_internal/memcache"
+)
+
+func TestMemcacheClock(t *testing.T) {
+	c, err := NewInstance(&Options{Hermetic: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetClock(time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	req := &memcachepb.MemcacheSetRequest{
+		Item: []*memcachepb.MemcacheSetRequest_Item{
+			{Key: []byte("a"), Value: []byte("1"), ExpirationTime: proto.Uint32(60)},
+			{Key: []byte("b"), Value: []byte("2")},
+		},
+	}
+	want := proto.Clone(req)
+	if err := c.Call("memcache", "Set", req, &memcachepb.MemcacheSetResponse{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(req, want) {
+		t.Errorf("Set changed the request to %v, want %v", req, want)
+	}
+
+	get := func() int {
+		res := &memcachepb.MemcacheGetResponse{}
+		req := &memcachepb.MemcacheGetRequest{Key: [][]byte{[]byte("a"), []byte("b")}}
+		if err := c.Call("memcache", "Get", req, res, nil); err != nil {
+			t.Fatal(err)
+		}
+		return len(res.Item)
+	}
+	if n := get(); n != 2 {
+		t.Errorf("got %d items, want 2", n)
+	}
+	c.AdvanceClock(time.Minute)
+	if n := get(); n != 1 {
+		t.Errorf("got %d items after they expire, want 1", n)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"errors"
+)
+
+// ErrClosed is returned by the API calls made after Close.
+var ErrClosed = errors.New("aetest: API call on a closed context")
+
+// The states of an instance.
+const (
+	stateOpen = iota
+	stateClosing
+	stateClosed
+)
+
+// beginClose moves c from the open to the closing state, and reports
+// whether it did. Otherwise, Close was already called.
+func (c *Instance) beginClose() bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.state != stateOpen {
+		return false
+	}
+	c.state = stateClosing
+	return true
+}
+
+// endClose moves c to the closed state, in which Close returns err.
+func (c *Instance) endClose(err error) {
+	c.stateMu.Lock()
+	c.state = stateClosed
+	c.closeErr = err
+	c.stateMu.Unlock()
+	close(c.closed)
+}
+
+// isClosed reports whether Close was called.
+func (c *Instance) isClosed() bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.state != stateOpen
+}
@@ -0,0 +1,92 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"code.google.com/p/goprotobuf/proto"
+
+	datastorepb "appengine_internal/datastore"
+)
+
+// rootKey identifies the root entity of an entity group.
+type rootKey struct {
+	namespace string
+	kind      string
+	name      string
+	id        int64
+}
+
+func newRootKey(ref *datastorepb.Reference) (rootKey, bool) {
+	elems := ref.GetPath().GetElement()
+	if len(elems) == 0 {
+		return rootKey{}, false
+	}
+	return rootKey{
+		namespace: ref.GetNameSpace(),
+		kind:      elems[0].GetType(),
+		name:      elems[0].GetName(),
+		id:        elems[0].GetId(),
+	}, true
+}
+
+// trackPendingWrites records the entity groups written to when the
+// datastore is not strongly consistent.
+func (c *Instance) trackPendingWrites(service, method string, in, out proto.Message, next func() error) error {
+	if service != "datastore_v3" || c.opts.consistencyPolicy() == "consistent" {
+		return next()
+	}
+	var refs []*datastorepb.Reference
+	switch method {
+	case "Put":
+		if err := next(); err != nil {
+			return err
+		}
+		refs = out.(*datastorepb.PutResponse).Key
+	case "Delete":
+		if err := next(); err != nil {
+			return err
+		}
+		refs = in.(*datastorepb.DeleteRequest).Key
+	default:
+		return next()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pendingRoots == nil {
+		c.pendingRoots = make(map[rootKey]bool)
+	}
+	for _, ref := range refs {
+		if rk, ok := newRootKey(ref); ok {
+			c.pendingRoots[rk] = true
+		}
+	}
+	return nil
+}
+
+// ApplyPendingWrites makes every datastore write visible to
+// queries. It is only needed when Options.ConsistencyPolicy is not
+// "consistent".
+func (c *Instance) ApplyPendingWrites() error {
+	c.mu.Lock()
+	roots := c.pendingRoots
+	c.pendingRoots = nil
+	c.mu.Unlock()
+
+	// An ancestor query is strongly consistent, so the API server applies
+	// the unapplied writes of the entity group before running it.
+	for rk := range roots {
+		nsc, err := appengine.Namespace(c, rk.namespace)
+		if err != nil {
+			return err
+		}
+		k := datastore.NewKey(nsc, rk.kind, rk.name, rk.id, nil)
+		if _, err := datastore.NewQuery("").Ancestor(k).KeysOnly().GetAll(nsc, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
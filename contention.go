@@ -0,0 +1,68 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"math/rand"
+
+	"appengine_internal"
+	"code.google.com/p/goprotobuf/proto"
+
+	basepb "appengine_internal/base"
+	datastorepb "appengine_internal/datastore"
+)
+
+// InjectTransactionContention makes the next n transaction commits
+// fail with datastore.ErrConcurrentTransaction.
+func (c *Instance) InjectTransactionContention(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.contention = n
+}
+
+// SetTransactionContentionRate makes each transaction commit fail
+// with datastore.ErrConcurrentTransaction with probability p. The
+// failures follow the same sequence on every run.
+func (c *Instance) SetTransactionContentionRate(p float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.contentionRate = p
+	if c.contentionRand == nil {
+		c.contentionRand = rand.New(rand.NewSource(1))
+	}
+}
+
+// contended reports whether the next commit should fail.
+func (c *Instance) contended() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.contention > 0 {
+		c.contention--
+		return true
+	}
+	return c.contentionRate > 0 && c.contentionRand.Float64() < c.contentionRate
+}
+
+// injectContention fails transaction commits as if another transaction had
+// modified the same entity groups.
+func (c *Instance) injectContention(service, method string, in, out proto.Message, next func() error) error {
+	if service != "datastore_v3" || method != "Commit" || !c.contended() {
+		return next()
+	}
+	// Roll the transaction back so the API server releases its locks.
+	// The call bypasses the hooks, which must not see a call the code
+	// under test did not make.
+	if err := c.dispatch("datastore_v3", "Rollback", in, &basepb.VoidProto{}, nil); err != nil {
+		return err
+	}
+	// Nor does checkTransactions see the commit, which ends the
+	// transaction all the same.
+	c.endTxn(in.(*datastorepb.Transaction))
+	return &appengine_internal.APIError{
+		Service: "datastore_v3",
+		Detail:  "too much contention on these datastore entities. please try again.",
+		Code:    int32(datastorepb.Error_CONCURRENT_TRANSACTION),
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"testing"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	datastorepb "appengine_internal/datastore"
+)
+
+func TestContentionEndsStrictTransaction(t *testing.T) {
+	c, err := NewInstance(&Options{Hermetic: true, StrictTransactions: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	tx := &datastorepb.Transaction{}
+	req := &datastorepb.BeginTransactionRequest{App: proto.String(c.FullyQualifiedAppID())}
+	if err := c.Call("datastore_v3", "BeginTransaction", req, tx, nil); err != nil {
+		t.Fatal(err)
+	}
+	c.InjectTransactionContention(1)
+	if err := c.Call("datastore_v3", "Commit", tx, &datastorepb.CommitResponse{}, nil); err == nil {
+		t.Fatal("Commit succeeded, want contention")
+	}
+	c.mu.Lock()
+	n := len(c.txns)
+	c.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d transactions left after the rejected commit, want 0", n)
+	}
+}
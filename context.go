@@ -12,8 +12,7 @@ An example test file:
 	import (
 		"testing"
 
-		"appengine/memcache"
-		"appengine/aetest"
+			"appengine/aetest"
 	)
 
 	func TestFoo(t *testing.T) {
@@ -40,13 +39,13 @@ An example test file:
 		}
 	}
 
-The environment variable APPENGINE_DEV_APPSERVER specifies the location of the
-dev_appserver.py executable to use. If unset, the system PATH is consulted.
+Options.SDKPath or the environment variable APPENGINE_DEV_APPSERVER specifies
+the location of the dev_appserver.py executable to use. If neither is set, the
+system PATH is consulted, then the installed Google Cloud SDK.
 */
 package aetest
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/rand"
 	"errors"
@@ -55,13 +54,17 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	mathrand "math/rand"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"testing"
 	"time"
 
 	"appengine"
@@ -75,18 +78,33 @@ import (
 
 // Context is an appengine.Context that sends all App Engine API calls to an
 // instance of the API server.
+//
+// A Context may be used by multiple goroutines simultaneously, including
+// to make API calls while Close runs, which makes them fail.
 type Context interface {
 	appengine.Context
 
 	// Login causes the context to act as the given user.
+	// It does nothing after Close.
 	Login(*user.User)
 	// Logout causes the context to act as a logged-out user.
+	// It does nothing after Close.
 	Logout()
+
 	// Close kills the child api_server.py process,
-	// releasing its resources.
+	// releasing its resources. API calls in flight fail with
+	// ErrCanceled, and API calls made after Close with ErrClosed.
+	// Later calls to Close return the result of the first one.
 	io.Closer
 }
 
+// InstanceOf returns the Instance c is, or nil if c was not returned by
+// this package.
+func InstanceOf(c appengine.Context) *Instance {
+	i, _ := c.(*Instance)
+	return i
+}
+
 func btos(b bool) string {
 	if b {
 		return "1"
@@ -97,22 +115,214 @@ func btos(b bool) string {
 // NewContext launches an instance of api_server.py and returns a Context
 // that delegates all App Engine API calls to that instance.
 // If opts is nil the default values are used.
+// No instance is launched if opts.Hermetic or opts.RemoteAPI is set, or if
+// opts.Cassette names a cassette to replay.
+// The returned Context is an *Instance.
 func NewContext(opts *Options) (Context, error) {
-	req, _ := http.NewRequest("GET", "/", nil)
-	c := &context{
-		appID:   opts.appID(),
-		req:     req,
-		session: newSessionID(),
+	c, err := NewInstance(opts)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewInstance is like NewContext, but returns the Instance, whose methods
+// inspect and control the API server.
+func NewInstance(opts *Options) (*Instance, error) {
+	c := &Instance{
+		instance: &instance{
+			appID:  opts.appID(),
+			done:   make(chan struct{}),
+			closed: make(chan struct{}),
+		},
+	}
+	if opts != nil {
+		c.opts = *opts
+	}
+	c.idRand = c.opts.Rand
+	if c.idRand == nil {
+		c.idRand = rand.Reader
+	}
+	c.session = c.newID()
+	c.requestID = c.newID()
+	if c.opts.UniqueAppID {
+		if c.opts.RemoteAPI != nil {
+			return nil, errors.New("aetest: Options.UniqueAppID cannot be used with Options.RemoteAPI")
+		}
+		// The suffix does not come from Options.Rand, which may
+		// repeat it in every run.
+		var suffix [4]byte
+		if _, err := rand.Read(suffix[:]); err != nil {
+			return nil, err
+		}
+		c.appID += fmt.Sprintf("-%x", suffix)
+	}
+	c.client = c.opts.Client
+	if c.client == nil {
+		c.client = &http.Client{
+			Transport: &http.Transport{MaxIdleConnsPerHost: maxBatchConns},
+		}
+	}
+	if c.opts.RequestDeadline > 0 {
+		c.deadline = time.Now().Add(c.opts.RequestDeadline)
+	}
+	if ns := c.opts.DefaultNamespace; ns != "" {
+		if !validNamespace.MatchString(ns) {
+			return nil, fmt.Errorf("aetest: invalid default namespace %q", ns)
+		}
 	}
-	if err := c.startChild(); err != nil {
+	if e := c.opts.Environment; e != nil {
+		c.opts.Environment = e.withDefaults(c.appID, c.newID())
+	}
+	c.req = c.newRequest()
+	if c.opts.Modules != nil {
+		c.modules = newModuleSet(c.opts.Modules)
+	}
+	c.hooks = []CallHook{
+		c.injectErrors,
+		c.enforceQuotas,
+		c.captureMail,
+		c.captureXMPP,
+		c.captureChannel,
+		c.checkCapability,
+		c.simulateModules,
+		c.appIdentity,
+		c.defaultBucket,
+		c.startBackgroundRequests,
+		c.simulateSystemStats,
+		c.trackPendingWrites,
+		c.trackOpenWork,
+		c.injectContention,
+		c.checkTransactions,
+		c.checkTaskTargets,
+		c.recordTaskEdges,
+		c.trackMemcacheKeys,
+		c.simulateMemcache,
+		c.expireMemcache,
+	}
+	if c.opts.Hermetic {
+		c.handlers = c.hermeticHandlers()
+	} else {
+		c.handlers = make(map[string]CallHandler)
+	}
+	// The cassettes are opened before any process is started, so that
+	// failing to open them leaves nothing to stop.
+	if c.opts.Cassette != "" {
+		cs, err := openCassette(c.opts.Cassette)
+		if err != nil {
+			return nil, err
+		}
+		c.cassette = cs
+	}
+	if c.opts.URLFetchCassette != "" {
+		fc, err := openFetchCassette(c.opts.URLFetchCassette, c.opts.URLFetchTransport)
+		if err != nil {
+			return nil, err
+		}
+		c.fetchCassette = fc
+		c.handlers["urlfetch"] = newURLFetchStub(fc).call
+	} else if c.opts.InterceptURLFetch {
+		c.handlers["urlfetch"] = newURLFetchStub(c.opts.URLFetchTransport).call
+	}
+	if o := c.opts.DatastoreEmulator; o != nil {
+		e, err := startEmulator(o, c.appID, c.opts.consistencyPolicy())
+		if err != nil {
+			return nil, err
+		}
+		c.emulator = e
+		c.handlers["datastore_v3"] = newEmulatorDatastore(e, c.FullyQualifiedAppID()).call
+	}
+	c.sockets = newSocketStub()
+	if c.opts.Sockets {
+		c.handlers["remote_socket"] = c.sockets.call
+	}
+	for service, h := range c.opts.ServiceOverrides {
+		c.handlers[service] = h
+	}
+	if e := c.opts.Environment; e != nil {
+		c.restoreEnv = e.setenv()
+	}
+	var err error
+	switch {
+	case c.opts.Hermetic || c.cassette != nil && !c.cassette.recording:
+	case c.opts.RemoteAPI != nil:
+		err = c.useRemoteAPI()
+	default:
+		start := time.Now()
+		if err = c.startChild(); err == nil && c.opts.Metrics != nil {
+			c.opts.Metrics.Startup(time.Since(start))
+		}
+	}
+	if err != nil {
+		if c.emulator != nil {
+			c.emulator.stop()
+		}
+		if c.restoreEnv != nil {
+			c.restoreEnv()
+		}
 		return nil, err
 	}
+	if c.opts.Cancel != nil {
+		go c.watchCancel(c.opts.Cancel)
+	}
 	return c, nil
 }
 
-func newSessionID() string {
+// AddCallHook makes h intercept the API calls made through the
+// context and the contexts derived from it. Hooks run in the order
+// they were added, before the hooks that implement the other
+// methods of Instance.
+func (c *Instance) AddCallHook(h CallHook) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Copy the hooks, as calls in progress may be ranging over them.
+	c.userHooks = append(c.userHooks[:len(c.userHooks):len(c.userHooks)], h)
+}
+
+// Derive returns a new Context that shares the API server, and the
+// state recorded from the API calls, with this one. The new context
+// starts logged out, in the default namespace, or in a namespace of
+// its own if Options.IsolateNamespaces is set, and as another
+// request. Closing it does nothing.
+func (c *Instance) Derive() *Instance {
+	d := &Instance{
+		instance:  c.instance,
+		req:       c.newRequest(),
+		requestID: c.newID(),
+		derived:   true,
+	}
+	if c.opts.RequestDeadline > 0 {
+		d.deadline = time.Now().Add(c.opts.RequestDeadline)
+	}
+	if c.opts.IsolateNamespaces {
+		d.namespace = fmt.Sprintf("aetest-%d", atomic.AddInt32(&c.derivedCount, 1))
+	}
+	return d
+}
+
+// newRequest returns the request a new context acts as.
+func (c *Instance) newRequest() *http.Request {
+	req, _ := http.NewRequest("GET", "/", nil)
+	if ns := c.opts.DefaultNamespace; ns != "" {
+		req.Header.Set("X-AppEngine-Default-Namespace", ns)
+	}
+	if b := c.opts.DefaultGCSBucket; b != "" {
+		// Apps name the default bucket after the default hostname.
+		req.Header.Set("X-AppEngine-Default-Version-Hostname", b)
+	}
+	if e := c.opts.Environment; e != nil {
+		req.Header.Set("X-AppEngine-Default-Version-Hostname", e.DefaultVersionHostname)
+		req.Header.Set("X-AppEngine-Datacenter", e.Datacenter)
+	}
+	return req
+}
+
+// newID returns a new session or request ID read from Options.Rand.
+func (c *Instance) newID() string {
 	var buf [16]byte
-	io.ReadFull(rand.Reader, buf[:])
+	c.idMu.Lock()
+	io.ReadFull(c.idRand, buf[:])
+	c.idMu.Unlock()
 	return fmt.Sprintf("%x", buf[:])
 }
 
@@ -123,6 +333,253 @@ type Options struct {
 	// AppID specifies the App ID to use during tests.
 	// By default, "testapp".
 	AppID string
+
+	// DefaultGCSBucket is the name of the default Google Cloud Storage
+	// bucket of the app, such as "testapp.appspot.com". If set, it is
+	// returned by the file and app identity services and, unless
+	// Environment is set, by appengine.DefaultVersionHostname.
+	DefaultGCSBucket string
+
+	// UniqueAppID appends a random suffix to AppID, such as
+	// "testapp-3f9c01ab", so that the state keyed by the app ID, such
+	// as keys and bucket names, differs between contexts. The contexts
+	// returned by Derive, Run and ContextForRequest share the app ID of
+	// their parent. It cannot be used with RemoteAPI.
+	UniqueAppID bool
+
+	// QueueYAML is the content of a queue.yaml file used to configure
+	// task queues, including pull queues. By default only the default
+	// push queue exists.
+	QueueYAML string
+
+	// ClearSearchIndexes causes the search indexes left behind by
+	// earlier runs to be deleted when the API server starts.
+	ClearSearchIndexes bool
+
+	// Modules, if non-nil, defines the modules, versions and instances
+	// reported by the modules service in place of the single module of
+	// the API server's stub app.
+	Modules []Module
+
+	// ServiceAccountName is the name reported by appengine.ServiceAccount.
+	// If empty, the API server's default name is used.
+	ServiceAccountName string
+
+	// SequentialIDs causes the datastore to allocate integer IDs
+	// sequentially, starting at 1, instead of scattering them, so that
+	// the same test allocates the same IDs on every run.
+	SequentialIDs bool
+
+	// ConsistencyPolicy is the datastore consistency policy of the API
+	// server: "consistent", "random" or "time". By default, "consistent".
+	// Under the other policies, queries may not see recent writes until
+	// ApplyPendingWrites is called.
+	ConsistencyPolicy string
+
+	// StrictTransactions makes datastore calls fail when a transaction
+	// touches more than one entity group without being a cross-group
+	// transaction, or more than 25 entity groups in any case, as they
+	// would in production.
+	StrictTransactions bool
+
+	// StrictClose makes Close fail, after releasing the resources of the
+	// context, if work is left behind, as reported by Verify.
+	StrictClose bool
+
+	// TraceTasks records which tasks are added by the appengine/delay
+	// functions run by RunDelayedTasks, as reported by TaskGraph. The API
+	// calls of the functions then tag the tasks they add with an
+	// X-Aetest-Parent-Task header.
+	TraceTasks bool
+
+	// IsolateNamespaces gives every context returned by Derive a
+	// namespace of its own, so that tests sharing an API server do not
+	// see each other's data.
+	IsolateNamespaces bool
+
+	// DefaultNamespace is the default namespace of the requests, which
+	// App Engine sets to the Google Apps domain of the app. It is the
+	// value of the X-AppEngine-Default-Namespace header of the requests
+	// and the result of the __go__.GetDefaultNamespace call.
+	DefaultNamespace string
+
+	// Hermetic serves the API calls in-process, with Go implementations
+	// of the services, instead of starting an API server. It needs
+	// neither Python nor the SDK and starts instantly, but only the
+	// datastore, memcache, taskqueue and user services are available,
+	// and the helpers that rely on the API server's admin pages fail.
+	// The datastore does not support projection queries, and push tasks
+	// are never run.
+	Hermetic bool
+
+	// ServiceOverrides, keyed by service name, serves the calls to the
+	// given services in-process, while the calls to the other services
+	// still go to the API server, or to the in-process services of
+	// hermetic mode.
+	ServiceOverrides map[string]CallHandler
+
+	// Cassette is the path of a file of recorded API calls. If the file
+	// exists, the calls sent to the API server are answered from it,
+	// in the order they were recorded, and no API server is started.
+	// Otherwise, or if the test runs with -aetest.record, the calls are
+	// sent to the API server and recorded to the file on Close.
+	Cassette string
+
+	// RequestDeadline, if non-zero, is how long the simulated request
+	// of a context lasts, from its creation by NewContext or Derive.
+	// Past it, API calls fail with a deadline exceeded error, as they
+	// do once a frontend request passes its 60 second deadline.
+	RequestDeadline time.Duration
+
+	// CallTimeout is the timeout of the API calls made without one.
+	// By default, 60 seconds. A negative value means no timeout.
+	CallTimeout time.Duration
+
+	// ServiceTimeouts overrides CallTimeout for the calls to the given
+	// services, such as a long timeout for "urlfetch" and a short one
+	// for "memcache". A negative value means no timeout.
+	ServiceTimeouts map[string]time.Duration
+
+	// Retry is how the API calls that fail to connect to the API server are
+	// retried. By default, they are sent up to 3 times, 100ms apart
+	// and then 200ms apart.
+	Retry *RetryPolicy
+
+	// Cancel, if non-nil, aborts the API calls in flight when closed.
+	// Those and any later calls fail with ErrCanceled, as they do once
+	// the context is closed.
+	Cancel <-chan struct{}
+
+	// GoStubApp makes the API server run alongside a Go app, compiled
+	// with the SDK's Go toolchain, rather than a Python app, which
+	// starts several seconds faster.
+	GoStubApp bool
+
+	// APIServerOnly runs the SDK's api_server.py on its own, instead of
+	// dev_appserver.py, which saves the time and memory of starting an
+	// instance of the stub app. There is then no admin server, so
+	// RefreshDatastoreStats is unavailable, and a ConsistencyPolicy
+	// other than "consistent" selects the high replication datastore.
+	APIServerOnly bool
+
+	// T, if set, is the test that uses the context.
+	T testing.TB
+
+	// PreserveOnFailure makes Close keep the stub app, the storage of
+	// the API server and its log, and log where they are, if T has
+	// failed.
+	PreserveOnFailure bool
+
+	// ReuseWorkDirs makes Close leave the stub app and the storage of the
+	// API server for reuse by a later context with the same stub app,
+	// instead of removing them. RemoveWorkDirs removes what is left.
+	ReuseWorkDirs bool
+
+	// WarmUp makes NewContext send a call to the API server and a
+	// request to the stub app before it returns, so that their lazy
+	// initialization does not slow down the first call of the test.
+	WarmUp bool
+
+	// Metrics, if set, receives the time taken to start and stop the
+	// API server, and by each API call.
+	Metrics MetricsSink
+
+	// DatastoreEmulator, if set, makes the Cloud Datastore emulator
+	// serve the datastore_v3 calls, translated to the Cloud Datastore
+	// API, instead of the API server. Its datastore is cleared by
+	// NewContext.
+	DatastoreEmulator *DatastoreEmulator
+
+	// BackgroundHandler serves the background requests started by
+	// runtime.RunInBackground, in the test process, with a context
+	// returned by BackgroundContext, which both RequestContext and
+	// appengine.NewContext return for the request. By default,
+	// http.DefaultServeMux, where the appengine/runtime package
+	// registers the handler that calls the function passed to
+	// RunInBackground.
+	BackgroundHandler http.Handler
+
+	// SystemStats is the CPU and memory usage of the instance reported
+	// by runtime.Stats. By default, that of a lightly loaded instance.
+	SystemStats *SystemStats
+
+	// Environment, if set, makes the functions of the appengine package
+	// that describe the environment of the app return production-like
+	// values instead of those of the development server.
+	Environment *Environment
+
+	// RemoteAPI, if set, sends the API calls to the remote_api handler
+	// of a deployed app instead of a local API server. AppID must then
+	// be the fully qualified ID of the app, such as "s~myapp".
+	RemoteAPI *RemoteAPI
+
+	// SDKPath is the directory of the App Engine SDK, or of a Google
+	// Cloud SDK with the App Engine components, that provides
+	// dev_appserver.py. It takes precedence over APPENGINE_DEV_APPSERVER.
+	// If empty, the SDK installed by EnsureSDK is used, if any.
+	// A relative path is looked up in the Bazel runfiles of the test.
+	SDKPath string
+
+	// PythonPath is the python 2.7 interpreter that runs
+	// dev_appserver.py. If empty, python2.7 or python is looked up in
+	// the PATH. A relative path is looked up in the Bazel runfiles of
+	// the test.
+	PythonPath string
+
+	// Docker, if set, runs dev_appserver.py in a Docker container, so
+	// that neither python nor the SDK need to be installed.
+	Docker *Docker
+
+	// HostOverride, if set, replaces the host in the URLs advertised by
+	// the child process, such as "127.0.0.1" when "localhost" resolves
+	// to an address the servers do not listen on.
+	HostOverride string
+
+	// Client, if set, sends the API calls and the requests to the admin
+	// server, for instance to instrument them or to inject transport
+	// failures. By default, a client that uses no proxy is used.
+	Client *http.Client
+
+	// Rand, if set, is the source of the session and request IDs, such
+	// as a math/rand.Rand with a fixed seed, so that they are the same
+	// in every run. By default, crypto/rand.Reader.
+	Rand io.Reader
+
+	// InterceptURLFetch serves the urlfetch calls in-process by sending
+	// them with URLFetchTransport, so that tests never reach the
+	// internet. If URLFetchTransport is nil, only the requests to the
+	// local host are sent, and the others fail.
+	InterceptURLFetch bool
+
+	// URLFetchTransport sends the urlfetch calls intercepted because of
+	// InterceptURLFetch, for instance to stub the responses of external
+	// APIs.
+	URLFetchTransport http.RoundTripper
+
+	// URLFetchCassette, if set, is the path of a file that records the
+	// HTTP exchanges of the urlfetch calls, which are intercepted. If
+	// the file exists, and the -aetest.record flag is not set, the
+	// recorded responses are replayed instead, matched by method, URL
+	// and body. Otherwise the requests are sent with URLFetchTransport,
+	// or to the network if it is nil, and recorded by Close.
+	URLFetchCassette string
+
+	// Sockets serves the remote_socket calls of the appengine/socket
+	// package in-process, with TCP connections made by the test, instead
+	// of with the API server. RedirectSocket points them at local test
+	// servers. Only outbound TCP connections are supported.
+	Sockets bool
+
+	// AppDir, if set, is the directory of an app, holding its app.yaml,
+	// that dev_appserver.py serves instead of the stub app, so that
+	// tests can send requests to its handlers with Instance.Client. A
+	// relative path is looked up in the Bazel runfiles of the test.
+	AppDir string
+
+	// MaxLogLine is the number of bytes of each line of the output of
+	// the child process searched for its URLs. By default, 64KB. Longer
+	// lines are still read, but not searched past the limit.
+	MaxLogLine int
 }
 
 func (o *Options) appID() string {
@@ -132,36 +589,206 @@ func (o *Options) appID() string {
 	return o.AppID
 }
 
+func (o *Options) consistencyPolicy() string {
+	if o == nil || o.ConsistencyPolicy == "" {
+		return "consistent"
+	}
+	return o.ConsistencyPolicy
+}
+
+func (o *Options) callTimeout(service string) time.Duration {
+	if o == nil {
+		return 60 * time.Second
+	}
+	d := o.CallTimeout
+	if sd := o.ServiceTimeouts[service]; sd != 0 {
+		d = sd
+	}
+	switch {
+	case d == 0:
+		return 60 * time.Second
+	case d < 0:
+		return 0
+	}
+	return d
+}
+
 // PrepareDevAppserver is a hook which, if set, will be called before the
 // dev_appserver.py is started, each time it is started. If aetest.NewContext
 // is invoked from the goapp test tool, this hook is unnecessary.
 var PrepareDevAppserver func() error
 
-// context implements appengine.Context by running an api_server.py
-// process as a child and proxying all Context calls to the child.
-type context struct {
+// An Instance is a Context that runs an api_server.py process as a child
+// and proxies all Context calls to the child. Its other methods inspect
+// and control the API server, and the state recorded from the API calls,
+// which it shares with the contexts derived from it.
+type Instance struct {
+	*instance
+	derived bool // set if the context was returned by Derive
+
+	reqMu     sync.Mutex // guards req and requestID
+	req       *http.Request
+	requestID string // sent with the API calls
+
+	deadline time.Time // zero unless Options.RequestDeadline is set
+
+	namespace string // set by SetNamespace; guarded by mu
+
+	logT testing.TB // receives the logs of a context passed by Run
+
+	task *TaskID  // the task the context runs, with Options.TraceTasks
+	errs *taskLog // receives the errors logged while the context runs a task
+}
+
+// instance is the api_server.py child process, and the state of the
+// services it runs, shared by a context and the contexts derived from it.
+type instance struct {
+	opts     Options
 	appID    string
-	req      *http.Request
 	child    *exec.Cmd
 	apiURL   string // base URL of API HTTP server
 	adminURL string // base URL of admin HTTP server
 	appDir   string
+	workDir  string    // holds appDir and the storage of the API server
+	logFile  *os.File  // receives the output of the child process
+	smtp     *smtpSink // receives the mail sent by the child process
 	session  string
+	hooks    []CallHook
+	handlers map[string]CallHandler // keyed by service
+	cassette *cassette              // nil unless Options.Cassette is set
+	emulator *emulator              // nil unless Options.DatastoreEmulator is set
+
+	client *http.Client // shared by the calls to the API and admin servers
+
+	fetchCassette *fetchCassette // nil unless Options.URLFetchCassette is set
+	sockets       *socketStub    // serves remote_socket if Options.Sockets is set
+
+	restoreEnv func() // nil unless Options.Environment is set
+
+	idMu   sync.Mutex // guards idRand
+	idRand io.Reader  // source of the session and request IDs
+
+	done       chan struct{} // closed to cancel the API calls
+	cancelOnce sync.Once
+
+	stateMu  sync.Mutex    // guards state and closeErr
+	state    int           // stateOpen, stateClosing or stateClosed
+	closeErr error         // returned by Close
+	closed   chan struct{} // closed once Close is done
+
+	derivedCount int32 // atomic; number of contexts derived
+
+	mu        sync.Mutex // guards the fields below
+	userHooks []CallHook // added by AddCallHook
+	mail      []sentMail
+	xmpp      []XMPPStanza
+
+	channelTokens   map[string][]string // keyed by client ID
+	channelMessages map[string][]string // keyed by client ID
+
+	openTxns  map[uint64]bool // keyed by transaction handle
+	openFiles map[string]bool // files created and not finalized
+
+	disabled map[string]bool // keyed by "service.capability"
+
+	modules     map[string]*moduleState // nil unless Options.Modules is set
+	moduleCalls []ModuleCall
+
+	tokenScopes map[string][]string // keyed by access token
+
+	moduleURLs map[string]string // keyed by module, as printed by the child
+
+	pendingRoots map[rootKey]bool // entity groups with writes that may be unapplied
+
+	contention     int // number of commits left to fail
+	contentionRate float64
+	contentionRand *mathrand.Rand
+
+	txns map[uint64]*txnState // keyed by transaction handle
+
+	faults    map[string][]*fault      // keyed by "service.method"
+	latencies map[string]time.Duration // keyed by service
+	quotas    map[string]*quotaState   // keyed by service
+
+	memcacheKeys map[string]map[string]bool // keyed by namespace, then key
+	memcacheMode MemcacheMode
+
+	clockSet       bool // set once SetClock or AdvanceClock is called
+	clockOffset    time.Duration
+	memcacheExpiry map[string]map[string]time.Time // keyed by namespace, then key
+
+	taskRuns     []*TaskRun // in the order of their first execution
+	taskRunIndex map[TaskID]*TaskRun
+
+	taskEdges []TaskEdge // recorded if Options.TraceTasks is set
 }
 
-func (c *context) AppID() string               { return c.appID }
-func (c *context) Request() interface{}        { return c.req }
-func (c *context) FullyQualifiedAppID() string { return "dev~" + c.appID }
+// A CallHook intercepts API calls made through a context. It may inspect or
+// modify in and out, and calls next to continue the call, or returns
+// without calling next to answer the call itself.
+type CallHook func(service, method string, in, out proto.Message, next func() error) error
+
+func (c *Instance) AppID() string { return c.appID }
+func (c *Instance) Request() interface{} {
+	c.reqMu.Lock()
+	defer c.reqMu.Unlock()
+	return c.req
+}
 
-func (c *context) logf(level, format string, args ...interface{}) {
+// NewRequestScope starts a new request: the API calls made through
+// the context from now on carry a new request ID, so that the API
+// server treats them as made by another request to the app.
+func (c *Instance) NewRequestScope() {
+	c.reqMu.Lock()
+	defer c.reqMu.Unlock()
+	c.requestID = c.newID()
+}
+
+func (c *Instance) currentRequestID() string {
+	c.reqMu.Lock()
+	defer c.reqMu.Unlock()
+	return c.requestID
+}
+
+// setUserHeaders replaces c.req with a copy whose user headers are changed
+// by f, as the request returned by Request must not change.
+func (c *Instance) setUserHeaders(f func(h http.Header)) {
+	c.reqMu.Lock()
+	defer c.reqMu.Unlock()
+	req := new(http.Request)
+	*req = *c.req
+	req.Header = make(http.Header, len(c.req.Header))
+	for k, v := range c.req.Header {
+		req.Header[k] = v
+	}
+	f(req.Header)
+	c.req = req
+}
+func (c *Instance) FullyQualifiedAppID() string {
+	if c.opts.RemoteAPI != nil {
+		return c.appID
+	}
+	return "dev~" + c.appID
+}
+
+func (c *Instance) logf(level, format string, args ...interface{}) {
+	if c.errs != nil && (level == "ERROR" || level == "CRITICAL") {
+		c.errs.Lock()
+		c.errs.msgs = append(c.errs.msgs, fmt.Sprintf(format, args...))
+		c.errs.Unlock()
+	}
+	if c.logT != nil {
+		c.logT.Logf(level+": "+format, args...)
+		return
+	}
 	log.Printf(level+": "+format, args...)
 }
 
-func (c *context) Debugf(format string, args ...interface{})    { c.logf("DEBUG", format, args...) }
-func (c *context) Infof(format string, args ...interface{})     { c.logf("INFO", format, args...) }
-func (c *context) Warningf(format string, args ...interface{})  { c.logf("WARNING", format, args...) }
-func (c *context) Errorf(format string, args ...interface{})    { c.logf("ERROR", format, args...) }
-func (c *context) Criticalf(format string, args ...interface{}) { c.logf("CRITICAL", format, args...) }
+func (c *Instance) Debugf(format string, args ...interface{})    { c.logf("DEBUG", format, args...) }
+func (c *Instance) Infof(format string, args ...interface{})     { c.logf("INFO", format, args...) }
+func (c *Instance) Warningf(format string, args ...interface{})  { c.logf("WARNING", format, args...) }
+func (c *Instance) Errorf(format string, args ...interface{})    { c.logf("ERROR", format, args...) }
+func (c *Instance) Criticalf(format string, args ...interface{}) { c.logf("CRITICAL", format, args...) }
 
 var errTimeout = &appengine_internal.CallError{
 	Detail:  "Deadline exceeded",
@@ -170,40 +797,78 @@ var errTimeout = &appengine_internal.CallError{
 }
 
 // postWithTimeout issues a POST to the specified URL with a given timeout.
-func postWithTimeout(url, bodyType string, body io.Reader, timeout time.Duration) (b []byte, err error) {
+// The connections of client are kept alive for later calls. Closing cancel
+// aborts the request.
+func postWithTimeout(client *http.Client, url, bodyType string, body io.Reader, timeout time.Duration, cancel <-chan struct{}) (b []byte, err error) {
 	req, err := http.NewRequest("POST", url, body)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", bodyType)
-	tr := &http.Transport{}
-	client := &http.Client{
-		Transport: tr,
+	// Required by the remote_api handler of deployed apps.
+	req.Header.Set("X-Appcfg-Api-Version", "1")
+	tr := client.Transport
+	if tr == nil {
+		tr = http.DefaultTransport
 	}
+	var expired <-chan time.Time
 	if timeout != 0 {
-		var canceled int32 // atomic; set to 1 if canceled
-		t := time.AfterFunc(timeout, func() {
-			atomic.StoreInt32(&canceled, 1)
-			tr.CancelRequest(req)
-		})
+		t := time.NewTimer(timeout)
 		defer t.Stop()
-		defer func() {
-			// Check to see whether the call was canceled.
-			if atomic.LoadInt32(&canceled) != 0 {
-				err = errTimeout
-			}
-		}()
+		expired = t.C
 	}
+	var aborted int32 // atomic; 1 if timed out, 2 if canceled
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-expired:
+			atomic.StoreInt32(&aborted, 1)
+		case <-cancel:
+			atomic.StoreInt32(&aborted, 2)
+		case <-stop:
+			return
+		}
+		if tr, ok := tr.(interface {
+			CancelRequest(*http.Request)
+		}); ok {
+			tr.CancelRequest(req)
+		}
+	}()
+	defer func() {
+		// Check to see whether the call was aborted.
+		if err == nil {
+			return
+		}
+		switch atomic.LoadInt32(&aborted) {
+		case 1:
+			err = errTimeout
+		case 2:
+			err = ErrCanceled
+		}
+	}()
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	return ioutil.ReadAll(resp.Body)
+	var buf bytes.Buffer
+	if resp.ContentLength > 0 {
+		// Leave room for ReadFrom to detect EOF without growing buf.
+		buf.Grow(int(resp.ContentLength) + bytes.MinRead)
+	}
+	_, err = buf.ReadFrom(resp.Body)
+	return buf.Bytes(), err
+}
+
+// protoBuffers holds the *proto.Buffers used to encode the requests to the
+// API server.
+var protoBuffers = sync.Pool{
+	New: func() interface{} { return proto.NewBuffer(nil) },
 }
 
-func call(service, method string, data []byte, apiAddress, requestID string, timeout time.Duration) ([]byte, error) {
+func call(client *http.Client, service, method string, data []byte, apiAddress, requestID string, timeout time.Duration, cancel <-chan struct{}) ([]byte, error) {
 	req := &remoteapipb.Request{
 		ServiceName: proto.String(service),
 		Method:      proto.String(method),
@@ -211,15 +876,19 @@ func call(service, method string, data []byte, apiAddress, requestID string, tim
 		RequestId:   proto.String(requestID),
 	}
 
-	buf, err := proto.Marshal(req)
-	if err != nil {
+	buf := protoBuffers.Get().(*proto.Buffer)
+	buf.Reset()
+	if err := buf.Marshal(req); err != nil {
+		protoBuffers.Put(buf)
 		return nil, err
 	}
 
-	body, err := postWithTimeout(apiAddress, "application/octet-stream", bytes.NewReader(buf), timeout)
+	body, err := postWithTimeout(client, apiAddress, "application/octet-stream", bytes.NewReader(buf.Bytes()), timeout, cancel)
 	if err != nil {
+		// The transport may still be reading buf, so it is not reused.
 		return nil, err
 	}
+	protoBuffers.Put(buf)
 
 	res := &remoteapipb.Response{}
 	err = proto.Unmarshal(body, res)
@@ -231,25 +900,107 @@ func call(service, method string, data []byte, apiAddress, requestID string, tim
 		// All Remote API application errors are API-level failures.
 		return nil, &appengine_internal.APIError{Service: service, Detail: *ae.Detail, Code: *ae.Code}
 	}
+	if re := res.RpcError; re != nil {
+		return nil, &appengine_internal.CallError{Detail: re.GetDetail(), Code: re.GetCode()}
+	}
+	if res.Exception != nil || res.JavaException != nil {
+		return nil, &appengine_internal.CallError{Detail: "service bridge returned an exception"}
+	}
 	return res.Response, nil
 }
 
 // Call is an implementation of appengine.Context's Call that delegates
 // to a child api_server.py instance.
-func (c *context) Call(service, method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
-	if service == "__go__" && (method == "GetNamespace" || method == "GetDefaultNamespace") {
-		out.(*basepb.StringProto).Value = proto.String("")
-		return nil
+func (c *Instance) Call(service, method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) (err error) {
+	if c.isClosed() {
+		return ErrClosed
+	}
+	if m := c.opts.Metrics; m != nil {
+		start := time.Now()
+		defer func() { m.Call(service, method, time.Since(start), err) }()
+	}
+	c.applyNamespace(service, in)
+	c.tagParentTask(service, method, in)
+	c.mu.Lock()
+	hooks := append(c.userHooks[:len(c.userHooks):len(c.userHooks)], c.hooks...)
+	c.mu.Unlock()
+	next := func() error {
+		return c.dispatch(service, method, in, out, opts)
+	}
+	for i := len(hooks) - 1; i >= 0; i-- {
+		h, inner := hooks[i], next
+		next = func() error {
+			return h(service, method, in, out, inner)
+		}
+	}
+	return next()
+}
+
+// dispatch sends an API call to its in-process service, if any, or else to
+// the child api_server.py instance.
+func (c *Instance) dispatch(service, method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	if c.canceled() {
+		return ErrCanceled
+	}
+	if service == "__go__" {
+		switch method {
+		case "GetNamespace":
+			out.(*basepb.StringProto).Value = proto.String(c.currentNamespace())
+			return nil
+		case "GetDefaultNamespace":
+			ns := c.Request().(*http.Request).Header.Get("X-AppEngine-Default-Namespace")
+			out.(*basepb.StringProto).Value = proto.String(ns)
+			return nil
+		}
+	}
+	d := c.opts.callTimeout(service)
+	if opts != nil && opts.Timeout != 0 {
+		d = opts.Timeout
+	}
+	if !c.deadline.IsZero() {
+		left := c.deadline.Sub(time.Now())
+		if left <= 0 {
+			return errTimeout
+		}
+		if d == 0 || d > left {
+			d = left
+		}
+	}
+	if lat := c.latency(service); lat > 0 {
+		if d != 0 && lat >= d {
+			if !c.sleep(d) {
+				return ErrCanceled
+			}
+			return errTimeout
+		}
+		if !c.sleep(lat) {
+			return ErrCanceled
+		}
+		if d != 0 {
+			d -= lat
+		}
+	}
+	if h := c.handlers[service]; h != nil {
+		return h(method, in, out)
+	}
+	if c.opts.Hermetic {
+		return callNotFound(service, method)
+	}
+	if c.cassette != nil && !c.cassette.recording {
+		return c.cassette.replay(service, method, out)
 	}
 	data, err := proto.Marshal(in)
 	if err != nil {
 		return err
 	}
-	var d time.Duration
-	if opts != nil && opts.Timeout != 0 {
-		d = opts.Timeout
+	var res []byte
+	err = c.opts.retryPolicy().do(c.done, func() error {
+		res, err = call(c.client, service, method, data, c.apiURL, c.currentRequestID(), d, c.done)
+		return err
+	})
+	if c.cassette != nil {
+		c.cassette.add(service, method, data, res, err)
 	}
-	res, err := call(service, method, data, c.apiURL, c.session, d)
 	if err != nil {
 		return err
 	}
@@ -258,15 +1009,85 @@ func (c *context) Call(service, method string, in, out appengine_internal.ProtoM
 
 // Close kills the child api_server.py process, releasing its resources.
 // Close is not part of the appengine.Context interface.
-func (c *context) Close() (err error) {
+func (c *Instance) Close() error {
+	if c.derived {
+		return nil
+	}
+	// The work left behind is listed with API calls, before they fail
+	// with ErrClosed.
+	var leaks []string
+	if c.opts.StrictClose && !c.isClosed() {
+		leaks = c.leaks()
+	}
+	if !c.beginClose() {
+		<-c.closed
+		return c.closeErr
+	}
+	err := c.shutdown()
+	if err == nil && len(leaks) > 0 {
+		err = fmt.Errorf("aetest: work left behind at Close: %s", strings.Join(leaks, "; "))
+	}
+	c.endClose(err)
+	return err
+}
+
+// shutdown releases the resources of c.
+func (c *Instance) shutdown() (err error) {
+	c.cancel()
+	if c.sockets != nil {
+		c.sockets.closeAll()
+	}
+	if c.restoreEnv != nil {
+		c.restoreEnv()
+	}
+	if c.cassette != nil && c.cassette.recording {
+		defer func() {
+			err1 := c.cassette.save()
+			if err == nil {
+				err = err1
+			}
+		}()
+	}
+	if c.fetchCassette != nil && c.fetchCassette.recording {
+		defer func() {
+			err1 := c.fetchCassette.save()
+			if err == nil {
+				err = err1
+			}
+		}()
+	}
+	if c.emulator != nil {
+		defer func() {
+			err1 := c.emulator.stop()
+			if err == nil {
+				err = err1
+			}
+		}()
+	}
 	if c.child == nil {
 		return nil
 	}
+	if m := c.opts.Metrics; m != nil {
+		start := time.Now()
+		defer func() { m.Shutdown(time.Since(start)) }()
+	}
 	defer func() {
-		c.child = nil
-		err1 := os.RemoveAll(c.appDir)
-		if err == nil {
-			err = err1
+		if tr, ok := c.client.Transport.(*http.Transport); ok && c.opts.Client == nil {
+			tr.CloseIdleConnections()
+		}
+		c.logFile.Close()
+		if c.smtp != nil {
+			c.smtp.close()
+		}
+		if c.opts.Docker != nil {
+			c.removeContainer()
+		}
+		switch {
+		case c.preserveWorkDir():
+		case err == nil && c.opts.ReuseWorkDirs:
+			c.releaseWorkDir()
+		default:
+			os.RemoveAll(c.workDir)
 		}
 	}()
 
@@ -276,13 +1097,21 @@ func (c *context) Close() (err error) {
 			errc <- c.child.Wait()
 		}()
 
-		// Call the quit handler on the admin server.
-		res, err := http.Get(c.adminURL + "/quit")
-		if err != nil {
-			p.Kill()
-			return fmt.Errorf("unable to call /quit handler: %v", err)
+		if c.adminURL == "" {
+			// There is no quit handler to call; api_server.py, and
+			// dev_appserver.py, exit on an interrupt.
+			if err := p.Signal(os.Interrupt); err != nil {
+				p.Kill()
+			}
+		} else {
+			// Call the quit handler on the admin server.
+			res, err := c.client.Get(c.adminURL + "/quit")
+			if err != nil {
+				p.Kill()
+				return fmt.Errorf("unable to call /quit handler: %v", err)
+			}
+			res.Body.Close()
 		}
-		res.Body.Close()
 
 		select {
 		case <-time.After(15 * time.Second):
@@ -295,24 +1124,34 @@ func (c *context) Close() (err error) {
 	return
 }
 
-func (c *context) Login(u *user.User) {
-	c.req.Header.Set("X-AppEngine-User-Email", u.Email)
+func (c *Instance) Login(u *user.User) {
+	if c.isClosed() {
+		return
+	}
 	id := u.ID
 	if id == "" {
 		id = strconv.Itoa(int(crc32.Checksum([]byte(u.Email), crc32.IEEETable)))
 	}
-	c.req.Header.Set("X-AppEngine-User-Id", id)
-	c.req.Header.Set("X-AppEngine-User-Federated-Identity", u.Email)
-	c.req.Header.Set("X-AppEngine-User-Federated-Provider", u.FederatedProvider)
-	c.req.Header.Set("X-AppEngine-User-Is-Admin", btos(u.Admin))
+	c.setUserHeaders(func(h http.Header) {
+		h.Set("X-AppEngine-User-Email", u.Email)
+		h.Set("X-AppEngine-User-Id", id)
+		h.Set("X-AppEngine-User-Federated-Identity", u.Email)
+		h.Set("X-AppEngine-User-Federated-Provider", u.FederatedProvider)
+		h.Set("X-AppEngine-User-Is-Admin", btos(u.Admin))
+	})
 }
 
-func (c *context) Logout() {
-	c.req.Header.Del("X-AppEngine-User-Email")
-	c.req.Header.Del("X-AppEngine-User-Id")
-	c.req.Header.Del("X-AppEngine-User-Is-Admin")
-	c.req.Header.Del("X-AppEngine-User-Federated-Identity")
-	c.req.Header.Del("X-AppEngine-User-Federated-Provider")
+func (c *Instance) Logout() {
+	if c.isClosed() {
+		return
+	}
+	c.setUserHeaders(func(h http.Header) {
+		h.Del("X-AppEngine-User-Email")
+		h.Del("X-AppEngine-User-Id")
+		h.Del("X-AppEngine-User-Is-Admin")
+		h.Del("X-AppEngine-User-Federated-Identity")
+		h.Del("X-AppEngine-User-Federated-Provider")
+	})
 }
 
 func fileExists(path string) bool {
@@ -320,7 +1159,14 @@ func fileExists(path string) bool {
 	return err == nil
 }
 
-func findPython() (path string, err error) {
+func findPython(pythonPath string) (path string, err error) {
+	if pythonPath != "" {
+		path = resolvePath(pythonPath)
+		if !fileExists(path) {
+			return "", fmt.Errorf("invalid Options.PythonPath; path %q doesn't exist", pythonPath)
+		}
+		return path, nil
+	}
 	for _, name := range []string{"python2.7", "python"} {
 		path, err = exec.LookPath(name)
 		if err == nil {
@@ -330,116 +1176,281 @@ func findPython() (path string, err error) {
 	return
 }
 
-func findDevAppserver() (string, error) {
+func findDevAppserver(sdkPath string) (string, error) {
+	if sdkPath == "" {
+		sdkPath = ensuredSDK()
+	}
+	if sdkPath != "" {
+		if p, ok := sdkDevAppserver(resolvePath(sdkPath)); ok {
+			return p, nil
+		}
+		return "", fmt.Errorf("aetest: invalid Options.SDKPath; no dev_appserver.py in %q", sdkPath)
+	}
 	if p := os.Getenv("APPENGINE_DEV_APPSERVER"); p != "" {
 		if fileExists(p) {
 			return p, nil
 		}
-		return "", fmt.Errorf("invalid APPENGINE_DEV_APPSERVER environment variable; path %q doesn't exist", p)
+		return "", fmt.Errorf("aetest: invalid APPENGINE_DEV_APPSERVER environment variable; path %q doesn't exist", p)
+	}
+	p, err := exec.LookPath("dev_appserver.py")
+	if err == nil {
+		return p, nil
+	}
+	for _, root := range gcloudSDKRoots() {
+		if p, ok := sdkDevAppserver(root); ok {
+			return p, nil
+		}
 	}
-	return exec.LookPath("dev_appserver.py")
+	return "", ErrSDKNotFound
 }
 
 var apiServerAddrRE = regexp.MustCompile(`Starting API server at: (\S+)`)
 var adminServerAddrRE = regexp.MustCompile(`Starting admin server at: (\S+)`)
+var moduleAddrRE = regexp.MustCompile(`Starting module "([^"]+)" running at: (\S+)`)
 
-func (c *context) startChild() (err error) {
+// adminURLGrace is how long startChild waits for the URL of the admin
+// server once it has read the URL of the API server.
+const adminURLGrace = 5 * time.Second
+
+func (c *Instance) startChild() (err error) {
 	if PrepareDevAppserver != nil {
 		if err := PrepareDevAppserver(); err != nil {
 			return err
 		}
 	}
-	python, err := findPython()
-	if err != nil {
-		return fmt.Errorf("Could not find python interpreter: %v", err)
-	}
-	devAppserver, err := findDevAppserver()
-	if err != nil {
-		return fmt.Errorf("Could not find dev_appserver.py: %v", err)
+	var python, devAppserver string
+	if c.opts.Docker != nil {
+		if c.opts.APIServerOnly {
+			return errors.New("aetest: Options.Docker cannot be used with Options.APIServerOnly")
+		}
+		if c.opts.AppDir != "" {
+			return errors.New("aetest: Options.Docker cannot be used with Options.AppDir")
+		}
+		devAppserver = "dev_appserver.py"
+	} else {
+		python, err = findPython(c.opts.PythonPath)
+		if err != nil {
+			return fmt.Errorf("Could not find python interpreter: %v", err)
+		}
+		devAppserver, err = findDevAppserver(c.opts.SDKPath)
+		if err != nil {
+			return err
+		}
 	}
 
-	c.appDir, err = ioutil.TempDir("", "appengine-aetest")
-	if err != nil {
+	if err = c.makeWorkDir(); err != nil {
 		return err
 	}
 	defer func() {
 		if err != nil {
-			os.RemoveAll(c.appDir)
+			os.RemoveAll(c.workDir)
 		}
 	}()
-	err = ioutil.WriteFile(filepath.Join(c.appDir, "app.yaml"), []byte(c.appYAML()), 0644)
-	if err != nil {
-		return err
+
+	var args []string
+	if c.opts.APIServerOnly {
+		args = []string{
+			filepath.Join(filepath.Dir(devAppserver), "api_server.py"),
+			"--application=" + c.appID,
+			"--application_root=" + c.servedAppDir(),
+			"--api_port=0",
+			"--clear_datastore=true",
+		}
+		if c.opts.consistencyPolicy() != "consistent" {
+			args = append(args, "--high_replication=true")
+		}
+	} else {
+		args = []string{
+			devAppserver,
+			"--skip_sdk_update_check=true",
+			"--storage_path=" + c.childPath(filepath.Join(c.workDir, "storage")),
+			"--clear_datastore=true",
+			"--datastore_consistency_policy=" + c.opts.consistencyPolicy(),
+		}
+		if c.opts.AppDir != "" {
+			// The app ID of the contexts, not that of app.yaml.
+			args = append(args, "--application="+c.appID)
+		}
+		args = append(args, c.portArgs()...)
+	}
+	if c.opts.ClearSearchIndexes {
+		args = append(args, "--clear_search_indexes=true")
+	}
+	if c.opts.SequentialIDs {
+		args = append(args, "--auto_id_policy=sequential")
+	}
+	if b := c.opts.DefaultGCSBucket; b != "" {
+		args = append(args, "--default_gcs_bucket_name="+b)
 	}
-	err = ioutil.WriteFile(filepath.Join(c.appDir, "stubapp.go"), []byte(appSource), 0644)
+	if c.opts.Docker == nil {
+		// The mail stub delivers the mail it sends to the SMTP sink,
+		// which a container could not reach.
+		if c.smtp, err = newSMTPSink(c.deliverMail); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				c.smtp.close()
+			}
+		}()
+		args = append(args, "--smtp_host=127.0.0.1", "--smtp_port="+strconv.Itoa(c.smtp.port()))
+	}
+	if !c.opts.APIServerOnly {
+		args = append(args, c.servedAppDir())
+	}
+	c.logFile, err = os.Create(filepath.Join(c.workDir, "server.log"))
 	if err != nil {
 		return err
 	}
-
-	c.child = exec.Command(
-		python,
-		devAppserver,
-		"--port=0",
-		"--api_port=0",
-		"--admin_port=0",
-		"--skip_sdk_update_check=true",
-		"--clear_datastore=true",
-		"--datastore_consistency_policy=consistent",
-		c.appDir,
-	)
-	c.child.Stdout = os.Stdout
+	defer func() {
+		if err != nil {
+			c.logFile.Close()
+		}
+	}()
+	if c.opts.Docker != nil {
+		if c.child, err = c.dockerCommand(args); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				c.removeContainer()
+			}
+		}()
+	} else {
+		c.child = exec.Command(python, args...)
+	}
+	c.child.Env = childEnv()
+	c.child.Stdout = io.MultiWriter(os.Stdout, c.logFile)
 	var stderr io.Reader
 	stderr, err = c.child.StderrPipe()
 	if err != nil {
 		return err
 	}
-	stderr = io.TeeReader(stderr, os.Stderr)
+	tail := &tailBuffer{}
+	stderr = io.TeeReader(stderr, io.MultiWriter(os.Stderr, c.logFile, tail))
 	if err = c.child.Start(); err != nil {
 		return err
 	}
 
 	// Wait until we have read the URLs of the API server and admin interface.
 	errc := make(chan error, 1)
-	apic := make(chan string)
-	adminc := make(chan string)
+	exitc := make(chan struct{})
+	// Buffered so that the scanner never blocks once startChild returns.
+	apic := make(chan string, 1)
+	adminc := make(chan string, 1)
+	modulec := make(chan string, 1)
 	go func() {
-		s := bufio.NewScanner(stderr)
-		for s.Scan() {
-			if match := apiServerAddrRE.FindSubmatch(s.Bytes()); match != nil {
-				apic <- string(match[1])
+		err := readLines(stderr, c.opts.maxLogLine(), func(line []byte) {
+			if match := apiServerAddrRE.FindSubmatch(line); match != nil {
+				apic <- c.childURL(string(match[1]))
 			}
-			if match := adminServerAddrRE.FindSubmatch(s.Bytes()); match != nil {
-				adminc <- string(match[1])
+			if match := adminServerAddrRE.FindSubmatch(line); match != nil {
+				adminc <- c.childURL(string(match[1]))
 			}
-		}
-		if err = s.Err(); err != nil {
+			if match := moduleAddrRE.FindSubmatch(line); match != nil {
+				module, u := string(match[1]), c.childURL(string(match[2]))
+				c.setModuleURL(module, u)
+				if module == "default" {
+					select {
+					case modulec <- u:
+					default:
+					}
+				}
+			}
+		})
+		if err != nil {
 			errc <- err
+			// Keep draining stderr, so that the child does not block.
+			io.Copy(ioutil.Discard, stderr)
+			return
 		}
+		close(exitc)
 	}()
 
-	for c.apiURL == "" || c.adminURL == "" {
+	timeout := time.NewTimer(15 * time.Second)
+	defer timeout.Stop()
+	var grace <-chan time.Time // set once the API URL is read
+	wantAdmin := !c.opts.APIServerOnly
+	for c.apiURL == "" || wantAdmin && c.adminURL == "" {
 		select {
 		case c.apiURL = <-apic:
+			if wantAdmin && c.adminURL == "" {
+				grace = time.After(adminURLGrace)
+			}
 		case c.adminURL = <-adminc:
-		case <-time.After(15 * time.Second):
+		case <-grace:
+			// Some SDKs do not print the URL of the admin server. The
+			// context does without it, and Close signals the child.
+			wantAdmin = false
+		case <-timeout.C:
 			if p := c.child.Process; p != nil {
 				p.Kill()
 			}
-			return errors.New("timeout starting child process")
+			var missing []string
+			if c.apiURL == "" {
+				missing = append(missing, "API server")
+			}
+			if wantAdmin && c.adminURL == "" {
+				missing = append(missing, "admin server")
+			}
+			return &ErrStartupTimeout{Missing: missing, Stderr: tail.Bytes()}
 		case err := <-errc:
-			return fmt.Errorf("error reading child process stderr: %v", err)
+			if p := c.child.Process; p != nil {
+				p.Kill()
+			}
+			return fmt.Errorf("aetest: error reading child process stderr: %v", err)
+		case <-exitc:
+			c.child.Wait()
+			return &ErrChildExited{State: c.child.ProcessState, Stderr: tail.Bytes()}
 		}
 	}
+	if c.opts.WarmUp {
+		if err = c.warmUp(modulec); err != nil {
+			c.child.Process.Kill()
+		}
+		return err
+	}
 	return nil
 }
 
-func (c *context) appYAML() string {
+func (c *Instance) appYAML() string {
+	if c.opts.GoStubApp {
+		return fmt.Sprintf(goAppYAMLTemplate, c.appID)
+	}
 	return fmt.Sprintf(appYAMLTemplate, c.appID)
 }
 
+// appFile returns the name and content of the source file of the stub app.
+func (c *Instance) appFile() (string, string) {
+	if c.opts.GoStubApp {
+		return "stubapp.go", goAppSource
+	}
+	return "stubapp.py", appSource
+}
+
+// The stub app uses the python27 runtime, which starts without compiling
+// anything, as it only needs to get the API server running.
 const appYAMLTemplate = `
 application: %s
 version: 1
+runtime: python27
+api_version: 1
+threadsafe: true
+
+handlers:
+- url: /.*
+  script: stubapp.app
+`
+
+const appSource = `
+def app(environ, start_response):
+    start_response('404 Not Found', [('Content-Type', 'text/plain')])
+    return []
+`
+
+const goAppYAMLTemplate = `
+application: %s
+version: 1
 runtime: go
 api_version: go1
 
@@ -448,7 +1459,7 @@ handlers:
   script: _go_app
 `
 
-const appSource = `
+const goAppSource = `
 package nihilist
 
 func init() {}
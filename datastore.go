@@ -0,0 +1,216 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Entity is a datastore entity.
+type Entity struct {
+	Key        *datastore.Key
+	Properties datastore.PropertyList
+}
+
+// Snapshot is a copy of the entities in the datastore at a point in time.
+type Snapshot struct {
+	// Entities holds the entities of every namespace, ordered by
+	// namespace and then by key.
+	Entities []Entity
+}
+
+// maxBatch is the largest number of entities read, written or deleted in
+// one datastore call.
+const maxBatch = 500
+
+// namespaces returns the names of the namespaces that hold entities.
+func (c *Instance) namespaces() ([]string, error) {
+	dc, err := appengine.Namespace(c, "")
+	if err != nil {
+		return nil, err
+	}
+	keys, err := datastore.NewQuery("__namespace__").KeysOnly().GetAll(dc, nil)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = k.StringID()
+	}
+	return names, nil
+}
+
+// SnapshotDatastore returns a copy of every entity in the datastore.
+func (c *Instance) SnapshotDatastore() (Snapshot, error) {
+	var s Snapshot
+	namespaces, err := c.namespaces()
+	if err != nil {
+		return s, err
+	}
+	for _, ns := range namespaces {
+		nsc, err := appengine.Namespace(c, ns)
+		if err != nil {
+			return s, err
+		}
+		for t := datastore.NewQuery("").Run(nsc); ; {
+			var e Entity
+			e.Key, err = t.Next(&e.Properties)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				return s, err
+			}
+			s.Entities = append(s.Entities, e)
+		}
+	}
+	return s, nil
+}
+
+// RestoreDatastore replaces the content of the datastore with the
+// entities of s.
+func (c *Instance) RestoreDatastore(s Snapshot) error {
+	if err := c.ClearDatastore(); err != nil {
+		return err
+	}
+	for len(s.Entities) > 0 {
+		// Store a batch of entities that share a namespace.
+		ns := s.Entities[0].Key.Namespace()
+		n := 0
+		for n < len(s.Entities) && n < maxBatch && s.Entities[n].Key.Namespace() == ns {
+			n++
+		}
+		keys := make([]*datastore.Key, n)
+		props := make([]datastore.PropertyList, n)
+		for i, e := range s.Entities[:n] {
+			keys[i], props[i] = e.Key, e.Properties
+		}
+		nsc, err := appengine.Namespace(c, ns)
+		if err != nil {
+			return err
+		}
+		if _, err := datastore.PutMulti(nsc, keys, props); err != nil {
+			return err
+		}
+		s.Entities = s.Entities[n:]
+	}
+	return nil
+}
+
+// ClearDatastore deletes every entity in every namespace.
+func (c *Instance) ClearDatastore() error {
+	namespaces, err := c.namespaces()
+	if err != nil {
+		return err
+	}
+	for _, ns := range namespaces {
+		nsc, err := appengine.Namespace(c, ns)
+		if err != nil {
+			return err
+		}
+		keys, err := datastore.NewQuery("").KeysOnly().GetAll(nsc, nil)
+		if err != nil {
+			return err
+		}
+		for len(keys) > 0 {
+			n := len(keys)
+			if n > maxBatch {
+				n = maxBatch
+			}
+			if err := datastore.DeleteMulti(nsc, keys[:n]); err != nil {
+				return err
+			}
+			keys = keys[n:]
+		}
+	}
+	return nil
+}
+
+// DumpKind returns the entities of the given kind in c's namespace,
+// ordered by key.
+func DumpKind(c appengine.Context, kind string) ([]Entity, error) {
+	var entities []Entity
+	for t := datastore.NewQuery(kind).Run(c); ; {
+		var e Entity
+		var err error
+		e.Key, err = t.Next(&e.Properties)
+		if err == datastore.Done {
+			return entities, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, e)
+	}
+}
+
+// Changes describes how the datastore changed between two snapshots.
+type Changes struct {
+	Created  []Entity
+	Modified []Entity // the entities as found in the later snapshot
+	Deleted  []Entity // the entities as found in the earlier snapshot
+}
+
+// Empty reports whether there are no changes.
+func (ch Changes) Empty() bool {
+	return len(ch.Created) == 0 && len(ch.Modified) == 0 && len(ch.Deleted) == 0
+}
+
+// String lists the keys of the changed entities, one per line.
+func (ch Changes) String() string {
+	var b bytes.Buffer
+	for _, c := range []struct {
+		verb     string
+		entities []Entity
+	}{
+		{"created", ch.Created},
+		{"modified", ch.Modified},
+		{"deleted", ch.Deleted},
+	} {
+		for _, e := range c.entities {
+			fmt.Fprintf(&b, "%s %s\n", c.verb, keyString(e.Key))
+		}
+	}
+	return b.String()
+}
+
+// keyString formats k, including its namespace if it has one.
+func keyString(k *datastore.Key) string {
+	if ns := k.Namespace(); ns != "" {
+		return ns + ":" + k.String()
+	}
+	return k.String()
+}
+
+// DiffDatastore returns the changes that turn before into after.
+func DiffDatastore(before, after Snapshot) Changes {
+	var ch Changes
+	old := make(map[string]Entity, len(before.Entities))
+	for _, e := range before.Entities {
+		old[e.Key.Encode()] = e
+	}
+	for _, e := range after.Entities {
+		k := e.Key.Encode()
+		o, ok := old[k]
+		switch {
+		case !ok:
+			ch.Created = append(ch.Created, e)
+		case !reflect.DeepEqual(o.Properties, e.Properties):
+			ch.Modified = append(ch.Modified, e)
+		}
+		delete(old, k)
+	}
+	for _, e := range before.Entities {
+		if _, ok := old[e.Key.Encode()]; ok {
+			ch.Deleted = append(ch.Deleted, e)
+		}
+	}
+	return ch
+}
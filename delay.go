@@ -0,0 +1,128 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"appengine_internal"
+
+	taskqueuepb "appengine_internal/taskqueue"
+
+	// Registers the handler of delay tasks on http.DefaultServeMux.
+	_ "appengine/delay"
+)
+
+// delayPath is the URL that appengine/delay posts its tasks to.
+const delayPath = "/_ah/queue/go/delay"
+
+// taskLog collects the errors logged while a task runs.
+type taskLog struct {
+	sync.Mutex
+	msgs []string
+}
+
+// RunDelayedTasks runs the appengine/delay tasks in the named queue by
+// serving them, as the task queue would, with the handler appengine/delay
+// registers on http.DefaultServeMux. Each task runs as a request of its
+// own, whose context appengine.NewContext returns. Tasks that run
+// successfully are removed from the queue. Only the tasks whose ETA Now
+// has reached run, and a task that fails is run again once Now reaches
+// the time its retry parameters give, or removed once they allow no more
+// retries. It runs every due task, and returns the number of tasks that
+// succeeded and an error listing the failures.
+func (c *Instance) RunDelayedTasks(queue string) (int, error) {
+	if queue == "" {
+		queue = "default"
+	}
+	tasks, err := c.queuedTasks(queue)
+	if err != nil {
+		return 0, err
+	}
+	now := c.Now()
+	n := 0
+	var failures []string
+	for _, task := range tasks {
+		if string(task.Url) != delayPath {
+			continue
+		}
+		if time.Unix(0, task.GetEtaUsec()*1e3).After(now) {
+			continue
+		}
+		name := string(task.TaskName)
+		run := c.taskRun(queue, name)
+		if c.nextRun(run).After(now) {
+			continue
+		}
+		if err := c.serveDelayTask(queue, task, run); err != nil {
+			p := task.RetryParameters
+			if p == nil {
+				qp, qerr := c.queueRetryParameters(queue)
+				if qerr != nil {
+					return n, qerr
+				}
+				p = qp
+			}
+			if c.taskFailed(run, err, p, now) {
+				if err := c.deleteTask(queue, name); err != nil {
+					return n, err
+				}
+			}
+			failures = append(failures, fmt.Sprintf("%q: %v", name, err))
+			continue
+		}
+		if err := c.deleteTask(queue, name); err != nil {
+			return n, err
+		}
+		c.taskSucceeded(run)
+		n++
+	}
+	if len(failures) > 0 {
+		return n, fmt.Errorf("aetest: %d delay tasks failed: %s", len(failures), strings.Join(failures, "; "))
+	}
+	return n, nil
+}
+
+// serveDelayTask serves task with http.DefaultServeMux. It fails if the
+// handler panics or does not answer with a 2xx status.
+func (c *Instance) serveDelayTask(queue string, task *taskqueuepb.TaskQueueQueryTasksResponse_Task, run *TaskRun) (err error) {
+	req, err := http.NewRequest(task.GetMethod().String(), delayPath, bytes.NewReader(task.Body))
+	if err != nil {
+		return err
+	}
+	for _, h := range task.Header {
+		req.Header.Add(string(h.Key), string(h.Value))
+	}
+	req.Header.Set("X-AppEngine-QueueName", queue)
+	req.Header.Set("X-AppEngine-TaskName", string(task.TaskName))
+	req.Header.Set("X-AppEngine-TaskRetryCount", strconv.Itoa(run.RetryCount))
+	req.Header.Set("X-AppEngine-TaskExecutionCount", strconv.Itoa(run.RetryCount))
+
+	tc := c.taskContext(TaskID{queue, string(task.TaskName)}, req)
+	defer appengine_internal.RegisterTestContext(req, tc)()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	w := httptest.NewRecorder()
+	serveWithContext(tc, http.DefaultServeMux, w, req)
+	if w.Code >= 200 && w.Code < 300 {
+		return nil
+	}
+	tc.errs.Lock()
+	defer tc.errs.Unlock()
+	if len(tc.errs.msgs) > 0 {
+		return fmt.Errorf("%s", strings.Join(tc.errs.msgs, "; "))
+	}
+	return fmt.Errorf("status %d", w.Code)
+}
@@ -0,0 +1,81 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"appengine"
+	"appengine/delay"
+)
+
+var delayed []string
+
+var (
+	delayOK = delay.Func("aetest-ok", func(c appengine.Context, s string) {
+		if InstanceOf(c) == nil {
+			panic("not an *Instance")
+		}
+		delayed = append(delayed, s)
+	})
+	delayFail = delay.Func("aetest-fail", func(c appengine.Context, s string) error {
+		delayed = append(delayed, s)
+		return errors.New("boom " + s)
+	})
+	delayPanic = delay.Func("aetest-panic", func(c appengine.Context) {
+		panic("kaboom")
+	})
+)
+
+func TestRunDelayedTasks(t *testing.T) {
+	c, err := NewInstance(&Options{Hermetic: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	delayed = nil
+	delayFail.Call(c, "a")
+	delayOK.Call(c, "b")
+	delayPanic.Call(c)
+	delayOK.Call(c, "c")
+
+	n, err := c.RunDelayedTasks("")
+	if n != 2 {
+		t.Errorf("RunDelayedTasks ran %d tasks successfully, want 2", n)
+	}
+	if err == nil {
+		t.Fatal("RunDelayedTasks succeeded, want an error")
+	}
+	for _, s := range []string{"2 delay tasks failed", "boom a", "panic: kaboom"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("RunDelayedTasks error %q does not contain %q", err, s)
+		}
+	}
+	if got, want := strings.Join(delayed, ","), "a,b,c"; got != want {
+		t.Errorf("ran %s, want %s", got, want)
+	}
+
+	runs := c.TaskRuns("default")
+	if len(runs) != 4 {
+		t.Fatalf("got %d task runs, want 4", len(runs))
+	}
+	var failed int
+	for _, run := range runs {
+		if run.Err != nil {
+			failed++
+			if run.Done || run.RetryCount != 1 {
+				t.Errorf("failed task %q: Done %v, RetryCount %d", run.Name, run.Done, run.RetryCount)
+			}
+		} else if !run.Done {
+			t.Errorf("task %q is not done", run.Name)
+		}
+	}
+	if failed != 2 {
+		t.Errorf("got %d failed task runs, want 2", failed)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Docker configures the container that runs dev_appserver.py when
+// Options.Docker is set.
+type Docker struct {
+	// Image is the Docker image to run. It must have python 2.7 and
+	// dev_appserver.py on its PATH, as an image based on google/cloud-sdk
+	// with the app-engine-python component does.
+	Image string
+}
+
+// The ports of dev_appserver.py inside the container, published on
+// random ports of the loopback interface of the host.
+const (
+	dockerModulePort = "8080"
+	dockerAdminPort  = "8000"
+	dockerAPIPort    = "8001"
+)
+
+// dockerWorkDir is where the work directory is mounted in the container.
+const dockerWorkDir = "/aetest"
+
+// containerName returns the name of the container, unique even if
+// Options.Rand makes the session IDs repeat across test processes.
+func (c *Instance) containerName() string {
+	return fmt.Sprintf("aetest-%d-%s", os.Getpid(), c.session)
+}
+
+// portArgs returns the flags that set the addresses of dev_appserver.py.
+func (c *Instance) portArgs() []string {
+	if c.opts.Docker == nil {
+		return []string{"--port=0", "--api_port=0", "--admin_port=0"}
+	}
+	return []string{
+		"--host=0.0.0.0", "--port=" + dockerModulePort,
+		"--admin_host=0.0.0.0", "--admin_port=" + dockerAdminPort,
+		"--api_host=0.0.0.0", "--api_port=" + dockerAPIPort,
+	}
+}
+
+// childPath returns the path under which dev_appserver.py sees path, a
+// file of the work directory.
+func (c *Instance) childPath(path string) string {
+	if c.opts.Docker == nil {
+		return path
+	}
+	rel, err := filepath.Rel(c.workDir, path)
+	if err != nil {
+		return path
+	}
+	return dockerWorkDir + "/" + filepath.ToSlash(rel)
+}
+
+// dockerCommand returns the command that runs args in a container of
+// c.opts.Docker.Image.
+func (c *Instance) dockerCommand(args []string) (*exec.Cmd, error) {
+	docker, err := exec.LookPath("docker")
+	if err != nil {
+		return nil, fmt.Errorf("Could not find docker: %v", err)
+	}
+	run := []string{
+		"run", "--rm",
+		"--name=" + c.containerName(),
+		"--volume=" + c.workDir + ":" + dockerWorkDir,
+		"--publish=127.0.0.1::" + dockerModulePort,
+		"--publish=127.0.0.1::" + dockerAdminPort,
+		"--publish=127.0.0.1::" + dockerAPIPort,
+	}
+	if uid, gid := os.Getuid(), os.Getgid(); uid >= 0 {
+		// Keep the files of the work directory removable.
+		run = append(run, fmt.Sprintf("--user=%d:%d", uid, gid))
+	}
+	run = append(run, c.opts.Docker.Image)
+	return exec.Command(docker, append(run, args...)...), nil
+}
+
+// dockerHost returns the address of the host to which port of the
+// container is published.
+func (c *Instance) dockerHost(port string) (string, bool) {
+	out, err := exec.Command("docker", "port", c.containerName(), port).Output()
+	if err != nil {
+		return "", false
+	}
+	// docker port prints one address per line, for IPv4 and IPv6.
+	return strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0]), true
+}
+
+// removeContainer removes the container of dev_appserver.py, which
+// outlives the docker client if it is killed.
+func (c *Instance) removeContainer() {
+	exec.Command("docker", "rm", "--force", c.containerName()).Run()
+}
@@ -0,0 +1,62 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Dump copies the stub app, the storage of the API server, which
+// holds the datastore, blobstore and search indexes, and its log
+// to dir.
+func (c *Instance) Dump(dir string) error {
+	if c.workDir == "" {
+		return errors.New("aetest: no API server is running")
+	}
+	return filepath.Walk(c.workDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(c.workDir, path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(dir, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(dst, 0755)
+		}
+		return copyFile(dst, path)
+	})
+}
+
+func copyFile(dst, src string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// preserveWorkDir reports whether the work directory should be kept for
+// inspection, as Options.PreserveOnFailure requests.
+func (c *Instance) preserveWorkDir() bool {
+	if !c.opts.PreserveOnFailure || c.opts.T == nil || !c.opts.T.Failed() {
+		return false
+	}
+	c.opts.T.Logf("aetest: the app, API server storage and log are kept in %s", c.workDir)
+	return true
+}
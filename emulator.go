@@ -0,0 +1,204 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"appengine_internal"
+
+	datastorepb "appengine_internal/datastore"
+)
+
+// DatastoreEmulator configures the Cloud Datastore emulator that serves
+// the datastore_v3 calls when Options.DatastoreEmulator is set.
+type DatastoreEmulator struct {
+	// Host is the host and port of a running emulator, such as
+	// "localhost:8081". If empty, an emulator is started with
+	// "gcloud beta emulators datastore start", and stopped by Close.
+	Host string
+
+	// ProjectID is the project of the emulator. By default, the app ID.
+	ProjectID string
+}
+
+// emulator is a Cloud Datastore emulator.
+type emulator struct {
+	host    string
+	project string
+	cmd     *exec.Cmd // nil if the emulator was already running
+	client  *http.Client
+}
+
+// startEmulator starts the emulator configured by opts, or attaches to it,
+// and clears its datastore.
+func startEmulator(opts *DatastoreEmulator, project, consistencyPolicy string) (*emulator, error) {
+	if opts.ProjectID != "" {
+		project = opts.ProjectID
+	}
+	e := &emulator{
+		host:    opts.Host,
+		project: project,
+		client:  localClient,
+	}
+	if e.host == "" {
+		if err := e.start(consistencyPolicy); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.admin("/reset"); err != nil {
+		e.stop()
+		return nil, fmt.Errorf("aetest: unable to reset the datastore emulator: %v", err)
+	}
+	return e, nil
+}
+
+func (e *emulator) start(consistencyPolicy string) error {
+	gcloud, err := exec.LookPath("gcloud")
+	if err != nil {
+		return fmt.Errorf("aetest: could not find gcloud: %v", err)
+	}
+	// Pick a free port for the emulator.
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return err
+	}
+	e.host = l.Addr().String()
+	l.Close()
+
+	args := []string{
+		"beta", "emulators", "datastore", "start",
+		"--host-port=" + e.host,
+		"--project=" + e.project,
+		"--no-store-on-disk",
+	}
+	if consistencyPolicy == "consistent" {
+		args = append(args, "--consistency=1.0")
+	}
+	e.cmd = exec.Command(gcloud, args...)
+	e.cmd.Stdout = os.Stdout
+	e.cmd.Stderr = os.Stderr
+	if err := e.cmd.Start(); err != nil {
+		return err
+	}
+
+	// Wait until the emulator answers.
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		res, err := e.client.Get("http://" + e.host + "/")
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			e.cmd.Process.Kill()
+			return errors.New("aetest: timeout starting the datastore emulator")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// stop stops the emulator if it was started by startEmulator.
+func (e *emulator) stop() error {
+	if e.cmd == nil {
+		return nil
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- e.cmd.Wait()
+	}()
+	if err := e.admin("/shutdown"); err != nil {
+		e.cmd.Process.Kill()
+		return fmt.Errorf("unable to shut down the datastore emulator: %v", err)
+	}
+	select {
+	case <-time.After(15 * time.Second):
+		e.cmd.Process.Kill()
+		return errors.New("timeout stopping the datastore emulator")
+	case <-errc:
+	}
+	return nil
+}
+
+// admin posts to an administration handler of the emulator.
+func (e *emulator) admin(path string) error {
+	res, err := e.client.Post("http://"+e.host+path, "text/plain", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", path, res.Status)
+	}
+	return nil
+}
+
+// emulatorError is the error returned by the Cloud Datastore API.
+type emulatorError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error"`
+}
+
+// emulatorErrorCodes maps the statuses of the Cloud Datastore API errors
+// to the datastore_v3 error codes.
+var emulatorErrorCodes = map[string]datastorepb.Error_ErrorCode{
+	"INVALID_ARGUMENT":    datastorepb.Error_BAD_REQUEST,
+	"NOT_FOUND":           datastorepb.Error_BAD_REQUEST,
+	"ABORTED":             datastorepb.Error_CONCURRENT_TRANSACTION,
+	"FAILED_PRECONDITION": datastorepb.Error_NEED_INDEX,
+	"DEADLINE_EXCEEDED":   datastorepb.Error_TIMEOUT,
+	"PERMISSION_DENIED":   datastorepb.Error_PERMISSION_DENIED,
+}
+
+// post calls a method of the Cloud Datastore API.
+func (e *emulator) post(method string, req, res interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("http://%s/v1/projects/%s:%s", e.host, e.project, method)
+	resp, err := e.client.Post(u, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var ee emulatorError
+		if err := json.Unmarshal(b, &ee); err != nil || ee.Error.Status == "" {
+			return fmt.Errorf("aetest: datastore emulator: %s: %s", resp.Status, b)
+		}
+		code, ok := emulatorErrorCodes[ee.Error.Status]
+		if !ok {
+			code = datastorepb.Error_INTERNAL_ERROR
+		}
+		return &appengine_internal.APIError{
+			Service: "datastore_v3",
+			Detail:  ee.Error.Message,
+			Code:    int32(code),
+		}
+	}
+	if res == nil {
+		return nil
+	}
+	return json.Unmarshal(b, res)
+}
@@ -0,0 +1,828 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	datastorepb "appengine_internal/datastore"
+)
+
+// The Cloud Datastore API represents entities in JSON as follows.
+
+type v1Key struct {
+	PartitionID *v1PartitionID  `json:"partitionId,omitempty"`
+	Path        []v1PathElement `json:"path"`
+}
+
+type v1PartitionID struct {
+	ProjectID   string `json:"projectId"`
+	NamespaceID string `json:"namespaceId,omitempty"`
+}
+
+type v1PathElement struct {
+	Kind string `json:"kind"`
+	ID   string `json:"id,omitempty"` // a decimal int64
+	Name string `json:"name,omitempty"`
+}
+
+type v1Entity struct {
+	Key        *v1Key              `json:"key,omitempty"`
+	Properties map[string]*v1Value `json:"properties,omitempty"`
+}
+
+type v1Value struct {
+	NullValue      json.RawMessage `json:"nullValue,omitempty"`
+	BooleanValue   *bool           `json:"booleanValue,omitempty"`
+	IntegerValue   *string         `json:"integerValue,omitempty"` // a decimal int64
+	DoubleValue    *float64        `json:"doubleValue,omitempty"`
+	TimestampValue *string         `json:"timestampValue,omitempty"` // in RFC 3339
+	KeyValue       *v1Key          `json:"keyValue,omitempty"`
+	StringValue    *string         `json:"stringValue,omitempty"`
+	BlobValue      *string         `json:"blobValue,omitempty"` // in base64
+	GeoPointValue  *v1LatLng       `json:"geoPointValue,omitempty"`
+	EntityValue    *v1Entity       `json:"entityValue,omitempty"`
+	ArrayValue     *v1ArrayValue   `json:"arrayValue,omitempty"`
+
+	Meaning            int32 `json:"meaning,omitempty"`
+	ExcludeFromIndexes bool  `json:"excludeFromIndexes,omitempty"`
+}
+
+type v1LatLng struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+type v1ArrayValue struct {
+	Values []*v1Value `json:"values"`
+}
+
+// v1UserMeaning is the meaning of the entity values that hold users.
+const v1UserMeaning = 20
+
+type v1ReadOptions struct {
+	Transaction string `json:"transaction,omitempty"`
+}
+
+type v1Mutation struct {
+	Upsert *v1Entity `json:"upsert,omitempty"`
+	Delete *v1Key    `json:"delete,omitempty"`
+}
+
+type v1CommitRequest struct {
+	Mode        string       `json:"mode"`
+	Transaction string       `json:"transaction,omitempty"`
+	Mutations   []v1Mutation `json:"mutations"`
+}
+
+type v1CommitResponse struct {
+	MutationResults []struct {
+		Key *v1Key `json:"key"`
+	} `json:"mutationResults"`
+}
+
+type v1EntityResult struct {
+	Entity *v1Entity `json:"entity"`
+}
+
+type v1Query struct {
+	Kind        []v1KindExpression `json:"kind,omitempty"`
+	Filter      *v1Filter          `json:"filter,omitempty"`
+	Order       []v1Order          `json:"order,omitempty"`
+	Projection  []v1Projection     `json:"projection,omitempty"`
+	DistinctOn  []v1PropertyRef    `json:"distinctOn,omitempty"`
+	StartCursor string             `json:"startCursor,omitempty"`
+	EndCursor   string             `json:"endCursor,omitempty"`
+	Offset      int32              `json:"offset,omitempty"`
+	Limit       *int32             `json:"limit,omitempty"`
+}
+
+type v1KindExpression struct {
+	Name string `json:"name"`
+}
+
+type v1PropertyRef struct {
+	Name string `json:"name"`
+}
+
+type v1Projection struct {
+	Property v1PropertyRef `json:"property"`
+}
+
+type v1Order struct {
+	Property  v1PropertyRef `json:"property"`
+	Direction string        `json:"direction"`
+}
+
+type v1Filter struct {
+	CompositeFilter *v1CompositeFilter `json:"compositeFilter,omitempty"`
+	PropertyFilter  *v1PropertyFilter  `json:"propertyFilter,omitempty"`
+}
+
+type v1CompositeFilter struct {
+	Op      string     `json:"op"`
+	Filters []v1Filter `json:"filters"`
+}
+
+type v1PropertyFilter struct {
+	Property v1PropertyRef `json:"property"`
+	Op       string        `json:"op"`
+	Value    *v1Value      `json:"value"`
+}
+
+var v1FilterOps = map[datastorepb.Query_Filter_Operator]string{
+	datastorepb.Query_Filter_LESS_THAN:             "LESS_THAN",
+	datastorepb.Query_Filter_LESS_THAN_OR_EQUAL:    "LESS_THAN_OR_EQUAL",
+	datastorepb.Query_Filter_GREATER_THAN:          "GREATER_THAN",
+	datastorepb.Query_Filter_GREATER_THAN_OR_EQUAL: "GREATER_THAN_OR_EQUAL",
+	datastorepb.Query_Filter_EQUAL:                 "EQUAL",
+}
+
+// emulatorDatastore implements the datastore_v3 service on top of the
+// Cloud Datastore API of an emulator. Like the datastoreStub, it returns
+// all the results of a query in its first batch.
+type emulatorDatastore struct {
+	e   *emulator
+	app string // the app of the keys returned
+
+	mu         sync.Mutex
+	txns       map[uint64]*emulatorTxn // keyed by handle
+	lastHandle uint64
+}
+
+// emulatorTxn is a transaction of the emulatorDatastore. Its writes are
+// sent when it is committed.
+type emulatorTxn struct {
+	id        string
+	mutations []v1Mutation
+}
+
+func newEmulatorDatastore(e *emulator, app string) *emulatorDatastore {
+	return &emulatorDatastore{
+		e:    e,
+		app:  app,
+		txns: make(map[uint64]*emulatorTxn),
+	}
+}
+
+func (s *emulatorDatastore) call(method string, in, out proto.Message) error {
+	switch method {
+	case "Get":
+		return s.get(in.(*datastorepb.GetRequest), out.(*datastorepb.GetResponse))
+	case "Put":
+		return s.put(in.(*datastorepb.PutRequest), out.(*datastorepb.PutResponse))
+	case "Delete":
+		return s.delete(in.(*datastorepb.DeleteRequest))
+	case "RunQuery":
+		return s.runQuery(in.(*datastorepb.Query), out.(*datastorepb.QueryResult))
+	case "Next":
+		res := out.(*datastorepb.QueryResult)
+		res.Cursor = in.(*datastorepb.NextRequest).Cursor
+		res.MoreResults = proto.Bool(false)
+		return nil
+	case "DeleteCursor":
+		return nil
+	case "BeginTransaction":
+		var res struct {
+			Transaction string `json:"transaction"`
+		}
+		if err := s.e.post("beginTransaction", struct{}{}, &res); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.lastHandle++
+		h := s.lastHandle
+		s.txns[h] = &emulatorTxn{id: res.Transaction}
+		s.mu.Unlock()
+		tx := out.(*datastorepb.Transaction)
+		tx.Handle = proto.Uint64(h)
+		tx.App = in.(*datastorepb.BeginTransactionRequest).App
+		return nil
+	case "Commit":
+		t, err := s.endTxn(in.(*datastorepb.Transaction))
+		if err != nil {
+			return err
+		}
+		return s.e.post("commit", &v1CommitRequest{
+			Mode:        "TRANSACTIONAL",
+			Transaction: t.id,
+			Mutations:   t.mutations,
+		}, nil)
+	case "Rollback":
+		t, err := s.endTxn(in.(*datastorepb.Transaction))
+		if err != nil {
+			return err
+		}
+		return s.e.post("rollback", map[string]string{"transaction": t.id}, nil)
+	case "AllocateIds":
+		return s.allocateIDs(in.(*datastorepb.AllocateIdsRequest), out.(*datastorepb.AllocateIdsResponse))
+	}
+	return callNotFound("datastore_v3", method)
+}
+
+// txn returns the open transaction tx refers to, if any.
+func (s *emulatorDatastore) txn(tx *datastorepb.Transaction) (*emulatorTxn, error) {
+	if tx == nil {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.txns[tx.GetHandle()]
+	if t == nil {
+		return nil, datastoreStubError(datastorepb.Error_BAD_REQUEST, "transaction has expired or is invalid")
+	}
+	return t, nil
+}
+
+// endTxn removes the open transaction tx refers to and returns it.
+func (s *emulatorDatastore) endTxn(tx *datastorepb.Transaction) (*emulatorTxn, error) {
+	t, err := s.txn(tx)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	delete(s.txns, tx.GetHandle())
+	s.mu.Unlock()
+	return t, nil
+}
+
+func (s *emulatorDatastore) readOptions(tx *datastorepb.Transaction) (*v1ReadOptions, error) {
+	t, err := s.txn(tx)
+	if err != nil || t == nil {
+		return nil, err
+	}
+	return &v1ReadOptions{Transaction: t.id}, nil
+}
+
+func (s *emulatorDatastore) get(req *datastorepb.GetRequest, res *datastorepb.GetResponse) error {
+	ro, err := s.readOptions(req.Transaction)
+	if err != nil {
+		return err
+	}
+	found := make(map[string]*datastorepb.EntityProto)
+	keys := make([]*v1Key, len(req.Key))
+	for i, k := range req.Key {
+		keys[i] = s.toV1Key(k)
+	}
+	for len(keys) > 0 {
+		var lres struct {
+			Found    []v1EntityResult `json:"found"`
+			Deferred []*v1Key         `json:"deferred"`
+		}
+		lreq := struct {
+			ReadOptions *v1ReadOptions `json:"readOptions,omitempty"`
+			Keys        []*v1Key       `json:"keys"`
+		}{ro, keys}
+		if err := s.e.post("lookup", &lreq, &lres); err != nil {
+			return err
+		}
+		for _, r := range lres.Found {
+			e, err := s.fromV1Entity(r.Entity)
+			if err != nil {
+				return err
+			}
+			found[refKey(e.Key)] = e
+		}
+		keys = lres.Deferred
+	}
+	for _, k := range req.Key {
+		if e := found[refKey(k)]; e != nil {
+			res.Entity = append(res.Entity, &datastorepb.GetResponse_Entity{Entity: e})
+		} else {
+			res.Entity = append(res.Entity, &datastorepb.GetResponse_Entity{Key: k})
+		}
+	}
+	return nil
+}
+
+func (s *emulatorDatastore) put(req *datastorepb.PutRequest, res *datastorepb.PutResponse) error {
+	t, err := s.txn(req.Transaction)
+	if err != nil {
+		return err
+	}
+	entities := make([]*v1Entity, len(req.Entity))
+	for i, e := range req.Entity {
+		if entities[i], err = s.toV1Entity(e); err != nil {
+			return err
+		}
+	}
+	if t != nil {
+		// The keys must be complete when the transaction commits.
+		var incomplete []*v1Key
+		for _, e := range entities {
+			if last := e.Key.Path[len(e.Key.Path)-1]; last.ID == "" && last.Name == "" {
+				incomplete = append(incomplete, e.Key)
+			}
+		}
+		if len(incomplete) > 0 {
+			var ares struct {
+				Keys []*v1Key `json:"keys"`
+			}
+			if err := s.e.post("allocateIds", map[string][]*v1Key{"keys": incomplete}, &ares); err != nil {
+				return err
+			}
+			for i, k := range ares.Keys {
+				*incomplete[i] = *k
+			}
+		}
+		s.mu.Lock()
+		for _, e := range entities {
+			t.mutations = append(t.mutations, v1Mutation{Upsert: e})
+			res.Key = append(res.Key, s.fromV1Key(e.Key))
+		}
+		s.mu.Unlock()
+		return nil
+	}
+
+	creq := &v1CommitRequest{Mode: "NON_TRANSACTIONAL"}
+	for _, e := range entities {
+		creq.Mutations = append(creq.Mutations, v1Mutation{Upsert: e})
+	}
+	var cres v1CommitResponse
+	if err := s.e.post("commit", creq, &cres); err != nil {
+		return err
+	}
+	for i, e := range entities {
+		k := e.Key
+		if i < len(cres.MutationResults) && cres.MutationResults[i].Key != nil {
+			k = cres.MutationResults[i].Key
+		}
+		res.Key = append(res.Key, s.fromV1Key(k))
+	}
+	return nil
+}
+
+func (s *emulatorDatastore) delete(req *datastorepb.DeleteRequest) error {
+	t, err := s.txn(req.Transaction)
+	if err != nil {
+		return err
+	}
+	var mutations []v1Mutation
+	for _, k := range req.Key {
+		mutations = append(mutations, v1Mutation{Delete: s.toV1Key(k)})
+	}
+	if t != nil {
+		s.mu.Lock()
+		t.mutations = append(t.mutations, mutations...)
+		s.mu.Unlock()
+		return nil
+	}
+	return s.e.post("commit", &v1CommitRequest{Mode: "NON_TRANSACTIONAL", Mutations: mutations}, nil)
+}
+
+func (s *emulatorDatastore) runQuery(q *datastorepb.Query, res *datastorepb.QueryResult) error {
+	ro, err := s.readOptions(q.Transaction)
+	if err != nil {
+		return err
+	}
+	vq, err := s.toV1Query(q)
+	if err != nil {
+		return err
+	}
+	partition := &v1PartitionID{ProjectID: s.e.project, NamespaceID: q.GetNameSpace()}
+
+	skipped := int32(0)
+	endCursor := vq.StartCursor
+	for {
+		var qres struct {
+			Batch struct {
+				SkippedResults int32            `json:"skippedResults"`
+				EntityResults  []v1EntityResult `json:"entityResults"`
+				EndCursor      string           `json:"endCursor"`
+				MoreResults    string           `json:"moreResults"`
+			} `json:"batch"`
+		}
+		qreq := struct {
+			PartitionID *v1PartitionID `json:"partitionId"`
+			ReadOptions *v1ReadOptions `json:"readOptions,omitempty"`
+			Query       *v1Query       `json:"query"`
+		}{partition, ro, vq}
+		if err := s.e.post("runQuery", &qreq, &qres); err != nil {
+			return err
+		}
+		b := qres.Batch
+		skipped += b.SkippedResults
+		for _, r := range b.EntityResults {
+			e, err := s.fromV1Entity(r.Entity)
+			if err != nil {
+				return err
+			}
+			res.Result = append(res.Result, e)
+		}
+		if b.EndCursor != "" {
+			endCursor = b.EndCursor
+		}
+		if b.MoreResults != "NOT_FINISHED" {
+			break
+		}
+		// Ask for the rest of the results.
+		vq.StartCursor = b.EndCursor
+		vq.Offset -= b.SkippedResults
+		if vq.Limit != nil {
+			n := *vq.Limit - int32(len(b.EntityResults))
+			if n <= 0 {
+				break
+			}
+			vq.Limit = &n
+		}
+	}
+
+	if skipped > 0 {
+		res.SkippedResults = proto.Int32(skipped)
+	}
+	res.KeysOnly = q.KeysOnly
+	res.MoreResults = proto.Bool(false)
+	res.Cursor = &datastorepb.Cursor{Cursor: proto.Uint64(0), App: q.App}
+	if q.GetCompile() {
+		// The emulator's cursor is kept as is in the start key of the
+		// compiled cursor.
+		res.CompiledCursor = &datastorepb.CompiledCursor{}
+		if endCursor != "" {
+			res.CompiledCursor.Position = &datastorepb.CompiledCursor_Position{
+				StartKey: proto.String(endCursor),
+			}
+		}
+	}
+	return nil
+}
+
+func (s *emulatorDatastore) allocateIDs(req *datastorepb.AllocateIdsRequest, res *datastorepb.AllocateIdsResponse) error {
+	if req.GetSize() <= 0 {
+		return datastoreStubError(datastorepb.Error_BAD_REQUEST, "the datastore emulator does not support reserving IDs up to a maximum")
+	}
+	model := s.toV1Key(req.ModelKey)
+	last := &model.Path[len(model.Path)-1]
+	last.ID, last.Name = "", ""
+	keys := make([]*v1Key, req.GetSize())
+	for i := range keys {
+		keys[i] = model
+	}
+	var ares struct {
+		Keys []*v1Key `json:"keys"`
+	}
+	if err := s.e.post("allocateIds", map[string][]*v1Key{"keys": keys}, &ares); err != nil {
+		return err
+	}
+	var ids []int64
+	for _, k := range ares.Keys {
+		id, err := strconv.ParseInt(k.Path[len(k.Path)-1].ID, 10, 64)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	sort.Sort(int64s(ids))
+	if len(ids) == 0 || ids[len(ids)-1]-ids[0] != int64(len(ids)-1) {
+		return datastoreStubError(datastorepb.Error_INTERNAL_ERROR, "the datastore emulator allocated a non-contiguous range of IDs")
+	}
+	res.Start = proto.Int64(ids[0])
+	res.End = proto.Int64(ids[len(ids)-1])
+	return nil
+}
+
+type int64s []int64
+
+func (s int64s) Len() int           { return len(s) }
+func (s int64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (s *emulatorDatastore) toV1Query(q *datastorepb.Query) (*v1Query, error) {
+	vq := &v1Query{
+		Offset: q.GetOffset(),
+		Limit:  q.Limit,
+	}
+	if q.Kind != nil {
+		vq.Kind = []v1KindExpression{{Name: q.GetKind()}}
+	}
+	var filters []v1Filter
+	if q.Ancestor != nil {
+		filters = append(filters, v1Filter{PropertyFilter: &v1PropertyFilter{
+			Property: v1PropertyRef{Name: "__key__"},
+			Op:       "HAS_ANCESTOR",
+			Value:    &v1Value{KeyValue: s.toV1Key(q.Ancestor)},
+		}})
+	}
+	for _, f := range q.Filter {
+		op, ok := v1FilterOps[f.GetOp()]
+		if !ok || len(f.Property) != 1 {
+			return nil, datastoreStubError(datastorepb.Error_BAD_REQUEST, "the datastore emulator does not support the "+f.GetOp().String()+" filter")
+		}
+		p := f.Property[0]
+		v, err := s.toV1Value(p.Value, p.GetMeaning())
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, v1Filter{PropertyFilter: &v1PropertyFilter{
+			Property: v1PropertyRef{Name: p.GetName()},
+			Op:       op,
+			Value:    v,
+		}})
+	}
+	switch len(filters) {
+	case 0:
+	case 1:
+		vq.Filter = &filters[0]
+	default:
+		vq.Filter = &v1Filter{CompositeFilter: &v1CompositeFilter{Op: "AND", Filters: filters}}
+	}
+	for _, o := range q.Order {
+		dir := "ASCENDING"
+		if o.GetDirection() == datastorepb.Query_Order_DESCENDING {
+			dir = "DESCENDING"
+		}
+		vq.Order = append(vq.Order, v1Order{Property: v1PropertyRef{Name: o.GetProperty()}, Direction: dir})
+	}
+	if q.GetKeysOnly() {
+		vq.Projection = []v1Projection{{Property: v1PropertyRef{Name: "__key__"}}}
+	}
+	for _, name := range q.PropertyName {
+		vq.Projection = append(vq.Projection, v1Projection{Property: v1PropertyRef{Name: name}})
+	}
+	for _, name := range q.GroupByPropertyName {
+		vq.DistinctOn = append(vq.DistinctOn, v1PropertyRef{Name: name})
+	}
+	var err error
+	if vq.StartCursor, err = emulatorCursor(q.CompiledCursor); err != nil {
+		return nil, err
+	}
+	if vq.EndCursor, err = emulatorCursor(q.EndCompiledCursor); err != nil {
+		return nil, err
+	}
+	return vq, nil
+}
+
+// emulatorCursor returns the emulator's cursor kept in c by runQuery.
+func emulatorCursor(c *datastorepb.CompiledCursor) (string, error) {
+	if c == nil || c.Position == nil {
+		return "", nil
+	}
+	if c.Position.StartKey == nil {
+		return "", datastoreStubError(datastorepb.Error_BAD_REQUEST, "the cursor was not returned by the datastore emulator")
+	}
+	return c.Position.GetStartKey(), nil
+}
+
+func (s *emulatorDatastore) toV1Key(ref *datastorepb.Reference) *v1Key {
+	k := &v1Key{PartitionID: &v1PartitionID{
+		ProjectID:   s.e.project,
+		NamespaceID: ref.GetNameSpace(),
+	}}
+	for _, e := range ref.GetPath().GetElement() {
+		pe := v1PathElement{Kind: e.GetType(), Name: e.GetName()}
+		if e.GetId() != 0 {
+			pe.ID = strconv.FormatInt(e.GetId(), 10)
+		}
+		k.Path = append(k.Path, pe)
+	}
+	return k
+}
+
+func (s *emulatorDatastore) fromV1Key(k *v1Key) *datastorepb.Reference {
+	ref := &datastorepb.Reference{
+		App:  proto.String(s.app),
+		Path: &datastorepb.Path{},
+	}
+	if p := k.PartitionID; p != nil && p.NamespaceID != "" {
+		ref.NameSpace = proto.String(p.NamespaceID)
+	}
+	for _, pe := range k.Path {
+		e := &datastorepb.Path_Element{Type: proto.String(pe.Kind)}
+		if pe.Name != "" {
+			e.Name = proto.String(pe.Name)
+		} else if id, err := strconv.ParseInt(pe.ID, 10, 64); err == nil {
+			e.Id = proto.Int64(id)
+		}
+		ref.Path.Element = append(ref.Path.Element, e)
+	}
+	return ref
+}
+
+func (s *emulatorDatastore) toV1Entity(e *datastorepb.EntityProto) (*v1Entity, error) {
+	ve := &v1Entity{
+		Key:        s.toV1Key(e.Key),
+		Properties: make(map[string]*v1Value),
+	}
+	add := func(p *datastorepb.Property, indexed bool) error {
+		v, err := s.toV1Value(p.Value, p.GetMeaning())
+		if err != nil {
+			return err
+		}
+		v.ExcludeFromIndexes = !indexed
+		name := p.GetName()
+		if !p.GetMultiple() {
+			ve.Properties[name] = v
+			return nil
+		}
+		if ve.Properties[name] == nil {
+			ve.Properties[name] = &v1Value{ArrayValue: &v1ArrayValue{}}
+		}
+		a := ve.Properties[name].ArrayValue
+		a.Values = append(a.Values, v)
+		return nil
+	}
+	for _, p := range e.Property {
+		if err := add(p, true); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range e.RawProperty {
+		if err := add(p, false); err != nil {
+			return nil, err
+		}
+	}
+	return ve, nil
+}
+
+func (s *emulatorDatastore) fromV1Entity(ve *v1Entity) (*datastorepb.EntityProto, error) {
+	e := &datastorepb.EntityProto{Key: s.fromV1Key(ve.Key)}
+	e.EntityGroup = &datastorepb.Path{Element: e.Key.Path.Element[:1]}
+	names := make([]string, 0, len(ve.Properties))
+	for name := range ve.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	add := func(name string, v *v1Value, multiple bool) error {
+		pv, meaning, err := s.fromV1Value(v)
+		if err != nil {
+			return err
+		}
+		p := &datastorepb.Property{
+			Name:     proto.String(name),
+			Value:    pv,
+			Multiple: proto.Bool(multiple),
+		}
+		if meaning != datastorepb.Property_NO_MEANING {
+			p.Meaning = meaning.Enum()
+		}
+		if v.ExcludeFromIndexes {
+			e.RawProperty = append(e.RawProperty, p)
+		} else {
+			e.Property = append(e.Property, p)
+		}
+		return nil
+	}
+	for _, name := range names {
+		v := ve.Properties[name]
+		if v.ArrayValue == nil {
+			if err := add(name, v, false); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		for _, av := range v.ArrayValue.Values {
+			if err := add(name, av, true); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return e, nil
+}
+
+func (s *emulatorDatastore) toV1Value(pv *datastorepb.PropertyValue, meaning datastorepb.Property_Meaning) (*v1Value, error) {
+	v := &v1Value{}
+	switch {
+	case pv.Int64Value != nil && meaning == datastorepb.Property_GD_WHEN:
+		t := time.Unix(0, pv.GetInt64Value()*1e3).UTC().Format(time.RFC3339Nano)
+		v.TimestampValue = &t
+		return v, nil
+	case pv.Int64Value != nil:
+		i := strconv.FormatInt(pv.GetInt64Value(), 10)
+		v.IntegerValue = &i
+	case pv.BooleanValue != nil:
+		v.BooleanValue = pv.BooleanValue
+	case pv.StringValue != nil && (meaning == datastorepb.Property_BLOB || meaning == datastorepb.Property_BYTESTRING):
+		b := base64.StdEncoding.EncodeToString([]byte(pv.GetStringValue()))
+		v.BlobValue = &b
+		if meaning == datastorepb.Property_BLOB {
+			return v, nil
+		}
+	case pv.StringValue != nil:
+		v.StringValue = pv.StringValue
+	case pv.DoubleValue != nil:
+		v.DoubleValue = pv.DoubleValue
+	case pv.Pointvalue != nil:
+		v.GeoPointValue = &v1LatLng{Latitude: pv.Pointvalue.GetX(), Longitude: pv.Pointvalue.GetY()}
+		if meaning == datastorepb.Property_GEORSS_POINT {
+			return v, nil
+		}
+	case pv.Uservalue != nil:
+		u := pv.Uservalue
+		ue := &v1Entity{Properties: make(map[string]*v1Value)}
+		for name, s := range map[string]*string{
+			"email":              u.Email,
+			"auth_domain":        u.AuthDomain,
+			"nickname":           u.Nickname,
+			"federated_identity": u.FederatedIdentity,
+			"federated_provider": u.FederatedProvider,
+		} {
+			if s != nil {
+				ue.Properties[name] = &v1Value{StringValue: s}
+			}
+		}
+		v.EntityValue = ue
+		v.Meaning = v1UserMeaning
+		return v, nil
+	case pv.Referencevalue != nil:
+		rv := pv.Referencevalue
+		ref := &datastorepb.Reference{NameSpace: rv.NameSpace, Path: &datastorepb.Path{}}
+		for _, e := range rv.Pathelement {
+			ref.Path.Element = append(ref.Path.Element, &datastorepb.Path_Element{
+				Type: e.Type,
+				Id:   e.Id,
+				Name: e.Name,
+			})
+		}
+		v.KeyValue = s.toV1Key(ref)
+	default:
+		v.NullValue = json.RawMessage(`"NULL_VALUE"`)
+	}
+	v.Meaning = int32(meaning)
+	return v, nil
+}
+
+func (s *emulatorDatastore) fromV1Value(v *v1Value) (*datastorepb.PropertyValue, datastorepb.Property_Meaning, error) {
+	pv := &datastorepb.PropertyValue{}
+	meaning := datastorepb.Property_Meaning(v.Meaning)
+	switch {
+	case v.TimestampValue != nil:
+		t, err := time.Parse(time.RFC3339Nano, *v.TimestampValue)
+		if err != nil {
+			return nil, 0, err
+		}
+		pv.Int64Value = proto.Int64(t.UnixNano() / 1e3)
+		meaning = datastorepb.Property_GD_WHEN
+	case v.IntegerValue != nil:
+		i, err := strconv.ParseInt(*v.IntegerValue, 10, 64)
+		if err != nil {
+			return nil, 0, err
+		}
+		pv.Int64Value = proto.Int64(i)
+	case v.BooleanValue != nil:
+		pv.BooleanValue = v.BooleanValue
+	case v.BlobValue != nil:
+		b, err := base64.StdEncoding.DecodeString(*v.BlobValue)
+		if err != nil {
+			return nil, 0, err
+		}
+		pv.StringValue = proto.String(string(b))
+		if meaning != datastorepb.Property_BYTESTRING {
+			meaning = datastorepb.Property_BLOB
+		}
+	case v.StringValue != nil:
+		pv.StringValue = v.StringValue
+	case v.DoubleValue != nil:
+		pv.DoubleValue = v.DoubleValue
+	case v.GeoPointValue != nil:
+		pv.Pointvalue = &datastorepb.PropertyValue_PointValue{
+			X: proto.Float64(v.GeoPointValue.Latitude),
+			Y: proto.Float64(v.GeoPointValue.Longitude),
+		}
+		if meaning == datastorepb.Property_NO_MEANING {
+			meaning = datastorepb.Property_GEORSS_POINT
+		}
+	case v.EntityValue != nil && v.Meaning == v1UserMeaning:
+		str := func(name string) *string {
+			if p := v.EntityValue.Properties[name]; p != nil {
+				return p.StringValue
+			}
+			return nil
+		}
+		pv.Uservalue = &datastorepb.PropertyValue_UserValue{
+			Email:             str("email"),
+			AuthDomain:        str("auth_domain"),
+			Nickname:          str("nickname"),
+			FederatedIdentity: str("federated_identity"),
+			FederatedProvider: str("federated_provider"),
+		}
+		if pv.Uservalue.Email == nil {
+			pv.Uservalue.Email = proto.String("")
+		}
+		if pv.Uservalue.AuthDomain == nil {
+			pv.Uservalue.AuthDomain = proto.String("")
+		}
+		meaning = datastorepb.Property_NO_MEANING
+	case v.KeyValue != nil:
+		ref := s.fromV1Key(v.KeyValue)
+		rv := &datastorepb.PropertyValue_ReferenceValue{App: ref.App, NameSpace: ref.NameSpace}
+		for _, e := range ref.Path.Element {
+			rv.Pathelement = append(rv.Pathelement, &datastorepb.PropertyValue_ReferenceValue_PathElement{
+				Type: e.Type,
+				Id:   e.Id,
+				Name: e.Name,
+			})
+		}
+		pv.Referencevalue = rv
+	case v.EntityValue != nil:
+		return nil, 0, datastoreStubError(datastorepb.Error_BAD_REQUEST, "the datastore_v3 service does not support embedded entities")
+	}
+	return pv, meaning, nil
+}
@@ -0,0 +1,446 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	datastorepb "appengine_internal/datastore"
+)
+
+// newTestEmulatorDatastore returns an emulatorDatastore whose emulator
+// calls h to serve each method.
+func newTestEmulatorDatastore(h func(method string, body []byte) interface{}) (*emulatorDatastore, func()) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		method := r.URL.Path[strings.LastIndex(r.URL.Path, ":")+1:]
+		json.NewEncoder(w).Encode(h(method, body))
+	}))
+	e := &emulator{
+		host:    strings.TrimPrefix(srv.URL, "http://"),
+		project: "testapp",
+		client:  http.DefaultClient,
+	}
+	return newEmulatorDatastore(e, "dev~testapp"), srv.Close
+}
+
+// jsonRoundTrip encodes v in JSON, as post does, and decodes it back into v.
+func jsonRoundTrip(t *testing.T, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEmulatorKeys(t *testing.T) {
+	s := newEmulatorDatastore(&emulator{project: "testapp"}, "dev~testapp")
+	tests := []struct {
+		ref  *datastorepb.Reference
+		want string
+	}{
+		{
+			dsKey("", "A", "x"),
+			`{"partitionId":{"projectId":"testapp"},"path":[{"kind":"A","name":"x"}]}`,
+		},
+		{
+			dsKey("ns", "A", 1, "B", "y"),
+			`{"partitionId":{"projectId":"testapp","namespaceId":"ns"},"path":[{"kind":"A","id":"1"},{"kind":"B","name":"y"}]}`,
+		},
+		{
+			dsKey("", "A", -7, "B"),
+			`{"partitionId":{"projectId":"testapp"},"path":[{"kind":"A","id":"-7"},{"kind":"B"}]}`,
+		},
+		{
+			dsKey("", "A", "12"),
+			`{"partitionId":{"projectId":"testapp"},"path":[{"kind":"A","name":"12"}]}`,
+		},
+	}
+	for _, tt := range tests {
+		k := s.toV1Key(tt.ref)
+		b, err := json.Marshal(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("toV1Key(%v) = %s, want %s", tt.ref, b, tt.want)
+		}
+		jsonRoundTrip(t, k)
+		if got := s.fromV1Key(k); !proto.Equal(got, tt.ref) {
+			t.Errorf("fromV1Key(toV1Key(%v)) = %v", tt.ref, got)
+		}
+	}
+}
+
+func TestEmulatorValues(t *testing.T) {
+	s := newEmulatorDatastore(&emulator{project: "testapp"}, "dev~testapp")
+	ref := &datastorepb.PropertyValue_ReferenceValue{
+		App:       proto.String("dev~testapp"),
+		NameSpace: proto.String("ns"),
+		Pathelement: []*datastorepb.PropertyValue_ReferenceValue_PathElement{
+			{Type: proto.String("A"), Id: proto.Int64(1)},
+			{Type: proto.String("B"), Name: proto.String("y")},
+		},
+	}
+	tests := []struct {
+		pv      *datastorepb.PropertyValue
+		meaning datastorepb.Property_Meaning
+		want    string
+	}{
+		{&datastorepb.PropertyValue{}, datastorepb.Property_NO_MEANING,
+			`{"nullValue":"NULL_VALUE"}`},
+		{&datastorepb.PropertyValue{Int64Value: proto.Int64(-1 << 62)}, datastorepb.Property_NO_MEANING,
+			`{"integerValue":"-4611686018427387904"}`},
+		{&datastorepb.PropertyValue{Int64Value: proto.Int64(1394000000123456)}, datastorepb.Property_GD_WHEN,
+			`{"timestampValue":"2014-03-05T06:13:20.123456Z"}`},
+		{&datastorepb.PropertyValue{Int64Value: proto.Int64(-1500000)}, datastorepb.Property_GD_WHEN,
+			`{"timestampValue":"1969-12-31T23:59:58.5Z"}`},
+		{&datastorepb.PropertyValue{BooleanValue: proto.Bool(false)}, datastorepb.Property_NO_MEANING,
+			`{"booleanValue":false}`},
+		{&datastorepb.PropertyValue{StringValue: proto.String("héllo")}, datastorepb.Property_NO_MEANING,
+			`{"stringValue":"héllo"}`},
+		{&datastorepb.PropertyValue{StringValue: proto.String("long text")}, datastorepb.Property_TEXT,
+			`{"stringValue":"long text","meaning":15}`},
+		{&datastorepb.PropertyValue{StringValue: proto.String("\x00\xff")}, datastorepb.Property_BLOB,
+			`{"blobValue":"AP8="}`},
+		{&datastorepb.PropertyValue{StringValue: proto.String("\x00\xff")}, datastorepb.Property_BYTESTRING,
+			`{"blobValue":"AP8=","meaning":16}`},
+		{&datastorepb.PropertyValue{DoubleValue: proto.Float64(2.5)}, datastorepb.Property_NO_MEANING,
+			`{"doubleValue":2.5}`},
+		{&datastorepb.PropertyValue{Pointvalue: &datastorepb.PropertyValue_PointValue{X: proto.Float64(1.5), Y: proto.Float64(-2)}}, datastorepb.Property_GEORSS_POINT,
+			`{"geoPointValue":{"latitude":1.5,"longitude":-2}}`},
+		{&datastorepb.PropertyValue{Uservalue: &datastorepb.PropertyValue_UserValue{
+			Email:      proto.String("a@example.com"),
+			AuthDomain: proto.String("gmail.com"),
+			Nickname:   proto.String("a"),
+		}}, datastorepb.Property_NO_MEANING,
+			`{"entityValue":{"properties":{"auth_domain":{"stringValue":"gmail.com"},"email":{"stringValue":"a@example.com"},"nickname":{"stringValue":"a"}}},"meaning":20}`},
+		{&datastorepb.PropertyValue{Referencevalue: ref}, datastorepb.Property_NO_MEANING,
+			`{"keyValue":{"partitionId":{"projectId":"testapp","namespaceId":"ns"},"path":[{"kind":"A","id":"1"},{"kind":"B","name":"y"}]}}`},
+	}
+	for _, tt := range tests {
+		v, err := s.toV1Value(tt.pv, tt.meaning)
+		if err != nil {
+			t.Errorf("toV1Value(%v, %v) failed: %v", tt.pv, tt.meaning, err)
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("toV1Value(%v, %v) = %s, want %s", tt.pv, tt.meaning, b, tt.want)
+		}
+		jsonRoundTrip(t, v)
+		pv, meaning, err := s.fromV1Value(v)
+		if err != nil {
+			t.Errorf("fromV1Value(%s) failed: %v", b, err)
+			continue
+		}
+		if !proto.Equal(pv, tt.pv) || meaning != tt.meaning {
+			t.Errorf("fromV1Value(%s) = %v, %v, want %v, %v", b, pv, meaning, tt.pv, tt.meaning)
+		}
+	}
+
+	bad := []string{
+		`{"timestampValue":"yesterday"}`,
+		`{"integerValue":"1.5"}`,
+		`{"blobValue":"!"}`,
+		`{"entityValue":{"properties":{}}}`,
+	}
+	for _, in := range bad {
+		var v v1Value
+		if err := json.Unmarshal([]byte(in), &v); err != nil {
+			t.Fatal(err)
+		}
+		if pv, _, err := s.fromV1Value(&v); err == nil {
+			t.Errorf("fromV1Value(%s) = %v, want an error", in, pv)
+		}
+	}
+}
+
+func TestEmulatorEntities(t *testing.T) {
+	s := newEmulatorDatastore(&emulator{project: "testapp"}, "dev~testapp")
+	prop := func(name string, v interface{}, meaning datastorepb.Property_Meaning, multiple bool) *datastorepb.Property {
+		p := &datastorepb.Property{Name: proto.String(name), Value: dsValue(v), Multiple: proto.Bool(multiple)}
+		if meaning != datastorepb.Property_NO_MEANING {
+			p.Meaning = meaning.Enum()
+		}
+		return p
+	}
+	for _, ns := range []string{"", "ns"} {
+		key := dsKey(ns, "A", "x", "B", 2)
+		e := &datastorepb.EntityProto{
+			Key:         key,
+			EntityGroup: &datastorepb.Path{Element: key.Path.Element[:1]},
+			// The properties are sorted by name, as fromV1Entity returns them.
+			Property: []*datastorepb.Property{
+				prop("Age", 40, datastorepb.Property_NO_MEANING, false),
+				prop("Born", 1394000000123456, datastorepb.Property_GD_WHEN, false),
+				prop("Parent", dsKey(ns, "A", "x"), datastorepb.Property_NO_MEANING, false),
+				prop("Tags", "a", datastorepb.Property_NO_MEANING, true),
+				prop("Tags", "b", datastorepb.Property_NO_MEANING, true),
+				prop("Tags", "a", datastorepb.Property_NO_MEANING, true),
+			},
+			RawProperty: []*datastorepb.Property{
+				prop("Bio", "long text", datastorepb.Property_TEXT, false),
+				prop("Photo", "\x89PNG", datastorepb.Property_BLOB, false),
+				prop("Scores", 1.5, datastorepb.Property_NO_MEANING, true),
+				prop("Scores", 2.5, datastorepb.Property_NO_MEANING, true),
+			},
+		}
+		ve, err := s.toV1Entity(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ve.Properties["Tags"].ArrayValue; got == nil || len(got.Values) != 3 {
+			t.Errorf("%q: Tags = %+v, want an array of 3 values", ns, ve.Properties["Tags"])
+		}
+		if !ve.Properties["Bio"].ExcludeFromIndexes || ve.Properties["Age"].ExcludeFromIndexes {
+			t.Errorf("%q: raw properties are not excluded from indexes, or the others are", ns)
+		}
+		jsonRoundTrip(t, ve)
+		got, err := s.fromV1Entity(ve)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// fromV1Entity puts the indexed and the raw properties apart, but
+		// sorts each by name.
+		if !proto.Equal(got, e) {
+			t.Errorf("%q: fromV1Entity(toV1Entity(e)) =\n%v\nwant\n%v", ns, got, e)
+		}
+	}
+}
+
+func TestEmulatorQueries(t *testing.T) {
+	s := newEmulatorDatastore(&emulator{project: "testapp"}, "dev~testapp")
+	cursor := &datastorepb.CompiledCursor{Position: &datastorepb.CompiledCursor_Position{StartKey: proto.String("c1")}}
+	tests := []struct {
+		q    *datastorepb.Query
+		want string
+	}{
+		{
+			&datastorepb.Query{},
+			`{}`,
+		},
+		{
+			&datastorepb.Query{Kind: proto.String("A"), Offset: proto.Int32(2), Limit: proto.Int32(0)},
+			`{"kind":[{"name":"A"}],"offset":2,"limit":0}`,
+		},
+		{
+			&datastorepb.Query{Kind: proto.String("A"), Filter: []*datastorepb.Query_Filter{
+				dsFilter("N", datastorepb.Query_Filter_GREATER_THAN_OR_EQUAL, 1),
+			}},
+			`{"kind":[{"name":"A"}],"filter":{"propertyFilter":{"property":{"name":"N"},"op":"GREATER_THAN_OR_EQUAL","value":{"integerValue":"1"}}}}`,
+		},
+		{
+			&datastorepb.Query{Kind: proto.String("B"), Ancestor: dsKey("ns", "A", "x"), Filter: []*datastorepb.Query_Filter{
+				dsFilter("S", datastorepb.Query_Filter_EQUAL, "s"),
+				dsFilter("N", datastorepb.Query_Filter_LESS_THAN, 2.5),
+			}},
+			`{"kind":[{"name":"B"}],"filter":{"compositeFilter":{"op":"AND","filters":[` +
+				`{"propertyFilter":{"property":{"name":"__key__"},"op":"HAS_ANCESTOR","value":{"keyValue":{"partitionId":{"projectId":"testapp","namespaceId":"ns"},"path":[{"kind":"A","name":"x"}]}}}},` +
+				`{"propertyFilter":{"property":{"name":"S"},"op":"EQUAL","value":{"stringValue":"s"}}},` +
+				`{"propertyFilter":{"property":{"name":"N"},"op":"LESS_THAN","value":{"doubleValue":2.5}}}]}}}`,
+		},
+		{
+			&datastorepb.Query{Kind: proto.String("A"), KeysOnly: proto.Bool(true), Order: []*datastorepb.Query_Order{
+				dsOrder("N", datastorepb.Query_Order_DESCENDING),
+				dsOrder("__key__", datastorepb.Query_Order_ASCENDING),
+			}},
+			`{"kind":[{"name":"A"}],"order":[{"property":{"name":"N"},"direction":"DESCENDING"},{"property":{"name":"__key__"},"direction":"ASCENDING"}],"projection":[{"property":{"name":"__key__"}}]}`,
+		},
+		{
+			&datastorepb.Query{Kind: proto.String("A"), PropertyName: []string{"N", "S"}, GroupByPropertyName: []string{"N"}},
+			`{"kind":[{"name":"A"}],"projection":[{"property":{"name":"N"}},{"property":{"name":"S"}}],"distinctOn":[{"name":"N"}]}`,
+		},
+		{
+			&datastorepb.Query{CompiledCursor: cursor, EndCompiledCursor: &datastorepb.CompiledCursor{}},
+			`{"startCursor":"c1"}`,
+		},
+	}
+	for _, tt := range tests {
+		vq, err := s.toV1Query(tt.q)
+		if err != nil {
+			t.Errorf("toV1Query(%v) failed: %v", tt.q, err)
+			continue
+		}
+		b, err := json.Marshal(vq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("toV1Query(%v) =\n%s\nwant\n%s", tt.q, b, tt.want)
+		}
+	}
+
+	bad := []*datastorepb.Query{
+		{Filter: []*datastorepb.Query_Filter{dsFilter("N", datastorepb.Query_Filter_IN, 1)}},
+		{Filter: []*datastorepb.Query_Filter{{Op: datastorepb.Query_Filter_EQUAL.Enum()}}},
+		{CompiledCursor: &datastorepb.CompiledCursor{Position: &datastorepb.CompiledCursor_Position{}}},
+	}
+	for _, q := range bad {
+		if vq, err := s.toV1Query(q); err == nil {
+			t.Errorf("toV1Query(%v) = %+v, want an error", q, vq)
+		}
+	}
+}
+
+// fakeQueryEmulator serves runQuery over n entities of kind N with IDs 1
+// to n, skipping at most maxSkip and returning at most maxBatch of them in
+// each batch, as the emulator may. Its cursors are positions in decimal.
+type fakeQueryEmulator struct {
+	n, maxSkip, maxBatch int
+	queries              []v1Query // received
+	cursor               string    // the last end cursor returned
+}
+
+func (f *fakeQueryEmulator) serve(t *testing.T, method string, body []byte) interface{} {
+	if method != "runQuery" {
+		t.Fatalf("unexpected call to %s", method)
+	}
+	var req struct {
+		Query v1Query `json:"query"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+	q := req.Query
+	f.queries = append(f.queries, q)
+	pos := 0
+	if q.StartCursor != "" {
+		pos, _ = strconv.Atoi(q.StartCursor)
+	}
+	skipped := 0
+	for skipped < int(q.Offset) && skipped < f.maxSkip && pos < f.n {
+		pos++
+		skipped++
+	}
+	var results []v1EntityResult
+	if skipped == int(q.Offset) {
+		for (q.Limit == nil || len(results) < int(*q.Limit)) && len(results) < f.maxBatch && pos < f.n {
+			pos++
+			results = append(results, v1EntityResult{Entity: &v1Entity{Key: &v1Key{
+				PartitionID: &v1PartitionID{ProjectID: "testapp"},
+				Path:        []v1PathElement{{Kind: "N", ID: strconv.Itoa(pos)}},
+			}}})
+		}
+	}
+	more := "NO_MORE_RESULTS"
+	switch {
+	case q.Limit != nil && len(results) == int(*q.Limit):
+		more = "MORE_RESULTS_AFTER_LIMIT"
+	case pos < f.n:
+		more = "NOT_FINISHED"
+	}
+	f.cursor = strconv.Itoa(pos)
+	res := map[string]interface{}{
+		"skippedResults": skipped,
+		"entityResults":  results,
+		"endCursor":      f.cursor,
+		"moreResults":    more,
+	}
+	return map[string]interface{}{"batch": res}
+}
+
+func TestEmulatorRunQuery(t *testing.T) {
+	type batch struct {
+		offset int32
+		limit  int32 // -1 for none
+	}
+	tests := []struct {
+		name              string
+		start             string // cursor
+		offset, limit     int32  // -1 for no limit
+		maxSkip, maxBatch int
+		want              []string
+		skipped           int32
+		batches           []batch
+	}{
+		{"all in batches", "", 0, -1, 0, 3,
+			[]string{"N,1", "N,2", "N,3", "N,4", "N,5", "N,6", "N,7", "N,8", "N,9", "N,10"}, 0,
+			[]batch{{0, -1}, {0, -1}, {0, -1}, {0, -1}}},
+		{"offset in batches", "", 4, 3, 2, 10,
+			[]string{"N,5", "N,6", "N,7"}, 4,
+			[]batch{{4, 3}, {2, 3}}},
+		{"limit in batches", "", 2, 5, 10, 2,
+			[]string{"N,3", "N,4", "N,5", "N,6", "N,7"}, 2,
+			[]batch{{2, 5}, {0, 3}, {0, 1}}},
+		{"offset past the end", "", 12, -1, 5, 10,
+			nil, 10,
+			[]batch{{12, -1}, {7, -1}}},
+		{"zero limit", "", 0, 0, 10, 10,
+			nil, 0,
+			[]batch{{0, 0}}},
+		{"start cursor", "7", 1, -1, 10, 1,
+			[]string{"N,9", "N,10"}, 1,
+			[]batch{{1, -1}, {0, -1}}},
+	}
+	for _, tt := range tests {
+		f := &fakeQueryEmulator{n: 10, maxSkip: tt.maxSkip, maxBatch: tt.maxBatch}
+		s, stop := newTestEmulatorDatastore(func(method string, body []byte) interface{} {
+			return f.serve(t, method, body)
+		})
+		q := &datastorepb.Query{
+			App:     proto.String("dev~testapp"),
+			Kind:    proto.String("N"),
+			Offset:  proto.Int32(tt.offset),
+			Compile: proto.Bool(true),
+		}
+		if tt.limit >= 0 {
+			q.Limit = proto.Int32(tt.limit)
+		}
+		if tt.start != "" {
+			q.CompiledCursor = &datastorepb.CompiledCursor{Position: &datastorepb.CompiledCursor_Position{StartKey: proto.String(tt.start)}}
+		}
+		res := &datastorepb.QueryResult{}
+		err := s.call("RunQuery", q, res)
+		stop()
+		if err != nil {
+			t.Errorf("%s: RunQuery failed: %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, e := range res.Result {
+			got = append(got, refString(e.Key))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: RunQuery = %q, want %q", tt.name, got, tt.want)
+		}
+		if res.GetSkippedResults() != tt.skipped {
+			t.Errorf("%s: RunQuery skipped %d results, want %d", tt.name, res.GetSkippedResults(), tt.skipped)
+		}
+		var batches []batch
+		for _, vq := range f.queries {
+			b := batch{vq.Offset, -1}
+			if vq.Limit != nil {
+				b.limit = *vq.Limit
+			}
+			batches = append(batches, b)
+		}
+		if !reflect.DeepEqual(batches, tt.batches) {
+			t.Errorf("%s: RunQuery asked for the batches %v, want %v", tt.name, batches, tt.batches)
+		}
+		// The compiled cursor is the end cursor of the last batch.
+		if got := res.CompiledCursor.GetPosition().GetStartKey(); got != f.cursor {
+			t.Errorf("%s: RunQuery returned the cursor %q, want %q", tt.name, got, f.cursor)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// sdkURL is the download URL of a version of the App Engine SDK for Go,
+// given the OS, the architecture and the version.
+var sdkURL = "https://storage.googleapis.com/appengine-sdks/featured/go_appengine_sdk_%s_%s-%s.zip"
+
+var (
+	sdkMu       sync.Mutex
+	ensuredPath string // set by EnsureSDK; used when Options.SDKPath is empty
+)
+
+// sdkCacheDir returns the directory holding the SDKs downloaded by
+// EnsureSDK: $AETEST_SDK_CACHE if set, and a directory in the temporary
+// directory otherwise.
+func sdkCacheDir() string {
+	if dir := os.Getenv("AETEST_SDK_CACHE"); dir != "" {
+		return dir
+	}
+	return filepath.Join(tempDir(), "aetest-sdk")
+}
+
+// EnsureSDK makes the given version of the App Engine SDK, such as
+// "1.9.40", available in a cache directory, downloading it on first use,
+// and makes the contexts created afterwards without Options.SDKPath use
+// it. It returns the directory of the SDK.
+// The downloaded archive must have the SHA-256 checksum sum, in
+// hexadecimal, which depends on the OS and architecture the archive is
+// for; it is not unpacked otherwise. A cached SDK must have been
+// downloaded with the same checksum.
+// The cache directory is $AETEST_SDK_CACHE if set.
+func EnsureSDK(version, sum string) (string, error) {
+	if sum == "" {
+		return "", fmt.Errorf("aetest: no checksum given for SDK %s", version)
+	}
+	sdkMu.Lock()
+	defer sdkMu.Unlock()
+	dir := filepath.Join(sdkCacheDir(), version)
+	sdk := filepath.Join(dir, "go_appengine")
+	if !fileExists(filepath.Join(sdk, "dev_appserver.py")) {
+		if err := downloadSDK(version, sum, dir); err != nil {
+			return "", fmt.Errorf("aetest: unable to download SDK %s: %v", version, err)
+		}
+	}
+	cached, err := ioutil.ReadFile(filepath.Join(dir, sdkSumFile))
+	if err != nil || !strings.EqualFold(strings.TrimSpace(string(cached)), sum) {
+		return "", fmt.Errorf("aetest: SDK %s in %s was not downloaded with checksum %s", version, dir, sum)
+	}
+	ensuredPath = sdk
+	return sdk, nil
+}
+
+// sdkSumFile is the file that holds the checksum of the archive an SDK
+// was unpacked from, next to the SDK.
+const sdkSumFile = "archive.sha256"
+
+// ensuredSDK returns the directory of the SDK set by EnsureSDK, if any.
+func ensuredSDK() string {
+	sdkMu.Lock()
+	defer sdkMu.Unlock()
+	return ensuredPath
+}
+
+// downloadSDK downloads and extracts version of the SDK into dir, checking
+// the checksum of the archive against sum first. The archive is extracted
+// next to dir and renamed, so that dir never holds a partial SDK. If
+// another process has already done so, its SDK is kept.
+func downloadSDK(version, sum, dir string) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(dir), version+".zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	res, err := http.Get(fmt.Sprintf(sdkURL, runtime.GOOS, runtime.GOARCH, version))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", res.Request.URL, res.Status)
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), res.Body)
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, sum) {
+		return fmt.Errorf("%s: checksum %s, want %s", res.Request.URL, got, sum)
+	}
+
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), version+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := unzip(f, n, tmp); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, sdkSumFile), []byte(strings.ToLower(sum)+"\n"), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		if fileExists(filepath.Join(dir, "go_appengine", "dev_appserver.py")) {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// unzip extracts the zip archive of the given size read from r into dir.
+func unzip(r io.ReaderAt, size int64, dir string) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		path := filepath.Join(dir, zf.Name)
+		if !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return fmt.Errorf("invalid file name %q in archive", zf.Name)
+		}
+		if zf.FileInfo().IsDir() {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := unzipFile(zf, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unzipFile(zf *zip.File, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	r, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, zf.Mode()|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,82 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnsureSDK(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("go_appengine/dev_appserver.py")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("# dev_appserver.py\n"))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(buf.Bytes())
+	sum := hex.EncodeToString(h[:])
+
+	downloads := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		w.Write(buf.Bytes())
+	}))
+	defer srv.Close()
+	defer func(u string) { sdkURL = u }(sdkURL)
+	sdkURL = srv.URL + "/%s_%s-%s.zip"
+
+	cache, err := ioutil.TempDir("", "aetest-sdk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+	defer os.Setenv("AETEST_SDK_CACHE", os.Getenv("AETEST_SDK_CACHE"))
+	os.Setenv("AETEST_SDK_CACHE", cache)
+	defer func(p string) { ensuredPath = p }(ensuredSDK())
+
+	if _, err := EnsureSDK("1.0.0", ""); err == nil || downloads != 0 {
+		t.Errorf("EnsureSDK without a checksum = %v after %d downloads, want an error and none", err, downloads)
+	}
+	bad := hex.EncodeToString(make([]byte, sha256.Size))
+	if _, err := EnsureSDK("1.0.0", bad); err == nil {
+		t.Errorf("EnsureSDK with a wrong checksum succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(cache, "1.0.0")); !os.IsNotExist(err) {
+		t.Errorf("EnsureSDK with a wrong checksum unpacked the archive: %v", err)
+	}
+
+	dir, err := EnsureSDK("1.0.0", sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(cache, "1.0.0", "go_appengine"); dir != want || ensuredSDK() != want {
+		t.Errorf("EnsureSDK = %q, SDK %q, want %q", dir, ensuredSDK(), want)
+	}
+	if !fileExists(filepath.Join(dir, "dev_appserver.py")) {
+		t.Errorf("dev_appserver.py was not unpacked")
+	}
+
+	// The cached SDK is only used with the checksum it was downloaded with.
+	n := downloads
+	if _, err := EnsureSDK("1.0.0", sum); err != nil || downloads != n {
+		t.Errorf("EnsureSDK of the cached SDK = %v after %d more downloads", err, downloads-n)
+	}
+	if _, err := EnsureSDK("1.0.0", bad); err == nil {
+		t.Errorf("EnsureSDK of the cached SDK with another checksum succeeded")
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"os"
+)
+
+// Environment is the environment of the app in production, as reported by
+// the functions of the appengine package. Empty fields take
+// production-like defaults.
+type Environment struct {
+	// DefaultVersionHostname is returned by
+	// appengine.DefaultVersionHostname. By default, "<app ID>.appspot.com".
+	DefaultVersionHostname string
+
+	// ServerSoftware is returned by appengine.ServerSoftware. By default,
+	// "Google App Engine/1.9.0".
+	ServerSoftware string
+
+	// Datacenter is returned by appengine.Datacenter. By default, "us6".
+	Datacenter string
+
+	// InstanceID is returned by appengine.InstanceID. By default, a
+	// random ID.
+	InstanceID string
+}
+
+// withDefaults returns a copy of e with its empty fields set to their
+// defaults.
+func (e *Environment) withDefaults(appID, instanceID string) *Environment {
+	d := *e
+	if d.DefaultVersionHostname == "" {
+		d.DefaultVersionHostname = appID + ".appspot.com"
+	}
+	if d.ServerSoftware == "" {
+		d.ServerSoftware = "Google App Engine/1.9.0"
+	}
+	if d.Datacenter == "" {
+		d.Datacenter = "us6"
+	}
+	if d.InstanceID == "" {
+		d.InstanceID = instanceID
+	}
+	return &d
+}
+
+// setenv sets the environment variables that appengine.ServerSoftware and
+// appengine.InstanceID read, which are shared by the whole test binary,
+// and returns a function that restores them.
+func (e *Environment) setenv() (restore func()) {
+	vars := map[string]string{
+		"SERVER_SOFTWARE": e.ServerSoftware,
+		"INSTANCE_ID":     e.InstanceID,
+	}
+	old := make(map[string]*string)
+	for k, v := range vars {
+		var ov *string // nil if unset
+		if s, ok := os.LookupEnv(k); ok {
+			ov = &s
+		}
+		old[k] = ov
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k, ov := range old {
+			if ov == nil {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, *ov)
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ErrSDKNotFound is returned by NewContext when dev_appserver.py is found
+// neither through Options.SDKPath and APPENGINE_DEV_APPSERVER, which are
+// unset, nor in the PATH or a Google Cloud SDK.
+var ErrSDKNotFound = errors.New("aetest: could not find dev_appserver.py")
+
+// ErrStartupTimeout is returned by NewContext when the child process does
+// not report its URLs in time.
+type ErrStartupTimeout struct {
+	// Missing names the servers whose URL was not reported: "API server"
+	// or "admin server".
+	Missing []string
+	// Stderr is the end of the output of the child process.
+	Stderr []byte
+}
+
+func (e *ErrStartupTimeout) Error() string {
+	if len(e.Missing) == 0 {
+		return "aetest: timeout starting child process"
+	}
+	return "aetest: timeout starting child process; no URL reported for the " + strings.Join(e.Missing, " and ")
+}
+
+// ErrChildExited is returned by NewContext when the child process exits
+// before reporting its URLs.
+type ErrChildExited struct {
+	State *os.ProcessState
+	// Stderr is the end of the output of the child process.
+	Stderr []byte
+}
+
+func (e *ErrChildExited) Error() string {
+	return "aetest: child process exited during startup: " + e.State.String()
+}
+
+// maxTail is the amount of output kept by a tailBuffer.
+const maxTail = 64 << 10
+
+// tailBuffer keeps the end of what is written to it.
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if n := len(t.buf) - maxTail; n > 0 {
+		t.buf = append(t.buf[:0], t.buf[n:]...)
+	}
+	return len(p), nil
+}
+
+// Bytes returns a copy of the kept output.
+func (t *tailBuffer) Bytes() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]byte(nil), t.buf...)
+}
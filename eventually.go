@@ -0,0 +1,39 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"fmt"
+	"time"
+)
+
+// eventuallyInterval is the delay between two checks of the condition of
+// Eventually.
+const eventuallyInterval = 10 * time.Millisecond
+
+// Eventually calls cond until it returns true or an error, or until
+// timeout has elapsed. Between two calls, it applies the pending
+// datastore writes of c, so that a condition on the results of queries
+// is met as soon as the writes it depends on are visible, even with an
+// eventually consistent Options.ConsistencyPolicy.
+//
+// It returns the error returned by cond, or an error if the condition is
+// still not met after timeout.
+func Eventually(c *Instance, cond func() (bool, error), timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := cond()
+		if err != nil || ok {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("aetest: condition not met after %v", timeout)
+		}
+		if err := c.ApplyPendingWrites(); err != nil {
+			return err
+		}
+		time.Sleep(eventuallyInterval)
+	}
+}
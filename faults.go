@@ -0,0 +1,65 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"appengine_internal"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// fault is a step of the error script of a method.
+type fault struct {
+	err   *appengine_internal.APIError // nil to let the calls through
+	times int                          // negative for every call
+}
+
+// InjectError makes the next times calls to the given method of
+// service fail with err, without reaching the service. A nil err
+// lets the calls through, and a negative times applies to every
+// call from then on. Successive calls for the same method queue
+// up, so that, for instance, injecting nil twice and then a
+// timeout once makes only the third call fail.
+func (c *Instance) InjectError(service, method string, err *appengine_internal.APIError, times int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if times == 0 {
+		return
+	}
+	if c.faults == nil {
+		c.faults = make(map[string][]*fault)
+	}
+	k := service + "." + method
+	c.faults[k] = append(c.faults[k], &fault{err: err, times: times})
+}
+
+// nextFault advances the error script of a method and returns the error
+// the call should fail with, if any.
+func (c *Instance) nextFault(service, method string) *appengine_internal.APIError {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := service + "." + method
+	script := c.faults[k]
+	if len(script) == 0 {
+		return nil
+	}
+	f := script[0]
+	if f.times > 0 {
+		f.times--
+		if f.times == 0 {
+			c.faults[k] = script[1:]
+		}
+	}
+	return f.err
+}
+
+// injectErrors fails the calls selected by InjectError without sending
+// them to the API server.
+func (c *Instance) injectErrors(service, method string, in, out proto.Message, next func() error) error {
+	if err := c.nextFault(service, method); err != nil {
+		e := *err
+		return &e
+	}
+	return next()
+}
@@ -0,0 +1,262 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+/*
+Package fixtures loads datastore entities from a declarative JSON or
+YAML file.
+
+A fixture file holds a list of entities:
+
+	[
+		{
+			"key": ["Author", "alice"],
+			"properties": {
+				"Name": "Alice",
+				"Born": {"time": "1970-01-01T00:00:00Z"},
+				"Tags": ["go", "appengine"]
+			}
+		},
+		{
+			"key": ["Author", "alice", "Post", 1],
+			"namespace": "blog",
+			"properties": {
+				"Title": "Hello",
+				"Body": "A long text",
+				"Author": {"key": ["Author", "alice"]}
+			},
+			"noindex": ["Body"]
+		}
+	]
+
+The same file in YAML reads:
+
+	---
+	- key: [Author, alice]
+	  properties:
+	    Name: Alice
+	    Born: {time: "1970-01-01T00:00:00Z"}
+	    Tags: [go, appengine]
+	- key: [Author, alice, Post, 1]
+	  namespace: blog
+	  properties:
+	    Title: Hello
+	    Body: A long text
+	    Author: {key: [Author, alice]}
+	  noindex: [Body]
+
+A file whose first character other than white space is '[' is read as
+JSON, and any other file as YAML. Only the subset of YAML above is
+understood: block and flow collections, and plain and quoted scalars that
+fit on one line.
+
+A key is a path of alternating kinds and IDs, starting at the root entity.
+IDs are either string names or integers; a final kind without an ID makes
+the datastore allocate one.
+
+Property values may be strings, numbers, booleans or null. Integral
+numbers are stored as int64 and other numbers as float64. A list stores a
+multi-valued property. Objects with a single member hold the other types:
+"time" (an RFC 3339 string), "key" (a key path in the entity's
+namespace) and "bytes" (base64-encoded data).
+*/
+package fixtures
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// entity is an entity as written in a fixture file.
+type entity struct {
+	Key        []interface{}          `json:"key"`
+	Namespace  string                 `json:"namespace"`
+	Properties map[string]interface{} `json:"properties"`
+	NoIndex    []string               `json:"noindex"`
+}
+
+// maxPut is the largest number of entities stored in one call.
+const maxPut = 500
+
+// LoadDatastore stores the entities of the fixture file read from r.
+func LoadDatastore(c appengine.Context, r io.Reader) error {
+	entities, err := decode(r)
+	if err != nil {
+		return fmt.Errorf("fixtures: %v", err)
+	}
+
+	// Entities are stored in batches of entities that share a namespace.
+	var (
+		keys  []*datastore.Key
+		props []datastore.PropertyList
+		nsc   appengine.Context
+		ns    string
+	)
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		_, err := datastore.PutMulti(nsc, keys, props)
+		keys, props = nil, nil
+		return err
+	}
+	for i, e := range entities {
+		if nsc == nil || e.Namespace != ns || len(keys) == maxPut {
+			if err := flush(); err != nil {
+				return err
+			}
+			var err error
+			if nsc, err = appengine.Namespace(c, e.Namespace); err != nil {
+				return err
+			}
+			ns = e.Namespace
+		}
+		k, err := newKey(nsc, e.Key)
+		if err != nil {
+			return fmt.Errorf("fixtures: entity %d: %v", i, err)
+		}
+		p, err := properties(nsc, e)
+		if err != nil {
+			return fmt.Errorf("fixtures: entity %d: %v", i, err)
+		}
+		keys = append(keys, k)
+		props = append(props, p)
+	}
+	return flush()
+}
+
+// decode reads the entities of a JSON or YAML fixture file.
+func decode(r io.Reader) ([]entity, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		// The YAML values are those of a JSON file, which
+		// encoding/json turns into entities.
+		v, err := parseYAML(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var entities []entity
+	if err := dec.Decode(&entities); err != nil {
+		return nil, err
+	}
+	return entities, nil
+}
+
+// newKey converts a key path to a key. A path with an odd number of
+// elements denotes an incomplete key.
+func newKey(c appengine.Context, path []interface{}) (*datastore.Key, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("empty key")
+	}
+	var k *datastore.Key
+	for i := 0; i < len(path); i += 2 {
+		kind, ok := path[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("key kind %v is not a string", path[i])
+		}
+		if i+1 == len(path) {
+			return datastore.NewIncompleteKey(c, kind, k), nil
+		}
+		switch id := path[i+1].(type) {
+		case string:
+			k = datastore.NewKey(c, kind, id, 0, k)
+		case json.Number:
+			n, err := id.Int64()
+			if err != nil {
+				return nil, fmt.Errorf("key ID %v is not an integer", id)
+			}
+			k = datastore.NewKey(c, kind, "", n, k)
+		case nil:
+			return nil, fmt.Errorf("key ID of kind %q is null, as in a golden file that ignores IDs", kind)
+		default:
+			return nil, fmt.Errorf("key ID %v is neither a string nor an integer", id)
+		}
+	}
+	return k, nil
+}
+
+// properties converts the properties of e.
+func properties(c appengine.Context, e entity) (datastore.PropertyList, error) {
+	noIndex := make(map[string]bool)
+	for _, name := range e.NoIndex {
+		noIndex[name] = true
+	}
+	var props datastore.PropertyList
+	for name, v := range e.Properties {
+		values, multiple := v.([]interface{})
+		if !multiple {
+			values = []interface{}{v}
+		}
+		for _, v := range values {
+			pv, err := value(c, v)
+			if err != nil {
+				return nil, fmt.Errorf("property %q: %v", name, err)
+			}
+			props = append(props, datastore.Property{
+				Name:     name,
+				Value:    pv,
+				NoIndex:  noIndex[name],
+				Multiple: multiple,
+			})
+		}
+	}
+	return props, nil
+}
+
+// value converts a JSON property value to a datastore property value.
+func value(c appengine.Context, v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case nil, string, bool:
+		return v, nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+		return v.Float64()
+	case map[string]interface{}:
+		if len(v) != 1 {
+			return nil, fmt.Errorf("typed value must have exactly one member")
+		}
+		for typ, x := range v {
+			switch typ {
+			case "time":
+				s, ok := x.(string)
+				if !ok {
+					return nil, fmt.Errorf("time %v is not a string", x)
+				}
+				return time.Parse(time.RFC3339Nano, s)
+			case "key":
+				path, ok := x.([]interface{})
+				if !ok {
+					return nil, fmt.Errorf("key %v is not a list", x)
+				}
+				return newKey(c, path)
+			case "bytes":
+				s, ok := x.(string)
+				if !ok {
+					return nil, fmt.Errorf("bytes %v is not a string", x)
+				}
+				return base64.StdEncoding.DecodeString(s)
+			}
+			return nil, fmt.Errorf("unknown value type %q", typ)
+		}
+	}
+	return nil, fmt.Errorf("unsupported value %v", v)
+}
@@ -0,0 +1,234 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package fixtures
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine_internal"
+)
+
+// keyContext is an appengine.Context good enough to make keys with.
+type keyContext struct {
+	appengine.Context
+}
+
+func (keyContext) FullyQualifiedAppID() string { return "dev~testapp" }
+
+func (keyContext) Call(service, method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	return nil
+}
+
+func TestNewKey(t *testing.T) {
+	c := keyContext{}
+	alice := datastore.NewKey(c, "Author", "alice", 0, nil)
+	tests := []struct {
+		path []interface{}
+		want *datastore.Key
+	}{
+		{
+			[]interface{}{"Author", "alice"},
+			alice,
+		},
+		{
+			[]interface{}{"Author", json.Number("7")},
+			datastore.NewKey(c, "Author", "", 7, nil),
+		},
+		{
+			[]interface{}{"Author", "alice", "Post", json.Number("1")},
+			datastore.NewKey(c, "Post", "", 1, alice),
+		},
+		{
+			[]interface{}{"Author", "alice", "Post", "7"},
+			datastore.NewKey(c, "Post", "7", 0, alice),
+		},
+		{
+			[]interface{}{"Author"},
+			datastore.NewIncompleteKey(c, "Author", nil),
+		},
+		{
+			[]interface{}{"Author", "alice", "Post"},
+			datastore.NewIncompleteKey(c, "Post", alice),
+		},
+	}
+	for _, tt := range tests {
+		got, err := newKey(c, tt.path)
+		if err != nil {
+			t.Errorf("newKey(%v) failed: %v", tt.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("newKey(%v) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	bad := [][]interface{}{
+		nil,
+		{json.Number("1"), "alice"},
+		{"Author", json.Number("1.5")},
+		{"Author", true},
+		{"Author", "alice", nil, "x"},
+	}
+	for _, path := range bad {
+		if k, err := newKey(c, path); err == nil {
+			t.Errorf("newKey(%v) = %v, want an error", path, k)
+		}
+	}
+}
+
+func TestValue(t *testing.T) {
+	c := keyContext{}
+	tests := []struct {
+		in   interface{}
+		want interface{}
+	}{
+		{nil, nil},
+		{"text", "text"},
+		{true, true},
+		{json.Number("42"), int64(42)},
+		{json.Number("-1"), int64(-1)},
+		{json.Number("2.5"), 2.5},
+		{json.Number("1e3"), 1000.0},
+		{map[string]interface{}{"time": "2014-03-01T12:30:00Z"}, time.Date(2014, 3, 1, 12, 30, 0, 0, time.UTC)},
+		{map[string]interface{}{"key": []interface{}{"Author", "alice"}}, datastore.NewKey(c, "Author", "alice", 0, nil)},
+		{map[string]interface{}{"bytes": "AAEC"}, []byte{0, 1, 2}},
+	}
+	for _, tt := range tests {
+		got, err := value(c, tt.in)
+		if err != nil {
+			t.Errorf("value(%v) failed: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("value(%v) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+
+	bad := []interface{}{
+		map[string]interface{}{},
+		map[string]interface{}{"time": "yesterday"},
+		map[string]interface{}{"time": json.Number("1")},
+		map[string]interface{}{"key": "Author"},
+		map[string]interface{}{"bytes": "!"},
+		map[string]interface{}{"blob": "x"},
+		map[string]interface{}{"time": "2014-03-01T12:30:00Z", "bytes": "AAEC"},
+		[]interface{}{"nested"},
+	}
+	for _, in := range bad {
+		if v, err := value(c, in); err == nil {
+			t.Errorf("value(%v) = %v, want an error", in, v)
+		}
+	}
+}
+
+const jsonFixture = `[
+	{
+		"key": ["Author", "alice"],
+		"properties": {
+			"Name": "Alice",
+			"Born": {"time": "1970-01-01T00:00:00Z"},
+			"Tags": ["go", "appengine"]
+		}
+	},
+	{
+		"key": ["Author", "alice", "Post", 1],
+		"namespace": "blog",
+		"properties": {
+			"Title": "Hello",
+			"Body": "A long text",
+			"Author": {"key": ["Author", "alice"]}
+		},
+		"noindex": ["Body"]
+	}
+]`
+
+const yamlFixture = `---
+# The entities of jsonFixture.
+- key: [Author, alice]
+  properties:
+    Name: 'Alice'
+    Born: {time: "1970-01-01T00:00:00Z"}
+    Tags:
+    - go
+    - appengine
+- key:
+    - Author
+    - alice
+    - Post
+    - 1
+  namespace: blog   # a comment
+  properties:
+    Title: Hello
+    Body: "A long text"
+    Author: {key: [Author, alice]}
+  noindex: [Body]
+`
+
+func TestDecode(t *testing.T) {
+	want, err := decode(strings.NewReader(jsonFixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != 2 || want[1].Namespace != "blog" {
+		t.Fatalf("decode of the JSON fixture = %+v", want)
+	}
+	got, err := decode(strings.NewReader(yamlFixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decode of the YAML fixture = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		in   string
+		want interface{}
+	}{
+		{"", nil},
+		{"a", "a"},
+		{"[]", []interface{}{}},
+		{"- 1\n- -2.5\n- true\n- ~\n- 'it''s'\n- \"a\\\"b\"", []interface{}{json.Number("1"), json.Number("-2.5"), true, nil, "it's", `a"b`}},
+		{"a: 1\nb:\n  c: x y\n", map[string]interface{}{"a": json.Number("1"), "b": map[string]interface{}{"c": "x y"}}},
+		{"a:\n- 1\n- 2\nb: {}", map[string]interface{}{"a": []interface{}{json.Number("1"), json.Number("2")}, "b": map[string]interface{}{}}},
+		{"a:\nb: [x, [y], {z: 1},]", map[string]interface{}{"a": nil, "b": []interface{}{"x", []interface{}{"y"}, map[string]interface{}{"z": json.Number("1")}}}},
+		{"-\n  - a\n- - b\n  - c", []interface{}{[]interface{}{"a"}, []interface{}{"b", "c"}}},
+		{"url: http://example.com/#x # comment\n'k: v': \"# not a comment\"", map[string]interface{}{"url": "http://example.com/#x", "k: v": "# not a comment"}},
+	}
+	for _, tt := range tests {
+		got, err := parseYAML(strings.NewReader(tt.in))
+		if err != nil {
+			t.Errorf("parseYAML(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseYAML(%q) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+
+	bad := []string{
+		"a: 1\n  b: 2",
+		"a: 1\na: 2",
+		"- 1\nb: 2",
+		"[1, 2",
+		"{a 1}",
+		"a: 'unterminated",
+		"a: |\n  text",
+		"a: *alias",
+		"\ta: 1",
+	}
+	for _, in := range bad {
+		if v, err := parseYAML(strings.NewReader(in)); err == nil {
+			t.Errorf("parseYAML(%q) = %#v, want an error", in, v)
+		}
+	}
+}
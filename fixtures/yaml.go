@@ -0,0 +1,394 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package fixtures
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// yamlLine is a line of a YAML file, without its indentation and comment.
+type yamlLine struct {
+	num    int // 1-based
+	indent int
+	text   string
+}
+
+// parseYAML parses the subset of YAML that fixture files use into the
+// values encoding/json decodes with UseNumber: block sequences and
+// mappings, flow sequences and mappings written on one line, and plain,
+// single-quoted and double-quoted scalars. Multi-line scalars, anchors,
+// tags and multiple documents are not supported.
+func parseYAML(r io.Reader) (interface{}, error) {
+	var lines []yamlLine
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		s := sc.Text()
+		text := strings.TrimLeft(s, " ")
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("line %d: tab in indentation", n)
+		}
+		text = strings.TrimSpace(stripComment(text))
+		if text == "" || n == 1 && text == "---" {
+			continue
+		}
+		lines = append(lines, yamlLine{num: n, indent: len(s) - len(strings.TrimLeft(s, " ")), text: text})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	p := &yamlParser{lines: lines}
+	v, err := p.node(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.i < len(p.lines) {
+		return nil, p.errorf("unexpected %q", p.lines[p.i].text)
+	}
+	return v, nil
+}
+
+// stripComment removes the comment that ends s, if any.
+func stripComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' '):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	i     int // the next line
+}
+
+func (p *yamlParser) errorf(format string, args ...interface{}) error {
+	n := 0
+	if p.i < len(p.lines) {
+		n = p.lines[p.i].num
+	} else if len(p.lines) > 0 {
+		n = p.lines[len(p.lines)-1].num
+	}
+	return fmt.Errorf("line %d: %s", n, fmt.Sprintf(format, args...))
+}
+
+// isItem reports whether text is an item of a block sequence.
+func isItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// node parses the node whose first line is the next one, indented by
+// indent.
+func (p *yamlParser) node(indent int) (interface{}, error) {
+	l := p.lines[p.i]
+	if l.indent != indent {
+		return nil, p.errorf("bad indentation")
+	}
+	switch {
+	case isItem(l.text):
+		return p.sequence(indent)
+	case mappingKey(l.text) >= 0:
+		return p.mapping(indent)
+	}
+	p.i++
+	return flowValue(l.text)
+}
+
+// sequence parses a block sequence indented by indent.
+func (p *yamlParser) sequence(indent int) (interface{}, error) {
+	list := []interface{}{}
+	for p.i < len(p.lines) && p.lines[p.i].indent == indent && isItem(p.lines[p.i].text) {
+		l := p.lines[p.i]
+		rest := strings.TrimLeft(strings.TrimPrefix(l.text, "-"), " ")
+		if rest == "" {
+			p.i++
+			v, err := p.child(indent, false)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+			continue
+		}
+		// The rest of the line is the first line of a node indented
+		// by its column.
+		col := indent + len(l.text) - len(rest)
+		p.lines[p.i] = yamlLine{num: l.num, indent: col, text: rest}
+		v, err := p.node(col)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+// mapping parses a block mapping indented by indent.
+func (p *yamlParser) mapping(indent int) (interface{}, error) {
+	m := make(map[string]interface{})
+	for p.i < len(p.lines) && p.lines[p.i].indent == indent && !isItem(p.lines[p.i].text) {
+		l := p.lines[p.i]
+		i := mappingKey(l.text)
+		if i < 0 {
+			return nil, p.errorf("mapping key expected, found %q", l.text)
+		}
+		key, err := flowValue(l.text[:i])
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		k, ok := key.(string)
+		if !ok {
+			k = fmt.Sprint(key)
+		}
+		if _, dup := m[k]; dup {
+			return nil, p.errorf("duplicate key %q", k)
+		}
+		p.i++
+		rest := strings.TrimSpace(l.text[i+1:])
+		if rest != "" {
+			if m[k], err = flowValue(rest); err != nil {
+				return nil, p.errorf("%v", err)
+			}
+			continue
+		}
+		if m[k], err = p.child(indent, true); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// child parses the node nested under a line indented by indent, or returns
+// nil if there is none. The items of a sequence nested under a mapping key
+// may be indented as the key is.
+func (p *yamlParser) child(indent int, inMapping bool) (interface{}, error) {
+	if p.i == len(p.lines) {
+		return nil, nil
+	}
+	l := p.lines[p.i]
+	if l.indent > indent || inMapping && l.indent == indent && isItem(l.text) {
+		return p.node(l.indent)
+	}
+	return nil, nil
+}
+
+// mappingKey returns the index of the colon that ends the key of a
+// mapping entry, or -1 if text is not one.
+func mappingKey(text string) int {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case i == 0 && (c == '"' || c == '\''):
+			quote = c
+		case i == 0 && (c == '[' || c == '{'):
+			return -1
+		case c == ':' && (i+1 == len(text) || text[i+1] == ' '):
+			return i
+		}
+	}
+	return -1
+}
+
+// flowValue parses a scalar or a flow collection that makes up s.
+func flowValue(s string) (interface{}, error) {
+	f := &flowParser{s: s}
+	v, err := f.value()
+	if err != nil {
+		return nil, err
+	}
+	if f.skipSpace(); f.i < len(f.s) {
+		return nil, fmt.Errorf("unexpected %q", f.s[f.i:])
+	}
+	return v, nil
+}
+
+type flowParser struct {
+	s     string
+	i     int
+	depth int // of nested flow collections
+}
+
+func (f *flowParser) skipSpace() {
+	for f.i < len(f.s) && f.s[f.i] == ' ' {
+		f.i++
+	}
+}
+
+func (f *flowParser) value() (interface{}, error) {
+	f.skipSpace()
+	if f.i == len(f.s) {
+		return nil, nil
+	}
+	switch f.s[f.i] {
+	case '[':
+		return f.sequence()
+	case '{':
+		return f.mapping()
+	case '"', '\'':
+		return f.quoted()
+	}
+	return f.plain()
+}
+
+func (f *flowParser) sequence() (interface{}, error) {
+	f.i++ // [
+	f.depth++
+	defer func() { f.depth-- }()
+	list := []interface{}{}
+	for {
+		f.skipSpace()
+		if f.i == len(f.s) {
+			return nil, fmt.Errorf("unterminated flow sequence")
+		}
+		if f.s[f.i] == ']' {
+			f.i++
+			return list, nil
+		}
+		if len(list) > 0 {
+			if f.s[f.i] != ',' {
+				return nil, fmt.Errorf("',' expected in flow sequence, found %q", f.s[f.i:])
+			}
+			f.i++
+			f.skipSpace()
+			if f.i < len(f.s) && f.s[f.i] == ']' {
+				continue
+			}
+		}
+		v, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+}
+
+func (f *flowParser) mapping() (interface{}, error) {
+	f.i++ // {
+	f.depth++
+	defer func() { f.depth-- }()
+	m := make(map[string]interface{})
+	for {
+		f.skipSpace()
+		if f.i == len(f.s) {
+			return nil, fmt.Errorf("unterminated flow mapping")
+		}
+		if f.s[f.i] == '}' {
+			f.i++
+			return m, nil
+		}
+		if len(m) > 0 {
+			if f.s[f.i] != ',' {
+				return nil, fmt.Errorf("',' expected in flow mapping, found %q", f.s[f.i:])
+			}
+			f.i++
+			f.skipSpace()
+			if f.i < len(f.s) && f.s[f.i] == '}' {
+				continue
+			}
+		}
+		key, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		k, ok := key.(string)
+		if !ok {
+			k = fmt.Sprint(key)
+		}
+		f.skipSpace()
+		if f.i == len(f.s) || f.s[f.i] != ':' {
+			return nil, fmt.Errorf("':' expected after key %q", k)
+		}
+		f.i++
+		if m[k], err = f.value(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// quoted parses a single-quoted or double-quoted scalar.
+func (f *flowParser) quoted() (interface{}, error) {
+	q := f.s[f.i]
+	for j := f.i + 1; j < len(f.s); j++ {
+		switch {
+		case q == '"' && f.s[j] == '\\':
+			j++
+		case f.s[j] == q && q == '\'' && j+1 < len(f.s) && f.s[j+1] == '\'':
+			j++
+		case f.s[j] == q:
+			raw := f.s[f.i : j+1]
+			f.i = j + 1
+			if q == '\'' {
+				return strings.Replace(raw[1:len(raw)-1], "''", "'", -1), nil
+			}
+			var s string
+			if err := json.Unmarshal([]byte(raw), &s); err != nil {
+				return nil, fmt.Errorf("invalid string %s", raw)
+			}
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("unterminated string %s", f.s[f.i:])
+}
+
+var (
+	yamlInt   = regexp.MustCompile(`^[-+]?[0-9]+$`)
+	yamlFloat = regexp.MustCompile(`^[-+]?([0-9]+(\.[0-9]*)?|\.[0-9]+)([eE][-+]?[0-9]+)?$`)
+)
+
+// plain parses a plain scalar, which ends at the end of s or, in a flow
+// collection, at a flow indicator.
+func (f *flowParser) plain() (interface{}, error) {
+	j := f.i
+	for j < len(f.s) && (f.depth == 0 || strings.IndexByte(",[]{}", f.s[j]) < 0) {
+		if f.depth > 0 && f.s[j] == ':' && (j+1 == len(f.s) || f.s[j+1] == ' ') {
+			break
+		}
+		j++
+	}
+	s := strings.TrimSpace(f.s[f.i:j])
+	f.i = j
+	if s == "" {
+		return nil, fmt.Errorf("value expected, found %q", f.s[j:])
+	}
+	switch s {
+	case "null", "Null", "NULL", "~":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if yamlInt.MatchString(s) || yamlFloat.MatchString(s) {
+		return json.Number(strings.TrimPrefix(s, "+")), nil
+	}
+	switch s[0] {
+	case '&', '*', '!', '|', '>', '%', '@', '`':
+		return nil, fmt.Errorf("unsupported YAML %q", s)
+	}
+	return s, nil
+}
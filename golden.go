@@ -0,0 +1,214 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"appengine/datastore"
+)
+
+var update = flag.Bool("aetest.update", false, "rewrite the golden files of AssertDatastoreGolden")
+
+// GoldenOptions controls how AssertDatastoreGolden normalizes the datastore
+// before comparing it with a golden file.
+type GoldenOptions struct {
+	// IgnoreIDs replaces integer key IDs, which the datastore may
+	// allocate differently on every run, with null.
+	IgnoreIDs bool
+	// IgnoreTimes replaces time values with {"time": null}.
+	IgnoreTimes bool
+	// IgnoreProperties lists the names of properties to leave out.
+	IgnoreProperties []string
+	// Kinds lists the kinds to compare. If empty, every kind is compared.
+	Kinds []string
+}
+
+// goldenEntity is an entity as written in a golden file. The format is
+// that of the fixtures package.
+type goldenEntity struct {
+	Key        []interface{}          `json:"key"`
+	Namespace  string                 `json:"namespace,omitempty"`
+	Properties map[string]interface{} `json:"properties"`
+	NoIndex    []string               `json:"noindex,omitempty"`
+}
+
+// AssertDatastoreGolden reports an error to t unless the entities in the
+// datastore match the golden file at path. The file uses the format of the
+// fixtures package, with null standing for the values ignored by opts,
+// which the fixtures package refuses to load.
+// Running the test with -aetest.update rewrites the file instead.
+func AssertDatastoreGolden(t testing.TB, c *Instance, path string, opts *GoldenOptions) {
+	if opts == nil {
+		opts = &GoldenOptions{}
+	}
+	s, err := c.SnapshotDatastore()
+	if err != nil {
+		t.Errorf("aetest: unable to read the datastore: %v", err)
+		return
+	}
+	got, err := encodeGolden(s, opts)
+	if err != nil {
+		t.Errorf("aetest: unable to encode the datastore: %v", err)
+		return
+	}
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Errorf("aetest: unable to write golden file: %v", err)
+			return
+		}
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Errorf("aetest: unable to write golden file: %v", err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Errorf("aetest: unable to read golden file (run with -aetest.update to create it): %v", err)
+		return
+	}
+	if bytes.Equal(got, want) {
+		return
+	}
+	gl, wl := strings.Split(string(got), "\n"), strings.Split(string(want), "\n")
+	for i := 0; ; i++ {
+		var g, w string
+		if i < len(gl) {
+			g = gl[i]
+		}
+		if i < len(wl) {
+			w = wl[i]
+		}
+		if g != w {
+			t.Errorf("aetest: datastore does not match golden file %s at line %d:\n\tgot:  %s\n\twant: %s", path, i+1, g, w)
+			return
+		}
+	}
+}
+
+// encodeGolden returns the normalized golden file contents for s.
+func encodeGolden(s Snapshot, opts *GoldenOptions) ([]byte, error) {
+	kinds := make(map[string]bool)
+	for _, k := range opts.Kinds {
+		kinds[k] = true
+	}
+	ignored := make(map[string]bool)
+	for _, name := range opts.IgnoreProperties {
+		ignored[name] = true
+	}
+
+	entities := []goldenEntity{}
+	for _, e := range s.Entities {
+		if len(kinds) > 0 && !kinds[e.Key.Kind()] {
+			continue
+		}
+		ge := goldenEntity{
+			Key:        keyPath(e.Key, opts),
+			Namespace:  e.Key.Namespace(),
+			Properties: make(map[string]interface{}),
+		}
+		noIndex := make(map[string]bool)
+		for _, p := range e.Properties {
+			if ignored[p.Name] {
+				continue
+			}
+			v := goldenValue(p.Value, opts)
+			if p.Multiple {
+				values, _ := ge.Properties[p.Name].([]interface{})
+				ge.Properties[p.Name] = append(values, v)
+			} else {
+				ge.Properties[p.Name] = v
+			}
+			if p.NoIndex && !noIndex[p.Name] {
+				noIndex[p.Name] = true
+				ge.NoIndex = append(ge.NoIndex, p.Name)
+			}
+		}
+		sort.Strings(ge.NoIndex)
+		entities = append(entities, ge)
+	}
+
+	encode := func(v interface{}) ([]byte, error) {
+		return json.MarshalIndent(v, "", "\t")
+	}
+	if opts.IgnoreIDs {
+		// Without IDs, the datastore's key order no longer determines
+		// the order of the entities, so order them by their encoding.
+		encoded := make([]string, len(entities))
+		for i, ge := range entities {
+			b, err := encode(ge)
+			if err != nil {
+				return nil, err
+			}
+			encoded[i] = string(b)
+		}
+		sort.Sort(byEncoding{entities, encoded})
+	}
+	b, err := encode(entities)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// byEncoding sorts entities by their encoded form.
+type byEncoding struct {
+	entities []goldenEntity
+	encoded  []string
+}
+
+func (s byEncoding) Len() int           { return len(s.entities) }
+func (s byEncoding) Less(i, j int) bool { return s.encoded[i] < s.encoded[j] }
+func (s byEncoding) Swap(i, j int) {
+	s.entities[i], s.entities[j] = s.entities[j], s.entities[i]
+	s.encoded[i], s.encoded[j] = s.encoded[j], s.encoded[i]
+}
+
+// keyPath returns k as a path of alternating kinds and IDs.
+func keyPath(k *datastore.Key, opts *GoldenOptions) []interface{} {
+	var path []interface{}
+	for ; k != nil; k = k.Parent() {
+		var id interface{}
+		switch {
+		case k.StringID() != "":
+			id = k.StringID()
+		case opts.IgnoreIDs:
+			id = nil
+		default:
+			id = k.IntID()
+		}
+		path = append([]interface{}{k.Kind(), id}, path...)
+	}
+	return path
+}
+
+// goldenValue converts a datastore property value to its golden form.
+func goldenValue(v interface{}, opts *GoldenOptions) interface{} {
+	switch v := v.(type) {
+	case time.Time:
+		if opts.IgnoreTimes {
+			return map[string]interface{}{"time": nil}
+		}
+		return map[string]interface{}{"time": v.UTC().Format(time.RFC3339Nano)}
+	case *datastore.Key:
+		return map[string]interface{}{"key": keyPath(v, opts)}
+	case []byte:
+		return map[string]interface{}{"bytes": base64.StdEncoding.EncodeToString(v)}
+	case nil, string, bool, int64, float64:
+		return v
+	}
+	return fmt.Sprint(v)
+}
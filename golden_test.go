@@ -0,0 +1,142 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"appengine/datastore"
+
+	"github.com/jeisenberg/aetest/fixtures"
+)
+
+func TestEncodeGolden(t *testing.T) {
+	c := keyContext{}
+	alice := datastore.NewKey(c, "Author", "alice", 0, nil)
+	post1 := datastore.NewKey(c, "Post", "", 1, alice)
+	post2 := datastore.NewKey(c, "Post", "", 2, alice)
+	born := time.Date(1970, 1, 1, 0, 0, 0, 0, time.FixedZone("CET", 3600))
+	s := Snapshot{Entities: []Entity{
+		{Key: alice, Properties: datastore.PropertyList{
+			{Name: "Tags", Value: "go", Multiple: true},
+			{Name: "Name", Value: "Alice"},
+			{Name: "Tags", Value: "appengine", Multiple: true},
+			{Name: "Born", Value: born},
+			{Name: "Secret", Value: []byte{0, 1, 2}, NoIndex: true},
+		}},
+		{Key: post1, Properties: datastore.PropertyList{
+			{Name: "Title", Value: "B"},
+			{Name: "Author", Value: alice},
+			{Name: "Views", Value: int64(3)},
+		}},
+		{Key: post2, Properties: datastore.PropertyList{
+			{Name: "Title", Value: "A"},
+			{Name: "Body", Value: "text", NoIndex: true},
+			{Name: "Score", Value: 0.5, NoIndex: true},
+		}},
+	}}
+
+	got, err := encodeGolden(s, &GoldenOptions{IgnoreProperties: []string{"Views"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[
+	{
+		"key": [
+			"Author",
+			"alice"
+		],
+		"properties": {
+			"Born": {
+				"time": "1969-12-31T23:00:00Z"
+			},
+			"Name": "Alice",
+			"Secret": {
+				"bytes": "AAEC"
+			},
+			"Tags": [
+				"go",
+				"appengine"
+			]
+		},
+		"noindex": [
+			"Secret"
+		]
+	},
+	{
+		"key": [
+			"Author",
+			"alice",
+			"Post",
+			1
+		],
+		"properties": {
+			"Author": {
+				"key": [
+					"Author",
+					"alice"
+				]
+			},
+			"Title": "B"
+		}
+	},
+	{
+		"key": [
+			"Author",
+			"alice",
+			"Post",
+			2
+		],
+		"properties": {
+			"Body": "text",
+			"Score": 0.5,
+			"Title": "A"
+		},
+		"noindex": [
+			"Body",
+			"Score"
+		]
+	}
+]
+`
+	if string(got) != want {
+		t.Errorf("encodeGolden = %s, want %s", got, want)
+	}
+
+	// Without their IDs, the posts are ordered by their encoding, whatever
+	// the order of the snapshot.
+	opts := &GoldenOptions{IgnoreIDs: true, IgnoreTimes: true, Kinds: []string{"Post"}}
+	got, err = encodeGolden(s, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	swapped := Snapshot{Entities: []Entity{s.Entities[2], s.Entities[0], s.Entities[1]}}
+	got2, err := encodeGolden(swapped, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, got2) {
+		t.Errorf("encodeGolden depends on the order of the snapshot:\n%s\n%s", got, got2)
+	}
+	if i, j := bytes.Index(got, []byte(`"Views"`)), bytes.Index(got, []byte(`"Body"`)); i < 0 || j < i {
+		t.Errorf("encodeGolden did not order the posts by their encoding: %s", got)
+	}
+	if !bytes.Contains(got, []byte("\"Post\",\n\t\t\tnull\n")) || bytes.Contains(got, []byte("Alice")) {
+		t.Errorf("encodeGolden = %s, want the posts only, with null IDs", got)
+	}
+
+	// The fixtures package refuses the values a golden file ignores.
+	got, err = encodeGolden(s, &GoldenOptions{IgnoreTimes: true, Kinds: []string{"Author"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range [][]byte{got, got2} {
+		if err := fixtures.LoadDatastore(c, bytes.NewReader(b)); err == nil {
+			t.Errorf("fixtures.LoadDatastore loaded a golden file with ignored values:\n%s", b)
+		}
+	}
+}
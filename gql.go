@@ -0,0 +1,391 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// GQL runs a GQL query, such as
+//
+//	SELECT * FROM Order WHERE Customer = KEY('Customer', 'alice') AND Total > 100 ORDER BY Total DESC LIMIT 10
+//
+// in c's namespace and returns the matched entities. SELECT __key__ only
+// sets their keys, and a projection only the projected properties.
+// Values are strings in quotes, integers, floats, TRUE, FALSE, NULL,
+// KEY('Kind', 'name' or id, ...), KEY('encoded key') and
+// DATETIME('2006-01-02 15:04:05'), in UTC. The != and IN operators, which
+// the datastore package does not support, and bound arguments are not
+// supported.
+func GQL(c appengine.Context, query string) ([]Entity, error) {
+	p := &gqlParser{c: c, toks: tokenizeGQL(query)}
+	q, keysOnly, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("aetest: invalid GQL query %q: %v", query, err)
+	}
+	var entities []Entity
+	for t := q.Run(c); ; {
+		var e Entity
+		var err error
+		if keysOnly {
+			e.Key, err = t.Next(nil)
+		} else {
+			e.Key, err = t.Next(&e.Properties)
+		}
+		if err == datastore.Done {
+			return entities, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, e)
+	}
+}
+
+// tokenizeGQL splits a GQL query into identifiers, keywords, numbers,
+// quoted strings, which keep their quotes, and punctuation.
+func tokenizeGQL(s string) []string {
+	var toks []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'' || c == '"' || c == '`':
+			j := i + 1
+			for j < len(s) && (s[j] != c || j+1 < len(s) && s[j+1] == c) {
+				if s[j] == '\\' || s[j] == c {
+					// An escaped or doubled quote.
+					j++
+				}
+				j++
+			}
+			if j < len(s) {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		case strings.HasPrefix(s[i:], "<=") || strings.HasPrefix(s[i:], ">=") || strings.HasPrefix(s[i:], "!="):
+			toks = append(toks, s[i:i+2])
+			i += 2
+		case strings.IndexByte("*,()=<>", c) >= 0:
+			toks = append(toks, s[i:i+1])
+			i++
+		default:
+			j := i + 1
+			for j < len(s) && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || strings.IndexByte("_.-+", s[j]) >= 0) {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		}
+	}
+	return toks
+}
+
+type gqlParser struct {
+	c    appengine.Context
+	toks []string
+}
+
+func (p *gqlParser) peek() string {
+	if len(p.toks) == 0 {
+		return ""
+	}
+	return p.toks[0]
+}
+
+func (p *gqlParser) next() string {
+	t := p.peek()
+	if len(p.toks) > 0 {
+		p.toks = p.toks[1:]
+	}
+	return t
+}
+
+// accept consumes the next token if it is the keyword or punctuation t.
+func (p *gqlParser) accept(t string) bool {
+	if strings.EqualFold(p.peek(), t) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *gqlParser) expect(t string) error {
+	if !p.accept(t) {
+		return fmt.Errorf("%s expected, found %q", t, p.peek())
+	}
+	return nil
+}
+
+// name returns the next token as a kind or property name.
+func (p *gqlParser) name() (string, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return "", fmt.Errorf("name expected")
+	case t[0] == '`':
+		return strings.Trim(t, "`"), nil
+	case strings.IndexByte(`'"*,()=<>!`, t[0]) >= 0:
+		return "", fmt.Errorf("name expected, found %q", t)
+	}
+	return t, nil
+}
+
+func (p *gqlParser) parse() (q *datastore.Query, keysOnly bool, err error) {
+	if err := p.expect("SELECT"); err != nil {
+		return nil, false, err
+	}
+	distinct := p.accept("DISTINCT")
+	var project []string
+	switch {
+	case p.accept("*"):
+	case p.accept("__key__"):
+		keysOnly = true
+	default:
+		for {
+			name, err := p.name()
+			if err != nil {
+				return nil, false, err
+			}
+			project = append(project, name)
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	if err := p.expect("FROM"); err != nil {
+		return nil, false, err
+	}
+	kind, err := p.name()
+	if err != nil {
+		return nil, false, err
+	}
+	q = datastore.NewQuery(kind)
+	switch {
+	case keysOnly:
+		q = q.KeysOnly()
+	case project != nil:
+		q = q.Project(project...)
+		if distinct {
+			q = q.Distinct()
+		}
+	}
+
+	if p.accept("WHERE") {
+		for {
+			if q, err = p.condition(q); err != nil {
+				return nil, false, err
+			}
+			if !p.accept("AND") {
+				break
+			}
+		}
+	}
+	if p.accept("ORDER") {
+		if err := p.expect("BY"); err != nil {
+			return nil, false, err
+		}
+		for {
+			name, err := p.name()
+			if err != nil {
+				return nil, false, err
+			}
+			if p.accept("DESC") {
+				name = "-" + name
+			} else {
+				p.accept("ASC")
+			}
+			q = q.Order(name)
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	if p.accept("LIMIT") {
+		n, err := p.int()
+		if err != nil {
+			return nil, false, err
+		}
+		if p.accept(",") {
+			// LIMIT offset, count
+			q = q.Offset(n)
+			if n, err = p.int(); err != nil {
+				return nil, false, err
+			}
+		}
+		q = q.Limit(n)
+	}
+	if p.accept("OFFSET") {
+		n, err := p.int()
+		if err != nil {
+			return nil, false, err
+		}
+		q = q.Offset(n)
+	}
+	if t := p.peek(); t != "" {
+		return nil, false, fmt.Errorf("unexpected %q", t)
+	}
+	return q, keysOnly, nil
+}
+
+func (p *gqlParser) int() (int, error) {
+	t := p.next()
+	n, err := strconv.Atoi(t)
+	if err != nil {
+		return 0, fmt.Errorf("integer expected, found %q", t)
+	}
+	return n, nil
+}
+
+// condition parses a condition of the WHERE clause and adds it to q.
+func (p *gqlParser) condition(q *datastore.Query) (*datastore.Query, error) {
+	if p.accept("ANCESTOR") {
+		if err := p.expect("IS"); err != nil {
+			return nil, err
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		k, ok := v.(*datastore.Key)
+		if !ok {
+			return nil, fmt.Errorf("ANCESTOR IS needs a key")
+		}
+		return q.Ancestor(k), nil
+	}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	op := p.next()
+	switch op {
+	case "=", "<", "<=", ">", ">=":
+	case "!=":
+		return nil, fmt.Errorf("the != operator is not supported")
+	default:
+		if strings.EqualFold(op, "IN") {
+			return nil, fmt.Errorf("the IN operator is not supported")
+		}
+		return nil, fmt.Errorf("operator expected, found %q", op)
+	}
+	v, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	return q.Filter(name+" "+op, v), nil
+}
+
+// unquote returns the content of a quoted string token.
+func unquote(t string) (string, bool) {
+	if len(t) < 2 || (t[0] != '\'' && t[0] != '"') || t[len(t)-1] != t[0] {
+		return "", false
+	}
+	s := t[1 : len(t)-1]
+	// Quotes are escaped by doubling them or with a backslash.
+	s = strings.Replace(s, string(t[0])+string(t[0]), string(t[0]), -1)
+	s = strings.Replace(s, `\`+string(t[0]), string(t[0]), -1)
+	return s, true
+}
+
+func (p *gqlParser) value() (interface{}, error) {
+	t := p.next()
+	if s, ok := unquote(t); ok {
+		return s, nil
+	}
+	switch strings.ToUpper(t) {
+	case "TRUE":
+		return true, nil
+	case "FALSE":
+		return false, nil
+	case "NULL":
+		return nil, nil
+	case "KEY":
+		return p.key()
+	case "DATETIME":
+		args, err := p.args()
+		if err != nil {
+			return nil, err
+		}
+		if len(args) != 1 {
+			return nil, fmt.Errorf("DATETIME needs one string")
+		}
+		s, _ := args[0].(string)
+		d, err := time.Parse("2006-01-02 15:04:05", s)
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+	if n, err := strconv.ParseInt(t, 10, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(t, 64); err == nil {
+		return f, nil
+	}
+	return nil, fmt.Errorf("value expected, found %q", t)
+}
+
+// args parses the parenthesized arguments of a function.
+func (p *gqlParser) args() ([]interface{}, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var args []interface{}
+	for !p.accept(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+	return args, nil
+}
+
+func (p *gqlParser) key() (*datastore.Key, error) {
+	args, err := p.args()
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 1 {
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("KEY needs an encoded key or kind and ID pairs")
+		}
+		return datastore.DecodeKey(s)
+	}
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, fmt.Errorf("KEY needs an encoded key or kind and ID pairs")
+	}
+	var k *datastore.Key
+	for i := 0; i < len(args); i += 2 {
+		kind, ok := args[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("KEY kinds must be strings")
+		}
+		switch id := args[i+1].(type) {
+		case string:
+			k = datastore.NewKey(p.c, kind, id, 0, k)
+		case int64:
+			k = datastore.NewKey(p.c, kind, "", id, k)
+		default:
+			return nil, fmt.Errorf("KEY IDs must be strings or integers")
+		}
+	}
+	return k, nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine_internal"
+)
+
+// keyContext is an appengine.Context good enough to make keys with.
+type keyContext struct {
+	appengine.Context
+}
+
+func (keyContext) FullyQualifiedAppID() string { return "dev~testapp" }
+
+func (keyContext) Call(service, method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	return nil
+}
+
+func TestTokenizeGQL(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"SELECT * FROM Order", []string{"SELECT", "*", "FROM", "Order"}},
+		{"SELECT a,b FROM `My Kind`", []string{"SELECT", "a", ",", "b", "FROM", "`My Kind`"}},
+		{"WHERE a>=1 AND b<=-2.5 AND c!=x", []string{"WHERE", "a", ">=", "1", "AND", "b", "<=", "-2.5", "AND", "c", "!=", "x"}},
+		{"a<1 AND b>2 AND c=3", []string{"a", "<", "1", "AND", "b", ">", "2", "AND", "c", "=", "3"}},
+		{"x = 'it''s' AND y = \"a \\\" b\"", []string{"x", "=", "'it''s'", "AND", "y", "=", `"a \" b"`}},
+		{"KEY('Customer', 'alice')", []string{"KEY", "(", "'Customer'", ",", "'alice'", ")"}},
+		{"\tLIMIT\n5,\r10", []string{"LIMIT", "5", ",", "10"}},
+		{"'a''''b' c", []string{"'a''''b'", "c"}},
+		{"'' c", []string{"''", "c"}},
+		{"'unterminated", []string{"'unterminated"}},
+	}
+	for _, tt := range tests {
+		if got := tokenizeGQL(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenizeGQL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUnquote(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{`'abc'`, "abc", true},
+		{`"abc"`, "abc", true},
+		{`''`, "", true},
+		{`'it''s'`, "it's", true},
+		{`'it\'s'`, "it's", true},
+		{`"say ""hi"""`, `say "hi"`, true},
+		{`"it's"`, "it's", true},
+		{"`name`", "", false},
+		{`'abc"`, "", false},
+		{`'`, "", false},
+		{`abc`, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := unquote(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("unquote(%s) = %q, %v, want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseGQL(t *testing.T) {
+	c := keyContext{}
+	alice := datastore.NewKey(c, "Customer", "alice", 0, nil)
+	order := datastore.NewKey(c, "Order", "", 7, alice)
+	tests := []struct {
+		query    string
+		want     *datastore.Query
+		keysOnly bool
+	}{
+		{
+			"SELECT * FROM Order",
+			datastore.NewQuery("Order"), false,
+		},
+		{
+			"select * from Order",
+			datastore.NewQuery("Order"), false,
+		},
+		{
+			"SELECT __key__ FROM Order",
+			datastore.NewQuery("Order").KeysOnly(), true,
+		},
+		{
+			"SELECT Total, Customer FROM `Order`",
+			datastore.NewQuery("Order").Project("Total", "Customer"), false,
+		},
+		{
+			"SELECT DISTINCT Customer FROM Order",
+			datastore.NewQuery("Order").Project("Customer").Distinct(), false,
+		},
+		{
+			"SELECT * FROM Order WHERE Total > 100 AND Paid = TRUE AND Note = NULL AND Rate <= 0.5 AND Name = 'bob'",
+			datastore.NewQuery("Order").
+				Filter("Total >", int64(100)).
+				Filter("Paid =", true).
+				Filter("Note =", nil).
+				Filter("Rate <=", 0.5).
+				Filter("Name =", "bob"), false,
+		},
+		{
+			"SELECT * FROM Order WHERE Customer = KEY('Customer', 'alice')",
+			datastore.NewQuery("Order").Filter("Customer =", alice), false,
+		},
+		{
+			"SELECT * FROM Item WHERE Order = KEY('Customer', 'alice', 'Order', 7)",
+			datastore.NewQuery("Item").Filter("Order =", order), false,
+		},
+		{
+			"SELECT * FROM Item WHERE ANCESTOR IS KEY('" + order.Encode() + "')",
+			datastore.NewQuery("Item").Ancestor(order), false,
+		},
+		{
+			"SELECT * FROM Order WHERE Date >= DATETIME('2014-03-01 12:30:00')",
+			datastore.NewQuery("Order").Filter("Date >=", time.Date(2014, 3, 1, 12, 30, 0, 0, time.UTC)), false,
+		},
+		{
+			"SELECT * FROM Order ORDER BY Total DESC, Date ASC, Name",
+			datastore.NewQuery("Order").Order("-Total").Order("Date").Order("Name"), false,
+		},
+		{
+			"SELECT * FROM Order LIMIT 10",
+			datastore.NewQuery("Order").Limit(10), false,
+		},
+		{
+			"SELECT * FROM Order LIMIT 5, 10",
+			datastore.NewQuery("Order").Offset(5).Limit(10), false,
+		},
+		{
+			"SELECT * FROM Order LIMIT 10 OFFSET 5",
+			datastore.NewQuery("Order").Limit(10).Offset(5), false,
+		},
+		{
+			"SELECT * FROM Order OFFSET 5",
+			datastore.NewQuery("Order").Offset(5), false,
+		},
+	}
+	for _, tt := range tests {
+		p := &gqlParser{c: c, toks: tokenizeGQL(tt.query)}
+		q, keysOnly, err := p.parse()
+		if err != nil {
+			t.Errorf("parse(%q) failed: %v", tt.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(q, tt.want) || keysOnly != tt.keysOnly {
+			t.Errorf("parse(%q) = %+v, %v, want %+v, %v", tt.query, q, keysOnly, tt.want, tt.keysOnly)
+		}
+	}
+}
+
+func TestParseGQLErrors(t *testing.T) {
+	queries := []string{
+		"",
+		"DELETE FROM Order",
+		"SELECT * Order",
+		"SELECT * FROM",
+		"SELECT a, FROM Order",
+		"SELECT * FROM Order WHERE",
+		"SELECT * FROM Order WHERE Total != 1",
+		"SELECT * FROM Order WHERE Total IN (1, 2)",
+		"SELECT * FROM Order WHERE Total ~ 1",
+		"SELECT * FROM Order WHERE Total = bogus",
+		"SELECT * FROM Order WHERE ANCESTOR = KEY('Customer', 'alice')",
+		"SELECT * FROM Order WHERE ANCESTOR IS 'alice'",
+		"SELECT * FROM Order WHERE Customer = KEY()",
+		"SELECT * FROM Order WHERE Customer = KEY(1, 'alice')",
+		"SELECT * FROM Order WHERE Customer = KEY('Customer', TRUE)",
+		"SELECT * FROM Order WHERE Customer = KEY('Customer' 'alice')",
+		"SELECT * FROM Order WHERE Date = DATETIME('2014-03-01')",
+		"SELECT * FROM Order WHERE Date = DATETIME('a', 'b')",
+		"SELECT * FROM Order ORDER Total",
+		"SELECT * FROM Order LIMIT ten",
+		"SELECT * FROM Order LIMIT 5,",
+		"SELECT * FROM Order OFFSET",
+		"SELECT * FROM Order LIMIT 10 extra",
+	}
+	for _, query := range queries {
+		p := &gqlParser{c: keyContext{}, toks: tokenizeGQL(query)}
+		if _, _, err := p.parse(); err == nil {
+			t.Errorf("parse(%q) succeeded, want an error", query)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"net/http"
+	"sync"
+)
+
+// requestContexts holds the contexts of the requests served by the
+// handlers of WrapHandler.
+var requestContexts = struct {
+	sync.Mutex
+	m map[*http.Request]*Instance
+}{m: make(map[*http.Request]*Instance)}
+
+// WrapHandler returns a handler that serves the requests with h, in the
+// test process, for instance behind an httptest.Server. Each request gets
+// the context returned by c.ContextForRequest; h gets it with
+// RequestContext.
+func WrapHandler(c *Instance, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWithContext(c.ContextForRequest(r), h, w, r)
+	})
+}
+
+// serveWithContext serves r with h, with rc as the context of r.
+func serveWithContext(rc *Instance, h http.Handler, w http.ResponseWriter, r *http.Request) {
+	requestContexts.Lock()
+	requestContexts.m[r] = rc
+	requestContexts.Unlock()
+	defer func() {
+		requestContexts.Lock()
+		delete(requestContexts.m, r)
+		requestContexts.Unlock()
+	}()
+	h.ServeHTTP(w, r)
+}
+
+// RequestContext returns the context of r, a request being served by a
+// handler of WrapHandler, in place of appengine.NewContext(r). It returns
+// nil for other requests, including copies of r.
+func RequestContext(r *http.Request) *Instance {
+	requestContexts.Lock()
+	defer requestContexts.Unlock()
+	return requestContexts.m[r]
+}
+
+// ContextForRequest returns a context derived from this one that
+// acts as r, as appengine.NewContext(r) does in production: its
+// Request is a copy of r, it acts as the user of the
+// X-AppEngine-User-* headers of r, and it uses the namespace of its
+// X-AppEngine-Current-Namespace header, if any, or else that of the
+// context, and the default namespace of its
+// X-AppEngine-Default-Namespace header.
+func (c *Instance) ContextForRequest(r *http.Request) *Instance {
+	d := c.Derive()
+	req := new(http.Request)
+	*req = *r
+	req.Header = make(http.Header, len(r.Header))
+	for k, v := range r.Header {
+		req.Header[k] = v
+	}
+	d.req = req
+	d.namespace = c.currentNamespace()
+	if ns := r.Header.Get("X-AppEngine-Current-Namespace"); ns != "" && validNamespace.MatchString(ns) {
+		d.namespace = ns
+	}
+	return d
+}
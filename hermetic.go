@@ -0,0 +1,41 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"appengine_internal"
+	"code.google.com/p/goprotobuf/proto"
+
+	remoteapipb "appengine_internal/remote_api"
+)
+
+// A CallHandler serves the API calls to a service in-process, in place of
+// the API server. It fills out with the response to the call of method
+// with the request in.
+type CallHandler func(method string, in, out proto.Message) error
+
+// hermeticHandlers returns the in-process services used in hermetic mode,
+// keyed by service name.
+func (c *Instance) hermeticHandlers() map[string]CallHandler {
+	ds := newDatastoreStub()
+	tq := newTaskqueueStub(c.opts.QueueYAML)
+	// Transactional tasks are added once their transaction commits.
+	ds.ended = tq.endTransaction
+	return map[string]CallHandler{
+		"datastore_v3": ds.call,
+		"memcache":     newMemcacheStub(c.Now).call,
+		"taskqueue":    tq.call,
+		"user":         userStub,
+	}
+}
+
+// callNotFound is the error returned for calls to a service or method that
+// has no in-process implementation.
+func callNotFound(service, method string) error {
+	return &appengine_internal.CallError{
+		Detail: "The API call " + service + "." + method + "() is not implemented in hermetic mode.",
+		Code:   int32(remoteapipb.RpcError_CALL_NOT_FOUND),
+	}
+}
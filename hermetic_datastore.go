@@ -0,0 +1,741 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+
+	"appengine_internal"
+	"code.google.com/p/goprotobuf/proto"
+
+	datastorepb "appengine_internal/datastore"
+)
+
+// datastoreStub is an in-memory implementation of the datastore_v3
+// service. It is strongly consistent, and allocates integer IDs
+// sequentially. Every entity group has a version, bumped by every write,
+// that transactions use to detect conflicting commits.
+type datastoreStub struct {
+	mu         sync.Mutex
+	entities   map[string]*datastorepb.EntityProto // keyed by refKey
+	versions   map[string]int64                    // keyed by refRoot
+	txns       map[uint64]*stubTxn                 // keyed by handle
+	lastID     int64
+	lastHandle uint64
+
+	// ended, if set, is called when a transaction commits or fails to,
+	// or is rolled back, with s.mu held.
+	ended func(handle uint64, committed bool)
+}
+
+// stubTxn is a transaction of the datastoreStub.
+type stubTxn struct {
+	// versions holds the version of every entity group the transaction
+	// touched, as of its first access.
+	versions map[string]int64
+	// writes holds the entities to put, or nil for the entities to
+	// delete, keyed by refKey.
+	writes map[string]*datastorepb.EntityProto
+	// written holds the entity groups written to, keyed by refRoot.
+	written map[string]bool
+}
+
+func newDatastoreStub() *datastoreStub {
+	return &datastoreStub{
+		entities: make(map[string]*datastorepb.EntityProto),
+		versions: make(map[string]int64),
+		txns:     make(map[uint64]*stubTxn),
+	}
+}
+
+func datastoreStubError(code datastorepb.Error_ErrorCode, detail string) error {
+	return &appengine_internal.APIError{
+		Service: "datastore_v3",
+		Detail:  detail,
+		Code:    int32(code),
+	}
+}
+
+func (s *datastoreStub) call(method string, in, out proto.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch method {
+	case "Get":
+		return s.get(in.(*datastorepb.GetRequest), out.(*datastorepb.GetResponse))
+	case "Put":
+		return s.put(in.(*datastorepb.PutRequest), out.(*datastorepb.PutResponse))
+	case "Delete":
+		return s.delete(in.(*datastorepb.DeleteRequest))
+	case "RunQuery":
+		return s.runQuery(in.(*datastorepb.Query), out.(*datastorepb.QueryResult))
+	case "Next":
+		// Every query returns all of its results in the first batch.
+		res := out.(*datastorepb.QueryResult)
+		res.Cursor = in.(*datastorepb.NextRequest).Cursor
+		res.MoreResults = proto.Bool(false)
+		return nil
+	case "DeleteCursor":
+		return nil
+	case "BeginTransaction":
+		s.lastHandle++
+		s.txns[s.lastHandle] = &stubTxn{
+			versions: make(map[string]int64),
+			writes:   make(map[string]*datastorepb.EntityProto),
+			written:  make(map[string]bool),
+		}
+		res := out.(*datastorepb.Transaction)
+		res.Handle = proto.Uint64(s.lastHandle)
+		res.App = in.(*datastorepb.BeginTransactionRequest).App
+		return nil
+	case "Commit":
+		return s.commit(in.(*datastorepb.Transaction))
+	case "Rollback":
+		h := in.(*datastorepb.Transaction).GetHandle()
+		if _, ok := s.txns[h]; ok {
+			delete(s.txns, h)
+			s.end(h, false)
+		}
+		return nil
+	case "AllocateIds":
+		req := in.(*datastorepb.AllocateIdsRequest)
+		res := out.(*datastorepb.AllocateIdsResponse)
+		res.Start = proto.Int64(s.lastID + 1)
+		if req.GetSize() > 0 {
+			s.lastID += req.GetSize()
+		} else if req.GetMax() > s.lastID {
+			s.lastID = req.GetMax()
+		}
+		res.End = proto.Int64(s.lastID)
+		return nil
+	}
+	return callNotFound("datastore_v3", method)
+}
+
+// txn returns the open transaction tx refers to, if any.
+func (s *datastoreStub) txn(tx *datastorepb.Transaction) (*stubTxn, error) {
+	if tx == nil {
+		return nil, nil
+	}
+	t := s.txns[tx.GetHandle()]
+	if t == nil {
+		return nil, datastoreStubError(datastorepb.Error_BAD_REQUEST, "transaction has expired or is invalid")
+	}
+	return t, nil
+}
+
+// refKey returns a string that identifies the entity ref refers to.
+func refKey(ref *datastorepb.Reference) string {
+	var b bytes.Buffer
+	b.WriteString(ref.GetNameSpace())
+	for _, e := range ref.GetPath().GetElement() {
+		fmt.Fprintf(&b, "\x00%s\x00%d\x00%s", e.GetType(), e.GetId(), e.GetName())
+	}
+	return b.String()
+}
+
+// refRoot returns the refKey of the root entity of ref's entity group.
+func refRoot(ref *datastorepb.Reference) string {
+	root := &datastorepb.Reference{
+		NameSpace: ref.NameSpace,
+		Path:      &datastorepb.Path{Element: ref.GetPath().GetElement()},
+	}
+	if len(root.Path.Element) > 1 {
+		root.Path.Element = root.Path.Element[:1]
+	}
+	return refKey(root)
+}
+
+// touch records the version of the entity group of ref in t.
+func (s *datastoreStub) touch(t *stubTxn, ref *datastorepb.Reference) {
+	root := refRoot(ref)
+	if _, ok := t.versions[root]; !ok {
+		t.versions[root] = s.versions[root]
+	}
+}
+
+func (s *datastoreStub) get(req *datastorepb.GetRequest, res *datastorepb.GetResponse) error {
+	t, err := s.txn(req.Transaction)
+	if err != nil {
+		return err
+	}
+	for _, k := range req.Key {
+		if t != nil {
+			s.touch(t, k)
+		}
+		e := s.entities[refKey(k)]
+		if e == nil {
+			res.Entity = append(res.Entity, &datastorepb.GetResponse_Entity{Key: k})
+			continue
+		}
+		res.Entity = append(res.Entity, &datastorepb.GetResponse_Entity{
+			Entity: proto.Clone(e).(*datastorepb.EntityProto),
+		})
+	}
+	return nil
+}
+
+func (s *datastoreStub) put(req *datastorepb.PutRequest, res *datastorepb.PutResponse) error {
+	t, err := s.txn(req.Transaction)
+	if err != nil {
+		return err
+	}
+	for _, e := range req.Entity {
+		e = proto.Clone(e).(*datastorepb.EntityProto)
+		elems := e.GetKey().GetPath().GetElement()
+		if len(elems) == 0 {
+			return datastoreStubError(datastorepb.Error_BAD_REQUEST, "entity key has an empty path")
+		}
+		if last := elems[len(elems)-1]; last.GetId() == 0 && last.GetName() == "" {
+			s.lastID++
+			last.Id = proto.Int64(s.lastID)
+		}
+		e.EntityGroup = &datastorepb.Path{Element: elems[:1]}
+		k := refKey(e.Key)
+		if t != nil {
+			s.touch(t, e.Key)
+			t.writes[k] = e
+			t.written[refRoot(e.Key)] = true
+		} else {
+			s.entities[k] = e
+			s.versions[refRoot(e.Key)]++
+		}
+		res.Key = append(res.Key, proto.Clone(e.Key).(*datastorepb.Reference))
+	}
+	return nil
+}
+
+func (s *datastoreStub) delete(req *datastorepb.DeleteRequest) error {
+	t, err := s.txn(req.Transaction)
+	if err != nil {
+		return err
+	}
+	for _, ref := range req.Key {
+		k := refKey(ref)
+		if t != nil {
+			s.touch(t, ref)
+			t.writes[k] = nil
+			t.written[refRoot(ref)] = true
+		} else {
+			delete(s.entities, k)
+			s.versions[refRoot(ref)]++
+		}
+	}
+	return nil
+}
+
+func (s *datastoreStub) commit(tx *datastorepb.Transaction) error {
+	t, err := s.txn(tx)
+	if err != nil {
+		return err
+	}
+	delete(s.txns, tx.GetHandle())
+	for root, v := range t.versions {
+		if s.versions[root] != v {
+			s.end(tx.GetHandle(), false)
+			return datastoreStubError(datastorepb.Error_CONCURRENT_TRANSACTION, "too much contention on these datastore entities. please try again.")
+		}
+	}
+	for k, e := range t.writes {
+		if e == nil {
+			delete(s.entities, k)
+		} else {
+			s.entities[k] = e
+		}
+	}
+	for root := range t.written {
+		s.versions[root]++
+	}
+	s.end(tx.GetHandle(), true)
+	return nil
+}
+
+// end reports the end of the transaction handle to s.ended.
+func (s *datastoreStub) end(handle uint64, committed bool) {
+	if s.ended != nil {
+		s.ended(handle, committed)
+	}
+}
+
+func (s *datastoreStub) runQuery(q *datastorepb.Query, res *datastorepb.QueryResult) error {
+	if len(q.PropertyName) > 0 || q.GetDistinct() {
+		return datastoreStubError(datastorepb.Error_BAD_REQUEST, "projection queries are not supported in hermetic mode")
+	}
+	t, err := s.txn(q.Transaction)
+	if err != nil {
+		return err
+	}
+	if t != nil {
+		if q.Ancestor == nil {
+			return datastoreStubError(datastorepb.Error_BAD_REQUEST, "Only ancestor queries are allowed inside transactions.")
+		}
+		s.touch(t, q.Ancestor)
+	}
+
+	var results []*datastorepb.EntityProto
+	for _, e := range s.candidates(q) {
+		if matchQuery(q, e) {
+			results = append(results, e)
+		}
+	}
+	sort.Sort(byQueryOrder{results, q.Order})
+	if c := q.CompiledCursor; c != nil && c.Position != nil {
+		i := 0
+		for i < len(results) && compareToPosition(results[i], c.Position, q.Order) <= 0 {
+			i++
+		}
+		results = results[i:]
+	}
+	if c := q.EndCompiledCursor; c != nil && c.Position != nil {
+		i := 0
+		for i < len(results) && compareToPosition(results[i], c.Position, q.Order) <= 0 {
+			i++
+		}
+		results = results[:i]
+	}
+
+	skipped := int(q.GetOffset())
+	if skipped > len(results) {
+		skipped = len(results)
+	}
+	rest := results[skipped:]
+	if q.Limit != nil && int(q.GetLimit()) < len(rest) {
+		rest = rest[:q.GetLimit()]
+	}
+	for _, e := range rest {
+		e = proto.Clone(e).(*datastorepb.EntityProto)
+		if q.GetKeysOnly() {
+			e.Property, e.RawProperty = nil, nil
+		}
+		res.Result = append(res.Result, e)
+	}
+	if skipped > 0 {
+		res.SkippedResults = proto.Int32(int32(skipped))
+	}
+	res.KeysOnly = q.KeysOnly
+	res.MoreResults = proto.Bool(false)
+	res.Cursor = &datastorepb.Cursor{Cursor: proto.Uint64(0), App: q.App}
+	if q.GetCompile() {
+		// The cursor points after the last result returned or skipped.
+		switch n := skipped + len(rest); {
+		case n > 0:
+			res.CompiledCursor = &datastorepb.CompiledCursor{
+				Position: position(results[n-1], q.Order),
+			}
+		case q.CompiledCursor != nil:
+			res.CompiledCursor = q.CompiledCursor
+		default:
+			res.CompiledCursor = &datastorepb.CompiledCursor{}
+		}
+	}
+	return nil
+}
+
+// candidates returns the entities a query may return before filtering,
+// including the entities of the __namespace__, __kind__ and __property__
+// metadata kinds.
+func (s *datastoreStub) candidates(q *datastorepb.Query) []*datastorepb.EntityProto {
+	var entities []*datastorepb.EntityProto
+	switch q.GetKind() {
+	case "__namespace__":
+		seen := make(map[string]bool)
+		for _, e := range s.entities {
+			ns := e.Key.GetNameSpace()
+			if seen[ns] {
+				continue
+			}
+			seen[ns] = true
+			elem := &datastorepb.Path_Element{Type: proto.String("__namespace__")}
+			if ns == "" {
+				elem.Id = proto.Int64(1)
+			} else {
+				elem.Name = proto.String(ns)
+			}
+			entities = append(entities, metadataEntity(q.GetApp(), "", elem))
+		}
+	case "__kind__":
+		seen := make(map[string]bool)
+		for _, e := range s.entities {
+			if e.Key.GetNameSpace() != q.GetNameSpace() {
+				continue
+			}
+			elems := e.Key.Path.Element
+			kind := elems[len(elems)-1].GetType()
+			if seen[kind] {
+				continue
+			}
+			seen[kind] = true
+			elem := &datastorepb.Path_Element{Type: proto.String("__kind__"), Name: proto.String(kind)}
+			entities = append(entities, metadataEntity(q.GetApp(), q.GetNameSpace(), elem))
+		}
+	case "__property__":
+		// The indexed properties of each kind, with the
+		// representations of their values.
+		reprs := make(map[[2]string]map[string]bool)
+		var props [][2]string
+		for _, e := range s.entities {
+			if e.Key.GetNameSpace() != q.GetNameSpace() {
+				continue
+			}
+			elems := e.Key.Path.Element
+			kind := elems[len(elems)-1].GetType()
+			for _, p := range e.Property {
+				k := [2]string{kind, p.GetName()}
+				if reprs[k] == nil {
+					reprs[k] = make(map[string]bool)
+					props = append(props, k)
+				}
+				reprs[k][representations[valueRank(p.Value)]] = true
+			}
+		}
+		for _, k := range props {
+			elem := &datastorepb.Path_Element{Type: proto.String("__kind__"), Name: proto.String(k[0])}
+			// The entity group is the __kind__ entity.
+			e := metadataEntity(q.GetApp(), q.GetNameSpace(), elem)
+			e.Key.Path = &datastorepb.Path{Element: []*datastorepb.Path_Element{elem, {
+				Type: proto.String("__property__"),
+				Name: proto.String(k[1]),
+			}}}
+			var names []string
+			for r := range reprs[k] {
+				names = append(names, r)
+			}
+			sort.Strings(names)
+			for _, r := range names {
+				e.Property = append(e.Property, &datastorepb.Property{
+					Name:     proto.String("property_representation"),
+					Value:    &datastorepb.PropertyValue{StringValue: proto.String(r)},
+					Multiple: proto.Bool(true),
+				})
+			}
+			entities = append(entities, e)
+		}
+	default:
+		for _, e := range s.entities {
+			entities = append(entities, e)
+		}
+	}
+	return entities
+}
+
+func metadataEntity(app, namespace string, elem *datastorepb.Path_Element) *datastorepb.EntityProto {
+	path := &datastorepb.Path{Element: []*datastorepb.Path_Element{elem}}
+	key := &datastorepb.Reference{App: proto.String(app), Path: path}
+	if namespace != "" {
+		key.NameSpace = proto.String(namespace)
+	}
+	return &datastorepb.EntityProto{Key: key, EntityGroup: path}
+}
+
+// matchQuery reports whether e satisfies the kind, namespace, ancestor,
+// filters and orders of q.
+func matchQuery(q *datastorepb.Query, e *datastorepb.EntityProto) bool {
+	elems := e.Key.GetPath().GetElement()
+	if q.GetKind() != "__namespace__" && e.Key.GetNameSpace() != q.GetNameSpace() {
+		return false
+	}
+	if q.Kind != nil && elems[len(elems)-1].GetType() != q.GetKind() {
+		return false
+	}
+	if q.Ancestor != nil {
+		anc := q.Ancestor.GetPath().GetElement()
+		if len(anc) > len(elems) || comparePaths(toPath(anc), toPath(elems[:len(anc)])) != 0 {
+			return false
+		}
+	}
+	for _, f := range q.Filter {
+		if len(f.Property) == 0 || !matchFilter(f, e) {
+			return false
+		}
+	}
+	// Entities without an indexed value for a sort order are not in the
+	// index the query scans.
+	for _, o := range q.Order {
+		if len(indexedValues(e, o.GetProperty())) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func matchFilter(f *datastorepb.Query_Filter, e *datastorepb.EntityProto) bool {
+	for _, v := range indexedValues(e, f.Property[0].GetName()) {
+		if f.GetOp() == datastorepb.Query_Filter_EXISTS {
+			return true
+		}
+		for _, p := range f.Property {
+			c := compareValues(v, p.Value)
+			var ok bool
+			switch f.GetOp() {
+			case datastorepb.Query_Filter_LESS_THAN:
+				ok = c < 0
+			case datastorepb.Query_Filter_LESS_THAN_OR_EQUAL:
+				ok = c <= 0
+			case datastorepb.Query_Filter_GREATER_THAN:
+				ok = c > 0
+			case datastorepb.Query_Filter_GREATER_THAN_OR_EQUAL:
+				ok = c >= 0
+			case datastorepb.Query_Filter_EQUAL, datastorepb.Query_Filter_IN:
+				ok = c == 0
+			}
+			if ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// indexedValues returns the indexed values of the named property of e. The
+// __key__ property holds the key of e.
+func indexedValues(e *datastorepb.EntityProto, name string) []*datastorepb.PropertyValue {
+	if name == "__key__" {
+		return []*datastorepb.PropertyValue{keyValue(e.Key)}
+	}
+	var values []*datastorepb.PropertyValue
+	for _, p := range e.Property {
+		if p.GetName() == name {
+			values = append(values, p.Value)
+		}
+	}
+	return values
+}
+
+func keyValue(ref *datastorepb.Reference) *datastorepb.PropertyValue {
+	rv := &datastorepb.PropertyValue_ReferenceValue{
+		App:       ref.App,
+		NameSpace: ref.NameSpace,
+	}
+	for _, elem := range ref.GetPath().GetElement() {
+		rv.Pathelement = append(rv.Pathelement, &datastorepb.PropertyValue_ReferenceValue_PathElement{
+			Type: elem.Type,
+			Id:   elem.Id,
+			Name: elem.Name,
+		})
+	}
+	return &datastorepb.PropertyValue{Referencevalue: rv}
+}
+
+// sortValue returns the value of the named property that determines the
+// position of e in the given direction, or nil if e has no such value.
+func sortValue(e *datastorepb.EntityProto, name string, dir datastorepb.Query_Order_Direction) *datastorepb.PropertyValue {
+	var best *datastorepb.PropertyValue
+	for _, v := range indexedValues(e, name) {
+		c := 0
+		if best != nil {
+			c = compareValues(v, best)
+		}
+		if best == nil || (dir == datastorepb.Query_Order_ASCENDING && c < 0) || (dir == datastorepb.Query_Order_DESCENDING && c > 0) {
+			best = v
+		}
+	}
+	return best
+}
+
+// byQueryOrder sorts entities by the orders of a query, then by key.
+type byQueryOrder struct {
+	entities []*datastorepb.EntityProto
+	orders   []*datastorepb.Query_Order
+}
+
+func (s byQueryOrder) Len() int      { return len(s.entities) }
+func (s byQueryOrder) Swap(i, j int) { s.entities[i], s.entities[j] = s.entities[j], s.entities[i] }
+func (s byQueryOrder) Less(i, j int) bool {
+	return compareToPosition(s.entities[i], position(s.entities[j], s.orders), s.orders) < 0
+}
+
+// position returns the cursor position of e in a query with the given
+// orders.
+func position(e *datastorepb.EntityProto, orders []*datastorepb.Query_Order) *datastorepb.CompiledCursor_Position {
+	pos := &datastorepb.CompiledCursor_Position{
+		Key:            proto.Clone(e.Key).(*datastorepb.Reference),
+		StartInclusive: proto.Bool(false),
+	}
+	for _, o := range orders {
+		v := sortValue(e, o.GetProperty(), o.GetDirection())
+		if v == nil {
+			v = &datastorepb.PropertyValue{}
+		}
+		pos.Indexvalue = append(pos.Indexvalue, &datastorepb.CompiledCursor_Position_IndexValue{
+			Property: o.Property,
+			Value:    v,
+		})
+	}
+	return pos
+}
+
+// compareToPosition compares the position of e in a query with the given
+// orders with pos.
+func compareToPosition(e *datastorepb.EntityProto, pos *datastorepb.CompiledCursor_Position, orders []*datastorepb.Query_Order) int {
+	for i, o := range orders {
+		if i >= len(pos.Indexvalue) {
+			break
+		}
+		v := sortValue(e, o.GetProperty(), o.GetDirection())
+		if v == nil {
+			v = &datastorepb.PropertyValue{}
+		}
+		c := compareValues(v, pos.Indexvalue[i].Value)
+		if o.GetDirection() == datastorepb.Query_Order_DESCENDING {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	if pos.Key == nil {
+		return 0
+	}
+	return comparePaths(toPath(e.Key.GetPath().GetElement()), toPath(pos.Key.GetPath().GetElement()))
+}
+
+// pathElem is an element of a key path.
+type pathElem struct {
+	kind string
+	id   int64
+	name string
+}
+
+func toPath(elems []*datastorepb.Path_Element) []pathElem {
+	path := make([]pathElem, len(elems))
+	for i, e := range elems {
+		path[i] = pathElem{e.GetType(), e.GetId(), e.GetName()}
+	}
+	return path
+}
+
+func refValuePath(rv *datastorepb.PropertyValue_ReferenceValue) []pathElem {
+	path := make([]pathElem, len(rv.Pathelement))
+	for i, e := range rv.Pathelement {
+		path[i] = pathElem{e.GetType(), e.GetId(), e.GetName()}
+	}
+	return path
+}
+
+// comparePaths compares key paths in datastore order: element by element,
+// by kind and then by identifier, with integer IDs before names.
+func comparePaths(a, b []pathElem) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		x, y := a[i], b[i]
+		if c := compareStrings(x.kind, y.kind); c != 0 {
+			return c
+		}
+		switch {
+		case x.name == "" && y.name != "":
+			return -1
+		case x.name != "" && y.name == "":
+			return 1
+		case x.name != "":
+			if c := compareStrings(x.name, y.name); c != 0 {
+				return c
+			}
+		case x.id != y.id:
+			if x.id < y.id {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+func compareStrings(a, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// representations names the types of property values, by valueRank, as
+// __property__ entities do.
+var representations = []string{"NULL", "INT64", "BOOLEAN", "STRING", "DOUBLE", "POINT", "USER", "REFERENCE"}
+
+// valueRank orders the types of property values as the datastore does.
+func valueRank(v *datastorepb.PropertyValue) int {
+	switch {
+	case v.Int64Value != nil:
+		return 1
+	case v.BooleanValue != nil:
+		return 2
+	case v.StringValue != nil:
+		return 3
+	case v.DoubleValue != nil:
+		return 4
+	case v.Pointvalue != nil:
+		return 5
+	case v.Uservalue != nil:
+		return 6
+	case v.Referencevalue != nil:
+		return 7
+	}
+	return 0
+}
+
+// compareValues compares property values in datastore order.
+func compareValues(a, b *datastorepb.PropertyValue) int {
+	ra, rb := valueRank(a), valueRank(b)
+	if ra != rb {
+		return ra - rb
+	}
+	switch ra {
+	case 1:
+		x, y := a.GetInt64Value(), b.GetInt64Value()
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	case 2:
+		x, y := a.GetBooleanValue(), b.GetBooleanValue()
+		switch {
+		case !x && y:
+			return -1
+		case x && !y:
+			return 1
+		}
+	case 3:
+		return bytes.Compare([]byte(a.GetStringValue()), []byte(b.GetStringValue()))
+	case 4:
+		x, y := a.GetDoubleValue(), b.GetDoubleValue()
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	case 5:
+		x, y := a.Pointvalue, b.Pointvalue
+		switch {
+		case x.GetX() != y.GetX():
+			if x.GetX() < y.GetX() {
+				return -1
+			}
+			return 1
+		case x.GetY() != y.GetY():
+			if x.GetY() < y.GetY() {
+				return -1
+			}
+			return 1
+		}
+	case 6:
+		if c := compareStrings(a.Uservalue.GetEmail(), b.Uservalue.GetEmail()); c != 0 {
+			return c
+		}
+		return compareStrings(a.Uservalue.GetAuthDomain(), b.Uservalue.GetAuthDomain())
+	case 7:
+		x, y := a.Referencevalue, b.Referencevalue
+		if c := compareStrings(x.GetNameSpace(), y.GetNameSpace()); c != 0 {
+			return c
+		}
+		return comparePaths(refValuePath(x), refValuePath(y))
+	}
+	return 0
+}
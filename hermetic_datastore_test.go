@@ -0,0 +1,509 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"appengine_internal"
+	"code.google.com/p/goprotobuf/proto"
+
+	datastorepb "appengine_internal/datastore"
+)
+
+// dsKey returns the key of the given path of kinds and IDs, which are
+// int64 IDs or string names, in namespace ns.
+func dsKey(ns string, path ...interface{}) *datastorepb.Reference {
+	ref := &datastorepb.Reference{App: proto.String("dev~testapp"), Path: &datastorepb.Path{}}
+	if ns != "" {
+		ref.NameSpace = proto.String(ns)
+	}
+	for i := 0; i < len(path); i += 2 {
+		elem := &datastorepb.Path_Element{Type: proto.String(path[i].(string))}
+		if i+1 < len(path) {
+			switch id := path[i+1].(type) {
+			case int:
+				elem.Id = proto.Int64(int64(id))
+			case string:
+				elem.Name = proto.String(id)
+			}
+		}
+		ref.Path.Element = append(ref.Path.Element, elem)
+	}
+	return ref
+}
+
+// dsValue returns the property value of v.
+func dsValue(v interface{}) *datastorepb.PropertyValue {
+	switch v := v.(type) {
+	case int:
+		return &datastorepb.PropertyValue{Int64Value: proto.Int64(int64(v))}
+	case bool:
+		return &datastorepb.PropertyValue{BooleanValue: proto.Bool(v)}
+	case string:
+		return &datastorepb.PropertyValue{StringValue: proto.String(v)}
+	case float64:
+		return &datastorepb.PropertyValue{DoubleValue: proto.Float64(v)}
+	case *datastorepb.Reference:
+		return keyValue(v)
+	}
+	return &datastorepb.PropertyValue{}
+}
+
+// dsEntity returns an entity with the given key and properties, given as
+// name and value pairs. A []interface{} value is multi-valued.
+func dsEntity(key *datastorepb.Reference, props ...interface{}) *datastorepb.EntityProto {
+	e := &datastorepb.EntityProto{Key: key, EntityGroup: &datastorepb.Path{}}
+	for i := 0; i < len(props); i += 2 {
+		values, multiple := props[i+1].([]interface{})
+		if !multiple {
+			values = []interface{}{props[i+1]}
+		}
+		for _, v := range values {
+			e.Property = append(e.Property, &datastorepb.Property{
+				Name:     proto.String(props[i].(string)),
+				Value:    dsValue(v),
+				Multiple: proto.Bool(multiple),
+			})
+		}
+	}
+	return e
+}
+
+// refString formats the path of ref as "Kind,id/Kind,name".
+func refString(ref *datastorepb.Reference) string {
+	var elems []string
+	for _, e := range ref.GetPath().GetElement() {
+		if e.Name != nil {
+			elems = append(elems, e.GetType()+","+e.GetName())
+		} else {
+			elems = append(elems, fmt.Sprintf("%s,%d", e.GetType(), e.GetId()))
+		}
+	}
+	return strings.Join(elems, "/")
+}
+
+func resultKeys(res *datastorepb.QueryResult) []string {
+	keys := []string{}
+	for _, e := range res.Result {
+		keys = append(keys, refString(e.Key))
+	}
+	return keys
+}
+
+func dsFilter(name string, op datastorepb.Query_Filter_Operator, v interface{}) *datastorepb.Query_Filter {
+	return &datastorepb.Query_Filter{
+		Op: op.Enum(),
+		Property: []*datastorepb.Property{{
+			Name:     proto.String(name),
+			Value:    dsValue(v),
+			Multiple: proto.Bool(false),
+		}},
+	}
+}
+
+func dsOrder(name string, dir datastorepb.Query_Order_Direction) *datastorepb.Query_Order {
+	return &datastorepb.Query_Order{Property: proto.String(name), Direction: dir.Enum()}
+}
+
+// newTestDatastore returns a datastoreStub holding the entities.
+func newTestDatastore(t *testing.T, entities ...*datastorepb.EntityProto) *datastoreStub {
+	s := newDatastoreStub()
+	req := &datastorepb.PutRequest{Entity: entities}
+	if err := s.call("Put", req, &datastorepb.PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestDatastoreStubPutGetDelete(t *testing.T) {
+	s := newTestDatastore(t)
+	res := &datastorepb.PutResponse{}
+	req := &datastorepb.PutRequest{Entity: []*datastorepb.EntityProto{
+		dsEntity(dsKey("", "A", "x"), "N", 1),
+		dsEntity(dsKey("", "A"), "N", 2),
+		dsEntity(dsKey("ns", "A", "x"), "N", 3),
+		dsEntity(dsKey("", "A", "x", "B"), "N", 4),
+	}}
+	if err := s.call("Put", req, res); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, k := range res.Key {
+		keys = append(keys, k.GetNameSpace()+":"+refString(k))
+	}
+	if want := []string{":A,x", ":A,1", "ns:A,x", ":A,x/B,2"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Put returned keys %q, want %q", keys, want)
+	}
+
+	get := func(keys ...*datastorepb.Reference) []interface{} {
+		res := &datastorepb.GetResponse{}
+		if err := s.call("Get", &datastorepb.GetRequest{Key: keys}, res); err != nil {
+			t.Fatal(err)
+		}
+		var got []interface{}
+		for _, e := range res.Entity {
+			if e.Entity == nil {
+				got = append(got, nil)
+				continue
+			}
+			got = append(got, e.Entity.Property[0].Value.GetInt64Value())
+		}
+		return got
+	}
+	got := get(dsKey("", "A", "x"), dsKey("ns", "A", "x"), dsKey("", "A", 1), dsKey("", "A", "y"), dsKey("", "A", "x", "B", 2))
+	if want := []interface{}{int64(1), int64(3), int64(2), nil, int64(4)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Get = %v, want %v", got, want)
+	}
+
+	// Overwrite, then delete.
+	req = &datastorepb.PutRequest{Entity: []*datastorepb.EntityProto{dsEntity(dsKey("", "A", "x"), "N", 5)}}
+	if err := s.call("Put", req, &datastorepb.PutResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(dsKey("", "A", "x")); !reflect.DeepEqual(got, []interface{}{int64(5)}) {
+		t.Errorf("Get after overwrite = %v, want [5]", got)
+	}
+	del := &datastorepb.DeleteRequest{Key: []*datastorepb.Reference{dsKey("", "A", "x"), dsKey("", "A", "missing")}}
+	if err := s.call("Delete", del, &datastorepb.DeleteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(dsKey("", "A", "x"), dsKey("ns", "A", "x")); !reflect.DeepEqual(got, []interface{}{nil, int64(3)}) {
+		t.Errorf("Get after delete = %v, want [<nil> 3]", got)
+	}
+
+	if err := s.call("Put", &datastorepb.PutRequest{Entity: []*datastorepb.EntityProto{dsEntity(dsKey(""))}}, &datastorepb.PutResponse{}); err == nil {
+		t.Errorf("Put of an entity with an empty key succeeded")
+	}
+}
+
+func TestDatastoreStubQueries(t *testing.T) {
+	mark := dsKey("", "Person", "mark")
+	s := newTestDatastore(t,
+		dsEntity(mark, "Age", 40, "Tags", []interface{}{"a", "b"}),
+		dsEntity(dsKey("", "Person", "mark", "Pet", "rex"), "Age", 3, "Tags", "a"),
+		dsEntity(dsKey("", "Person", "mark", "Pet", "tom", "Toy", "ball"), "Age", 1),
+		dsEntity(dsKey("", "Person", "anna"), "Age", 30, "Tags", "b", "Boss", mark),
+		dsEntity(dsKey("", "Person", "zoe"), "Tags", "c"),
+		dsEntity(dsKey("ns", "Person", "mark"), "Age", 40),
+	)
+	all := func(q *datastorepb.Query) *datastorepb.Query {
+		q.App = proto.String("dev~testapp")
+		return q
+	}
+	tests := []struct {
+		name string
+		q    *datastorepb.Query
+		want []string
+	}{
+		{"kind", all(&datastorepb.Query{Kind: proto.String("Person")}),
+			[]string{"Person,anna", "Person,mark", "Person,zoe"}},
+		{"namespace", all(&datastorepb.Query{Kind: proto.String("Person"), NameSpace: proto.String("ns")}),
+			[]string{"Person,mark"}},
+		{"kindless ancestor", all(&datastorepb.Query{Ancestor: mark}),
+			[]string{"Person,mark", "Person,mark/Pet,rex", "Person,mark/Pet,tom/Toy,ball"}},
+		{"ancestor", all(&datastorepb.Query{Kind: proto.String("Pet"), Ancestor: mark}),
+			[]string{"Person,mark/Pet,rex"}},
+		{"descendant ancestor", all(&datastorepb.Query{Ancestor: dsKey("", "Person", "mark", "Pet", "tom")}),
+			[]string{"Person,mark/Pet,tom/Toy,ball"}},
+		{"equal", all(&datastorepb.Query{Kind: proto.String("Person"), Filter: []*datastorepb.Query_Filter{
+			dsFilter("Age", datastorepb.Query_Filter_EQUAL, 30)}}),
+			[]string{"Person,anna"}},
+		{"multi-valued equal", all(&datastorepb.Query{Kind: proto.String("Person"), Filter: []*datastorepb.Query_Filter{
+			dsFilter("Tags", datastorepb.Query_Filter_EQUAL, "b")}}),
+			[]string{"Person,anna", "Person,mark"}},
+		{"range", all(&datastorepb.Query{Filter: []*datastorepb.Query_Filter{
+			dsFilter("Age", datastorepb.Query_Filter_GREATER_THAN, 1),
+			dsFilter("Age", datastorepb.Query_Filter_LESS_THAN_OR_EQUAL, 30)}}),
+			[]string{"Person,anna", "Person,mark/Pet,rex"}},
+		{"key filter", all(&datastorepb.Query{Kind: proto.String("Person"), Filter: []*datastorepb.Query_Filter{
+			dsFilter("__key__", datastorepb.Query_Filter_GREATER_THAN, dsKey("", "Person", "mark"))}}),
+			[]string{"Person,zoe"}},
+		{"reference filter", all(&datastorepb.Query{Filter: []*datastorepb.Query_Filter{
+			dsFilter("Boss", datastorepb.Query_Filter_EQUAL, mark)}}),
+			[]string{"Person,anna"}},
+		{"order", all(&datastorepb.Query{Kind: proto.String("Person"), Order: []*datastorepb.Query_Order{
+			dsOrder("Age", datastorepb.Query_Order_DESCENDING)}}),
+			[]string{"Person,mark", "Person,anna"}},
+		{"multi-valued order", all(&datastorepb.Query{Kind: proto.String("Person"), Order: []*datastorepb.Query_Order{
+			dsOrder("Tags", datastorepb.Query_Order_DESCENDING), dsOrder("__key__", datastorepb.Query_Order_ASCENDING)}}),
+			[]string{"Person,zoe", "Person,anna", "Person,mark"}},
+		{"offset and limit", all(&datastorepb.Query{Kind: proto.String("Person"), Offset: proto.Int32(1), Limit: proto.Int32(1)}),
+			[]string{"Person,mark"}},
+		{"offset past the end", all(&datastorepb.Query{Kind: proto.String("Person"), Offset: proto.Int32(5)}),
+			[]string{}},
+		{"zero limit", all(&datastorepb.Query{Kind: proto.String("Person"), Limit: proto.Int32(0)}),
+			[]string{}},
+	}
+	for _, tt := range tests {
+		res := &datastorepb.QueryResult{}
+		if err := s.call("RunQuery", tt.q, res); err != nil {
+			t.Errorf("%s: RunQuery failed: %v", tt.name, err)
+			continue
+		}
+		if got := resultKeys(res); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: RunQuery = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDatastoreStubCursors(t *testing.T) {
+	var entities []*datastorepb.EntityProto
+	for i := 1; i <= 5; i++ {
+		entities = append(entities, dsEntity(dsKey("", "N", i), "V", 10-i))
+	}
+	s := newTestDatastore(t, entities...)
+	query := func(start, end *datastorepb.CompiledCursor, offset, limit int32) *datastorepb.QueryResult {
+		q := &datastorepb.Query{
+			App:               proto.String("dev~testapp"),
+			Kind:              proto.String("N"),
+			Order:             []*datastorepb.Query_Order{dsOrder("V", datastorepb.Query_Order_ASCENDING)},
+			CompiledCursor:    start,
+			EndCompiledCursor: end,
+			Offset:            proto.Int32(offset),
+			Compile:           proto.Bool(true),
+		}
+		if limit >= 0 {
+			q.Limit = proto.Int32(limit)
+		}
+		res := &datastorepb.QueryResult{}
+		if err := s.call("RunQuery", q, res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// Page through the results, two at a time, after skipping one.
+	res := query(nil, nil, 1, 2)
+	if got, want := resultKeys(res), []string{"N,4", "N,3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("first page = %q, want %q", got, want)
+	}
+	if res.GetSkippedResults() != 1 {
+		t.Errorf("first page skipped %d results, want 1", res.GetSkippedResults())
+	}
+	res = query(res.CompiledCursor, nil, 0, 2)
+	if got, want := resultKeys(res), []string{"N,2", "N,1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("second page = %q, want %q", got, want)
+	}
+	last := res.CompiledCursor
+	res = query(last, nil, 0, 2)
+	if got := resultKeys(res); len(got) != 0 {
+		t.Errorf("third page = %q, want none", got)
+	}
+	if !proto.Equal(res.CompiledCursor, last) {
+		t.Errorf("an empty page moved the cursor to %v, want %v", res.CompiledCursor, last)
+	}
+
+	// An end cursor stops the query after the result it points to.
+	end := query(nil, nil, 0, 2).CompiledCursor
+	if got, want := resultKeys(query(nil, end, 0, -1)), []string{"N,5", "N,4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("query up to the end cursor = %q, want %q", got, want)
+	}
+	// An offset that skips everything still moves the cursor.
+	res = query(nil, nil, 3, 0)
+	if got, want := resultKeys(query(res.CompiledCursor, nil, 0, -1)), []string{"N,2", "N,1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("query after skipping 3 = %q, want %q", got, want)
+	}
+}
+
+func TestDatastoreStubMixedTypeOrder(t *testing.T) {
+	values := []interface{}{
+		"b", 2.5, nil, dsKey("", "K", "a"), true, -3, "a", false, 7, 1.5,
+	}
+	var entities []*datastorepb.EntityProto
+	for i, v := range values {
+		entities = append(entities, dsEntity(dsKey("", "M", i+1), "V", v))
+	}
+	// A user value and a point sort between doubles and references.
+	user := dsEntity(dsKey("", "M", 100))
+	user.Property = []*datastorepb.Property{{
+		Name: proto.String("V"),
+		Value: &datastorepb.PropertyValue{Uservalue: &datastorepb.PropertyValue_UserValue{
+			Email: proto.String("a@example.com"), AuthDomain: proto.String("gmail.com"),
+		}},
+		Multiple: proto.Bool(false),
+	}}
+	point := dsEntity(dsKey("", "M", 101))
+	point.Property = []*datastorepb.Property{{
+		Name:     proto.String("V"),
+		Value:    &datastorepb.PropertyValue{Pointvalue: &datastorepb.PropertyValue_PointValue{X: proto.Float64(1), Y: proto.Float64(2)}},
+		Multiple: proto.Bool(false),
+	}}
+	s := newTestDatastore(t, append(entities, user, point)...)
+
+	q := &datastorepb.Query{
+		App:   proto.String("dev~testapp"),
+		Kind:  proto.String("M"),
+		Order: []*datastorepb.Query_Order{dsOrder("V", datastorepb.Query_Order_ASCENDING)},
+	}
+	res := &datastorepb.QueryResult{}
+	if err := s.call("RunQuery", q, res); err != nil {
+		t.Fatal(err)
+	}
+	// null < integers < booleans < strings < doubles < points < users < keys
+	want := []string{"M,3", "M,6", "M,9", "M,8", "M,5", "M,7", "M,1", "M,10", "M,2", "M,101", "M,100", "M,4"}
+	if got := resultKeys(res); !reflect.DeepEqual(got, want) {
+		t.Errorf("ascending order = %q, want %q", got, want)
+	}
+
+	q.Order[0].Direction = datastorepb.Query_Order_DESCENDING.Enum()
+	res = &datastorepb.QueryResult{}
+	if err := s.call("RunQuery", q, res); err != nil {
+		t.Fatal(err)
+	}
+	for i, j := 0, len(want)-1; i < j; i, j = i+1, j-1 {
+		want[i], want[j] = want[j], want[i]
+	}
+	if got := resultKeys(res); !reflect.DeepEqual(got, want) {
+		t.Errorf("descending order = %q, want %q", got, want)
+	}
+}
+
+func TestDatastoreStubTransactions(t *testing.T) {
+	begin := func(s *datastoreStub) *datastorepb.Transaction {
+		tx := &datastorepb.Transaction{}
+		if err := s.call("BeginTransaction", &datastorepb.BeginTransactionRequest{App: proto.String("dev~testapp")}, tx); err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+	get := func(s *datastoreStub, tx *datastorepb.Transaction, k *datastorepb.Reference) {
+		if err := s.call("Get", &datastorepb.GetRequest{Key: []*datastorepb.Reference{k}, Transaction: tx}, &datastorepb.GetResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put := func(s *datastoreStub, tx *datastorepb.Transaction, e *datastorepb.EntityProto) {
+		if err := s.call("Put", &datastorepb.PutRequest{Entity: []*datastorepb.EntityProto{e}, Transaction: tx}, &datastorepb.PutResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit := func(s *datastoreStub, tx *datastorepb.Transaction) error {
+		return s.call("Commit", tx, &datastorepb.CommitResponse{})
+	}
+	a, b := dsKey("", "G", "a"), dsKey("", "G", "b")
+	achild := dsKey("", "G", "a", "C", 1)
+
+	tests := []struct {
+		name     string
+		conflict func(s *datastoreStub)
+		want     bool // whether the commit succeeds
+	}{
+		{"no conflict", func(s *datastoreStub) {}, true},
+		{"write to another group", func(s *datastoreStub) { put(s, nil, dsEntity(b, "V", 2)) }, true},
+		{"write to the group", func(s *datastoreStub) { put(s, nil, dsEntity(a, "V", 2)) }, false},
+		{"write to a child in the group", func(s *datastoreStub) { put(s, nil, dsEntity(achild, "V", 2)) }, false},
+		{"delete in the group", func(s *datastoreStub) {
+			s.call("Delete", &datastorepb.DeleteRequest{Key: []*datastorepb.Reference{a}}, &datastorepb.DeleteResponse{})
+		}, false},
+		{"committed transaction on the group", func(s *datastoreStub) {
+			tx := begin(s)
+			put(s, tx, dsEntity(achild, "V", 3))
+			if err := commit(s, tx); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"rolled back transaction on the group", func(s *datastoreStub) {
+			tx := begin(s)
+			put(s, tx, dsEntity(a, "V", 3))
+			s.call("Rollback", tx, &datastorepb.Transaction{})
+		}, true},
+	}
+	for _, tt := range tests {
+		s := newTestDatastore(t, dsEntity(a, "V", 1), dsEntity(b, "V", 1))
+		var ended []bool
+		s.ended = func(handle uint64, committed bool) { ended = append(ended, committed) }
+		tx := begin(s)
+		get(s, tx, a)
+		put(s, tx, dsEntity(a, "V", 10))
+		tt.conflict(s)
+		ended = nil
+		err := commit(s, tx)
+		if ok := err == nil; ok != tt.want {
+			t.Errorf("%s: Commit = %v, want success %v", tt.name, err, tt.want)
+		}
+		if tt.want == false {
+			if aerr, ok := err.(*appengine_internal.APIError); !ok || aerr.Code != int32(datastorepb.Error_CONCURRENT_TRANSACTION) {
+				t.Errorf("%s: Commit = %v, want CONCURRENT_TRANSACTION", tt.name, err)
+			}
+		}
+		if !reflect.DeepEqual(ended, []bool{tt.want}) {
+			t.Errorf("%s: ended reported %v, want [%v]", tt.name, ended, tt.want)
+		}
+		if err := commit(s, tx); err == nil {
+			t.Errorf("%s: second Commit succeeded", tt.name)
+		}
+	}
+
+	// Writes made in a transaction are invisible until it commits.
+	s := newTestDatastore(t)
+	tx := begin(s)
+	put(s, tx, dsEntity(a, "V", 1))
+	res := &datastorepb.GetResponse{}
+	s.call("Get", &datastorepb.GetRequest{Key: []*datastorepb.Reference{a}}, res)
+	if res.Entity[0].Entity != nil {
+		t.Errorf("uncommitted write is visible")
+	}
+	q := &datastorepb.Query{App: proto.String("dev~testapp"), Kind: proto.String("G"), Transaction: tx}
+	if err := s.call("RunQuery", q, &datastorepb.QueryResult{}); err == nil {
+		t.Errorf("non-ancestor query in a transaction succeeded")
+	}
+	if err := commit(s, tx); err != nil {
+		t.Fatal(err)
+	}
+	res = &datastorepb.GetResponse{}
+	s.call("Get", &datastorepb.GetRequest{Key: []*datastorepb.Reference{a}}, res)
+	if res.Entity[0].Entity == nil {
+		t.Errorf("committed write is not visible")
+	}
+}
+
+func TestDatastoreStubMetadata(t *testing.T) {
+	s := newTestDatastore(t,
+		dsEntity(dsKey("", "A", "x"), "N", 1, "S", "s"),
+		dsEntity(dsKey("", "A", "y"), "N", "one"),
+		dsEntity(dsKey("", "A", "x", "B", "z"), "M", true),
+		dsEntity(dsKey("ns", "C", "w"), "P", 1.5),
+	)
+	query := func(kind, ns string, ancestor *datastorepb.Reference) *datastorepb.QueryResult {
+		q := &datastorepb.Query{App: proto.String("dev~testapp"), Kind: proto.String(kind), Ancestor: ancestor}
+		if ns != "" {
+			q.NameSpace = proto.String(ns)
+		}
+		res := &datastorepb.QueryResult{}
+		if err := s.call("RunQuery", q, res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	tests := []struct {
+		kind, ns string
+		ancestor *datastorepb.Reference
+		want     []string
+	}{
+		{"__namespace__", "", nil, []string{"__namespace__,1", "__namespace__,ns"}},
+		{"__kind__", "", nil, []string{"__kind__,A", "__kind__,B"}},
+		{"__kind__", "ns", nil, []string{"__kind__,C"}},
+		{"__property__", "", nil, []string{"__kind__,A/__property__,N", "__kind__,A/__property__,S", "__kind__,B/__property__,M"}},
+		{"__property__", "", dsKey("", "__kind__", "B"), []string{"__kind__,B/__property__,M"}},
+		{"__property__", "ns", nil, []string{"__kind__,C/__property__,P"}},
+	}
+	for _, tt := range tests {
+		if got := resultKeys(query(tt.kind, tt.ns, tt.ancestor)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s query in %q = %q, want %q", tt.kind, tt.ns, got, tt.want)
+		}
+	}
+
+	res := query("__property__", "", dsKey("", "__kind__", "A"))
+	var reprs []string
+	for _, p := range res.Result[0].Property {
+		reprs = append(reprs, p.GetName()+"="+p.Value.GetStringValue())
+	}
+	if want := []string{"property_representation=INT64", "property_representation=STRING"}; !reflect.DeepEqual(reprs, want) {
+		t.Errorf("representations of A.N = %q, want %q", reprs, want)
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	memcachepb "appengine_internal/memcache"
+)
+
+// memcacheStub is an in-memory implementation of the memcache service. It
+// never evicts items before they expire.
+type memcacheStub struct {
+	mu      sync.Mutex
+	items   map[string]*stubItem // keyed by namespace and key
+	lastCAS uint64
+
+	hits, misses, byteHits uint64
+
+	now func() time.Time // the clock of the context
+}
+
+// stubItem is an item of the memcacheStub.
+type stubItem struct {
+	value   []byte
+	flags   uint32
+	cas     uint64
+	stored  time.Time
+	expires time.Time // zero if the item never expires
+}
+
+func newMemcacheStub(now func() time.Time) *memcacheStub {
+	return &memcacheStub{items: make(map[string]*stubItem), now: now}
+}
+
+func itemKey(namespace string, key []byte) string {
+	return namespace + "\x00" + string(key)
+}
+
+// expiry converts a memcache expiration time to the time an item expires.
+func expiry(e uint32, now time.Time) time.Time {
+	switch {
+	case e == 0:
+		return time.Time{}
+	case e <= maxRelativeExpiration:
+		return now.Add(time.Duration(e) * time.Second)
+	}
+	return time.Unix(int64(e), 0)
+}
+
+// lookup returns the unexpired item stored under k, if any.
+func (s *memcacheStub) lookup(k string, now time.Time) *stubItem {
+	it := s.items[k]
+	if it != nil && !it.expires.IsZero() && !now.Before(it.expires) {
+		delete(s.items, k)
+		return nil
+	}
+	return it
+}
+
+func (s *memcacheStub) call(method string, in, out proto.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	switch method {
+	case "Get":
+		req := in.(*memcachepb.MemcacheGetRequest)
+		res := out.(*memcachepb.MemcacheGetResponse)
+		for _, key := range req.Key {
+			it := s.lookup(itemKey(req.GetNameSpace(), key), now)
+			if it == nil {
+				s.misses++
+				continue
+			}
+			s.hits++
+			s.byteHits += uint64(len(it.value))
+			ri := &memcachepb.MemcacheGetResponse_Item{
+				Key:   key,
+				Value: it.value,
+				Flags: proto.Uint32(it.flags),
+			}
+			if req.GetForCas() {
+				ri.CasId = proto.Uint64(it.cas)
+			}
+			res.Item = append(res.Item, ri)
+		}
+	case "Set":
+		req := in.(*memcachepb.MemcacheSetRequest)
+		res := out.(*memcachepb.MemcacheSetResponse)
+		for _, item := range req.Item {
+			res.SetStatus = append(res.SetStatus, s.set(req.GetNameSpace(), item, now))
+		}
+	case "Delete":
+		req := in.(*memcachepb.MemcacheDeleteRequest)
+		res := out.(*memcachepb.MemcacheDeleteResponse)
+		for _, item := range req.Item {
+			k := itemKey(req.GetNameSpace(), item.Key)
+			status := memcachepb.MemcacheDeleteResponse_NOT_FOUND
+			if s.lookup(k, now) != nil {
+				delete(s.items, k)
+				status = memcachepb.MemcacheDeleteResponse_DELETED
+			}
+			res.DeleteStatus = append(res.DeleteStatus, status)
+		}
+	case "Increment":
+		req := in.(*memcachepb.MemcacheIncrementRequest)
+		s.increment(req.GetNameSpace(), req, out.(*memcachepb.MemcacheIncrementResponse), now)
+	case "BatchIncrement":
+		req := in.(*memcachepb.MemcacheBatchIncrementRequest)
+		res := out.(*memcachepb.MemcacheBatchIncrementResponse)
+		for _, item := range req.Item {
+			ir := &memcachepb.MemcacheIncrementResponse{}
+			s.increment(req.GetNameSpace(), item, ir, now)
+			res.Item = append(res.Item, ir)
+		}
+	case "FlushAll":
+		s.items = make(map[string]*stubItem)
+	case "Stats":
+		var items, size uint64
+		var oldest time.Time
+		for k := range s.items {
+			it := s.lookup(k, now)
+			if it == nil {
+				continue
+			}
+			items++
+			size += uint64(len(k) + len(it.value))
+			if oldest.IsZero() || it.stored.Before(oldest) {
+				oldest = it.stored
+			}
+		}
+		var age uint32
+		if !oldest.IsZero() {
+			age = uint32(now.Sub(oldest) / time.Second)
+		}
+		out.(*memcachepb.MemcacheStatsResponse).Stats = &memcachepb.MergedNamespaceStats{
+			Hits:          proto.Uint64(s.hits),
+			Misses:        proto.Uint64(s.misses),
+			ByteHits:      proto.Uint64(s.byteHits),
+			Items:         proto.Uint64(items),
+			Bytes:         proto.Uint64(size),
+			OldestItemAge: proto.Uint32(age),
+		}
+	default:
+		return callNotFound("memcache", method)
+	}
+	return nil
+}
+
+// set stores item according to its set policy.
+func (s *memcacheStub) set(namespace string, item *memcachepb.MemcacheSetRequest_Item, now time.Time) memcachepb.MemcacheSetResponse_SetStatusCode {
+	k := itemKey(namespace, item.Key)
+	old := s.lookup(k, now)
+	switch item.GetSetPolicy() {
+	case memcachepb.MemcacheSetRequest_ADD:
+		if old != nil {
+			return memcachepb.MemcacheSetResponse_NOT_STORED
+		}
+	case memcachepb.MemcacheSetRequest_REPLACE:
+		if old == nil {
+			return memcachepb.MemcacheSetResponse_NOT_STORED
+		}
+	case memcachepb.MemcacheSetRequest_CAS:
+		if old == nil {
+			return memcachepb.MemcacheSetResponse_NOT_STORED
+		}
+		if old.cas != item.GetCasId() {
+			return memcachepb.MemcacheSetResponse_EXISTS
+		}
+	}
+	s.lastCAS++
+	s.items[k] = &stubItem{
+		value:   item.Value,
+		flags:   item.GetFlags(),
+		cas:     s.lastCAS,
+		stored:  now,
+		expires: expiry(item.GetExpirationTime(), now),
+	}
+	return memcachepb.MemcacheSetResponse_STORED
+}
+
+// increment applies an increment request. Items hold decimal numbers, and
+// decrementing stops at zero.
+func (s *memcacheStub) increment(namespace string, req *memcachepb.MemcacheIncrementRequest, res *memcachepb.MemcacheIncrementResponse, now time.Time) {
+	k := itemKey(namespace, req.Key)
+	it := s.lookup(k, now)
+	if it == nil {
+		if req.InitialValue == nil {
+			res.IncrementStatus = memcachepb.MemcacheIncrementResponse_NOT_CHANGED.Enum()
+			return
+		}
+		it = &stubItem{
+			value:  []byte(strconv.FormatUint(req.GetInitialValue(), 10)),
+			flags:  req.GetInitialFlags(),
+			stored: now,
+		}
+		s.items[k] = it
+	}
+	n, err := strconv.ParseUint(string(it.value), 10, 64)
+	if err != nil {
+		res.IncrementStatus = memcachepb.MemcacheIncrementResponse_ERROR.Enum()
+		return
+	}
+	if req.GetDirection() == memcachepb.MemcacheIncrementRequest_DECREMENT {
+		if req.GetDelta() > n {
+			n = 0
+		} else {
+			n -= req.GetDelta()
+		}
+	} else {
+		n += req.GetDelta()
+	}
+	s.lastCAS++
+	it.value = []byte(strconv.FormatUint(n, 10))
+	it.cas = s.lastCAS
+	res.NewValue = proto.Uint64(n)
+	res.IncrementStatus = memcachepb.MemcacheIncrementResponse_OK.Enum()
+}
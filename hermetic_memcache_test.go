@@ -0,0 +1,260 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	memcachepb "appengine_internal/memcache"
+)
+
+// memcacheStep is a call to the memcache stub and its result, formatted
+// as the do method of memcacheTester does.
+type memcacheStep struct {
+	advance time.Duration // of the clock before the call
+	op      string
+	ns, key string
+	arg     string // the value to store, or the delta
+	exp     uint32
+	want    string
+}
+
+type memcacheTester struct {
+	t   *testing.T
+	s   *memcacheStub
+	now time.Time
+	cas map[string]uint64 // the CAS IDs gets returned, by namespace and key
+}
+
+func newMemcacheTester(t *testing.T) *memcacheTester {
+	m := &memcacheTester{t: t, now: time.Unix(1400000000, 0), cas: make(map[string]uint64)}
+	m.s = newMemcacheStub(func() time.Time { return m.now })
+	return m
+}
+
+func (m *memcacheTester) call(method string, in, out proto.Message) {
+	if err := m.s.call(method, in, out); err != nil {
+		m.t.Fatalf("%s failed: %v", method, err)
+	}
+}
+
+// do runs step and returns the result of the call.
+func (m *memcacheTester) do(step memcacheStep) string {
+	m.now = m.now.Add(step.advance)
+	ns := proto.String(step.ns)
+	switch step.op {
+	case "get", "gets":
+		res := &memcachepb.MemcacheGetResponse{}
+		m.call("Get", &memcachepb.MemcacheGetRequest{
+			Key:       [][]byte{[]byte(step.key)},
+			NameSpace: ns,
+			ForCas:    proto.Bool(step.op == "gets"),
+		}, res)
+		if len(res.Item) == 0 {
+			return "miss"
+		}
+		it := res.Item[0]
+		if it.CasId != nil {
+			m.cas[step.ns+"/"+step.key] = it.GetCasId()
+		}
+		return fmt.Sprintf("%s/%d", it.Value, it.GetFlags())
+	case "set", "add", "replace", "cas":
+		policy := map[string]memcachepb.MemcacheSetRequest_SetPolicy{
+			"set":     memcachepb.MemcacheSetRequest_SET,
+			"add":     memcachepb.MemcacheSetRequest_ADD,
+			"replace": memcachepb.MemcacheSetRequest_REPLACE,
+			"cas":     memcachepb.MemcacheSetRequest_CAS,
+		}[step.op]
+		item := &memcachepb.MemcacheSetRequest_Item{
+			Key:            []byte(step.key),
+			Value:          []byte(step.arg),
+			Flags:          proto.Uint32(uint32(len(step.arg))),
+			SetPolicy:      policy.Enum(),
+			ExpirationTime: proto.Uint32(step.exp),
+		}
+		if step.op == "cas" {
+			item.CasId = proto.Uint64(m.cas[step.ns+"/"+step.key])
+		}
+		res := &memcachepb.MemcacheSetResponse{}
+		m.call("Set", &memcachepb.MemcacheSetRequest{Item: []*memcachepb.MemcacheSetRequest_Item{item}, NameSpace: ns}, res)
+		return res.SetStatus[0].String()
+	case "delete":
+		res := &memcachepb.MemcacheDeleteResponse{}
+		m.call("Delete", &memcachepb.MemcacheDeleteRequest{
+			Item:      []*memcachepb.MemcacheDeleteRequest_Item{{Key: []byte(step.key)}},
+			NameSpace: ns,
+		}, res)
+		return res.DeleteStatus[0].String()
+	case "incr", "decr", "incr0":
+		var delta uint64
+		fmt.Sscan(step.arg, &delta)
+		req := &memcachepb.MemcacheIncrementRequest{
+			Key:       []byte(step.key),
+			NameSpace: ns,
+			Delta:     proto.Uint64(delta),
+			Direction: memcachepb.MemcacheIncrementRequest_INCREMENT.Enum(),
+		}
+		if step.op == "decr" {
+			req.Direction = memcachepb.MemcacheIncrementRequest_DECREMENT.Enum()
+		}
+		if step.op == "incr0" {
+			req.InitialValue = proto.Uint64(0)
+		}
+		res := &memcachepb.MemcacheIncrementResponse{}
+		m.call("Increment", req, res)
+		if res.NewValue == nil {
+			return res.GetIncrementStatus().String()
+		}
+		return fmt.Sprintf("%s %d", res.GetIncrementStatus(), res.GetNewValue())
+	case "flush":
+		m.call("FlushAll", &memcachepb.MemcacheFlushRequest{}, &memcachepb.MemcacheFlushResponse{})
+		return ""
+	}
+	m.t.Fatalf("unknown op %q", step.op)
+	return ""
+}
+
+func TestMemcacheStub(t *testing.T) {
+	const month = maxRelativeExpiration * time.Second
+	tests := []struct {
+		name  string
+		steps []memcacheStep
+	}{
+		{"set and get", []memcacheStep{
+			{op: "get", key: "k", want: "miss"},
+			{op: "set", key: "k", arg: "v", want: "STORED"},
+			{op: "get", key: "k", want: "v/1"},
+			{op: "set", key: "k", arg: "v2", want: "STORED"},
+			{op: "get", key: "k", want: "v2/2"},
+		}},
+		{"add and replace", []memcacheStep{
+			{op: "replace", key: "k", arg: "v", want: "NOT_STORED"},
+			{op: "add", key: "k", arg: "v", want: "STORED"},
+			{op: "add", key: "k", arg: "v2", want: "NOT_STORED"},
+			{op: "replace", key: "k", arg: "v3", want: "STORED"},
+			{op: "get", key: "k", want: "v3/2"},
+		}},
+		{"delete", []memcacheStep{
+			{op: "delete", key: "k", want: "NOT_FOUND"},
+			{op: "set", key: "k", arg: "v", want: "STORED"},
+			{op: "delete", key: "k", want: "DELETED"},
+			{op: "get", key: "k", want: "miss"},
+			{op: "add", key: "k", arg: "v", want: "STORED"},
+		}},
+		{"compare and swap", []memcacheStep{
+			{op: "cas", key: "k", arg: "v", want: "NOT_STORED"},
+			{op: "set", key: "k", arg: "v", want: "STORED"},
+			{op: "gets", key: "k", want: "v/1"},
+			{op: "cas", key: "k", arg: "v2", want: "STORED"},
+			{op: "cas", key: "k", arg: "v3", want: "EXISTS"},
+			{op: "gets", key: "k", want: "v2/2"},
+			{op: "set", key: "k", arg: "v4", want: "STORED"},
+			{op: "cas", key: "k", arg: "v5", want: "EXISTS"},
+			{op: "gets", key: "k", want: "v4/2"},
+			{op: "incr0", key: "k", arg: "1", want: "ERROR"},
+			{op: "delete", key: "k", want: "DELETED"},
+			{op: "cas", key: "k", arg: "v6", want: "NOT_STORED"},
+		}},
+		{"increment", []memcacheStep{
+			{op: "incr", key: "n", arg: "1", want: "NOT_CHANGED"},
+			{op: "incr0", key: "n", arg: "5", want: "OK 5"},
+			{op: "incr", key: "n", arg: "2", want: "OK 7"},
+			{op: "decr", key: "n", arg: "3", want: "OK 4"},
+			{op: "decr", key: "n", arg: "10", want: "OK 0"},
+			{op: "get", key: "n", want: "0/0"},
+			{op: "set", key: "n", arg: "18446744073709551615", want: "STORED"},
+			{op: "incr", key: "n", arg: "2", want: "OK 1"},
+			{op: "set", key: "n", arg: "x", want: "STORED"},
+			{op: "incr", key: "n", arg: "1", want: "ERROR"},
+		}},
+		{"increment changes the CAS ID", []memcacheStep{
+			{op: "set", key: "n", arg: "1", want: "STORED"},
+			{op: "gets", key: "n", want: "1/1"},
+			{op: "incr", key: "n", arg: "1", want: "OK 2"},
+			{op: "cas", key: "n", arg: "5", want: "EXISTS"},
+		}},
+		{"relative expiration", []memcacheStep{
+			{op: "set", key: "k", arg: "v", exp: 60, want: "STORED"},
+			{advance: 59 * time.Second, op: "get", key: "k", want: "v/1"},
+			{advance: time.Second, op: "get", key: "k", want: "miss"},
+			{op: "replace", key: "k", arg: "v", want: "NOT_STORED"},
+			{op: "add", key: "k", arg: "v", exp: maxRelativeExpiration, want: "STORED"},
+			{advance: month - time.Second, op: "get", key: "k", want: "v/1"},
+			{advance: time.Second, op: "delete", key: "k", want: "NOT_FOUND"},
+		}},
+		{"absolute expiration", []memcacheStep{
+			{op: "set", key: "k", arg: "v", exp: 1400000000 + 3600, want: "STORED"},
+			{advance: time.Hour - time.Second, op: "get", key: "k", want: "v/1"},
+			{advance: time.Second, op: "get", key: "k", want: "miss"},
+			{op: "set", key: "k", arg: "v", exp: maxRelativeExpiration + 1, want: "STORED"},
+			{op: "get", key: "k", want: "miss"},
+			{op: "set", key: "k", arg: "v", want: "STORED"},
+			{advance: 10 * month, op: "get", key: "k", want: "v/1"},
+		}},
+		{"expired counter", []memcacheStep{
+			{op: "set", key: "n", arg: "5", exp: 1, want: "STORED"},
+			{advance: time.Second, op: "incr", key: "n", arg: "1", want: "NOT_CHANGED"},
+			{op: "incr0", key: "n", arg: "1", want: "OK 1"},
+		}},
+		{"namespaces", []memcacheStep{
+			{op: "set", key: "k", arg: "a", want: "STORED"},
+			{op: "set", ns: "ns", key: "k", arg: "bb", want: "STORED"},
+			{op: "get", key: "k", want: "a/1"},
+			{op: "get", ns: "ns", key: "k", want: "bb/2"},
+			{op: "get", ns: "other", key: "k", want: "miss"},
+			{op: "delete", ns: "ns", key: "k", want: "DELETED"},
+			{op: "get", key: "k", want: "a/1"},
+			{op: "incr0", ns: "ns", key: "k", arg: "1", want: "OK 1"},
+			{op: "get", key: "k", want: "a/1"},
+		}},
+		{"flush", []memcacheStep{
+			{op: "set", key: "k", arg: "v", want: "STORED"},
+			{op: "set", ns: "ns", key: "k", arg: "v", want: "STORED"},
+			{op: "flush"},
+			{op: "get", key: "k", want: "miss"},
+			{op: "get", ns: "ns", key: "k", want: "miss"},
+		}},
+	}
+	for _, tt := range tests {
+		m := newMemcacheTester(t)
+		for i, step := range tt.steps {
+			if got := m.do(step); got != step.want {
+				t.Errorf("%s: step %d: %s %q = %q, want %q", tt.name, i, step.op, step.key, got, step.want)
+			}
+		}
+	}
+}
+
+func TestMemcacheStubStats(t *testing.T) {
+	m := newMemcacheTester(t)
+	for _, step := range []memcacheStep{
+		{op: "set", key: "a", arg: "12345"},
+		{advance: 10 * time.Second, op: "set", ns: "ns", key: "b", arg: "1", exp: 60},
+		{op: "set", key: "c", arg: "1", exp: 5},
+		{advance: 5 * time.Second, op: "get", key: "a"},
+		{op: "get", key: "a"},
+		{op: "get", key: "c"},
+		{op: "get", ns: "ns", key: "b"},
+	} {
+		m.do(step)
+	}
+	res := &memcachepb.MemcacheStatsResponse{}
+	m.call("Stats", &memcachepb.MemcacheStatsRequest{}, res)
+	want := &memcachepb.MergedNamespaceStats{
+		Hits:          proto.Uint64(3),
+		Misses:        proto.Uint64(1),
+		ByteHits:      proto.Uint64(11),
+		Items:         proto.Uint64(2),
+		Bytes:         proto.Uint64(uint64(len(itemKey("", []byte("a"))) + 5 + len(itemKey("ns", []byte("b"))) + 1)),
+		OldestItemAge: proto.Uint32(15),
+	}
+	if !proto.Equal(res.Stats, want) {
+		t.Errorf("Stats = %v, want %v", res.Stats, want)
+	}
+}
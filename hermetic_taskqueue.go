@@ -0,0 +1,378 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"bufio"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"appengine_internal"
+	"code.google.com/p/goprotobuf/proto"
+
+	taskqueuepb "appengine_internal/taskqueue"
+)
+
+// taskqueueStub is an in-memory implementation of the taskqueue service.
+// It holds the queues declared in Options.QueueYAML and the default push
+// queue, and never runs push tasks itself.
+type taskqueueStub struct {
+	mu       sync.Mutex
+	queues   map[string]*stubQueue
+	lastTask int
+	// pending holds the tasks added in transactions, keyed by handle.
+	pending map[uint64][]*taskqueuepb.TaskQueueAddRequest
+}
+
+// stubQueue is a queue of the taskqueueStub.
+type stubQueue struct {
+	pull       bool
+	tasks      map[string]*stubTask // keyed by name
+	tombstones map[string]bool      // names of the deleted tasks
+}
+
+// stubTask is a task of the taskqueueStub.
+type stubTask struct {
+	add     *taskqueuepb.TaskQueueAddRequest
+	eta     int64 // in microseconds
+	created int64 // in microseconds
+	retries int32
+}
+
+func newTaskqueueStub(queueYAML string) *taskqueueStub {
+	s := &taskqueueStub{
+		queues:  make(map[string]*stubQueue),
+		pending: make(map[uint64][]*taskqueuepb.TaskQueueAddRequest),
+	}
+	s.queues["default"] = newStubQueue(false)
+	for name, pull := range parseQueueYAML(queueYAML) {
+		s.queues[name] = newStubQueue(pull)
+	}
+	return s
+}
+
+func newStubQueue(pull bool) *stubQueue {
+	return &stubQueue{
+		pull:       pull,
+		tasks:      make(map[string]*stubTask),
+		tombstones: make(map[string]bool),
+	}
+}
+
+// parseQueueYAML returns the queues declared in a queue.yaml file, and
+// whether each is a pull queue. It only understands the name and mode of
+// each queue.
+func parseQueueYAML(s string) map[string]bool {
+	queues := make(map[string]bool)
+	var name string
+	sc := bufio.NewScanner(strings.NewReader(s))
+	for sc.Scan() {
+		line := strings.TrimPrefix(strings.TrimSpace(sc.Text()), "- ")
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:i])
+		value := strings.Trim(strings.TrimSpace(line[i+1:]), `"'`)
+		switch key {
+		case "name":
+			name = value
+			queues[name] = false
+		case "mode":
+			if name != "" {
+				queues[name] = value == "pull"
+			}
+		}
+	}
+	return queues
+}
+
+func taskqueueError(code taskqueuepb.TaskQueueServiceError_ErrorCode) error {
+	return &appengine_internal.APIError{
+		Service: "taskqueue",
+		Detail:  code.String(),
+		Code:    int32(code),
+	}
+}
+
+func usec(t time.Time) int64 {
+	return t.UnixNano() / 1e3
+}
+
+func (s *taskqueueStub) call(method string, in, out proto.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch method {
+	case "Add":
+		req := in.(*taskqueuepb.TaskQueueAddRequest)
+		if code := s.check(req); code != taskqueuepb.TaskQueueServiceError_OK {
+			return taskqueueError(code)
+		}
+		out.(*taskqueuepb.TaskQueueAddResponse).ChosenTaskName = s.add(req)
+	case "BulkAdd":
+		req := in.(*taskqueuepb.TaskQueueBulkAddRequest)
+		res := out.(*taskqueuepb.TaskQueueBulkAddResponse)
+		// Either every task is added, or none is.
+		failed := false
+		codes := make([]taskqueuepb.TaskQueueServiceError_ErrorCode, len(req.AddRequest))
+		for i, ar := range req.AddRequest {
+			codes[i] = s.check(ar)
+			failed = failed || codes[i] != taskqueuepb.TaskQueueServiceError_OK
+		}
+		for i, ar := range req.AddRequest {
+			tr := &taskqueuepb.TaskQueueBulkAddResponse_TaskResult{}
+			switch {
+			case codes[i] != taskqueuepb.TaskQueueServiceError_OK:
+				tr.Result = codes[i].Enum()
+			case failed:
+				tr.Result = taskqueuepb.TaskQueueServiceError_SKIPPED.Enum()
+			default:
+				tr.Result = taskqueuepb.TaskQueueServiceError_OK.Enum()
+				tr.ChosenTaskName = s.add(ar)
+			}
+			res.Taskresult = append(res.Taskresult, tr)
+		}
+	case "Delete":
+		req := in.(*taskqueuepb.TaskQueueDeleteRequest)
+		q := s.queues[string(req.QueueName)]
+		if q == nil {
+			return taskqueueError(taskqueuepb.TaskQueueServiceError_UNKNOWN_QUEUE)
+		}
+		res := out.(*taskqueuepb.TaskQueueDeleteResponse)
+		for _, name := range req.TaskName {
+			code := taskqueuepb.TaskQueueServiceError_UNKNOWN_TASK
+			if q.tasks[string(name)] != nil {
+				delete(q.tasks, string(name))
+				q.tombstones[string(name)] = true
+				code = taskqueuepb.TaskQueueServiceError_OK
+			}
+			res.Result = append(res.Result, code)
+		}
+	case "PurgeQueue":
+		req := in.(*taskqueuepb.TaskQueuePurgeQueueRequest)
+		q := s.queues[string(req.QueueName)]
+		if q == nil {
+			return taskqueueError(taskqueuepb.TaskQueueServiceError_UNKNOWN_QUEUE)
+		}
+		q.tasks = make(map[string]*stubTask)
+	case "FetchQueues":
+		res := out.(*taskqueuepb.TaskQueueFetchQueuesResponse)
+		for _, name := range s.queueNames() {
+			mode := taskqueuepb.TaskQueueMode_PUSH
+			if s.queues[name].pull {
+				mode = taskqueuepb.TaskQueueMode_PULL
+			}
+			res.Queue = append(res.Queue, &taskqueuepb.TaskQueueFetchQueuesResponse_Queue{
+				QueueName:             []byte(name),
+				BucketRefillPerSecond: proto.Float64(5),
+				BucketCapacity:        proto.Float64(5),
+				Paused:                proto.Bool(false),
+				Mode:                  mode.Enum(),
+			})
+		}
+	case "FetchQueueStats":
+		req := in.(*taskqueuepb.TaskQueueFetchQueueStatsRequest)
+		res := out.(*taskqueuepb.TaskQueueFetchQueueStatsResponse)
+		for _, name := range req.QueueName {
+			q := s.queues[string(name)]
+			if q == nil {
+				return taskqueueError(taskqueuepb.TaskQueueServiceError_UNKNOWN_QUEUE)
+			}
+			qs := &taskqueuepb.TaskQueueFetchQueueStatsResponse_QueueStats{
+				NumTasks:      proto.Int32(int32(len(q.tasks))),
+				OldestEtaUsec: proto.Int64(-1),
+			}
+			if tasks := q.sorted(); len(tasks) > 0 {
+				qs.OldestEtaUsec = proto.Int64(tasks[0].eta)
+			}
+			res.Queuestats = append(res.Queuestats, qs)
+		}
+	case "QueryTasks":
+		req := in.(*taskqueuepb.TaskQueueQueryTasksRequest)
+		q := s.queues[string(req.QueueName)]
+		if q == nil {
+			return taskqueueError(taskqueuepb.TaskQueueServiceError_UNKNOWN_QUEUE)
+		}
+		res := out.(*taskqueuepb.TaskQueueQueryTasksResponse)
+		for _, t := range q.sorted() {
+			if len(res.Task) == int(req.GetMaxRows()) {
+				break
+			}
+			res.Task = append(res.Task, t.queried())
+		}
+	case "QueryAndOwnTasks":
+		req := in.(*taskqueuepb.TaskQueueQueryAndOwnTasksRequest)
+		q := s.queues[string(req.QueueName)]
+		if q == nil {
+			return taskqueueError(taskqueuepb.TaskQueueServiceError_UNKNOWN_QUEUE)
+		}
+		if !q.pull {
+			return taskqueueError(taskqueuepb.TaskQueueServiceError_INVALID_QUEUE_MODE)
+		}
+		res := out.(*taskqueuepb.TaskQueueQueryAndOwnTasksResponse)
+		now := usec(time.Now())
+		lease := int64(req.GetLeaseSeconds() * 1e6)
+		var tag []byte
+		for _, t := range q.sorted() {
+			if int64(len(res.Task)) == req.GetMaxTasks() || t.eta > now {
+				break
+			}
+			if req.GetGroupByTag() {
+				if tag == nil {
+					tag = req.Tag
+					if tag == nil {
+						tag = t.add.Tag
+					}
+				}
+				if string(t.add.Tag) != string(tag) {
+					continue
+				}
+			}
+			t.eta = now + lease
+			t.retries++
+			res.Task = append(res.Task, &taskqueuepb.TaskQueueQueryAndOwnTasksResponse_Task{
+				TaskName:   t.add.TaskName,
+				EtaUsec:    proto.Int64(t.eta),
+				RetryCount: proto.Int32(t.retries),
+				Body:       t.add.Body,
+				Tag:        t.add.Tag,
+			})
+		}
+	case "ModifyTaskLease":
+		req := in.(*taskqueuepb.TaskQueueModifyTaskLeaseRequest)
+		q := s.queues[string(req.QueueName)]
+		if q == nil {
+			return taskqueueError(taskqueuepb.TaskQueueServiceError_UNKNOWN_QUEUE)
+		}
+		t := q.tasks[string(req.TaskName)]
+		if t == nil {
+			return taskqueueError(taskqueuepb.TaskQueueServiceError_UNKNOWN_TASK)
+		}
+		now := usec(time.Now())
+		if t.eta != req.GetEtaUsec() || t.eta < now {
+			return taskqueueError(taskqueuepb.TaskQueueServiceError_TASK_LEASE_EXPIRED)
+		}
+		t.eta = now + int64(req.GetLeaseSeconds()*1e6)
+		out.(*taskqueuepb.TaskQueueModifyTaskLeaseResponse).UpdatedEtaUsec = proto.Int64(t.eta)
+	default:
+		return callNotFound("taskqueue", method)
+	}
+	return nil
+}
+
+// check returns the error that adding the task of req would cause.
+func (s *taskqueueStub) check(req *taskqueuepb.TaskQueueAddRequest) taskqueuepb.TaskQueueServiceError_ErrorCode {
+	q := s.queues[string(req.QueueName)]
+	switch {
+	case q == nil:
+		return taskqueuepb.TaskQueueServiceError_UNKNOWN_QUEUE
+	case q.pull != (req.GetMode() == taskqueuepb.TaskQueueMode_PULL):
+		return taskqueuepb.TaskQueueServiceError_INVALID_QUEUE_MODE
+	case q.tasks[string(req.TaskName)] != nil:
+		return taskqueuepb.TaskQueueServiceError_TASK_ALREADY_EXISTS
+	case q.tombstones[string(req.TaskName)]:
+		return taskqueuepb.TaskQueueServiceError_TOMBSTONED_TASK
+	}
+	return taskqueuepb.TaskQueueServiceError_OK
+}
+
+// add adds the task of req, which must pass check, and returns its name if
+// it was chosen by the stub. A task added in a transaction is held until
+// the transaction commits.
+func (s *taskqueueStub) add(req *taskqueuepb.TaskQueueAddRequest) []byte {
+	req = proto.Clone(req).(*taskqueuepb.TaskQueueAddRequest)
+	var chosen []byte
+	if len(req.TaskName) == 0 {
+		s.lastTask++
+		chosen = []byte(fmt.Sprintf("task%d", s.lastTask))
+		req.TaskName = chosen
+	}
+	if tx := req.Transaction; tx != nil {
+		req.Transaction = nil
+		s.pending[tx.GetHandle()] = append(s.pending[tx.GetHandle()], req)
+		return chosen
+	}
+	s.queues[string(req.QueueName)].tasks[string(req.TaskName)] = &stubTask{
+		add:     req,
+		eta:     req.GetEtaUsec(),
+		created: usec(time.Now()),
+	}
+	return chosen
+}
+
+// endTransaction adds the tasks held for the transaction handle if it
+// committed, and drops them otherwise.
+func (s *taskqueueStub) endTransaction(handle uint64, committed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	adds := s.pending[handle]
+	delete(s.pending, handle)
+	if !committed {
+		return
+	}
+	for _, req := range adds {
+		if s.check(req) == taskqueuepb.TaskQueueServiceError_OK {
+			s.add(req)
+		}
+	}
+}
+
+func (s *taskqueueStub) queueNames() []string {
+	var names []string
+	for name := range s.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sorted returns the tasks of q ordered by ETA, then by name.
+func (q *stubQueue) sorted() []*stubTask {
+	var tasks []*stubTask
+	for _, t := range q.tasks {
+		tasks = append(tasks, t)
+	}
+	sort.Sort(byETA(tasks))
+	return tasks
+}
+
+type byETA []*stubTask
+
+func (s byETA) Len() int      { return len(s) }
+func (s byETA) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byETA) Less(i, j int) bool {
+	if s[i].eta != s[j].eta {
+		return s[i].eta < s[j].eta
+	}
+	return string(s[i].add.TaskName) < string(s[j].add.TaskName)
+}
+
+// queried returns t as returned by QueryTasks.
+func (t *stubTask) queried() *taskqueuepb.TaskQueueQueryTasksResponse_Task {
+	qt := &taskqueuepb.TaskQueueQueryTasksResponse_Task{
+		TaskName:         t.add.TaskName,
+		EtaUsec:          proto.Int64(t.eta),
+		Url:              t.add.Url,
+		RetryCount:       proto.Int32(t.retries),
+		BodySize:         proto.Int32(int32(len(t.add.Body))),
+		Body:             t.add.Body,
+		CreationTimeUsec: proto.Int64(t.created),
+		RetryParameters:  t.add.RetryParameters,
+		Tag:              t.add.Tag,
+	}
+	if t.add.GetMode() == taskqueuepb.TaskQueueMode_PUSH {
+		qt.Method = taskqueuepb.TaskQueueQueryTasksResponse_Task_RequestMethod(t.add.GetMethod()).Enum()
+	}
+	for _, h := range t.add.Header {
+		qt.Header = append(qt.Header, &taskqueuepb.TaskQueueQueryTasksResponse_Task_Header{
+			Key:   h.Key,
+			Value: h.Value,
+		})
+	}
+	return qt
+}
@@ -0,0 +1,364 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"appengine_internal"
+	"code.google.com/p/goprotobuf/proto"
+
+	datastorepb "appengine_internal/datastore"
+	taskqueuepb "appengine_internal/taskqueue"
+)
+
+const stubQueueYAML = `queue:
+- name: mail
+  rate: 1/s
+- name: "work"
+  mode: pull
+`
+
+// tqAdd returns a request to add the task name to queue, which is a pull
+// queue if its name is "work". The task is named by the stub if name is
+// empty.
+func tqAdd(queue, name string, eta int64) *taskqueuepb.TaskQueueAddRequest {
+	req := &taskqueuepb.TaskQueueAddRequest{
+		QueueName: []byte(queue),
+		TaskName:  []byte(name),
+		EtaUsec:   proto.Int64(eta),
+		Body:      []byte("body of " + name),
+	}
+	if queue == "work" {
+		req.Mode = taskqueuepb.TaskQueueMode_PULL.Enum()
+	} else {
+		req.Url = []byte("/task")
+		req.Method = taskqueuepb.TaskQueueAddRequest_POST.Enum()
+	}
+	return req
+}
+
+// tqCode returns the error code of err, or OK if err is nil.
+func tqCode(t *testing.T, err error) taskqueuepb.TaskQueueServiceError_ErrorCode {
+	if err == nil {
+		return taskqueuepb.TaskQueueServiceError_OK
+	}
+	aerr, ok := err.(*appengine_internal.APIError)
+	if !ok {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return taskqueuepb.TaskQueueServiceError_ErrorCode(aerr.Code)
+}
+
+// tqTasks returns the names of the tasks of queue ordered by ETA.
+func tqTasks(t *testing.T, s *taskqueueStub, queue string) []string {
+	res := &taskqueuepb.TaskQueueQueryTasksResponse{}
+	req := &taskqueuepb.TaskQueueQueryTasksRequest{QueueName: []byte(queue), MaxRows: proto.Int32(100)}
+	if err := s.call("QueryTasks", req, res); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, task := range res.Task {
+		names = append(names, string(task.TaskName))
+	}
+	return names
+}
+
+func TestParseQueueYAML(t *testing.T) {
+	got := parseQueueYAML(stubQueueYAML)
+	want := map[string]bool{"mail": false, "work": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseQueueYAML = %v, want %v", got, want)
+	}
+}
+
+func TestTaskqueueStubAdd(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(s *taskqueueStub)
+		req    *taskqueuepb.TaskQueueAddRequest
+		want   taskqueuepb.TaskQueueServiceError_ErrorCode
+		chosen string
+	}{
+		{"unnamed push task", nil, tqAdd("default", "", 0), taskqueuepb.TaskQueueServiceError_OK, "task1"},
+		{"named push task", nil, tqAdd("mail", "a", 0), taskqueuepb.TaskQueueServiceError_OK, ""},
+		{"pull task", nil, tqAdd("work", "a", 0), taskqueuepb.TaskQueueServiceError_OK, ""},
+		{"unknown queue", nil, tqAdd("missing", "a", 0), taskqueuepb.TaskQueueServiceError_UNKNOWN_QUEUE, ""},
+		{"pull task in a push queue", nil, func() *taskqueuepb.TaskQueueAddRequest {
+			req := tqAdd("work", "a", 0)
+			req.QueueName = []byte("mail")
+			return req
+		}(), taskqueuepb.TaskQueueServiceError_INVALID_QUEUE_MODE, ""},
+		{"push task in a pull queue", nil, func() *taskqueuepb.TaskQueueAddRequest {
+			req := tqAdd("mail", "a", 0)
+			req.QueueName = []byte("work")
+			return req
+		}(), taskqueuepb.TaskQueueServiceError_INVALID_QUEUE_MODE, ""},
+		{"existing name", func(s *taskqueueStub) {
+			s.call("Add", tqAdd("mail", "a", 0), &taskqueuepb.TaskQueueAddResponse{})
+		}, tqAdd("mail", "a", 0), taskqueuepb.TaskQueueServiceError_TASK_ALREADY_EXISTS, ""},
+		{"name of another queue", func(s *taskqueueStub) {
+			s.call("Add", tqAdd("default", "a", 0), &taskqueuepb.TaskQueueAddResponse{})
+		}, tqAdd("mail", "a", 0), taskqueuepb.TaskQueueServiceError_OK, ""},
+		{"deleted name", func(s *taskqueueStub) {
+			s.call("Add", tqAdd("mail", "a", 0), &taskqueuepb.TaskQueueAddResponse{})
+			s.call("Delete", &taskqueuepb.TaskQueueDeleteRequest{QueueName: []byte("mail"), TaskName: [][]byte{[]byte("a")}}, &taskqueuepb.TaskQueueDeleteResponse{})
+		}, tqAdd("mail", "a", 0), taskqueuepb.TaskQueueServiceError_TOMBSTONED_TASK, ""},
+		{"purged name", func(s *taskqueueStub) {
+			s.call("Add", tqAdd("mail", "a", 0), &taskqueuepb.TaskQueueAddResponse{})
+			s.call("PurgeQueue", &taskqueuepb.TaskQueuePurgeQueueRequest{QueueName: []byte("mail")}, &taskqueuepb.TaskQueuePurgeQueueResponse{})
+		}, tqAdd("mail", "a", 0), taskqueuepb.TaskQueueServiceError_OK, ""},
+	}
+	for _, tt := range tests {
+		s := newTaskqueueStub(stubQueueYAML)
+		if tt.setup != nil {
+			tt.setup(s)
+		}
+		res := &taskqueuepb.TaskQueueAddResponse{}
+		err := s.call("Add", tt.req, res)
+		if code := tqCode(t, err); code != tt.want {
+			t.Errorf("%s: Add = %v, want %v", tt.name, code, tt.want)
+			continue
+		}
+		if string(res.ChosenTaskName) != tt.chosen {
+			t.Errorf("%s: Add chose the name %q, want %q", tt.name, res.ChosenTaskName, tt.chosen)
+		}
+		if err != nil {
+			continue
+		}
+		name := tt.chosen
+		if name == "" {
+			name = string(tt.req.TaskName)
+		}
+		if tasks := tqTasks(t, s, string(tt.req.QueueName)); !reflect.DeepEqual(tasks, []string{name}) {
+			t.Errorf("%s: queue holds %q, want [%q]", tt.name, tasks, name)
+		}
+	}
+}
+
+func TestTaskqueueStubBulkAdd(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string // the name of a task added before
+		reqs     []*taskqueuepb.TaskQueueAddRequest
+		want     []taskqueuepb.TaskQueueServiceError_ErrorCode
+		tasks    []string
+	}{
+		{
+			"all added",
+			"",
+			[]*taskqueuepb.TaskQueueAddRequest{tqAdd("mail", "a", 0), tqAdd("mail", "", 0)},
+			[]taskqueuepb.TaskQueueServiceError_ErrorCode{taskqueuepb.TaskQueueServiceError_OK, taskqueuepb.TaskQueueServiceError_OK},
+			[]string{"a", "task1"},
+		},
+		{
+			"one fails",
+			"old",
+			[]*taskqueuepb.TaskQueueAddRequest{tqAdd("mail", "a", 0), tqAdd("mail", "old", 0), tqAdd("mail", "b", 0)},
+			[]taskqueuepb.TaskQueueServiceError_ErrorCode{taskqueuepb.TaskQueueServiceError_SKIPPED, taskqueuepb.TaskQueueServiceError_TASK_ALREADY_EXISTS, taskqueuepb.TaskQueueServiceError_SKIPPED},
+			[]string{"old"},
+		},
+	}
+	for _, tt := range tests {
+		s := newTaskqueueStub(stubQueueYAML)
+		if tt.existing != "" {
+			s.call("Add", tqAdd("mail", tt.existing, 0), &taskqueuepb.TaskQueueAddResponse{})
+		}
+		res := &taskqueuepb.TaskQueueBulkAddResponse{}
+		if err := s.call("BulkAdd", &taskqueuepb.TaskQueueBulkAddRequest{AddRequest: tt.reqs}, res); err != nil {
+			t.Fatal(err)
+		}
+		var codes []taskqueuepb.TaskQueueServiceError_ErrorCode
+		for _, r := range res.Taskresult {
+			codes = append(codes, r.GetResult())
+		}
+		if !reflect.DeepEqual(codes, tt.want) {
+			t.Errorf("%s: BulkAdd = %v, want %v", tt.name, codes, tt.want)
+		}
+		if tasks := tqTasks(t, s, "mail"); !reflect.DeepEqual(tasks, tt.tasks) {
+			t.Errorf("%s: queue holds %q, want %q", tt.name, tasks, tt.tasks)
+		}
+	}
+}
+
+func TestTaskqueueStubETAs(t *testing.T) {
+	s := newTaskqueueStub(stubQueueYAML)
+	for _, req := range []*taskqueuepb.TaskQueueAddRequest{
+		tqAdd("mail", "c", 300), tqAdd("mail", "a", 200), tqAdd("mail", "b", 200), tqAdd("mail", "d", 100),
+	} {
+		if err := s.call("Add", req, &taskqueuepb.TaskQueueAddResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := tqTasks(t, s, "mail"), []string{"d", "a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tasks = %q, want %q", got, want)
+	}
+
+	res := &taskqueuepb.TaskQueueQueryTasksResponse{}
+	if err := s.call("QueryTasks", &taskqueuepb.TaskQueueQueryTasksRequest{QueueName: []byte("mail")}, res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Task) != 1 {
+		t.Fatalf("QueryTasks without MaxRows returned %d tasks, want 1", len(res.Task))
+	}
+	task := res.Task[0]
+	if task.GetEtaUsec() != 100 || string(task.Url) != "/task" || string(task.Body) != "body of d" ||
+		task.GetMethod() != taskqueuepb.TaskQueueQueryTasksResponse_Task_POST {
+		t.Errorf("QueryTasks returned %v", task)
+	}
+
+	stats := &taskqueuepb.TaskQueueFetchQueueStatsResponse{}
+	req := &taskqueuepb.TaskQueueFetchQueueStatsRequest{QueueName: [][]byte{[]byte("mail"), []byte("default")}}
+	if err := s.call("FetchQueueStats", req, stats); err != nil {
+		t.Fatal(err)
+	}
+	var got [][2]int64
+	for _, qs := range stats.Queuestats {
+		got = append(got, [2]int64{int64(qs.GetNumTasks()), qs.GetOldestEtaUsec()})
+	}
+	if want := [][2]int64{{4, 100}, {0, -1}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FetchQueueStats = %v, want %v", got, want)
+	}
+}
+
+func TestTaskqueueStubLeases(t *testing.T) {
+	s := newTaskqueueStub(stubQueueYAML)
+	now := usec(time.Now())
+	for _, req := range []*taskqueuepb.TaskQueueAddRequest{
+		tqAdd("work", "a", now-3), tqAdd("work", "b", now-2), tqAdd("work", "c", now-1), tqAdd("work", "later", now+3600e6),
+	} {
+		req.Tag = []byte(map[string]string{"a": "x", "b": "y", "c": "x"}[string(req.TaskName)])
+		if err := s.call("Add", req, &taskqueuepb.TaskQueueAddResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lease := func(max int64, groupByTag bool, tag string) []string {
+		req := &taskqueuepb.TaskQueueQueryAndOwnTasksRequest{
+			QueueName:    []byte("work"),
+			LeaseSeconds: proto.Float64(60),
+			MaxTasks:     proto.Int64(max),
+			GroupByTag:   proto.Bool(groupByTag),
+		}
+		if tag != "" {
+			req.Tag = []byte(tag)
+		}
+		res := &taskqueuepb.TaskQueueQueryAndOwnTasksResponse{}
+		if err := s.call("QueryAndOwnTasks", req, res); err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, task := range res.Task {
+			names = append(names, string(task.TaskName))
+		}
+		return names
+	}
+	if got, want := lease(10, true, "y"), []string{"b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lease of tag y = %q, want %q", got, want)
+	}
+	if got, want := lease(1, true, ""), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lease of one task of the first tag = %q, want %q", got, want)
+	}
+	// Leased tasks and tasks with a future ETA are not leased again.
+	if got, want := lease(10, false, ""), []string{"c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lease of the remaining tasks = %q, want %q", got, want)
+	}
+	if got := lease(10, false, ""); len(got) != 0 {
+		t.Errorf("lease with every task leased = %q, want none", got)
+	}
+
+	req := &taskqueuepb.TaskQueueQueryTasksRequest{QueueName: []byte("work"), MaxRows: proto.Int32(10)}
+	res := &taskqueuepb.TaskQueueQueryTasksResponse{}
+	if err := s.call("QueryTasks", req, res); err != nil {
+		t.Fatal(err)
+	}
+	var c *taskqueuepb.TaskQueueQueryTasksResponse_Task
+	for _, task := range res.Task {
+		if string(task.TaskName) == "c" {
+			c = task
+		}
+	}
+	if c.GetRetryCount() != 1 || c.Method != nil {
+		t.Errorf("leased pull task = %v, want a retry count of 1 and no method", c)
+	}
+
+	modify := func(eta int64) (*taskqueuepb.TaskQueueModifyTaskLeaseResponse, error) {
+		res := &taskqueuepb.TaskQueueModifyTaskLeaseResponse{}
+		err := s.call("ModifyTaskLease", &taskqueuepb.TaskQueueModifyTaskLeaseRequest{
+			QueueName:    []byte("work"),
+			TaskName:     []byte("c"),
+			EtaUsec:      proto.Int64(eta),
+			LeaseSeconds: proto.Float64(0),
+		}, res)
+		return res, err
+	}
+	if _, err := modify(c.GetEtaUsec() + 1); tqCode(t, err) != taskqueuepb.TaskQueueServiceError_TASK_LEASE_EXPIRED {
+		t.Errorf("ModifyTaskLease with the wrong ETA = %v, want TASK_LEASE_EXPIRED", err)
+	}
+	mres, err := modify(c.GetEtaUsec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mres.GetUpdatedEtaUsec() >= c.GetEtaUsec() {
+		t.Errorf("ModifyTaskLease to 0s moved the ETA from %d to %d", c.GetEtaUsec(), mres.GetUpdatedEtaUsec())
+	}
+	// A task whose lease was given up can be leased again.
+	if got, want := lease(10, false, ""), []string{"c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lease after giving up c = %q, want %q", got, want)
+	}
+
+	push := &taskqueuepb.TaskQueueQueryAndOwnTasksRequest{QueueName: []byte("mail"), LeaseSeconds: proto.Float64(1), MaxTasks: proto.Int64(1)}
+	if err := s.call("QueryAndOwnTasks", push, &taskqueuepb.TaskQueueQueryAndOwnTasksResponse{}); tqCode(t, err) != taskqueuepb.TaskQueueServiceError_INVALID_QUEUE_MODE {
+		t.Errorf("QueryAndOwnTasks on a push queue = %v, want INVALID_QUEUE_MODE", err)
+	}
+}
+
+func TestTaskqueueStubTransactions(t *testing.T) {
+	tests := []struct {
+		name      string
+		committed bool
+		existing  bool // whether a task named "a" is added before the commit
+		want      []string
+	}{
+		{"committed", true, false, []string{"a", "task1"}},
+		{"rolled back", false, false, []string{}},
+		{"committed after a task took the name", true, true, []string{"a", "task1"}},
+		{"rolled back after a task took the name", false, true, []string{"a"}},
+	}
+	for _, tt := range tests {
+		s := newTaskqueueStub(stubQueueYAML)
+		tx := &datastorepb.Transaction{App: proto.String("dev~testapp"), Handle: proto.Uint64(7)}
+		for _, name := range []string{"a", ""} {
+			req := tqAdd("mail", name, 0)
+			req.Transaction = tx
+			if err := s.call("Add", req, &taskqueuepb.TaskQueueAddResponse{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tasks := tqTasks(t, s, "mail"); len(tasks) != 0 {
+			t.Errorf("%s: tasks added in a transaction are visible before it ends: %q", tt.name, tasks)
+		}
+		if tt.existing {
+			req := tqAdd("mail", "a", 0)
+			req.Body = []byte("outside")
+			if err := s.call("Add", req, &taskqueuepb.TaskQueueAddResponse{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s.endTransaction(tx.GetHandle(), tt.committed)
+		if tasks := tqTasks(t, s, "mail"); !reflect.DeepEqual(tasks, tt.want) {
+			t.Errorf("%s: queue holds %q, want %q", tt.name, tasks, tt.want)
+		}
+		if tt.existing {
+			if body := string(s.queues["mail"].tasks["a"].add.Body); body != "outside" {
+				t.Errorf("%s: task a has the body %q, want %q", tt.name, body, "outside")
+			}
+		}
+		if len(s.pending) != 0 {
+			t.Errorf("%s: %d transactions are still pending", tt.name, len(s.pending))
+		}
+	}
+}
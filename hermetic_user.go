@@ -0,0 +1,38 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"net/url"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	userpb "appengine_internal/user"
+)
+
+// userStub implements the user service the way the development server
+// does: login and logout go through its /_ah/login page, and OAuth
+// requests are made by example@example.com.
+func userStub(method string, in, out proto.Message) error {
+	switch method {
+	case "CreateLoginURL":
+		req := in.(*userpb.CreateLoginURLRequest)
+		res := out.(*userpb.CreateLoginURLResponse)
+		res.LoginUrl = proto.String("/_ah/login?continue=" + url.QueryEscape(req.GetDestinationUrl()))
+	case "CreateLogoutURL":
+		req := in.(*userpb.CreateLogoutURLRequest)
+		res := out.(*userpb.CreateLogoutURLResponse)
+		res.LogoutUrl = proto.String("/_ah/login?continue=" + url.QueryEscape(req.GetDestinationUrl()) + "&action=Logout")
+	case "GetOAuthUser":
+		res := out.(*userpb.GetOAuthUserResponse)
+		res.Email = proto.String("example@example.com")
+		res.UserId = proto.String("0")
+		res.AuthDomain = proto.String("gmail.com")
+		res.IsAdmin = proto.Bool(false)
+	default:
+		return callNotFound("user", method)
+	}
+	return nil
+}
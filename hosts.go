@@ -0,0 +1,47 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"net"
+	"net/url"
+)
+
+// childURL returns the URL under which the test reaches u, a URL printed
+// by dev_appserver.py, such as "http://[::1]:8000".
+func (c *Instance) childURL(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	if c.opts.Docker != nil {
+		if host, ok := c.dockerHost(pu.Port()); ok {
+			pu.Host = host
+		}
+	}
+	pu.Host = c.reachableHost(pu.Host)
+	return pu.String()
+}
+
+// reachableHost returns hostport with its host replaced by
+// Options.HostOverride, if set, or by the loopback address if it is the
+// unspecified address, which servers listen on but clients cannot dial on
+// every OS.
+func (c *Instance) reachableHost(hostport string) string {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	switch ip := net.ParseIP(host); {
+	case c.opts.HostOverride != "":
+		host = c.opts.HostOverride
+	case ip == nil || !ip.IsUnspecified():
+	case ip.To4() != nil:
+		host = "127.0.0.1"
+	default:
+		host = "::1"
+	}
+	return net.JoinHostPort(host, port)
+}
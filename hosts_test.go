@@ -0,0 +1,31 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import "testing"
+
+func TestReachableHost(t *testing.T) {
+	tests := []struct {
+		override string
+		hostport string
+		want     string
+	}{
+		{"", "0.0.0.0:8000", "127.0.0.1:8000"},
+		{"", "[::]:8000", "[::1]:8000"},
+		{"", "127.0.0.1:8000", "127.0.0.1:8000"},
+		{"", "[::1]:8000", "[::1]:8000"},
+		{"", "localhost:8000", "localhost:8000"},
+		{"", "localhost", "localhost"},
+		{"docker.local", "0.0.0.0:8000", "docker.local:8000"},
+		{"docker.local", "localhost:8000", "docker.local:8000"},
+		{"::1", "0.0.0.0:8000", "[::1]:8000"},
+	}
+	for _, tt := range tests {
+		c := &Instance{instance: &instance{opts: Options{HostOverride: tt.override}}}
+		if got := c.reachableHost(tt.hostport); got != tt.want {
+			t.Errorf("reachableHost(%q) with HostOverride %q = %q, want %q", tt.hostport, tt.override, got, tt.want)
+		}
+	}
+}
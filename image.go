@@ -0,0 +1,34 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"appengine"
+	"appengine/image"
+)
+
+// ImageServingURL stores the image data in the blobstore and returns
+// its blob key together with the URL returned by image.ServingURL
+// for the given options.
+func (c *Instance) ImageServingURL(data []byte, opts *image.ServingURLOptions) (appengine.BlobKey, *url.URL, error) {
+	mimeType := http.DetectContentType(data)
+	if !strings.HasPrefix(mimeType, "image/") {
+		return "", nil, fmt.Errorf("aetest: data is %s, not an image", mimeType)
+	}
+	key, err := c.WriteBlob("", data)
+	if err != nil {
+		return "", nil, err
+	}
+	u, err := image.ServingURL(c, key, opts)
+	if err != nil {
+		return key, nil, err
+	}
+	return key, u, nil
+}
@@ -0,0 +1,32 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"time"
+)
+
+// InjectLatency delays every call to service by d. A call whose
+// timeout is shorter than d fails with a timeout error once its
+// timeout elapses. A d of zero removes the delay.
+func (c *Instance) InjectLatency(service string, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.latencies == nil {
+		c.latencies = make(map[string]time.Duration)
+	}
+	if d <= 0 {
+		delete(c.latencies, service)
+		return
+	}
+	c.latencies[service] = d
+}
+
+// latency returns the delay injected into the calls to service.
+func (c *Instance) latency(service string) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.latencies[service]
+}
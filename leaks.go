@@ -0,0 +1,102 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	datastorepb "appengine_internal/datastore"
+	filepb "appengine_internal/files"
+)
+
+// trackOpenWork records the transactions and blobstore files that are
+// still open, for Verify.
+func (c *Instance) trackOpenWork(service, method string, in, out proto.Message, next func() error) error {
+	err := next()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if service == "datastore_v3" && (method == "Commit" || method == "Rollback") {
+		// The transaction is over even if it failed to commit, as
+		// datastore.RunInTransaction does not roll it back then.
+		delete(c.openTxns, in.(*datastorepb.Transaction).GetHandle())
+	}
+	if err != nil {
+		return err
+	}
+	switch service + "." + method {
+	case "datastore_v3.BeginTransaction":
+		if c.openTxns == nil {
+			c.openTxns = make(map[uint64]bool)
+		}
+		c.openTxns[out.(*datastorepb.Transaction).GetHandle()] = true
+	case "file.Create":
+		if c.openFiles == nil {
+			c.openFiles = make(map[string]bool)
+		}
+		c.openFiles[out.(*filepb.CreateResponse).GetFilename()] = true
+	case "file.Close":
+		if req := in.(*filepb.CloseRequest); req.GetFinalize() {
+			delete(c.openFiles, req.GetFilename())
+		}
+	}
+	return nil
+}
+
+// Verify reports an error to t for every piece of work left behind:
+// queued tasks, open transactions, unfinalized blobstore files, and
+// channel messages sent to clients that never had a channel.
+func (c *Instance) Verify(t testing.TB) {
+	for _, leak := range c.leaks() {
+		t.Errorf("aetest: %s", leak)
+	}
+}
+
+// leaks describes the work left behind by the test.
+func (c *Instance) leaks() []string {
+	var leaks []string
+	queues, err := c.queueNames()
+	if err != nil {
+		leaks = append(leaks, fmt.Sprintf("unable to list task queues: %v", err))
+	}
+	for _, q := range queues {
+		tasks, err := c.queuedTasks(q)
+		if err != nil {
+			leaks = append(leaks, fmt.Sprintf("unable to list tasks in queue %q: %v", q, err))
+			continue
+		}
+		if len(tasks) > 0 {
+			leaks = append(leaks, fmt.Sprintf("queue %q has %d pending task(s)", q, len(tasks)))
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n := len(c.openTxns); n > 0 {
+		leaks = append(leaks, fmt.Sprintf("%d transaction(s) neither committed nor rolled back", n))
+	}
+	var files []string
+	for f := range c.openFiles {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		leaks = append(leaks, fmt.Sprintf("blobstore file %s is not finalized", f))
+	}
+	var ids []string
+	for id := range c.channelMessages {
+		if len(c.channelTokens[id]) == 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		leaks = append(leaks, fmt.Sprintf("%d channel message(s) sent to client %q, which has no channel", len(c.channelMessages[id]), id))
+	}
+	return leaks
+}
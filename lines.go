@@ -0,0 +1,53 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// defaultMaxLogLine is the default of Options.MaxLogLine.
+const defaultMaxLogLine = 64 << 10
+
+func (o *Options) maxLogLine() int {
+	if o.MaxLogLine <= 0 {
+		return defaultMaxLogLine
+	}
+	return o.MaxLogLine
+}
+
+// readLines calls f with each line read from r, without its line ending.
+// Lines longer than max bytes are cut to their first max bytes, so that a
+// long line, such as a stack trace with a huge payload, does not stop the
+// reading. It returns nil at EOF.
+func readLines(r io.Reader, max int, f func(line []byte)) error {
+	br := bufio.NewReader(r)
+	var line []byte
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if n := max - len(line); n > 0 {
+			if n > len(chunk) {
+				n = len(chunk)
+			}
+			line = append(line, chunk[:n]...)
+		}
+		switch err {
+		case bufio.ErrBufferFull:
+			continue
+		case nil:
+			f(bytes.TrimRight(line, "\r\n"))
+			line = line[:0]
+		case io.EOF:
+			if len(line) > 0 {
+				f(line)
+			}
+			return nil
+		default:
+			return err
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadLines(t *testing.T) {
+	long := strings.Repeat("x", 10000)
+	tests := []struct {
+		in   string
+		max  int
+		want []string
+	}{
+		{"", 10, nil},
+		{"a\nb\n", 10, []string{"a", "b"}},
+		{"a\r\nb", 10, []string{"a", "b"}},
+		{"\n\n", 10, []string{"", ""}},
+		{"abcdef\nghi\n", 3, []string{"abc", "ghi"}},
+		{long + "\nend\n", 5000, []string{long[:5000], "end"}},
+		{long + "\nend", 20000, []string{long, "end"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		err := readLines(strings.NewReader(tt.in), tt.max, func(line []byte) {
+			got = append(got, string(line))
+		})
+		if err != nil {
+			t.Errorf("readLines(%.20q, %d) failed: %v", tt.in, tt.max, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("readLines(%.20q, %d) = %.40q, want %.40q", tt.in, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestReadLinesError(t *testing.T) {
+	want := errors.New("boom")
+	if err := readLines(iotest.ErrReader(want), 10, func([]byte) {}); err != want {
+		t.Errorf("readLines returned %v, want %v", err, want)
+	}
+}
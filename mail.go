@@ -0,0 +1,247 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	netmail "net/mail"
+	"net/textproto"
+	"strings"
+
+	"appengine/mail"
+	"code.google.com/p/goprotobuf/proto"
+
+	mailpb "appengine_internal/mail"
+)
+
+// sentMail is a message sent through the mail service: the MIME message
+// the mail stub delivered to the SMTP sink, with its envelope
+// recipients, or else the message as it was handed to the service.
+type sentMail struct {
+	rcpts []string
+	data  []byte
+	msg   mail.Message
+}
+
+// deliverMail records a message delivered to the SMTP sink.
+func (c *Instance) deliverMail(rcpts []string, data []byte) {
+	c.mu.Lock()
+	c.mail = append(c.mail, sentMail{rcpts: rcpts, data: data})
+	c.mu.Unlock()
+}
+
+// captureMail records messages that were successfully handed to the mail
+// service and that its stub does not deliver to the SMTP sink: all of
+// them without a sink, and those sent to the admins otherwise.
+func (c *Instance) captureMail(service, method string, in, out proto.Message, next func() error) error {
+	if err := next(); err != nil || service != "mail" {
+		return err
+	}
+	if method != "Send" && method != "SendToAdmins" || method == "Send" && c.smtp != nil {
+		return nil
+	}
+	msg := toMessage(in.(*mailpb.MailMessage))
+	c.mu.Lock()
+	c.mail = append(c.mail, sentMail{msg: msg})
+	c.mu.Unlock()
+	return nil
+}
+
+// SentMessages returns the email messages sent through the mail
+// service, in the order they were sent. When an API server runs
+// outside a container, its mail stub delivers the messages to an SMTP
+// server of the context, so they include those sent by the served app
+// and with RawCall. Otherwise, and for the messages sent to the
+// admins, which the stub only logs, they are captured from the API
+// calls of the context and the contexts derived from it.
+func (c *Instance) SentMessages() ([]mail.Message, error) {
+	c.mu.Lock()
+	sent := append([]sentMail(nil), c.mail...)
+	c.mu.Unlock()
+	msgs := make([]mail.Message, len(sent))
+	for i, m := range sent {
+		if m.data == nil {
+			msgs[i] = m.msg
+			continue
+		}
+		msg, err := parseMail(m.rcpts, m.data)
+		if err != nil {
+			return nil, fmt.Errorf("aetest: unable to parse the message delivered by the mail stub: %v", err)
+		}
+		msgs[i] = msg
+	}
+	return msgs, nil
+}
+
+// toMessage converts a mail service request to a mail.Message.
+func toMessage(m *mailpb.MailMessage) mail.Message {
+	msg := mail.Message{
+		Sender:  m.GetSender(),
+		ReplyTo: m.GetReplyTo(),
+		To:      m.To,
+		Cc:      m.Cc,
+		Bcc:     m.Bcc,
+		Subject: m.GetSubject(),
+		Body:    m.GetTextBody(),
+		HTML:    m.GetHtmlBody(),
+	}
+	for _, a := range m.Attachment {
+		msg.Attachments = append(msg.Attachments, mail.Attachment{
+			Name:      a.GetFileName(),
+			Data:      a.Data,
+			ContentID: a.GetContentID(),
+		})
+	}
+	if len(m.Header) > 0 {
+		msg.Headers = make(netmail.Header)
+		for _, h := range m.Header {
+			msg.Headers[h.GetName()] = append(msg.Headers[h.GetName()], h.GetValue())
+		}
+	}
+	return msg
+}
+
+// mailHeaders are the headers that the mail service lets an app set.
+var mailHeaders = []string{
+	"Auto-Submitted", "In-Reply-To", "List-Id", "List-Unsubscribe",
+	"On-Behalf-Of", "References", "Resent-Date", "Resent-From", "Resent-To",
+}
+
+// parseMail converts a MIME message that was delivered to the envelope
+// recipients rcpts to a mail.Message. The recipients missing from its To
+// and Cc headers are its Bcc.
+func parseMail(rcpts []string, data []byte) (mail.Message, error) {
+	h, body, err := readMIME(data)
+	if err != nil {
+		return mail.Message{}, err
+	}
+	dec := new(mime.WordDecoder)
+	subject, err := dec.DecodeHeader(h.Get("Subject"))
+	if err != nil {
+		return mail.Message{}, err
+	}
+	msg := mail.Message{
+		Sender:  h.Get("From"),
+		ReplyTo: h.Get("Reply-To"),
+		To:      splitAddresses(h.Get("To")),
+		Cc:      splitAddresses(h.Get("Cc")),
+		Subject: subject,
+	}
+	seen := make(map[string]bool)
+	for _, a := range append(append([]string(nil), msg.To...), msg.Cc...) {
+		seen[addrSpec(a)] = true
+	}
+	for _, r := range rcpts {
+		if !seen[addrSpec(r)] {
+			msg.Bcc = append(msg.Bcc, r)
+		}
+	}
+	for _, k := range mailHeaders {
+		if v, ok := h[k]; ok {
+			if msg.Headers == nil {
+				msg.Headers = make(netmail.Header)
+			}
+			msg.Headers[k] = v
+		}
+	}
+	if err := parseMailPart(&msg, h, body); err != nil {
+		return mail.Message{}, err
+	}
+	return msg, nil
+}
+
+// parseMailPart adds the part of a message with header h to msg: its
+// text or HTML body, its attachments, or the parts it is made of.
+func parseMailPart(msg *mail.Message, h textproto.MIMEHeader, body io.Reader) error {
+	ct := h.Get("Content-Type")
+	if ct == "" {
+		ct = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		r := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := r.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := parseMailPart(msg, p.Header, p); err != nil {
+				return err
+			}
+		}
+	}
+	if strings.EqualFold(h.Get("Content-Transfer-Encoding"), "base64") {
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	disposition, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	switch {
+	case disposition != "attachment" && mediaType == "text/plain" && msg.Body == "":
+		msg.Body = string(data)
+	case disposition != "attachment" && mediaType == "text/html" && msg.HTML == "":
+		msg.HTML = string(data)
+	default:
+		name := dparams["filename"]
+		if name == "" {
+			name = params["name"]
+		}
+		msg.Attachments = append(msg.Attachments, mail.Attachment{
+			Name:      name,
+			Data:      data,
+			ContentID: h.Get("Content-Id"),
+		})
+	}
+	return nil
+}
+
+// splitAddresses splits a list of addresses at the commas that are not
+// quoted or in angle brackets.
+func splitAddresses(s string) []string {
+	var addrs []string
+	quoted, angle, start := false, false, 0
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) {
+			switch s[i] {
+			case '"':
+				quoted = !quoted
+			case '<':
+				angle = !quoted
+			case '>':
+				angle = false
+			}
+			if s[i] != ',' || quoted || angle {
+				continue
+			}
+		}
+		if a := strings.TrimSpace(s[start:i]); a != "" {
+			addrs = append(addrs, a)
+		}
+		start = i + 1
+	}
+	return addrs
+}
+
+// addrSpec returns the lower-cased address of an address, for comparing
+// addresses.
+func addrSpec(a string) string {
+	if pa, err := netmail.ParseAddress(a); err == nil {
+		a = pa.Address
+	}
+	return strings.ToLower(a)
+}
@@ -0,0 +1,131 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	netmail "net/mail"
+	"net/smtp"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"appengine/mail"
+)
+
+// pythonMail is a message as the mail stub of the SDK formats it.
+const pythonMail = `Content-Type: multipart/mixed; boundary="===============1=="
+MIME-Version: 1.0
+To: Bob <bob@example.com>, "Smith, Carol" <carol@example.com>
+Cc: dave@example.com
+From: app@example.com
+Reply-To: support@example.com
+Subject: =?utf-8?b?SMOpbGxv?=
+In-Reply-To: <1@example.com>
+
+--===============1==
+Content-Type: multipart/alternative; boundary="===============2=="
+MIME-Version: 1.0
+
+--===============2==
+Content-Type: text/plain; charset="us-ascii"
+MIME-Version: 1.0
+Content-Transfer-Encoding: 7bit
+
+Hello, Bob.
+--===============2==
+Content-Type: text/html; charset="utf-8"
+MIME-Version: 1.0
+Content-Transfer-Encoding: base64
+
+PHA+SMOpbGxvPC9wPg==
+
+--===============2==--
+--===============1==
+Content-Type: application/octet-stream
+MIME-Version: 1.0
+Content-Transfer-Encoding: base64
+Content-Disposition: attachment; filename="report.csv"
+Content-ID: <report>
+
+YSxiCjEsMgo=
+
+--===============1==--
+`
+
+func TestSMTPSink(t *testing.T) {
+	type delivery struct {
+		rcpts []string
+		data  string
+	}
+	got := make(chan delivery, 1)
+	s, err := newSMTPSink(func(rcpts []string, data []byte) {
+		got <- delivery{rcpts, string(data)}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	rcpts := []string{"bob@example.com", "carol@example.com", "dave@example.com", "eve@example.com"}
+	msg := strings.Replace(pythonMail, "\n", "\r\n", -1)
+	if err := smtp.SendMail("127.0.0.1:"+strconv.Itoa(s.port()), nil, "app@example.com", rcpts, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	d := <-got
+	if !reflect.DeepEqual(d.rcpts, rcpts) {
+		t.Errorf("recipients = %q, want %q", d.rcpts, rcpts)
+	}
+	if d.data != pythonMail {
+		t.Errorf("data = %q, want %q", d.data, pythonMail)
+	}
+}
+
+func TestParseMail(t *testing.T) {
+	rcpts := []string{"bob@example.com", "carol@example.com", "Dave@example.com", "eve@example.com"}
+	got, err := parseMail(rcpts, []byte(pythonMail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mail.Message{
+		Sender:  "app@example.com",
+		ReplyTo: "support@example.com",
+		To:      []string{"Bob <bob@example.com>", `"Smith, Carol" <carol@example.com>`},
+		Cc:      []string{"dave@example.com"},
+		Bcc:     []string{"eve@example.com"},
+		Subject: "Héllo",
+		Body:    "Hello, Bob.",
+		HTML:    "<p>Héllo</p>",
+		Attachments: []mail.Attachment{
+			{Name: "report.csv", Data: []byte("a,b\n1,2\n"), ContentID: "<report>"},
+		},
+		Headers: netmail.Header{"In-Reply-To": {"<1@example.com>"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseMail = %+v, want %+v", got, want)
+	}
+
+	if _, err := parseMail(rcpts, []byte("Content-Type: multipart/mixed; boundary=\"x\"\n\n--x\nContent-Type: ;\n\nbody\n--x--\n")); err == nil {
+		t.Errorf("parseMail of a malformed part succeeded")
+	}
+}
+
+func TestSplitAddresses(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"a@example.com", []string{"a@example.com"}},
+		{"a@example.com, b@example.com", []string{"a@example.com", "b@example.com"}},
+		{`"Smith, Carol" <carol@example.com>, Bob <bob@example.com>`, []string{`"Smith, Carol" <carol@example.com>`, "Bob <bob@example.com>"}},
+		{"<a,b@example.com>, c@example.com,", []string{"<a,b@example.com>", "c@example.com"}},
+	}
+	for _, tt := range tests {
+		if got := splitAddresses(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitAddresses(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
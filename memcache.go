@@ -0,0 +1,163 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"sort"
+
+	"appengine/memcache"
+	"appengine_internal"
+	"code.google.com/p/goprotobuf/proto"
+
+	memcachepb "appengine_internal/memcache"
+)
+
+// MemcacheMode is the behavior of the memcache service.
+type MemcacheMode int
+
+const (
+	// MemcacheNormal is the usual behavior of memcache.
+	MemcacheNormal MemcacheMode = iota
+	// MemcacheEvicting makes memcache evict every item as soon as it
+	// is stored, so that every lookup misses.
+	MemcacheEvicting
+	// MemcacheDown makes every memcache call fail.
+	MemcacheDown
+)
+
+// ClearMemcache removes every item from memcache.
+func (c *Instance) ClearMemcache() error {
+	return memcache.Flush(c)
+}
+
+// SetMemcacheMode changes the behavior of memcache, to simulate a
+// cold or unavailable cache.
+func (c *Instance) SetMemcacheMode(mode MemcacheMode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.memcacheMode = mode
+}
+
+// simulateMemcache applies the memcache mode set by SetMemcacheMode.
+func (c *Instance) simulateMemcache(service, method string, in, out proto.Message, next func() error) error {
+	if service != "memcache" {
+		return next()
+	}
+	c.mu.Lock()
+	mode := c.memcacheMode
+	c.mu.Unlock()
+	switch mode {
+	case MemcacheDown:
+		return &appengine_internal.APIError{
+			Service: "memcache",
+			Detail:  "memcache service is unavailable",
+			Code:    int32(memcachepb.MemcacheServiceError_UNSPECIFIED_ERROR),
+		}
+	case MemcacheEvicting:
+		if err := next(); err != nil {
+			return err
+		}
+		ns, keys := writtenKeys(method, in)
+		if len(keys) == 0 {
+			return nil
+		}
+		// Delete the items just written, rather than flushing, which
+		// would reset the statistics. The call bypasses the hooks,
+		// which must not see a call the code under test did not make.
+		req := &memcachepb.MemcacheDeleteRequest{
+			NameSpace: proto.String(ns),
+		}
+		for _, k := range keys {
+			req.Item = append(req.Item, &memcachepb.MemcacheDeleteRequest_Item{Key: k})
+		}
+		return c.dispatch("memcache", "Delete", req, &memcachepb.MemcacheDeleteResponse{}, nil)
+	}
+	return next()
+}
+
+// writtenKeys returns the namespace and keys of the items a memcache call
+// stores, if any.
+func writtenKeys(method string, in proto.Message) (ns string, keys [][]byte) {
+	switch method {
+	case "Set":
+		req := in.(*memcachepb.MemcacheSetRequest)
+		ns = req.GetNameSpace()
+		for _, item := range req.Item {
+			keys = append(keys, item.Key)
+		}
+	case "Increment":
+		req := in.(*memcachepb.MemcacheIncrementRequest)
+		ns = req.GetNameSpace()
+		keys = append(keys, req.Key)
+	case "BatchIncrement":
+		req := in.(*memcachepb.MemcacheBatchIncrementRequest)
+		ns = req.GetNameSpace()
+		for _, item := range req.Item {
+			keys = append(keys, item.Key)
+		}
+	}
+	return ns, keys
+}
+
+// MemcacheStats returns the memcache statistics, including the hit
+// and miss counts.
+func (c *Instance) MemcacheStats() (*memcache.Statistics, error) {
+	return memcache.Stats(c)
+}
+
+// trackMemcacheKeys records the keys of the items stored in memcache.
+func (c *Instance) trackMemcacheKeys(service, method string, in, out proto.Message, next func() error) error {
+	if service != "memcache" {
+		return next()
+	}
+	if err := next(); err != nil {
+		return err
+	}
+	ns, keys := writtenKeys(method, in)
+	if len(keys) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.memcacheKeys == nil {
+		c.memcacheKeys = make(map[string]map[string]bool)
+	}
+	if c.memcacheKeys[ns] == nil {
+		c.memcacheKeys[ns] = make(map[string]bool)
+	}
+	for _, k := range keys {
+		c.memcacheKeys[ns][string(k)] = true
+	}
+	return nil
+}
+
+// MemcacheKeys returns, in order, the keys of the items stored in
+// memcache in the context's namespace that memcache still holds.
+func (c *Instance) MemcacheKeys() ([]string, error) {
+	ns := c.currentNamespace()
+	req := &memcachepb.MemcacheGetRequest{
+		NameSpace: proto.String(ns),
+	}
+	c.mu.Lock()
+	for k := range c.memcacheKeys[ns] {
+		req.Key = append(req.Key, []byte(k))
+	}
+	c.mu.Unlock()
+	if len(req.Key) == 0 {
+		return nil, nil
+	}
+
+	// Keep only the keys that memcache still holds.
+	res := &memcachepb.MemcacheGetResponse{}
+	if err := c.Call("memcache", "Get", req, res, nil); err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(res.Item))
+	for i, item := range res.Item {
+		keys[i] = string(item.Key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
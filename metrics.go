@@ -0,0 +1,22 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"time"
+)
+
+// A MetricsSink receives timings of a context, for instance to track the
+// overhead of aetest in a test suite. Its methods may be called from
+// several goroutines at once.
+type MetricsSink interface {
+	// Startup reports the time NewContext took to start the API
+	// server.
+	Startup(d time.Duration)
+	// Call reports the time an API call took, and its error.
+	Call(service, method string, d time.Duration, err error)
+	// Shutdown reports the time Close took to stop the API server.
+	Shutdown(d time.Duration)
+}
@@ -0,0 +1,214 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"appengine_internal"
+	"code.google.com/p/goprotobuf/proto"
+
+	modulespb "appengine_internal/modules"
+)
+
+// Module describes a module reported by the modules service.
+type Module struct {
+	Name string
+	// Versions lists the versions of the module.
+	Versions []string
+	// DefaultVersion is the version that serves the module by default.
+	// If empty, the first of Versions is used.
+	DefaultVersion string
+	// Instances is the initial number of instances of each version. The
+	// instances are addressed by their index, from 0 to Instances-1, as
+	// in appengine.ModuleHostname, which fails for other indexes.
+	Instances int
+}
+
+// ModuleCall is a call that starts, stops or reconfigures a module.
+type ModuleCall struct {
+	// Method is the modules service method, such as "StartModule".
+	Method    string
+	Module    string
+	Version   string
+	Instances int // set for SetNumInstances only
+}
+
+// moduleState is the simulated state of a module.
+type moduleState struct {
+	versions       []string
+	defaultVersion string
+	instances      map[string]int64 // keyed by version
+	stopped        map[string]bool  // keyed by version
+}
+
+func newModuleSet(modules []Module) map[string]*moduleState {
+	set := make(map[string]*moduleState)
+	for _, m := range modules {
+		ms := &moduleState{
+			versions:       m.Versions,
+			defaultVersion: m.DefaultVersion,
+			instances:      make(map[string]int64),
+			stopped:        make(map[string]bool),
+		}
+		if ms.defaultVersion == "" && len(m.Versions) > 0 {
+			ms.defaultVersion = m.Versions[0]
+		}
+		for _, v := range m.Versions {
+			ms.instances[v] = int64(m.Instances)
+		}
+		set[m.Name] = ms
+	}
+	return set
+}
+
+// hasInstance reports whether version has an instance of index inst.
+func (ms *moduleState) hasInstance(version, inst string) bool {
+	i, err := strconv.ParseInt(inst, 10, 64)
+	return err == nil && i >= 0 && i < ms.instances[version]
+}
+
+func modulesError(code modulespb.ModulesServiceError_ErrorCode, format string, args ...interface{}) error {
+	return &appengine_internal.APIError{
+		Service: "modules",
+		Detail:  fmt.Sprintf(format, args...),
+		Code:    int32(code),
+	}
+}
+
+// lookupModule returns the named module and resolves version against it.
+// Empty names refer to the default module and its default version.
+func (c *Instance) lookupModule(module, version string) (*moduleState, string, error) {
+	if module == "" {
+		module = "default"
+	}
+	ms, ok := c.modules[module]
+	if !ok {
+		return nil, "", modulesError(modulespb.ModulesServiceError_INVALID_MODULE, "unknown module %q", module)
+	}
+	if version == "" {
+		version = ms.defaultVersion
+	}
+	if _, ok := ms.instances[version]; !ok {
+		return nil, "", modulesError(modulespb.ModulesServiceError_INVALID_VERSION, "unknown version %q of module %q", version, module)
+	}
+	return ms, version, nil
+}
+
+// ModuleCalls returns the calls made to the modules service that
+// start, stop or reconfigure a module, in the order they were made.
+func (c *Instance) ModuleCalls() []ModuleCall {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]ModuleCall(nil), c.moduleCalls...)
+}
+
+// simulateModules records calls that change module state and, if
+// Options.Modules is set, answers modules service calls from it.
+func (c *Instance) simulateModules(service, method string, in, out proto.Message, next func() error) error {
+	if service != "modules" {
+		return next()
+	}
+	var call *ModuleCall
+	switch req := in.(type) {
+	case *modulespb.SetNumInstancesRequest:
+		call = &ModuleCall{Method: method, Module: req.GetModule(), Version: req.GetVersion(), Instances: int(req.GetInstances())}
+	case *modulespb.StartModuleRequest:
+		call = &ModuleCall{Method: method, Module: req.GetModule(), Version: req.GetVersion()}
+	case *modulespb.StopModuleRequest:
+		call = &ModuleCall{Method: method, Module: req.GetModule(), Version: req.GetVersion()}
+	}
+	if call != nil {
+		c.mu.Lock()
+		c.moduleCalls = append(c.moduleCalls, *call)
+		c.mu.Unlock()
+	}
+	if c.modules == nil {
+		return next()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.answerModules(method, in, out)
+}
+
+// answerModules answers a modules service call from the simulated module
+// state. c.mu must be held.
+func (c *Instance) answerModules(method string, in, out proto.Message) error {
+	switch req := in.(type) {
+	case *modulespb.GetModulesRequest:
+		res := out.(*modulespb.GetModulesResponse)
+		for name := range c.modules {
+			res.Module = append(res.Module, name)
+		}
+		sort.Strings(res.Module)
+	case *modulespb.GetVersionsRequest:
+		ms, _, err := c.lookupModule(req.GetModule(), "")
+		if err != nil {
+			return err
+		}
+		out.(*modulespb.GetVersionsResponse).Version = append([]string(nil), ms.versions...)
+	case *modulespb.GetDefaultVersionRequest:
+		_, v, err := c.lookupModule(req.GetModule(), "")
+		if err != nil {
+			return err
+		}
+		out.(*modulespb.GetDefaultVersionResponse).Version = proto.String(v)
+	case *modulespb.GetNumInstancesRequest:
+		ms, v, err := c.lookupModule(req.GetModule(), req.GetVersion())
+		if err != nil {
+			return err
+		}
+		out.(*modulespb.GetNumInstancesResponse).Instances = proto.Int64(ms.instances[v])
+	case *modulespb.SetNumInstancesRequest:
+		ms, v, err := c.lookupModule(req.GetModule(), req.GetVersion())
+		if err != nil {
+			return err
+		}
+		if req.GetInstances() < 0 {
+			return modulesError(modulespb.ModulesServiceError_INVALID_INSTANCES, "invalid number of instances %d", req.GetInstances())
+		}
+		ms.instances[v] = req.GetInstances()
+	case *modulespb.StartModuleRequest:
+		ms, v, err := c.lookupModule(req.GetModule(), req.GetVersion())
+		if err != nil {
+			return err
+		}
+		if !ms.stopped[v] {
+			return modulesError(modulespb.ModulesServiceError_UNEXPECTED_STATE, "version %q is already started", v)
+		}
+		delete(ms.stopped, v)
+	case *modulespb.StopModuleRequest:
+		ms, v, err := c.lookupModule(req.GetModule(), req.GetVersion())
+		if err != nil {
+			return err
+		}
+		if ms.stopped[v] {
+			return modulesError(modulespb.ModulesServiceError_UNEXPECTED_STATE, "version %q is already stopped", v)
+		}
+		ms.stopped[v] = true
+	case *modulespb.GetHostnameRequest:
+		module := req.GetModule()
+		if module == "" {
+			module = "default"
+		}
+		ms, v, err := c.lookupModule(module, req.GetVersion())
+		if err != nil {
+			return err
+		}
+		host := fmt.Sprintf("%s.%s.%s.appspot.com", v, module, c.appID)
+		if inst := req.GetInstance(); inst != "" {
+			if !ms.hasInstance(v, inst) {
+				return modulesError(modulespb.ModulesServiceError_INVALID_INSTANCES, "version %q of module %q has no instance %q", v, module, inst)
+			}
+			host = inst + "." + host
+		}
+		out.(*modulespb.GetHostnameResponse).Hostname = proto.String(host)
+	default:
+		return modulesError(modulespb.ModulesServiceError_TRANSIENT_ERROR, "unsupported method %q", method)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"fmt"
+	"regexp"
+
+	"appengine_internal"
+)
+
+// validNamespace matches the namespaces accepted by appengine.Namespace.
+var validNamespace = regexp.MustCompile(`^[0-9A-Za-z._-]{0,100}$`)
+
+// SetNamespace makes the context use the given namespace for the
+// API calls that do not name one, as if every call was made through
+// appengine.Namespace. The empty namespace is the default.
+func (c *Instance) SetNamespace(namespace string) error {
+	if !validNamespace.MatchString(namespace) {
+		return fmt.Errorf("aetest: invalid namespace %q", namespace)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.namespace = namespace
+	return nil
+}
+
+// currentNamespace returns the namespace set by SetNamespace.
+func (c *Instance) currentNamespace() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.namespace
+}
+
+// applyNamespace sets the namespace of an API request that does not name
+// one already. Requests made through appengine.Namespace always do.
+func (c *Instance) applyNamespace(service string, in appengine_internal.ProtoMessage) {
+	ns := c.currentNamespace()
+	if ns == "" {
+		return
+	}
+	if mod, ok := appengine_internal.NamespaceMods[service]; ok {
+		mod(in, ns)
+	}
+}
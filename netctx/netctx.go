@@ -0,0 +1,180 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package netctx adapts the contexts of the aetest package to the
+// google.golang.org/appengine packages, and back.
+package netctx
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+
+	"appengine"
+	"appengine_internal"
+	"code.google.com/p/goprotobuf/proto"
+	gproto "github.com/golang/protobuf/proto"
+	"github.com/jeisenberg/aetest"
+	netcontext "golang.org/x/net/context"
+	netappengine "google.golang.org/appengine"
+	netdatastore "google.golang.org/appengine/datastore"
+)
+
+// NewNetContext is like aetest.NewContext, but also returns a context for the
+// google.golang.org/appengine packages. The API calls made with that
+// context go through the returned Context, as if they had been made
+// with the classic appengine packages.
+func NewNetContext(opts *aetest.Options) (netcontext.Context, aetest.Context, error) {
+	c, err := aetest.NewContext(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ContextOf(c), c, nil
+}
+
+// contextKey is the key of the Context a context returned by ContextOf
+// is bound to.
+type contextKey struct{}
+
+// ContextOf returns a context for the google.golang.org/appengine packages
+// whose API calls go through c, as if they had been made with the classic
+// appengine packages.
+func ContextOf(c aetest.Context) netcontext.Context {
+	// The google.golang.org/appengine packages find the classic context
+	// of a request with appengine.NewContext, so c is registered for a
+	// request only while the context is made.
+	req, _ := http.NewRequest("GET", "/", nil)
+	release := appengine_internal.RegisterTestContext(req, classicContext{c})
+	defer release()
+	ctx := netcontext.WithValue(netcontext.Background(), contextKey{}, c)
+	return netappengine.WithContext(ctx, req)
+}
+
+// classicContext is a Context that also accepts the messages of the
+// google.golang.org/appengine packages, converting them to those of the
+// classic appengine packages the hooks of the Context expect.
+type classicContext struct {
+	aetest.Context
+}
+
+func (c classicContext) Call(service, method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	if gproto.MessageName(in) == "" {
+		// A classic message, such as those of the __go__ calls.
+		return c.Context.Call(service, method, in, out, opts)
+	}
+	cin, err := newClassicMessage(in)
+	if err != nil {
+		return err
+	}
+	b, err := gproto.Marshal(in)
+	if err != nil {
+		return err
+	}
+	if err := proto.Unmarshal(b, cin); err != nil {
+		return err
+	}
+	cout, err := newClassicMessage(out)
+	if err != nil {
+		return err
+	}
+	if err := c.Context.Call(service, method, cin, cout, opts); err != nil {
+		return err
+	}
+	if b, err = proto.Marshal(cout); err != nil {
+		return err
+	}
+	return gproto.Unmarshal(b, out)
+}
+
+// FromContext returns a context for the classic appengine packages whose
+// API calls are made with ctx, a context of the google.golang.org/appengine
+// packages. If ctx was returned by ContextOf, FromContext returns the
+// Context it is bound to.
+func FromContext(ctx netcontext.Context) appengine.Context {
+	if c, ok := ctx.Value(contextKey{}).(aetest.Context); ok {
+		return c
+	}
+	return &netContext{ctx: ctx}
+}
+
+// netContext implements appengine.Context on top of a context of the
+// google.golang.org/appengine packages.
+type netContext struct {
+	ctx netcontext.Context
+}
+
+func (c *netContext) Call(service, method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	nin, err := newNetMessage(in)
+	if err != nil {
+		return err
+	}
+	b, err := proto.Marshal(in)
+	if err != nil {
+		return err
+	}
+	if err := gproto.Unmarshal(b, nin); err != nil {
+		return err
+	}
+	nout, err := newNetMessage(out)
+	if err != nil {
+		return err
+	}
+	ctx := c.ctx
+	if opts != nil && opts.Timeout != 0 {
+		var cancel netcontext.CancelFunc
+		ctx, cancel = netcontext.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	if err := netappengine.APICall(ctx, service, method, nin, nout); err != nil {
+		return err
+	}
+	if b, err = gproto.Marshal(nout); err != nil {
+		return err
+	}
+	return proto.Unmarshal(b, out)
+}
+
+// FullyQualifiedAppID returns the app ID of the keys made with c.ctx, which
+// unlike appengine.AppID keeps the partition.
+func (c *netContext) FullyQualifiedAppID() string {
+	return netdatastore.NewKey(c.ctx, "Kind", "", 1, nil).AppID()
+}
+
+func (c *netContext) Request() interface{} { return nil }
+
+func (c *netContext) logf(level, format string, args ...interface{}) {
+	log.Printf(level+": "+format, args...)
+}
+
+func (c *netContext) Debugf(format string, args ...interface{})   { c.logf("DEBUG", format, args...) }
+func (c *netContext) Infof(format string, args ...interface{})    { c.logf("INFO", format, args...) }
+func (c *netContext) Warningf(format string, args ...interface{}) { c.logf("WARNING", format, args...) }
+func (c *netContext) Errorf(format string, args ...interface{})   { c.logf("ERROR", format, args...) }
+func (c *netContext) Criticalf(format string, args ...interface{}) {
+	c.logf("CRITICAL", format, args...)
+}
+
+// newNetMessage returns a new message of the google.golang.org/appengine
+// packages of the same type as m.
+func newNetMessage(m proto.Message) (gproto.Message, error) {
+	name := proto.MessageName(m)
+	t := gproto.MessageType(name)
+	if t == nil {
+		return nil, fmt.Errorf("aetest: unknown message type %q", name)
+	}
+	return reflect.New(t.Elem()).Interface().(gproto.Message), nil
+}
+
+// newClassicMessage returns a new message of the classic appengine
+// packages of the same type as m, which the two sets of packages name
+// alike.
+func newClassicMessage(m gproto.Message) (proto.Message, error) {
+	name := gproto.MessageName(m)
+	t := proto.MessageType(name)
+	if t == nil {
+		return nil, fmt.Errorf("aetest: unknown message type %q", name)
+	}
+	return reflect.New(t.Elem()).Interface().(proto.Message), nil
+}
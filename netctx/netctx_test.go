@@ -0,0 +1,37 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package netctx
+
+import (
+	"testing"
+
+	"github.com/jeisenberg/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+type netEntity struct {
+	Value string
+}
+
+func TestContextOf(t *testing.T) {
+	c, err := aetest.NewContext(&aetest.Options{Hermetic: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := ContextOf(c)
+	key := datastore.NewKey(ctx, "Entity", "a", 0, nil)
+	if _, err := datastore.Put(ctx, key, &netEntity{Value: "b"}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	var e netEntity
+	if err := datastore.Get(ctx, key, &e); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if e.Value != "b" {
+		t.Errorf("Get returned %q, want %q", e.Value, "b")
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// An Option configures the Context created by NewContextWith.
+type Option func(*Options)
+
+// NewContextWith is like NewContext, with the Options set by opts. An
+// unset option keeps the default of NewContext.
+func NewContextWith(opts ...Option) (Context, error) {
+	var o Options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return NewContext(&o)
+}
+
+// WithAppID sets Options.AppID.
+func WithAppID(appID string) Option {
+	return func(o *Options) { o.AppID = appID }
+}
+
+// WithDefaultGCSBucket sets Options.DefaultGCSBucket.
+func WithDefaultGCSBucket(bucket string) Option {
+	return func(o *Options) { o.DefaultGCSBucket = bucket }
+}
+
+// WithUniqueAppID sets Options.UniqueAppID.
+func WithUniqueAppID() Option {
+	return func(o *Options) { o.UniqueAppID = true }
+}
+
+// WithQueueYAML sets Options.QueueYAML.
+func WithQueueYAML(queueYAML string) Option {
+	return func(o *Options) { o.QueueYAML = queueYAML }
+}
+
+// WithClearSearchIndexes sets Options.ClearSearchIndexes.
+func WithClearSearchIndexes() Option {
+	return func(o *Options) { o.ClearSearchIndexes = true }
+}
+
+// WithModules adds modules to Options.Modules.
+func WithModules(modules ...Module) Option {
+	return func(o *Options) { o.Modules = append(o.Modules, modules...) }
+}
+
+// WithServiceAccountName sets Options.ServiceAccountName.
+func WithServiceAccountName(name string) Option {
+	return func(o *Options) { o.ServiceAccountName = name }
+}
+
+// WithSequentialIDs sets Options.SequentialIDs.
+func WithSequentialIDs() Option {
+	return func(o *Options) { o.SequentialIDs = true }
+}
+
+// WithStronglyConsistentDatastore makes the datastore strongly consistent,
+// as by default, or, if consistent is false, applies writes at random as
+// the "random" Options.ConsistencyPolicy does.
+func WithStronglyConsistentDatastore(consistent bool) Option {
+	return func(o *Options) {
+		if consistent {
+			o.ConsistencyPolicy = "consistent"
+		} else {
+			o.ConsistencyPolicy = "random"
+		}
+	}
+}
+
+// WithConsistencyPolicy sets Options.ConsistencyPolicy.
+func WithConsistencyPolicy(policy string) Option {
+	return func(o *Options) { o.ConsistencyPolicy = policy }
+}
+
+// WithStrictTransactions sets Options.StrictTransactions.
+func WithStrictTransactions() Option {
+	return func(o *Options) { o.StrictTransactions = true }
+}
+
+// WithStrictClose sets Options.StrictClose.
+func WithStrictClose() Option {
+	return func(o *Options) { o.StrictClose = true }
+}
+
+// WithTraceTasks sets Options.TraceTasks.
+func WithTraceTasks() Option {
+	return func(o *Options) { o.TraceTasks = true }
+}
+
+// WithIsolatedNamespaces sets Options.IsolateNamespaces.
+func WithIsolatedNamespaces() Option {
+	return func(o *Options) { o.IsolateNamespaces = true }
+}
+
+// WithDefaultNamespace sets Options.DefaultNamespace.
+func WithDefaultNamespace(namespace string) Option {
+	return func(o *Options) { o.DefaultNamespace = namespace }
+}
+
+// WithHermetic sets Options.Hermetic.
+func WithHermetic() Option {
+	return func(o *Options) { o.Hermetic = true }
+}
+
+// WithServiceOverride adds h to Options.ServiceOverrides for service.
+func WithServiceOverride(service string, h CallHandler) Option {
+	return func(o *Options) {
+		if o.ServiceOverrides == nil {
+			o.ServiceOverrides = make(map[string]CallHandler)
+		}
+		o.ServiceOverrides[service] = h
+	}
+}
+
+// WithCassette sets Options.Cassette.
+func WithCassette(path string) Option {
+	return func(o *Options) { o.Cassette = path }
+}
+
+// WithRequestDeadline sets Options.RequestDeadline.
+func WithRequestDeadline(d time.Duration) Option {
+	return func(o *Options) { o.RequestDeadline = d }
+}
+
+// WithCallTimeout sets Options.CallTimeout.
+func WithCallTimeout(d time.Duration) Option {
+	return func(o *Options) { o.CallTimeout = d }
+}
+
+// WithServiceTimeout sets the timeout of service in Options.ServiceTimeouts.
+func WithServiceTimeout(service string, d time.Duration) Option {
+	return func(o *Options) {
+		if o.ServiceTimeouts == nil {
+			o.ServiceTimeouts = make(map[string]time.Duration)
+		}
+		o.ServiceTimeouts[service] = d
+	}
+}
+
+// WithRetry sets Options.Retry.
+func WithRetry(p RetryPolicy) Option {
+	return func(o *Options) { o.Retry = &p }
+}
+
+// WithCancel sets Options.Cancel.
+func WithCancel(cancel <-chan struct{}) Option {
+	return func(o *Options) { o.Cancel = cancel }
+}
+
+// WithGoStubApp sets Options.GoStubApp.
+func WithGoStubApp() Option {
+	return func(o *Options) { o.GoStubApp = true }
+}
+
+// WithAPIServerOnly sets Options.APIServerOnly.
+func WithAPIServerOnly() Option {
+	return func(o *Options) { o.APIServerOnly = true }
+}
+
+// WithTest sets Options.T.
+func WithTest(t testing.TB) Option {
+	return func(o *Options) { o.T = t }
+}
+
+// WithPreserveOnFailure sets Options.PreserveOnFailure.
+func WithPreserveOnFailure() Option {
+	return func(o *Options) { o.PreserveOnFailure = true }
+}
+
+// WithReuseWorkDirs sets Options.ReuseWorkDirs.
+func WithReuseWorkDirs() Option {
+	return func(o *Options) { o.ReuseWorkDirs = true }
+}
+
+// WithWarmUp sets Options.WarmUp.
+func WithWarmUp() Option {
+	return func(o *Options) { o.WarmUp = true }
+}
+
+// WithMetrics sets Options.Metrics.
+func WithMetrics(m MetricsSink) Option {
+	return func(o *Options) { o.Metrics = m }
+}
+
+// WithDatastoreEmulator sets Options.DatastoreEmulator.
+func WithDatastoreEmulator(e *DatastoreEmulator) Option {
+	return func(o *Options) { o.DatastoreEmulator = e }
+}
+
+// WithBackgroundHandler sets Options.BackgroundHandler.
+func WithBackgroundHandler(h http.Handler) Option {
+	return func(o *Options) { o.BackgroundHandler = h }
+}
+
+// WithSystemStats sets Options.SystemStats.
+func WithSystemStats(s *SystemStats) Option {
+	return func(o *Options) { o.SystemStats = s }
+}
+
+// WithEnvironment sets Options.Environment.
+func WithEnvironment(e *Environment) Option {
+	return func(o *Options) { o.Environment = e }
+}
+
+// WithRemoteAPI sets Options.RemoteAPI.
+func WithRemoteAPI(r *RemoteAPI) Option {
+	return func(o *Options) { o.RemoteAPI = r }
+}
+
+// WithSDKPath sets Options.SDKPath.
+func WithSDKPath(path string) Option {
+	return func(o *Options) { o.SDKPath = path }
+}
+
+// WithPythonPath sets Options.PythonPath.
+func WithPythonPath(path string) Option {
+	return func(o *Options) { o.PythonPath = path }
+}
+
+// WithDocker sets Options.Docker.
+func WithDocker(d *Docker) Option {
+	return func(o *Options) { o.Docker = d }
+}
+
+// WithHostOverride sets Options.HostOverride.
+func WithHostOverride(host string) Option {
+	return func(o *Options) { o.HostOverride = host }
+}
+
+// WithClient sets Options.Client.
+func WithClient(client *http.Client) Option {
+	return func(o *Options) { o.Client = client }
+}
+
+// WithRand sets Options.Rand.
+func WithRand(r io.Reader) Option {
+	return func(o *Options) { o.Rand = r }
+}
+
+// WithInterceptURLFetch sets Options.InterceptURLFetch.
+func WithInterceptURLFetch() Option {
+	return func(o *Options) { o.InterceptURLFetch = true }
+}
+
+// WithURLFetchTransport sets Options.URLFetchTransport.
+func WithURLFetchTransport(t http.RoundTripper) Option {
+	return func(o *Options) { o.URLFetchTransport = t }
+}
+
+// WithURLFetchCassette sets Options.URLFetchCassette.
+func WithURLFetchCassette(path string) Option {
+	return func(o *Options) { o.URLFetchCassette = path }
+}
+
+// WithSockets sets Options.Sockets.
+func WithSockets() Option {
+	return func(o *Options) { o.Sockets = true }
+}
+
+// WithAppDir sets Options.AppDir.
+func WithAppDir(dir string) Option {
+	return func(o *Options) { o.AppDir = dir }
+}
+
+// WithMaxLogLine sets Options.MaxLogLine.
+func WithMaxLogLine(n int) Option {
+	return func(o *Options) { o.MaxLogLine = n }
+}
@@ -0,0 +1,66 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// localClient makes the requests to the local servers. Like the default
+// client of the API calls, it never goes through the proxy of HTTP_PROXY,
+// which cannot reach them.
+var localClient = &http.Client{Transport: &http.Transport{}}
+
+// localHosts are the hosts the child process must reach without a proxy.
+var localHosts = []string{"localhost", "127.0.0.1", "::1"}
+
+// childEnv returns the environment of the child process: that of the test,
+// with the local hosts added to NO_PROXY and no_proxy.
+func childEnv() []string {
+	return noProxyEnv(os.Environ(), runtime.GOOS == "windows")
+}
+
+// noProxyEnv returns env with its NO_PROXY and no_proxy variables replaced
+// by one of each, which lists the hosts of both followed by the local
+// hosts, each once. Variable names are case-insensitive if foldCase is
+// set, so that there is a single NO_PROXY variable.
+func noProxyEnv(env []string, foldCase bool) []string {
+	var (
+		out   []string
+		hosts []string
+		seen  = make(map[string]bool)
+	)
+	add := func(list string) {
+		for _, h := range strings.Split(list, ",") {
+			if h = strings.TrimSpace(h); h != "" && !seen[h] {
+				seen[h] = true
+				hosts = append(hosts, h)
+			}
+		}
+	}
+	for _, kv := range env {
+		name := kv
+		if i := strings.Index(kv, "="); i >= 0 {
+			name = kv[:i]
+		}
+		if name == "NO_PROXY" || name == "no_proxy" || foldCase && strings.EqualFold(name, "no_proxy") {
+			add(strings.TrimPrefix(kv, name+"="))
+			continue
+		}
+		out = append(out, kv)
+	}
+	add(strings.Join(localHosts, ","))
+	names := []string{"NO_PROXY", "no_proxy"}
+	if foldCase {
+		names = names[:1]
+	}
+	for _, name := range names {
+		out = append(out, name+"="+strings.Join(hosts, ","))
+	}
+	return out
+}
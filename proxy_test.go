@@ -0,0 +1,45 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNoProxyEnv(t *testing.T) {
+	local := "localhost,127.0.0.1,::1"
+	tests := []struct {
+		env      []string
+		foldCase bool
+		want     []string
+	}{
+		{
+			[]string{"HOME=/root"},
+			false,
+			[]string{"HOME=/root", "NO_PROXY=" + local, "no_proxy=" + local},
+		},
+		{
+			[]string{"NO_PROXY=example.com, localhost", "HOME=/root", "no_proxy=corp.local,example.com"},
+			false,
+			[]string{"HOME=/root", "NO_PROXY=example.com,localhost,corp.local,127.0.0.1,::1", "no_proxy=example.com,localhost,corp.local,127.0.0.1,::1"},
+		},
+		{
+			[]string{"No_Proxy=example.com", "HTTP_PROXY=http://proxy:3128"},
+			true,
+			[]string{"HTTP_PROXY=http://proxy:3128", "NO_PROXY=example.com," + local},
+		},
+		{
+			[]string{"No_Proxy=example.com"},
+			false,
+			[]string{"No_Proxy=example.com", "NO_PROXY=" + local, "no_proxy=" + local},
+		},
+	}
+	for _, tt := range tests {
+		if got := noProxyEnv(tt.env, tt.foldCase); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("noProxyEnv(%q, %v) = %q, want %q", tt.env, tt.foldCase, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"fmt"
+
+	"appengine_internal"
+	"code.google.com/p/goprotobuf/proto"
+
+	remoteapipb "appengine_internal/remote_api"
+)
+
+// Quota limits the use of a service. A zero field is unlimited.
+type Quota struct {
+	// Calls is the number of calls that succeed.
+	Calls int
+	// Bytes is the total size of the request messages of the calls
+	// that succeed.
+	Bytes int
+}
+
+// quotaState is the use of a service with a quota.
+type quotaState struct {
+	quota       Quota
+	calls, size int
+}
+
+// SetQuota limits the use of service from now on. Once q is
+// exhausted, the calls to service fail with an error for which
+// appengine.IsOverQuota reports true. A nil q removes the limit.
+func (c *Instance) SetQuota(service string, q *Quota) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if q == nil {
+		delete(c.quotas, service)
+		return
+	}
+	if c.quotas == nil {
+		c.quotas = make(map[string]*quotaState)
+	}
+	c.quotas[service] = &quotaState{quota: *q}
+}
+
+// useQuota charges a call to the quota of service, and reports whether the
+// quota allows it.
+func (c *Instance) useQuota(service string, size int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	qs := c.quotas[service]
+	if qs == nil {
+		return true
+	}
+	if qs.quota.Calls > 0 && qs.calls+1 > qs.quota.Calls || qs.quota.Bytes > 0 && qs.size+size > qs.quota.Bytes {
+		return false
+	}
+	qs.calls++
+	qs.size += size
+	return true
+}
+
+// enforceQuotas fails the calls to services whose quota is exhausted, as
+// appengine.IsOverQuota expects.
+func (c *Instance) enforceQuotas(service, method string, in, out proto.Message, next func() error) error {
+	if !c.useQuota(service, proto.Size(in)) {
+		return &appengine_internal.CallError{
+			Detail: fmt.Sprintf("The API call %s.%s() required more quota than is available.", service, method),
+			Code:   int32(remoteapipb.RpcError_OVER_QUOTA),
+		}
+	}
+	return next()
+}
@@ -0,0 +1,35 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"errors"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+var errNoAPIServer = errors.New("aetest: no API server is running")
+
+// RawCall sends an API call straight to the API server, bypassing
+// the call hooks, the in-process services and the cassette, for
+// calls the appengine packages do not make, such as
+// taskqueue.QueryTasks.
+func (c *Instance) RawCall(service, method string, in, out proto.Message) error {
+	if c.isClosed() {
+		return ErrClosed
+	}
+	if c.apiURL == "" {
+		return errNoAPIServer
+	}
+	data, err := proto.Marshal(in)
+	if err != nil {
+		return err
+	}
+	res, err := call(c.client, service, method, data, c.apiURL, c.currentRequestID(), c.opts.callTimeout(service), c.done)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(res, out)
+}
@@ -0,0 +1,82 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"sync"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// RecordedCall is an API call seen by a Recorder.
+type RecordedCall struct {
+	Service string
+	Method  string
+	// In and Out are copies of the request and response messages.
+	In  proto.Message
+	Out proto.Message
+	Err error
+	// Latency is the time the call took.
+	Latency time.Duration
+}
+
+// A Recorder records the API calls made through a Context.
+type Recorder struct {
+	mu    sync.Mutex
+	calls []RecordedCall
+}
+
+// NewRecorder returns a Recorder that records the API calls made through c,
+// and the contexts derived from it, from now on.
+func NewRecorder(c *Instance) *Recorder {
+	r := &Recorder{}
+	c.AddCallHook(r.record)
+	return r
+}
+
+func (r *Recorder) record(service, method string, in, out proto.Message, next func() error) error {
+	start := time.Now()
+	err := next()
+	rc := RecordedCall{
+		Service: service,
+		Method:  method,
+		In:      proto.Clone(in),
+		Out:     proto.Clone(out),
+		Err:     err,
+		Latency: time.Since(start),
+	}
+	r.mu.Lock()
+	r.calls = append(r.calls, rc)
+	r.mu.Unlock()
+	return err
+}
+
+// Calls returns the recorded calls to the given method of service, in the
+// order they were made. An empty service or method matches any.
+func (r *Recorder) Calls(service, method string) []RecordedCall {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var calls []RecordedCall
+	for _, rc := range r.calls {
+		if (service == "" || rc.Service == service) && (method == "" || rc.Method == method) {
+			calls = append(calls, rc)
+		}
+	}
+	return calls
+}
+
+// Count returns the number of recorded calls to the given method of
+// service. An empty service or method matches any.
+func (r *Recorder) Count(service, method string) int {
+	return len(r.Calls(service, method))
+}
+
+// Reset forgets the calls recorded so far.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = nil
+}
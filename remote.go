@@ -0,0 +1,46 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+)
+
+var allowRemote = flag.Bool("aetest.remote", false, "allow Options.RemoteAPI to send API calls to a deployed app")
+
+// RemoteAPI configures a deployed App Engine application whose
+// /_ah/remote_api handler serves the API calls when Options.RemoteAPI is
+// set. The calls read and write the real data of the app, so they are
+// only sent if the -aetest.remote flag is set.
+type RemoteAPI struct {
+	// Host is the host of the app, such as "staging.myapp.appspot.com".
+	Host string
+
+	// Credentials authorizes the requests to the remote_api handler, such
+	// as an oauth2.Transport. If nil, http.DefaultTransport is used.
+	// Options.Client, if set, is used instead.
+	Credentials http.RoundTripper
+}
+
+var errRemoteNotAllowed = errors.New("aetest: Options.RemoteAPI requires the -aetest.remote flag")
+
+// useRemoteAPI makes c send its API calls to the app configured by
+// c.opts.RemoteAPI.
+func (c *Instance) useRemoteAPI() error {
+	r := c.opts.RemoteAPI
+	if !*allowRemote {
+		return errRemoteNotAllowed
+	}
+	if r.Host == "" {
+		return errors.New("aetest: Options.RemoteAPI.Host is empty")
+	}
+	c.apiURL = "https://" + r.Host + "/_ah/remote_api"
+	if c.opts.Client == nil {
+		c.client = &http.Client{Transport: r.Credentials}
+	}
+	return nil
+}
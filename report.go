@@ -0,0 +1,99 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"testing"
+	"text/tabwriter"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// MethodStats summarizes the recorded calls to a method.
+type MethodStats struct {
+	Service string
+	Method  string
+	Calls   int
+	Errors  int
+	// InBytes and OutBytes are the total sizes of the encoded request
+	// and response messages.
+	InBytes  int
+	OutBytes int
+	// TotalLatency and MaxLatency are the total and longest time the
+	// calls took.
+	TotalLatency time.Duration
+	MaxLatency   time.Duration
+}
+
+// Stats returns the statistics of the recorded calls, by method, sorted by
+// service and method.
+func (r *Recorder) Stats() []MethodStats {
+	byMethod := make(map[string]*MethodStats)
+	for _, rc := range r.Calls("", "") {
+		k := rc.Service + "." + rc.Method
+		ms := byMethod[k]
+		if ms == nil {
+			ms = &MethodStats{Service: rc.Service, Method: rc.Method}
+			byMethod[k] = ms
+		}
+		ms.Calls++
+		if rc.Err != nil {
+			ms.Errors++
+		}
+		ms.InBytes += proto.Size(rc.In)
+		ms.OutBytes += proto.Size(rc.Out)
+		ms.TotalLatency += rc.Latency
+		if rc.Latency > ms.MaxLatency {
+			ms.MaxLatency = rc.Latency
+		}
+	}
+	keys := make([]string, 0, len(byMethod))
+	for k := range byMethod {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	stats := make([]MethodStats, len(keys))
+	for i, k := range keys {
+		stats[i] = *byMethod[k]
+	}
+	return stats
+}
+
+// WriteReport writes a table of the statistics of the recorded calls to w.
+func (r *Recorder) WriteReport(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "method\tcalls\terrors\tin bytes\tout bytes\ttotal latency\tmax latency\t\n")
+	for _, ms := range r.Stats() {
+		fmt.Fprintf(tw, "%s.%s\t%d\t%d\t%d\t%d\t%v\t%v\t\n", ms.Service, ms.Method, ms.Calls, ms.Errors, ms.InBytes, ms.OutBytes, ms.TotalLatency, ms.MaxLatency)
+	}
+	return tw.Flush()
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<title>API calls</title>
+<table>
+<tr><th>Method<th>Calls<th>Errors<th>In bytes<th>Out bytes<th>Total latency<th>Max latency
+{{range .}}<tr><td>{{.Service}}.{{.Method}}<td>{{.Calls}}<td>{{.Errors}}<td>{{.InBytes}}<td>{{.OutBytes}}<td>{{.TotalLatency}}<td>{{.MaxLatency}}
+{{end}}</table>
+`))
+
+// WriteHTMLReport writes an HTML page of the statistics of the recorded
+// calls to w.
+func (r *Recorder) WriteHTMLReport(w io.Writer) error {
+	return reportTemplate.Execute(w, r.Stats())
+}
+
+// LogReport logs the statistics of the recorded calls to t.
+func (r *Recorder) LogReport(t testing.TB) {
+	var buf bytes.Buffer
+	r.WriteReport(&buf)
+	t.Logf("aetest: API calls:\n%s", buf.String())
+}
@@ -0,0 +1,62 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"net"
+	"net/url"
+	"time"
+)
+
+// RetryPolicy controls how calls that fail to connect to the API server are
+// retried. Only failures to dial the API server are retried: calls that
+// fail after being sent, for instance because the connection was reset
+// or the API server answered with a 5xx status, are not, since they may
+// have been applied.
+type RetryPolicy struct {
+	// Attempts is the maximum number of times a call is sent.
+	// One disables retries.
+	Attempts int
+	// Backoff is the delay before the first retry. It doubles for each
+	// retry after that.
+	Backoff time.Duration
+}
+
+var defaultRetryPolicy = RetryPolicy{Attempts: 3, Backoff: 100 * time.Millisecond}
+
+func (o *Options) retryPolicy() RetryPolicy {
+	if o == nil || o.Retry == nil {
+		return defaultRetryPolicy
+	}
+	return *o.Retry
+}
+
+// do calls f until it succeeds, fails with an error that is not transient,
+// or has been called p.Attempts times. It returns ErrCanceled if done is
+// closed while it waits to retry.
+func (p RetryPolicy) do(done <-chan struct{}, f func() error) error {
+	backoff := p.Backoff
+	for i := 1; ; i++ {
+		err := f()
+		if err == nil || i >= p.Attempts || !transient(err) {
+			return err
+		}
+		if !sleep(backoff, done) {
+			return ErrCanceled
+		}
+		backoff *= 2
+	}
+}
+
+// transient reports whether err is a failure to connect to the API server,
+// so that the call was never sent.
+func transient(err error) bool {
+	uerr, ok := err.(*url.Error)
+	if !ok {
+		return false
+	}
+	operr, ok := uerr.Err.(*net.OpError)
+	return ok && operr.Op == "dial"
+}
@@ -0,0 +1,59 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+var dialErr = &url.Error{Op: "Post", URL: "http://127.0.0.1:1", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}
+
+func TestTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{dialErr, true},
+		{&url.Error{Op: "Post", Err: &net.OpError{Op: "read", Err: errors.New("connection reset")}}, false},
+		{&url.Error{Op: "Post", Err: errors.New("EOF")}, false},
+		{errors.New("500 Internal Server Error"), false},
+	}
+	for _, tt := range tests {
+		if got := transient(tt.err); got != tt.want {
+			t.Errorf("transient(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	p := RetryPolicy{Attempts: 3, Backoff: time.Millisecond}
+	n := 0
+	err := p.do(nil, func() error {
+		n++
+		return dialErr
+	})
+	if err != dialErr || n != 3 {
+		t.Errorf("do = %v after %d calls, want %v after 3", err, n, dialErr)
+	}
+
+	n = 0
+	fatal := errors.New("fatal")
+	if err := p.do(nil, func() error { n++; return fatal }); err != fatal || n != 1 {
+		t.Errorf("do = %v after %d calls, want %v after 1", err, n, fatal)
+	}
+
+	// A closed done channel stops the backoff at once.
+	done := make(chan struct{})
+	close(done)
+	p.Backoff = time.Hour
+	n = 0
+	if err := p.do(done, func() error { n++; return dialErr }); err != ErrCanceled || n != 1 {
+		t.Errorf("do = %v after %d calls, want %v after 1", err, n, ErrCanceled)
+	}
+}
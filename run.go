@@ -0,0 +1,25 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+// Run runs f as a subtest of t called name, with a context derived
+// from this one in a namespace of its own, which logs to the
+// subtest. It reports whether the subtest succeeded.
+func (c *Instance) Run(t *testing.T, name string, f func(t *testing.T, c *Instance)) bool {
+	return t.Run(name, func(t *testing.T) {
+		d := c.Derive()
+		if d.namespace == "" {
+			d.namespace = fmt.Sprintf("aetest-%d", atomic.AddInt32(&c.derivedCount, 1))
+		}
+		d.logT = t
+		f(t, d)
+	})
+}
@@ -0,0 +1,79 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runfile returns the location of path, relative to the runfiles root of
+// a test run by Bazel, or false if the test has no such runfile.
+func runfile(path string) (string, bool) {
+	path = filepath.ToSlash(path)
+	if m := os.Getenv("RUNFILES_MANIFEST_FILE"); m != "" {
+		if p, ok := manifestRunfile(m, path); ok {
+			return p, true
+		}
+	}
+	for _, env := range []string{"RUNFILES_DIR", "TEST_SRCDIR"} {
+		if dir := os.Getenv(env); dir != "" {
+			p := filepath.Join(dir, filepath.FromSlash(path))
+			if fileExists(p) {
+				return p, true
+			}
+		}
+	}
+	return "", false
+}
+
+// manifestRunfile looks path up in the runfiles manifest m, whose lines
+// map runfiles paths to absolute paths. A directory is found through the
+// files under it.
+func manifestRunfile(m, path string) (string, bool) {
+	f, err := os.Open(m)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if parts[0] == path {
+			return parts[1], true
+		}
+		if rest := strings.TrimPrefix(parts[0], path+"/"); rest != parts[0] {
+			return strings.TrimSuffix(parts[1], "/"+rest), true
+		}
+	}
+	return "", false
+}
+
+// resolvePath returns path, resolved in the runfiles if it is relative and
+// a runfile.
+func resolvePath(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	if p, ok := runfile(path); ok {
+		return p
+	}
+	return path
+}
+
+// tempDir returns the directory for temporary files: the one Bazel gives
+// the test if any, as its sandbox may not allow writing to the default
+// one.
+func tempDir() string {
+	if dir := os.Getenv("TEST_TMPDIR"); dir != "" {
+		return dir
+	}
+	return os.TempDir()
+}
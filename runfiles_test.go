@@ -0,0 +1,51 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestManifestRunfile(t *testing.T) {
+	f, err := ioutil.TempFile("", "MANIFEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("ws/app/app.yaml /abs/ws/app/app.yaml\n" +
+		"ws/app/main.go /abs/ws/app/main.go\n" +
+		"ws/sdk/go_appengine/dev_appserver.py /cache/sdk/go_appengine/dev_appserver.py\n" +
+		"malformed\n")
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want string
+		ok   bool
+	}{
+		{"ws/app/app.yaml", "/abs/ws/app/app.yaml", true},
+		{"ws/app", "/abs/ws/app", true},
+		{"ws/sdk/go_appengine", "/cache/sdk/go_appengine", true},
+		{"ws/sdk", "/cache/sdk", true},
+		{"ws/ap", "", false},
+		{"malformed", "", false},
+		{"ws/other", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := manifestRunfile(f.Name(), tt.path)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("manifestRunfile(%q) = %q, %v, want %q, %v", tt.path, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	if _, ok := manifestRunfile(f.Name()+".missing", "ws/app"); ok {
+		t.Errorf("manifestRunfile of a missing manifest found a runfile")
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// sdkDevAppserver returns the dev_appserver.py of the SDK in dir, which is
+// either an App Engine SDK or a Google Cloud SDK with the App Engine
+// components installed.
+func sdkDevAppserver(dir string) (string, bool) {
+	for _, p := range []string{
+		filepath.Join(dir, "dev_appserver.py"),
+		filepath.Join(dir, "platform", "google_appengine", "dev_appserver.py"),
+	} {
+		if fileExists(p) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// gcloudSDKRoots returns the possible install directories of the Google
+// Cloud SDK: the one reported by gcloud, then the usual ones on the
+// current OS.
+func gcloudSDKRoots() []string {
+	var roots []string
+	if gcloud, err := exec.LookPath("gcloud"); err == nil {
+		out, err := exec.Command(gcloud, "info", "--format=value(installation.sdk_root)").Output()
+		if root := strings.TrimSpace(string(out)); err == nil && root != "" {
+			roots = append(roots, root)
+		}
+	}
+	home := os.Getenv("HOME")
+	switch runtime.GOOS {
+	case "windows":
+		for _, env := range []string{"LOCALAPPDATA", "ProgramFiles(x86)", "ProgramFiles"} {
+			if dir := os.Getenv(env); dir != "" {
+				roots = append(roots, filepath.Join(dir, "Google", "Cloud SDK", "google-cloud-sdk"))
+			}
+		}
+	case "darwin":
+		roots = append(roots,
+			filepath.Join(home, "google-cloud-sdk"),
+			"/usr/local/Caskroom/google-cloud-sdk/latest/google-cloud-sdk",
+			"/opt/homebrew/Caskroom/google-cloud-sdk/latest/google-cloud-sdk",
+		)
+	default:
+		roots = append(roots,
+			filepath.Join(home, "google-cloud-sdk"),
+			"/usr/lib/google-cloud-sdk",
+			"/usr/share/google-cloud-sdk",
+			"/snap/google-cloud-sdk/current",
+		)
+	}
+	return roots
+}
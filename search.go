@@ -0,0 +1,152 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"fmt"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	searchpb "appengine_internal/search"
+)
+
+// SearchDocument is a document stored in a search index.
+type SearchDocument struct {
+	ID string
+	// Fields maps field names to their values, formatted as strings.
+	Fields map[string][]string
+}
+
+// maxSearchRows is the largest page size the search service accepts.
+const maxSearchRows = 1000
+
+func searchError(s *searchpb.RequestStatus) error {
+	if s == nil || s.GetCode() == searchpb.SearchServiceError_OK {
+		return nil
+	}
+	return fmt.Errorf("aetest: search error %v: %s", s.GetCode(), s.GetErrorDetail())
+}
+
+// SearchIndexes returns the names of the search indexes in the
+// default namespace.
+func (c *Instance) SearchIndexes() ([]string, error) {
+	var names []string
+	params := &searchpb.ListIndexesParams{
+		Limit: proto.Int32(maxSearchRows),
+	}
+	for {
+		req := &searchpb.ListIndexesRequest{Params: params}
+		res := &searchpb.ListIndexesResponse{}
+		if err := c.Call("search", "ListIndexes", req, res, nil); err != nil {
+			return nil, err
+		}
+		if err := searchError(res.Status); err != nil {
+			return nil, err
+		}
+		for _, md := range res.IndexMetadata {
+			names = append(names, md.IndexSpec.GetName())
+		}
+		if len(res.IndexMetadata) < maxSearchRows {
+			return names, nil
+		}
+		params.StartIndexName = proto.String(names[len(names)-1])
+		params.IncludeStartIndex = proto.Bool(false)
+	}
+}
+
+// listDocuments returns the documents in the named index.
+func (c *Instance) listDocuments(index string, keysOnly bool) ([]*searchpb.Document, error) {
+	var docs []*searchpb.Document
+	params := &searchpb.ListDocumentsParams{
+		IndexSpec: &searchpb.IndexSpec{Name: proto.String(index)},
+		Limit:     proto.Int32(maxSearchRows),
+		KeysOnly:  proto.Bool(keysOnly),
+	}
+	for {
+		req := &searchpb.ListDocumentsRequest{Params: params}
+		res := &searchpb.ListDocumentsResponse{}
+		if err := c.Call("search", "ListDocuments", req, res, nil); err != nil {
+			return nil, err
+		}
+		if err := searchError(res.Status); err != nil {
+			return nil, err
+		}
+		docs = append(docs, res.Document...)
+		if len(res.Document) < maxSearchRows {
+			return docs, nil
+		}
+		params.StartDocId = docs[len(docs)-1].Id
+		params.IncludeStartDoc = proto.Bool(false)
+	}
+}
+
+// SearchDocuments returns every document in the named search index.
+func (c *Instance) SearchDocuments(index string) ([]SearchDocument, error) {
+	docs, err := c.listDocuments(index, false)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]SearchDocument, len(docs))
+	for i, d := range docs {
+		out[i] = SearchDocument{
+			ID:     d.GetId(),
+			Fields: make(map[string][]string),
+		}
+		for _, f := range d.Field {
+			v := f.GetValue().GetStringValue()
+			if g := f.GetValue().GetGeo(); g != nil {
+				v = fmt.Sprintf("%g,%g", g.GetLat(), g.GetLng())
+			}
+			out[i].Fields[f.GetName()] = append(out[i].Fields[f.GetName()], v)
+		}
+	}
+	return out, nil
+}
+
+// maxDeleteDocuments is the largest number of documents the search service
+// deletes in one call.
+const maxDeleteDocuments = 200
+
+// ClearSearchIndexes deletes every document from the search indexes
+// in the default namespace.
+func (c *Instance) ClearSearchIndexes() error {
+	indexes, err := c.SearchIndexes()
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		docs, err := c.listDocuments(index, true)
+		if err != nil {
+			return err
+		}
+		for len(docs) > 0 {
+			n := len(docs)
+			if n > maxDeleteDocuments {
+				n = maxDeleteDocuments
+			}
+			ids := make([]string, n)
+			for i, d := range docs[:n] {
+				ids[i] = d.GetId()
+			}
+			docs = docs[n:]
+			req := &searchpb.DeleteDocumentRequest{
+				Params: &searchpb.DeleteDocumentParams{
+					DocId:     ids,
+					IndexSpec: &searchpb.IndexSpec{Name: proto.String(index)},
+				},
+			}
+			res := &searchpb.DeleteDocumentResponse{}
+			if err := c.Call("search", "DeleteDocument", req, res, nil); err != nil {
+				return err
+			}
+			for _, s := range res.Status {
+				if err := searchError(s); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
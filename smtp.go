@@ -0,0 +1,133 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// smtpSink is an SMTP server that the mail stub of the API server
+// delivers the messages it sends to. It accepts any message, and passes
+// it to deliver with its envelope recipients.
+type smtpSink struct {
+	l       net.Listener
+	deliver func(rcpts []string, data []byte)
+	wg      sync.WaitGroup
+}
+
+// newSMTPSink starts an SMTP server on a port of the loopback interface.
+func newSMTPSink(deliver func(rcpts []string, data []byte)) (*smtpSink, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &smtpSink{l: l, deliver: deliver}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// port returns the port the server listens on.
+func (s *smtpSink) port() int {
+	return s.l.Addr().(*net.TCPAddr).Port
+}
+
+// close stops the server, waiting for the sessions in progress to end.
+func (s *smtpSink) close() error {
+	err := s.l.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *smtpSink) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			s.session(textproto.NewConn(conn))
+		}()
+	}
+}
+
+// session talks SMTP with the client of conn until it quits.
+func (s *smtpSink) session(conn *textproto.Conn) {
+	var rcpts []string
+	conn.PrintfLine("220 localhost aetest SMTP sink")
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "HELO", "EHLO":
+			conn.PrintfLine("250 localhost")
+		case "MAIL":
+			rcpts = nil
+			conn.PrintfLine("250 OK")
+		case "RCPT":
+			rcpts = append(rcpts, smtpPath(line))
+			conn.PrintfLine("250 OK")
+		case "DATA":
+			if len(rcpts) == 0 {
+				conn.PrintfLine("503 no recipients")
+				continue
+			}
+			conn.PrintfLine("354 end data with <CR><LF>.<CR><LF>")
+			data, err := conn.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.deliver(rcpts, data)
+			rcpts = nil
+			conn.PrintfLine("250 OK")
+		case "RSET":
+			rcpts = nil
+			conn.PrintfLine("250 OK")
+		case "NOOP":
+			conn.PrintfLine("250 OK")
+		case "QUIT":
+			conn.PrintfLine("221 bye")
+			return
+		default:
+			conn.PrintfLine("502 command not implemented")
+		}
+	}
+}
+
+// smtpPath returns the address of a MAIL FROM or RCPT TO command.
+func smtpPath(line string) string {
+	i := strings.IndexByte(line, '<')
+	j := strings.LastIndex(line, ">")
+	if i < 0 || j < i {
+		if k := strings.IndexByte(line, ':'); k >= 0 {
+			return strings.TrimSpace(line[k+1:])
+		}
+		return ""
+	}
+	return line[i+1 : j]
+}
+
+// readMIME reads the header of the MIME message data, and returns it with
+// a reader of the body.
+func readMIME(data []byte) (textproto.MIMEHeader, *bufio.Reader, error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	h, err := r.ReadMIMEHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, r.R, nil
+}
@@ -0,0 +1,310 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"appengine_internal"
+	"code.google.com/p/goprotobuf/proto"
+
+	socketpb "appengine_internal/socket"
+)
+
+// socketStub serves the remote_socket calls with real TCP connections
+// made by the test process.
+type socketStub struct {
+	mu        sync.Mutex
+	next      int
+	conns     map[string]net.Conn // keyed by socket descriptor; nil until connected
+	redirects map[string]string   // keyed by "host:port"
+}
+
+func newSocketStub() *socketStub {
+	return &socketStub{
+		conns:     make(map[string]net.Conn),
+		redirects: make(map[string]string),
+	}
+}
+
+// RedirectSocket makes the sockets that connect to addr, a
+// "host:port" address, connect to the address to instead, such as
+// that of a local test server. The host of addr resolves without a
+// DNS lookup, so it need not exist. It requires Options.Sockets.
+func (c *Instance) RedirectSocket(addr, to string) {
+	c.sockets.mu.Lock()
+	defer c.sockets.mu.Unlock()
+	c.sockets.redirects[addr] = to
+}
+
+func socketError(code socketpb.RemoteSocketServiceError_ErrorCode, detail string) error {
+	return &appengine_internal.APIError{Service: "remote_socket", Detail: detail, Code: int32(code)}
+}
+
+// socketTimeout converts the timeout of a request, negative if none, to a
+// deadline.
+func socketTimeout(seconds float64) time.Time {
+	if seconds < 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(seconds * float64(time.Second)))
+}
+
+func packAddr(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func addressPort(addr net.Addr) *socketpb.AddressPort {
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	return &socketpb.AddressPort{
+		Port:          proto.Int32(int32(ta.Port)),
+		PackedAddress: packAddr(ta.IP),
+	}
+}
+
+// placeholderIPs are the addresses a redirected host name resolves to,
+// from the ranges reserved for documentation, so that hosts unknown to the
+// test machine can be redirected. dial finds their redirect through the
+// host name hint of the address.
+var placeholderIPs = []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}
+
+// redirected reports whether the connections to a port of host are
+// redirected.
+func (s *socketStub) redirected(host string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr := range s.redirects {
+		if h, _, err := net.SplitHostPort(addr); err == nil && h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// dial connects to ap, or to the address it is redirected to.
+func (s *socketStub) dial(ap *socketpb.AddressPort, timeout float64) (net.Conn, error) {
+	port := strconv.Itoa(int(ap.GetPort()))
+	host := ap.GetHostnameHint()
+	if len(ap.PackedAddress) > 0 {
+		host = net.IP(ap.PackedAddress).String()
+	}
+	addr := net.JoinHostPort(host, port)
+	s.mu.Lock()
+	to, ok := s.redirects[addr]
+	if !ok && ap.GetHostnameHint() != "" {
+		to, ok = s.redirects[net.JoinHostPort(ap.GetHostnameHint(), port)]
+	}
+	s.mu.Unlock()
+	if ok {
+		addr = to
+	}
+	d := &net.Dialer{Deadline: socketTimeout(timeout)}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		return nil, socketError(socketpb.RemoteSocketServiceError_SYSTEM_ERROR, err.Error())
+	}
+	return conn, nil
+}
+
+// conn returns the socket with the given descriptor.
+func (s *socketStub) conn(sd string) (net.Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conn, ok := s.conns[sd]
+	switch {
+	case !ok:
+		return nil, socketError(socketpb.RemoteSocketServiceError_SOCKET_CLOSED, "unknown socket "+sd)
+	case conn == nil:
+		return nil, socketError(socketpb.RemoteSocketServiceError_INVALID_REQUEST, "socket "+sd+" is not connected")
+	}
+	return conn, nil
+}
+
+// closeAll closes the sockets left open.
+func (s *socketStub) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sd, conn := range s.conns {
+		if conn != nil {
+			conn.Close()
+		}
+		delete(s.conns, sd)
+	}
+}
+
+func (s *socketStub) call(method string, in, out proto.Message) error {
+	switch method {
+	case "CreateSocket":
+		req, res := in.(*socketpb.CreateSocketRequest), out.(*socketpb.CreateSocketReply)
+		if req.GetProtocol() != socketpb.CreateSocketRequest_TCP {
+			return socketError(socketpb.RemoteSocketServiceError_INVALID_REQUEST, "only TCP sockets are supported")
+		}
+		var conn net.Conn
+		if req.RemoteIp != nil {
+			var err error
+			if conn, err = s.dial(req.RemoteIp, -1); err != nil {
+				return err
+			}
+			res.ServerAddress = addressPort(conn.LocalAddr())
+			res.ProxyExternalIp = addressPort(conn.LocalAddr())
+		}
+		s.mu.Lock()
+		s.next++
+		sd := strconv.Itoa(s.next)
+		s.conns[sd] = conn
+		s.mu.Unlock()
+		res.SocketDescriptor = proto.String(sd)
+		return nil
+
+	case "Connect":
+		req, res := in.(*socketpb.ConnectRequest), out.(*socketpb.ConnectReply)
+		sd := req.GetSocketDescriptor()
+		s.mu.Lock()
+		conn, ok := s.conns[sd]
+		s.mu.Unlock()
+		if !ok || conn != nil {
+			return socketError(socketpb.RemoteSocketServiceError_INVALID_REQUEST, "socket "+sd+" cannot connect")
+		}
+		conn, err := s.dial(req.RemoteIp, req.GetTimeoutSeconds())
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.conns[sd] = conn
+		s.mu.Unlock()
+		res.ProxyExternalIp = addressPort(conn.LocalAddr())
+		return nil
+
+	case "Send":
+		req, res := in.(*socketpb.SendRequest), out.(*socketpb.SendReply)
+		conn, err := s.conn(req.GetSocketDescriptor())
+		if err != nil {
+			return err
+		}
+		conn.SetWriteDeadline(socketTimeout(req.GetTimeoutSeconds()))
+		n, err := conn.Write(req.Data)
+		res.DataSent = proto.Int32(int32(n))
+		if err != nil {
+			return socketError(socketpb.RemoteSocketServiceError_SYSTEM_ERROR, err.Error())
+		}
+		return nil
+
+	case "Receive":
+		req, res := in.(*socketpb.ReceiveRequest), out.(*socketpb.ReceiveReply)
+		conn, err := s.conn(req.GetSocketDescriptor())
+		if err != nil {
+			return err
+		}
+		conn.SetReadDeadline(socketTimeout(req.GetTimeoutSeconds()))
+		buf := make([]byte, req.GetDataSize())
+		n, err := conn.Read(buf)
+		res.Data = buf[:n]
+		// An empty reply means EOF.
+		if err != nil && err != io.EOF {
+			return socketError(socketpb.RemoteSocketServiceError_SYSTEM_ERROR, err.Error())
+		}
+		return nil
+
+	case "ShutDown":
+		req := in.(*socketpb.ShutDownRequest)
+		conn, err := s.conn(req.GetSocketDescriptor())
+		if err != nil {
+			return err
+		}
+		tc := conn.(*net.TCPConn)
+		switch req.GetHow() {
+		case socketpb.ShutDownRequest_SOCKET_SHUT_RD:
+			err = tc.CloseRead()
+		case socketpb.ShutDownRequest_SOCKET_SHUT_WR:
+			err = tc.CloseWrite()
+		default:
+			if err = tc.CloseRead(); err == nil {
+				err = tc.CloseWrite()
+			}
+		}
+		if err != nil {
+			return socketError(socketpb.RemoteSocketServiceError_SYSTEM_ERROR, err.Error())
+		}
+		return nil
+
+	case "Close":
+		sd := in.(*socketpb.CloseRequest).GetSocketDescriptor()
+		s.mu.Lock()
+		conn, ok := s.conns[sd]
+		delete(s.conns, sd)
+		s.mu.Unlock()
+		if !ok {
+			return socketError(socketpb.RemoteSocketServiceError_SOCKET_CLOSED, "unknown socket "+sd)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		return nil
+
+	case "GetSocketName":
+		req, res := in.(*socketpb.GetSocketNameRequest), out.(*socketpb.GetSocketNameReply)
+		conn, err := s.conn(req.GetSocketDescriptor())
+		if err != nil {
+			return err
+		}
+		res.ProxyExternalIp = addressPort(conn.LocalAddr())
+		return nil
+
+	case "GetPeerName":
+		req, res := in.(*socketpb.GetPeerNameRequest), out.(*socketpb.GetPeerNameReply)
+		conn, err := s.conn(req.GetSocketDescriptor())
+		if err != nil {
+			return err
+		}
+		res.PeerIp = addressPort(conn.RemoteAddr())
+		return nil
+
+	case "SetSocketOptions":
+		// The options are accepted, and ignored.
+		return nil
+
+	case "GetSocketOptions":
+		req, res := in.(*socketpb.GetSocketOptionsRequest), out.(*socketpb.GetSocketOptionsReply)
+		res.Options = req.Options
+		return nil
+
+	case "Resolve":
+		req, res := in.(*socketpb.ResolveRequest), out.(*socketpb.ResolveReply)
+		ips := placeholderIPs
+		if !s.redirected(req.GetName()) {
+			var err error
+			ips, err = net.LookupIP(req.GetName())
+			if err != nil {
+				return socketError(socketpb.RemoteSocketServiceError_GAI_ERROR, err.Error())
+			}
+		}
+		want := make(map[socketpb.CreateSocketRequest_SocketFamily]bool)
+		for _, f := range req.AddressFamilies {
+			want[f] = true
+		}
+		for _, ip := range ips {
+			f := socketpb.CreateSocketRequest_IPv6
+			if ip.To4() != nil {
+				f = socketpb.CreateSocketRequest_IPv4
+			}
+			if len(want) == 0 || want[f] {
+				res.PackedAddress = append(res.PackedAddress, packAddr(ip))
+			}
+		}
+		res.CanonicalName = proto.String(req.GetName())
+		return nil
+	}
+	return callNotFound("remote_socket", method)
+}
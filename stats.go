@@ -0,0 +1,62 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+var errNoAdminServer = errors.New("aetest: no admin server is running")
+
+var xsrfTokenRE = regexp.MustCompile(`name="xsrf_token" value="([^"]+)"`)
+
+// adminXSRFToken returns the token the admin server expects in forms.
+func (c *Instance) adminXSRFToken(page string) (string, error) {
+	if c.adminURL == "" {
+		return "", errNoAdminServer
+	}
+	res, err := c.client.Get(c.adminURL + page)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	m := xsrfTokenRE.FindSubmatch(body)
+	if m == nil {
+		return "", fmt.Errorf("aetest: no XSRF token found in admin page %s", page)
+	}
+	return string(m[1]), nil
+}
+
+// RefreshDatastoreStats recomputes the datastore statistics entities,
+// such as __Stat_Total__ and __Stat_Kind__, from the current content
+// of the datastore. The metadata kinds __namespace__, __kind__ and
+// __property__ are always up to date.
+func (c *Instance) RefreshDatastoreStats() error {
+	token, err := c.adminXSRFToken("/datastore-stats")
+	if err != nil {
+		return err
+	}
+	res, err := c.client.PostForm(c.adminURL+"/datastore-stats", url.Values{
+		"xsrf_token":           {token},
+		"action:compute_stats": {"1"},
+	})
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("aetest: unable to compute datastore statistics: %s", res.Status)
+	}
+	return nil
+}
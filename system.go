@@ -0,0 +1,66 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+
+	systempb "appengine_internal/system"
+)
+
+// SystemStats are the CPU and memory usage of the instance reported by
+// runtime.Stats.
+type SystemStats struct {
+	// CPUTotal is the CPU used by the instance, in megacycles.
+	CPUTotal float64
+	// CPURate1M and CPURate10M are the CPU used over the last minute and
+	// ten minutes, in megacycles per second.
+	CPURate1M, CPURate10M float64
+
+	// Memory is the memory used by the instance, in megabytes.
+	Memory float64
+	// Memory1M and Memory10M are the average memory used over the last
+	// minute and ten minutes, in megabytes.
+	Memory1M, Memory10M float64
+}
+
+// defaultSystemStats are the stats of a lightly loaded F1 instance.
+var defaultSystemStats = SystemStats{
+	CPUTotal:   12000,
+	CPURate1M:  60,
+	CPURate10M: 40,
+	Memory:     48,
+	Memory1M:   46,
+	Memory10M:  42,
+}
+
+func (o *Options) systemStats() SystemStats {
+	if o == nil || o.SystemStats == nil {
+		return defaultSystemStats
+	}
+	return *o.SystemStats
+}
+
+// simulateSystemStats answers the calls for the CPU and memory usage of
+// the instance, which the API server does not serve, with
+// Options.SystemStats.
+func (c *Instance) simulateSystemStats(service, method string, in, out proto.Message, next func() error) error {
+	if service != "system" || method != "GetSystemStats" {
+		return next()
+	}
+	s := c.opts.systemStats()
+	res := out.(*systempb.GetSystemStatsResponse)
+	res.Cpu = &systempb.SystemStat{
+		Total:   proto.Float64(s.CPUTotal),
+		Rate1M:  proto.Float64(s.CPURate1M),
+		Rate10M: proto.Float64(s.CPURate10M),
+	}
+	res.Memory = &systempb.SystemStat{
+		Current:    proto.Float64(s.Memory),
+		Average1M:  proto.Float64(s.Memory1M),
+		Average10M: proto.Float64(s.Memory10M),
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"net/http"
+	"strings"
+
+	"appengine_internal"
+	"code.google.com/p/goprotobuf/proto"
+
+	taskqueuepb "appengine_internal/taskqueue"
+)
+
+// parentTaskHeader is the header that tags a task with the task that added
+// it, as "queue/name".
+const parentTaskHeader = "X-Aetest-Parent-Task"
+
+// TaskEdge records that Child was added while Parent ran.
+type TaskEdge struct {
+	Parent TaskID
+	Child  TaskID
+}
+
+// TaskGraph returns the tasks added while RunDelayedTasks ran
+// another task, in the order they were added. It requires
+// Options.TraceTasks.
+func (c *Instance) TaskGraph() []TaskEdge {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]TaskEdge(nil), c.taskEdges...)
+}
+
+// taskContext returns a context of its own that runs the task id as
+// the request req. With Options.TraceTasks, it tags the tasks it adds.
+func (c *Instance) taskContext(id TaskID, req *http.Request) *Instance {
+	tc := &Instance{
+		instance:  c.instance,
+		derived:   true,
+		req:       req,
+		requestID: c.newID(),
+		deadline:  c.deadline,
+		namespace: c.currentNamespace(),
+		logT:      c.logT,
+		errs:      new(taskLog),
+	}
+	if c.opts.TraceTasks {
+		tc.task = &id
+	}
+	return tc
+}
+
+// tagParentTask tags the tasks added by an API request made while c runs
+// a task.
+func (c *Instance) tagParentTask(service, method string, in appengine_internal.ProtoMessage) {
+	if c.task == nil || service != "taskqueue" {
+		return
+	}
+	h := &taskqueuepb.TaskQueueAddRequest_Header{
+		Key:   []byte(parentTaskHeader),
+		Value: []byte(c.task.Queue + "/" + c.task.Name),
+	}
+	for _, add := range addRequests(method, in) {
+		add.Header = append(add.Header, h)
+	}
+}
+
+// addRequests returns the tasks added by a taskqueue request.
+func addRequests(method string, in proto.Message) []*taskqueuepb.TaskQueueAddRequest {
+	switch method {
+	case "Add":
+		return []*taskqueuepb.TaskQueueAddRequest{in.(*taskqueuepb.TaskQueueAddRequest)}
+	case "BulkAdd":
+		return in.(*taskqueuepb.TaskQueueBulkAddRequest).AddRequest
+	}
+	return nil
+}
+
+// recordTaskEdges records the tasks added with a parent task tag.
+func (c *Instance) recordTaskEdges(service, method string, in, out proto.Message, next func() error) error {
+	if err := next(); err != nil || service != "taskqueue" || !c.opts.TraceTasks {
+		return err
+	}
+	adds := addRequests(method, in)
+	var names [][]byte
+	switch res := out.(type) {
+	case *taskqueuepb.TaskQueueAddResponse:
+		names = [][]byte{res.ChosenTaskName}
+	case *taskqueuepb.TaskQueueBulkAddResponse:
+		for _, r := range res.Taskresult {
+			names = append(names, r.ChosenTaskName)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, add := range adds {
+		var parent string
+		for _, h := range add.Header {
+			if string(h.Key) == parentTaskHeader {
+				parent = string(h.Value)
+			}
+		}
+		p := strings.SplitN(parent, "/", 2)
+		if len(p) != 2 {
+			continue
+		}
+		name := string(add.TaskName)
+		if i < len(names) && len(names[i]) > 0 {
+			name = string(names[i])
+		}
+		queue := string(add.QueueName)
+		if queue == "" {
+			queue = "default"
+		}
+		c.taskEdges = append(c.taskEdges, TaskEdge{
+			Parent: TaskID{Queue: p[0], Name: p[1]},
+			Child:  TaskID{Queue: queue, Name: name},
+		})
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"appengine/taskqueue"
+	"code.google.com/p/goprotobuf/proto"
+
+	taskqueuepb "appengine_internal/taskqueue"
+)
+
+// maxQueueRows bounds the number of queues and tasks fetched in one RPC.
+const maxQueueRows = 1000
+
+// PurgeQueue removes all tasks from the named task queue.
+func (c *Instance) PurgeQueue(name string) error {
+	req := &taskqueuepb.TaskQueuePurgeQueueRequest{
+		QueueName: []byte(name),
+	}
+	res := &taskqueuepb.TaskQueuePurgeQueueResponse{}
+	return c.Call("taskqueue", "PurgeQueue", req, res, nil)
+}
+
+// AssertNoPendingTasks reports an error to t for every queue that
+// still holds tasks.
+func (c *Instance) AssertNoPendingTasks(t testing.TB) {
+	queues, err := c.queueNames()
+	if err != nil {
+		t.Errorf("aetest: unable to list task queues: %v", err)
+		return
+	}
+	for _, q := range queues {
+		tasks, err := c.queuedTasks(q)
+		if err != nil {
+			t.Errorf("aetest: unable to list tasks in queue %q: %v", q, err)
+			continue
+		}
+		if len(tasks) == 0 {
+			continue
+		}
+		names := make([]string, len(tasks))
+		for i, task := range tasks {
+			names[i] = string(task.TaskName)
+		}
+		t.Errorf("aetest: queue %q has %d pending task(s): %s", q, len(tasks), strings.Join(names, ", "))
+	}
+}
+
+// Tasks returns the tasks currently held in the named queue.
+func (c *Instance) Tasks(queue string) ([]*taskqueue.Task, error) {
+	qts, err := c.queuedTasks(queue)
+	if err != nil {
+		return nil, err
+	}
+	tasks := make([]*taskqueue.Task, len(qts))
+	for i, qt := range qts {
+		tasks[i] = toTask(qt)
+	}
+	return tasks, nil
+}
+
+// LeaseTasks leases up to max tasks from the named pull queue for
+// the given duration.
+func (c *Instance) LeaseTasks(queue string, max int, lease time.Duration) ([]*taskqueue.Task, error) {
+	return taskqueue.Lease(c, max, queue, int(lease/time.Second))
+}
+
+// DeleteTasks removes tasks from the named queue.
+func (c *Instance) DeleteTasks(queue string, tasks ...*taskqueue.Task) error {
+	return taskqueue.DeleteMulti(c, tasks, queue)
+}
+
+var taskMethods = map[taskqueuepb.TaskQueueQueryTasksResponse_Task_RequestMethod]string{
+	taskqueuepb.TaskQueueQueryTasksResponse_Task_GET:    "GET",
+	taskqueuepb.TaskQueueQueryTasksResponse_Task_POST:   "POST",
+	taskqueuepb.TaskQueueQueryTasksResponse_Task_HEAD:   "HEAD",
+	taskqueuepb.TaskQueueQueryTasksResponse_Task_PUT:    "PUT",
+	taskqueuepb.TaskQueueQueryTasksResponse_Task_DELETE: "DELETE",
+}
+
+// toTask converts a task returned by QueryTasks to a taskqueue.Task.
+// Tasks without a method are pull tasks.
+func toTask(qt *taskqueuepb.TaskQueueQueryTasksResponse_Task) *taskqueue.Task {
+	t := &taskqueue.Task{
+		Path:       string(qt.Url),
+		Payload:    qt.Body,
+		Header:     make(http.Header),
+		Method:     "PULL",
+		Name:       string(qt.TaskName),
+		ETA:        time.Unix(0, qt.GetEtaUsec()*1e3),
+		RetryCount: qt.GetRetryCount(),
+		Tag:        string(qt.Tag),
+	}
+	if qt.Method != nil {
+		t.Method = taskMethods[*qt.Method]
+	}
+	for _, h := range qt.Header {
+		t.Header.Add(string(h.Key), string(h.Value))
+	}
+	return t
+}
+
+// queueNames returns the names of all queues known to the API server.
+func (c *Instance) queueNames() ([]string, error) {
+	req := &taskqueuepb.TaskQueueFetchQueuesRequest{
+		MaxRows: proto.Int32(maxQueueRows),
+	}
+	res := &taskqueuepb.TaskQueueFetchQueuesResponse{}
+	if err := c.Call("taskqueue", "FetchQueues", req, res, nil); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(res.Queue))
+	for i, q := range res.Queue {
+		names[i] = string(q.QueueName)
+	}
+	return names, nil
+}
+
+// queueRetryParameters returns the retry parameters of the named queue,
+// or nil if it has none.
+func (c *Instance) queueRetryParameters(queue string) (*taskqueuepb.TaskQueueRetryParameters, error) {
+	req := &taskqueuepb.TaskQueueFetchQueuesRequest{
+		MaxRows: proto.Int32(maxQueueRows),
+	}
+	res := &taskqueuepb.TaskQueueFetchQueuesResponse{}
+	if err := c.Call("taskqueue", "FetchQueues", req, res, nil); err != nil {
+		return nil, err
+	}
+	for _, q := range res.Queue {
+		if string(q.QueueName) == queue {
+			return q.RetryParameters, nil
+		}
+	}
+	return nil, nil
+}
+
+// queuedTasks returns the tasks currently held in the named queue.
+func (c *Instance) queuedTasks(queue string) ([]*taskqueuepb.TaskQueueQueryTasksResponse_Task, error) {
+	req := &taskqueuepb.TaskQueueQueryTasksRequest{
+		QueueName: []byte(queue),
+		MaxRows:   proto.Int32(maxQueueRows),
+	}
+	res := &taskqueuepb.TaskQueueQueryTasksResponse{}
+	if err := c.Call("taskqueue", "QueryTasks", req, res, nil); err != nil {
+		return nil, err
+	}
+	return res.Task, nil
+}
+
+// deleteTask removes the named task from queue.
+func (c *Instance) deleteTask(queue, name string) error {
+	req := &taskqueuepb.TaskQueueDeleteRequest{
+		QueueName: []byte(queue),
+		TaskName:  [][]byte{[]byte(name)},
+	}
+	res := &taskqueuepb.TaskQueueDeleteResponse{}
+	return c.Call("taskqueue", "Delete", req, res, nil)
+}
@@ -0,0 +1,131 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"time"
+
+	taskqueuepb "appengine_internal/taskqueue"
+)
+
+// TaskRun records the executions of a task by RunDelayedTasks.
+type TaskRun struct {
+	Queue string
+	Name  string
+	// RetryCount is the number of failed executions.
+	RetryCount int
+	// Err is the error of the last execution, if it failed.
+	Err error
+	// NextRun is the time, as reported by Now, from which a failed task
+	// is run again, following the retry parameters of the task or of
+	// its queue. It is zero once the task succeeded or was abandoned.
+	NextRun time.Time
+	// Done is set once the task succeeded.
+	Done bool
+	// Abandoned is set once the task failed more than its retry
+	// parameters allow, and was removed from its queue.
+	Abandoned bool
+
+	first time.Time // of the first failed execution
+}
+
+// TaskID identifies a task.
+type TaskID struct {
+	Queue string
+	Name  string
+}
+
+// TaskRuns returns the records of the executions of the tasks of the
+// named queue by RunDelayedTasks, in the order they first ran.
+func (c *Instance) TaskRuns(queue string) []TaskRun {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var runs []TaskRun
+	for _, run := range c.taskRuns {
+		if run.Queue == queue {
+			runs = append(runs, *run)
+		}
+	}
+	return runs
+}
+
+// taskRun returns the record of the named task, creating it if needed.
+func (c *Instance) taskRun(queue, name string) *TaskRun {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := TaskID{queue, name}
+	if run, ok := c.taskRunIndex[k]; ok {
+		return run
+	}
+	if c.taskRunIndex == nil {
+		c.taskRunIndex = make(map[TaskID]*TaskRun)
+	}
+	run := &TaskRun{Queue: queue, Name: name}
+	c.taskRunIndex[k] = run
+	c.taskRuns = append(c.taskRuns, run)
+	return run
+}
+
+// nextRun returns the time from which run may be executed.
+func (c *Instance) nextRun(run *TaskRun) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return run.NextRun
+}
+
+func (c *Instance) taskSucceeded(run *TaskRun) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	run.Err = nil
+	run.NextRun = time.Time{}
+	run.Done = true
+}
+
+// taskFailed records a failed execution of run at now, and schedules its
+// retry according to p. It reports whether the task is abandoned instead.
+func (c *Instance) taskFailed(run *TaskRun, err error, p *taskqueuepb.TaskQueueRetryParameters, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if run.RetryCount == 0 {
+		run.first = now
+	}
+	run.RetryCount++
+	run.Err = err
+	if retriesExhausted(p, run.RetryCount, now.Sub(run.first)) {
+		run.NextRun = time.Time{}
+		run.Abandoned = true
+		return true
+	}
+	run.NextRun = now.Add(retryBackoff(p, run.RetryCount))
+	return false
+}
+
+// retryBackoff returns the delay before the retry of a task that failed
+// retries times.
+func retryBackoff(p *taskqueuepb.TaskQueueRetryParameters, retries int) time.Duration {
+	d := p.GetMinBackoffSec()
+	for i := 1; i < retries && i <= int(p.GetMaxDoublings()); i++ {
+		d *= 2
+	}
+	if max := p.GetMaxBackoffSec(); d > max {
+		d = max
+	}
+	return time.Duration(d * float64(time.Second))
+}
+
+// retriesExhausted reports whether a task that failed retries times, the
+// first of them age ago, must not be retried. When both limits are set,
+// both must be exceeded, as in production.
+func retriesExhausted(p *taskqueuepb.TaskQueueRetryParameters, retries int, age time.Duration) bool {
+	if p == nil {
+		return false
+	}
+	overRetries := p.RetryLimit != nil && retries > int(p.GetRetryLimit())
+	overAge := p.AgeLimitSec != nil && age > time.Duration(p.GetAgeLimitSec())*time.Second
+	if p.RetryLimit != nil && p.AgeLimitSec != nil {
+		return overRetries && overAge
+	}
+	return overRetries || overAge
+}
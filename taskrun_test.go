@@ -0,0 +1,74 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"testing"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	taskqueuepb "appengine_internal/taskqueue"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	capped := &taskqueuepb.TaskQueueRetryParameters{
+		MinBackoffSec: proto.Float64(1),
+		MaxBackoffSec: proto.Float64(10),
+		MaxDoublings:  proto.Int32(2),
+	}
+	short := &taskqueuepb.TaskQueueRetryParameters{
+		MinBackoffSec: proto.Float64(1),
+		MaxBackoffSec: proto.Float64(3),
+	}
+	tests := []struct {
+		p       *taskqueuepb.TaskQueueRetryParameters
+		retries int
+		want    time.Duration
+	}{
+		{nil, 1, 100 * time.Millisecond},
+		{nil, 2, 200 * time.Millisecond},
+		{nil, 3, 400 * time.Millisecond},
+		{capped, 1, 1 * time.Second},
+		{capped, 2, 2 * time.Second},
+		{capped, 3, 4 * time.Second},
+		{capped, 4, 4 * time.Second},
+		{short, 2, 2 * time.Second},
+		{short, 3, 3 * time.Second},
+		{short, 10, 3 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := retryBackoff(tt.p, tt.retries); got != tt.want {
+			t.Errorf("retryBackoff(%v, %d) = %v, want %v", tt.p, tt.retries, got, tt.want)
+		}
+	}
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	retries := &taskqueuepb.TaskQueueRetryParameters{RetryLimit: proto.Int32(3)}
+	age := &taskqueuepb.TaskQueueRetryParameters{AgeLimitSec: proto.Int64(60)}
+	both := &taskqueuepb.TaskQueueRetryParameters{RetryLimit: proto.Int32(3), AgeLimitSec: proto.Int64(60)}
+	tests := []struct {
+		p       *taskqueuepb.TaskQueueRetryParameters
+		retries int
+		age     time.Duration
+		want    bool
+	}{
+		{nil, 100, time.Hour, false},
+		{&taskqueuepb.TaskQueueRetryParameters{}, 100, time.Hour, false},
+		{retries, 3, time.Hour, false},
+		{retries, 4, 0, true},
+		{age, 100, time.Minute, false},
+		{age, 0, time.Minute + time.Second, true},
+		{both, 4, time.Minute, false},
+		{both, 3, time.Hour, false},
+		{both, 4, time.Hour, true},
+	}
+	for _, tt := range tests {
+		if got := retriesExhausted(tt.p, tt.retries, tt.age); got != tt.want {
+			t.Errorf("retriesExhausted(%v, %d, %v) = %v, want %v", tt.p, tt.retries, tt.age, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"fmt"
+	"strings"
+
+	"appengine/taskqueue"
+	"appengine_internal"
+	"code.google.com/p/goprotobuf/proto"
+
+	taskqueuepb "appengine_internal/taskqueue"
+)
+
+// TaskTarget is the module, version and instance a task is routed to.
+// Empty fields stand for the default module, its default version, and any
+// instance.
+type TaskTarget struct {
+	Module   string
+	Version  string
+	Instance string
+}
+
+// TaskTarget returns the module, version and instance that task,
+// as returned by Tasks, is routed to by its Host header. With
+// Options.Modules, adding a task routed to a module, version or
+// instance that does not exist fails.
+func (c *Instance) TaskTarget(task *taskqueue.Task) TaskTarget {
+	return c.parseTaskTarget(task.Header.Get("Host"))
+}
+
+// parseTaskTarget returns the target named by host, such as
+// "v1.backend.testapp.appspot.com" or "v1-dot-backend-dot-testapp.appspot.com".
+// Hosts that are not of the app route to the defaults.
+func (c *Instance) parseTaskTarget(host string) TaskTarget {
+	host = strings.Replace(strings.ToLower(host), "-dot-", ".", -1)
+	if !strings.HasSuffix(host, ".appspot.com") {
+		return TaskTarget{}
+	}
+	labels := strings.Split(strings.TrimSuffix(host, ".appspot.com"), ".")
+	n := len(labels) - 1
+	if labels[n] != c.appID {
+		return TaskTarget{}
+	}
+	labels = labels[:n]
+	switch len(labels) {
+	case 0:
+		return TaskTarget{}
+	case 1:
+		// A single label names a module, or else a version of the
+		// default module.
+		if _, ok := c.modules[labels[0]]; c.modules != nil && !ok {
+			return TaskTarget{Version: labels[0]}
+		}
+		return TaskTarget{Module: labels[0]}
+	case 2:
+		return TaskTarget{Module: labels[1], Version: labels[0]}
+	}
+	return TaskTarget{Module: labels[2], Version: labels[1], Instance: labels[0]}
+}
+
+// checkTaskTargets fails the addition of tasks routed to modules, versions
+// or instances that do not exist when Options.Modules is set.
+func (c *Instance) checkTaskTargets(service, method string, in, out proto.Message, next func() error) error {
+	if service != "taskqueue" || c.modules == nil {
+		return next()
+	}
+	adds := addRequests(method, in)
+	c.mu.Lock()
+	for _, add := range adds {
+		for _, h := range add.Header {
+			if !strings.EqualFold(string(h.Key), "Host") {
+				continue
+			}
+			if err := c.checkTaskTarget(c.parseTaskTarget(string(h.Value))); err != nil {
+				c.mu.Unlock()
+				return &appengine_internal.APIError{
+					Service: "taskqueue",
+					Detail:  fmt.Sprintf("task %q is routed to %s: %v", add.TaskName, h.Value, err),
+					Code:    int32(taskqueuepb.TaskQueueServiceError_INVALID_URL),
+				}
+			}
+		}
+	}
+	c.mu.Unlock()
+	return next()
+}
+
+// checkTaskTarget returns an error unless t exists in the simulated modules.
+// c.mu must be held.
+func (c *Instance) checkTaskTarget(t TaskTarget) error {
+	ms, v, err := c.lookupModule(t.Module, t.Version)
+	if err != nil {
+		return err
+	}
+	if t.Instance != "" && !ms.hasInstance(v, t.Instance) {
+		return fmt.Errorf("version %q has no instance %q", v, t.Instance)
+	}
+	return nil
+}
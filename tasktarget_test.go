@@ -0,0 +1,45 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import "testing"
+
+func TestParseTaskTarget(t *testing.T) {
+	tests := []struct {
+		host string
+		want TaskTarget
+	}{
+		{"", TaskTarget{}},
+		{"localhost:8080", TaskTarget{}},
+		{"testapp.appspot.com", TaskTarget{}},
+		{"otherapp.appspot.com", TaskTarget{}},
+		{"backend.otherapp.appspot.com", TaskTarget{}},
+		{"backend.testapp.appspot.com", TaskTarget{Module: "backend"}},
+		{"v2.testapp.appspot.com", TaskTarget{Version: "v2"}},
+		{"v1.backend.testapp.appspot.com", TaskTarget{Module: "backend", Version: "v1"}},
+		{"v1-dot-backend-dot-testapp.appspot.com", TaskTarget{Module: "backend", Version: "v1"}},
+		{"V1.Backend.TestApp.AppSpot.com", TaskTarget{Module: "backend", Version: "v1"}},
+		{"0.v1.backend.testapp.appspot.com", TaskTarget{Module: "backend", Version: "v1", Instance: "0"}},
+		{"0-dot-v1-dot-backend-dot-testapp.appspot.com", TaskTarget{Module: "backend", Version: "v1", Instance: "0"}},
+	}
+	c := &Instance{instance: &instance{
+		appID: "testapp",
+		modules: newModuleSet([]Module{
+			{Name: "default", Versions: []string{"v1", "v2"}},
+			{Name: "backend", Versions: []string{"v1"}},
+		}),
+	}}
+	for _, tt := range tests {
+		if got := c.parseTaskTarget(tt.host); got != tt.want {
+			t.Errorf("parseTaskTarget(%q) = %+v, want %+v", tt.host, got, tt.want)
+		}
+	}
+
+	// Without Options.Modules, a single label names a module.
+	c = &Instance{instance: &instance{appID: "testapp"}}
+	if got, want := c.parseTaskTarget("v2.testapp.appspot.com"), (TaskTarget{Module: "v2"}); got != want {
+		t.Errorf("parseTaskTarget without modules = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"appengine_internal"
+	"code.google.com/p/goprotobuf/proto"
+
+	datastorepb "appengine_internal/datastore"
+)
+
+// maxXGGroups is the number of entity groups a cross-group transaction
+// may touch in production.
+const maxXGGroups = 25
+
+// txnState is the set of entity groups touched by a transaction.
+type txnState struct {
+	xg     bool
+	groups map[rootKey]bool
+}
+
+func txnError(detail string) error {
+	return &appengine_internal.APIError{
+		Service: "datastore_v3",
+		Detail:  detail,
+		Code:    int32(datastorepb.Error_BAD_REQUEST),
+	}
+}
+
+// endTxn forgets the entity groups touched by the transaction tx, which
+// is committed or rolled back.
+func (c *Instance) endTxn(tx *datastorepb.Transaction) {
+	c.mu.Lock()
+	delete(c.txns, tx.GetHandle())
+	c.mu.Unlock()
+}
+
+// checkTransactions enforces the production limits on the entity groups a
+// transaction may touch when Options.StrictTransactions is set.
+func (c *Instance) checkTransactions(service, method string, in, out proto.Message, next func() error) error {
+	if service != "datastore_v3" || !c.opts.StrictTransactions {
+		return next()
+	}
+	switch method {
+	case "BeginTransaction":
+		if err := next(); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.txns == nil {
+			c.txns = make(map[uint64]*txnState)
+		}
+		c.txns[out.(*datastorepb.Transaction).GetHandle()] = &txnState{
+			xg:     in.(*datastorepb.BeginTransactionRequest).GetAllowMultipleEg(),
+			groups: make(map[rootKey]bool),
+		}
+		return nil
+	case "Commit", "Rollback":
+		c.endTxn(in.(*datastorepb.Transaction))
+		return next()
+	case "Get":
+		req := in.(*datastorepb.GetRequest)
+		if err := c.touchGroups(req.Transaction, req.Key); err != nil {
+			return err
+		}
+	case "Delete":
+		req := in.(*datastorepb.DeleteRequest)
+		if err := c.touchGroups(req.Transaction, req.Key); err != nil {
+			return err
+		}
+	case "RunQuery":
+		req := in.(*datastorepb.Query)
+		if req.Ancestor != nil {
+			if err := c.touchGroups(req.Transaction, []*datastorepb.Reference{req.Ancestor}); err != nil {
+				return err
+			}
+		}
+	case "Put":
+		// Incomplete keys only get their entity group once stored.
+		if err := next(); err != nil {
+			return err
+		}
+		return c.touchGroups(in.(*datastorepb.PutRequest).Transaction, out.(*datastorepb.PutResponse).Key)
+	}
+	return next()
+}
+
+// touchGroups adds the entity groups of refs to the transaction tx, if
+// any, and reports an error if that takes it over its limit.
+func (c *Instance) touchGroups(tx *datastorepb.Transaction, refs []*datastorepb.Reference) error {
+	if tx == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ts := c.txns[tx.GetHandle()]
+	if ts == nil {
+		return nil
+	}
+	for _, ref := range refs {
+		if rk, ok := newRootKey(ref); ok {
+			ts.groups[rk] = true
+		}
+	}
+	switch {
+	case !ts.xg && len(ts.groups) > 1:
+		return txnError("cross-group transaction need to be explicitly specified (xg=True)")
+	case len(ts.groups) > maxXGGroups:
+		return txnError("operating on too many entity groups in a single transaction.")
+	}
+	return nil
+}
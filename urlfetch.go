@@ -0,0 +1,118 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+
+	"appengine_internal"
+	"code.google.com/p/goprotobuf/proto"
+
+	urlfetchpb "appengine_internal/urlfetch"
+)
+
+// maxFetchSize is the size past which urlfetch truncates responses.
+const maxFetchSize = 32 << 20
+
+// refuseExternal is the transport of the intercepted urlfetch calls when
+// Options.URLFetchTransport is nil. It only lets through the requests to
+// the local host, such as those to the stub app.
+type refuseExternal struct{}
+
+func (refuseExternal) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, h := range localHosts {
+		if host == h {
+			return localClient.Transport.RoundTrip(req)
+		}
+	}
+	return nil, errors.New("aetest: urlfetch to an external host refused; set Options.URLFetchTransport")
+}
+
+// urlfetchStub serves the urlfetch calls with an http.RoundTripper.
+type urlfetchStub struct {
+	rt http.RoundTripper
+}
+
+func newURLFetchStub(rt http.RoundTripper) *urlfetchStub {
+	if rt == nil {
+		rt = refuseExternal{}
+	}
+	return &urlfetchStub{rt: rt}
+}
+
+func urlfetchError(code urlfetchpb.URLFetchServiceError_ErrorCode, detail string) error {
+	return &appengine_internal.APIError{Service: "urlfetch", Detail: detail, Code: int32(code)}
+}
+
+func (s *urlfetchStub) call(method string, in, out proto.Message) error {
+	if method != "Fetch" {
+		return callNotFound("urlfetch", method)
+	}
+	req := in.(*urlfetchpb.URLFetchRequest)
+	res := out.(*urlfetchpb.URLFetchResponse)
+
+	u, err := url.Parse(req.GetUrl())
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return urlfetchError(urlfetchpb.URLFetchServiceError_INVALID_URL, "invalid URL "+req.GetUrl())
+	}
+	var body io.Reader
+	if req.Payload != nil {
+		body = bytes.NewReader(req.Payload)
+	}
+	hreq, err := http.NewRequest(req.GetMethod().String(), u.String(), body)
+	if err != nil {
+		return urlfetchError(urlfetchpb.URLFetchServiceError_INVALID_URL, err.Error())
+	}
+	for _, h := range req.Header {
+		hreq.Header.Add(h.GetKey(), h.GetValue())
+	}
+
+	var hres *http.Response
+	if req.GetFollowRedirects() {
+		hres, err = (&http.Client{Transport: s.rt}).Do(hreq)
+	} else {
+		hres, err = s.rt.RoundTrip(hreq)
+	}
+	if err != nil {
+		return urlfetchError(urlfetchpb.URLFetchServiceError_FETCH_ERROR, err.Error())
+	}
+	defer hres.Body.Close()
+	content, err := ioutil.ReadAll(io.LimitReader(hres.Body, maxFetchSize+1))
+	if err != nil {
+		return urlfetchError(urlfetchpb.URLFetchServiceError_FETCH_ERROR, err.Error())
+	}
+	if len(content) > maxFetchSize {
+		content = content[:maxFetchSize]
+		res.ContentWasTruncated = proto.Bool(true)
+	}
+
+	res.Content = content
+	res.StatusCode = proto.Int32(int32(hres.StatusCode))
+	for k, vs := range hres.Header {
+		for _, v := range vs {
+			res.Header = append(res.Header, &urlfetchpb.URLFetchResponse_Header{
+				Key:   proto.String(k),
+				Value: proto.String(v),
+			})
+		}
+	}
+	// Stub transports may leave Request unset.
+	if hres.Request != nil {
+		if final := hres.Request.URL.String(); final != u.String() {
+			res.FinalUrl = proto.String(final)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fetchEntry is an HTTP exchange recorded in a urlfetch cassette file.
+type fetchEntry struct {
+	Method       string
+	URL          string
+	RequestBody  []byte `json:",omitempty"`
+	StatusCode   int
+	Header       http.Header `json:",omitempty"`
+	ResponseBody []byte      `json:",omitempty"`
+	replayed     bool
+}
+
+// fetchCassette is an http.RoundTripper that records the exchanges of the
+// urlfetch calls, or replays them without reaching the network.
+type fetchCassette struct {
+	path      string
+	recording bool
+	rt        http.RoundTripper // sends the recorded requests
+
+	mu      sync.Mutex
+	entries []*fetchEntry
+}
+
+// openFetchCassette opens the urlfetch cassette file at path. Like the
+// cassettes of Options.Cassette, it records if the file does not exist or
+// the -aetest.record flag is set, with rt, and replays otherwise.
+func openFetchCassette(path string, rt http.RoundTripper) (*fetchCassette, error) {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	fc := &fetchCassette{path: path, rt: rt}
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case *record || os.IsNotExist(err):
+		fc.recording = true
+		return fc, nil
+	case err != nil:
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &fc.entries); err != nil {
+		return nil, fmt.Errorf("aetest: invalid urlfetch cassette %s: %v", path, err)
+	}
+	return fc, nil
+}
+
+func (fc *fetchCassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	if fc.recording {
+		return fc.record(req, body)
+	}
+	return fc.replay(req, body)
+}
+
+func (fc *fetchCassette) record(req *http.Request, body []byte) (*http.Response, error) {
+	res, err := fc.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resBody, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(resBody))
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.entries = append(fc.entries, &fetchEntry{
+		Method:       req.Method,
+		URL:          req.URL.String(),
+		RequestBody:  body,
+		StatusCode:   res.StatusCode,
+		Header:       res.Header,
+		ResponseBody: resBody,
+	})
+	return res, nil
+}
+
+// replay answers req with the first recorded exchange with the same
+// method, URL and body that was not replayed yet.
+func (fc *fetchCassette) replay(req *http.Request, body []byte) (*http.Response, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	u := req.URL.String()
+	for _, e := range fc.entries {
+		if e.replayed || e.Method != req.Method || e.URL != u || !bytes.Equal(e.RequestBody, body) {
+			continue
+		}
+		e.replayed = true
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode)),
+			StatusCode:    e.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        e.Header,
+			Body:          ioutil.NopCloser(bytes.NewReader(e.ResponseBody)),
+			ContentLength: int64(len(e.ResponseBody)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("aetest: urlfetch cassette %s: no recorded response to %s %s", fc.path, req.Method, u)
+}
+
+// save writes the recorded exchanges to the cassette file.
+func (fc *fetchCassette) save() error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	b, err := json.MarshalIndent(fc.entries, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fc.path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fc.path, b, 0644)
+}
@@ -0,0 +1,36 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"fmt"
+	"time"
+
+	memcachepb "appengine_internal/memcache"
+)
+
+// warmUp makes a memcache call and, once the URL of the default module is
+// received from modulec, a request to the module, so that the API server
+// and the stub app are initialized before the first test call. The
+// memcache call is a RawCall.
+func (c *Instance) warmUp(modulec <-chan string) error {
+	if err := c.RawCall("memcache", "Stats", &memcachepb.MemcacheStatsRequest{}, &memcachepb.MemcacheStatsResponse{}); err != nil {
+		return fmt.Errorf("aetest: warm-up call failed: %v", err)
+	}
+	if c.opts.APIServerOnly {
+		return nil
+	}
+	select {
+	case u := <-modulec:
+		res, err := c.client.Get(u + "/_ah/warmup")
+		if err != nil {
+			return fmt.Errorf("aetest: warm-up request failed: %v", err)
+		}
+		res.Body.Close()
+	case <-time.After(15 * time.Second):
+		return fmt.Errorf("aetest: timeout waiting for the URL of the default module")
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2014 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetest
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+
+	xmpppb "appengine_internal/xmpp"
+)
+
+// XMPPStanza is an XMPP message, invitation, presence update or presence
+// probe sent through a Context.
+type XMPPStanza struct {
+	// Kind is one of "message", "invite", "presence" or "probe".
+	Kind string
+	From string
+	To   []string
+
+	// Body and RawXML are set for messages only.
+	Body   string
+	RawXML bool
+
+	// Type is the message or presence type.
+	Type string
+
+	// Show and Status are set for presence updates only.
+	Show   string
+	Status string
+}
+
+// captureXMPP records stanzas that were successfully handed to the XMPP
+// service.
+func (c *Instance) captureXMPP(service, method string, in, out proto.Message, next func() error) error {
+	if err := next(); err != nil || service != "xmpp" {
+		return err
+	}
+	var s XMPPStanza
+	switch req := in.(type) {
+	case *xmpppb.XmppMessageRequest:
+		s = XMPPStanza{
+			Kind:   "message",
+			From:   req.GetFromJid(),
+			To:     req.Jid,
+			Body:   req.GetBody(),
+			RawXML: req.GetRawXml(),
+			Type:   req.GetType(),
+		}
+	case *xmpppb.XmppInviteRequest:
+		s = XMPPStanza{
+			Kind: "invite",
+			From: req.GetFromJid(),
+			To:   []string{req.GetJid()},
+		}
+	case *xmpppb.XmppSendPresenceRequest:
+		s = XMPPStanza{
+			Kind:   "presence",
+			From:   req.GetFromJid(),
+			To:     []string{req.GetJid()},
+			Type:   req.GetType(),
+			Show:   req.GetShow(),
+			Status: req.GetStatus(),
+		}
+	case *xmpppb.PresenceRequest:
+		s = XMPPStanza{
+			Kind: "probe",
+			From: req.GetFromJid(),
+			To:   []string{req.GetJid()},
+		}
+	case *xmpppb.BulkPresenceRequest:
+		s = XMPPStanza{
+			Kind: "probe",
+			From: req.GetFromJid(),
+			To:   req.Jid,
+		}
+	default:
+		return nil
+	}
+	c.mu.Lock()
+	c.xmpp = append(c.xmpp, s)
+	c.mu.Unlock()
+	return nil
+}
+
+// SentXMPP returns the XMPP messages, invitations, presence updates
+// and presence probes sent through the context and the contexts
+// derived from it, in the order they were sent. The XMPP stub of the
+// API server only logs the stanzas, so those sent by the served app or
+// with RawCall are missing.
+func (c *Instance) SentXMPP() []XMPPStanza {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]XMPPStanza(nil), c.xmpp...)
+}